@@ -0,0 +1,77 @@
+package socks6
+
+import (
+	"net"
+
+	"github.com/studentmain/socks6/accounting"
+)
+
+// accountedConn is a remote side net.Conn which record traffic to accountant
+type accountedConn struct {
+	net.Conn
+	acct accounting.Accountant
+	rec  accounting.Record // traffic owner
+	peer net.Conn          // client side connection, closed when quota exceeded
+}
+
+// Read read data from remote, data read is counted as download
+func (a *accountedConn) Read(b []byte) (int, error) {
+	n, err := a.Conn.Read(b)
+	if n > 0 {
+		if e := a.add(accounting.Usage{BytesDown: uint64(n)}); e != nil {
+			err = e
+		}
+	}
+	return n, err
+}
+
+// Write write data to remote, data written is counted as upload
+func (a *accountedConn) Write(b []byte) (int, error) {
+	n, err := a.Conn.Write(b)
+	if n > 0 {
+		if e := a.add(accounting.Usage{BytesUp: uint64(n)}); e != nil && err == nil {
+			err = e
+		}
+	}
+	return n, err
+}
+
+func (a *accountedConn) unwrap() net.Conn {
+	return a.Conn
+}
+
+// add record usage, close both side when quota exceeded
+func (a *accountedConn) add(u accounting.Usage) error {
+	r := a.rec
+	r.Usage = u
+	err := a.acct.Add(r)
+	if err != nil {
+		a.Conn.Close()
+		a.peer.Close()
+	}
+	return err
+}
+
+// accountConn wrap remote side connection conn, record its traffic as cc's traffic to dst.
+// peer is the client side connection relaying with conn.
+func (c SocksConn) accountConn(conn net.Conn, peer net.Conn, dst string) net.Conn {
+	if c.acct == nil {
+		return conn
+	}
+	return &accountedConn{
+		Conn: conn,
+		acct: c.acct,
+		rec:  c.accountRecord(dst, accounting.Usage{}),
+		peer: peer,
+	}
+}
+
+// accountRecord create a traffic record owned by cc
+func (c SocksConn) accountRecord(dst string, u accounting.Usage) accounting.Record {
+	return accounting.Record{
+		ClientId:    c.ClientId,
+		Session:     c.Session,
+		Destination: dst,
+		Usage:       u,
+	}
+}
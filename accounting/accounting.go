@@ -0,0 +1,73 @@
+// accounting count traffic of clients, sessions and destinations, and enforce quotas
+package accounting
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrQuotaExceeded is returned when client used up its quota
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// Usage is traffic counter, upload is client to remote direction.
+// Packets are only counted for datagrams.
+type Usage struct {
+	BytesUp     uint64 `json:"bytes_up"`
+	BytesDown   uint64 `json:"bytes_down"`
+	PacketsUp   uint64 `json:"packets_up"`
+	PacketsDown uint64 `json:"packets_down"`
+}
+
+// Bytes return total bytes in both direction
+func (u Usage) Bytes() uint64 {
+	return u.BytesUp + u.BytesDown
+}
+
+// Add add v to u
+func (u *Usage) Add(v Usage) {
+	u.BytesUp += v.BytesUp
+	u.BytesDown += v.BytesDown
+	u.PacketsUp += v.PacketsUp
+	u.PacketsDown += v.PacketsDown
+}
+
+// Record is a piece of traffic and its owner
+type Record struct {
+	ClientId    string // client identifier provided by authenticator
+	Session     []byte // session id, nil when session not used
+	Destination string // remote endpoint
+	Usage
+}
+
+// Accountant is called by server to record traffic and check quota
+type Accountant interface {
+	// Allow check whether client can start a new request, non-nil error rejects the request
+	Allow(clientId string) error
+	// Add record traffic, non-nil error closes the relay or association
+	Add(r Record) error
+}
+
+// Quota is cumulative traffic limit of a client
+type Quota struct {
+	// Bytes is total bytes in both direction allowed in a period, 0 means unlimited
+	Bytes uint64 `json:"bytes"`
+	// Period is quota reset interval, aligned to UTC, 0 means never reset
+	Period time.Duration `json:"period"`
+}
+
+// Daily is the period of a daily quota
+const Daily = 24 * time.Hour
+
+// start return start time of the period which t belongs to
+func (q Quota) start(t time.Time) time.Time {
+	if q.Period <= 0 {
+		return time.Time{}
+	}
+	return t.UTC().Truncate(q.Period)
+}
+
+// QuotaUsage is traffic counted by quota in current period
+type QuotaUsage struct {
+	Start time.Time `json:"start"`
+	Bytes uint64    `json:"bytes"`
+}
@@ -0,0 +1,305 @@
+package accounting
+
+import (
+	"context"
+	"encoding/base64"
+	"sync"
+	"time"
+
+	"github.com/studentmain/socks6/common/lg"
+)
+
+// DefaultIdleTimeout is how long counters are kept after last traffic when idle timeout is not set
+const DefaultIdleTimeout = 24 * time.Hour
+
+// pruneInterval is the min interval between prunes triggered by Add
+const pruneInterval = time.Minute
+
+// Ledger is an in-memory Accountant with per client quota,
+// counters can be persisted by a Store.
+// Counters of idle clients, sessions and destinations are removed, so memory usage is bounded by active ones.
+type Ledger struct {
+	lock sync.Mutex
+
+	clients      map[string]*counter
+	sessions     map[string]*counter // map[base64_rawstd(id)]*counter
+	destinations map[string]*counter
+
+	quotas     map[string]Quota
+	defQuota   Quota
+	quotaUsage map[string]*QuotaUsage
+
+	idleTimeout time.Duration
+	lastPrune   time.Time
+
+	store Store
+}
+
+// counter is a Usage and the time it's last updated
+type counter struct {
+	Usage
+	last time.Time
+}
+
+// NewLedger create a Ledger and load counters from store, store can be nil
+func NewLedger(store Store) (*Ledger, error) {
+	l := &Ledger{
+		clients:      map[string]*counter{},
+		sessions:     map[string]*counter{},
+		destinations: map[string]*counter{},
+		quotas:       map[string]Quota{},
+		quotaUsage:   map[string]*QuotaUsage{},
+		idleTimeout:  DefaultIdleTimeout,
+		lastPrune:    time.Now(),
+		store:        store,
+	}
+	if store == nil {
+		return l, nil
+	}
+	snap, err := store.Load()
+	if err != nil {
+		return nil, err
+	}
+	if snap != nil {
+		l.restore(snap)
+	}
+	return l, nil
+}
+
+// SetQuota set quota of a client
+func (l *Ledger) SetQuota(clientId string, q Quota) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.quotas[clientId] = q
+}
+
+// RemoveQuota let a client use default quota
+func (l *Ledger) RemoveQuota(clientId string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	delete(l.quotas, clientId)
+}
+
+// SetDefaultQuota set quota of every client without specific quota,
+// unauthenticated clients share the quota of empty ClientId
+func (l *Ledger) SetDefaultQuota(q Quota) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.defQuota = q
+}
+
+// SetIdleTimeout set how long counters of a client, session or destination are kept after last traffic,
+// 0 means DefaultIdleTimeout
+func (l *Ledger) SetIdleTimeout(d time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if d <= 0 {
+		d = DefaultIdleTimeout
+	}
+	l.idleTimeout = d
+}
+
+// ResetQuota clear client's quota usage in current period
+func (l *Ledger) ResetQuota(clientId string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	delete(l.quotaUsage, clientId)
+}
+
+func (l *Ledger) Allow(clientId string) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.checkQuota(clientId, 0)
+}
+
+func (l *Ledger) Add(r Record) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := time.Now()
+	if now.Sub(l.lastPrune) >= pruneInterval {
+		l.prune(now)
+	}
+	add(l.clients, r.ClientId, r.Usage, now)
+	if len(r.Session) > 0 {
+		add(l.sessions, base64.RawStdEncoding.EncodeToString(r.Session), r.Usage, now)
+	}
+	if r.Destination != "" {
+		add(l.destinations, r.Destination, r.Usage, now)
+	}
+	return l.checkQuota(r.ClientId, r.Bytes())
+}
+
+// Prune remove counters not updated since idle timeout before now, and quota usage of ended periods.
+// It's called by Add periodically.
+func (l *Ledger) Prune(now time.Time) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.prune(now)
+}
+
+// prune is Prune without lock, caller should hold lock
+func (l *Ledger) prune(now time.Time) {
+	l.lastPrune = now
+	expire := now.Add(-l.idleTimeout)
+	for _, m := range []map[string]*counter{l.clients, l.sessions, l.destinations} {
+		for k, v := range m {
+			if v.last.Before(expire) {
+				delete(m, k)
+			}
+		}
+	}
+	for k, qu := range l.quotaUsage {
+		q := l.quota(k)
+		if !qu.Start.Equal(q.start(now)) {
+			// period ended, next request start a new one
+			delete(l.quotaUsage, k)
+			continue
+		}
+		if _, active := l.clients[k]; !active && q.Bytes == 0 {
+			// nothing to enforce for idle client
+			delete(l.quotaUsage, k)
+		}
+	}
+}
+
+// quota return client's quota, caller should hold lock
+func (l *Ledger) quota(clientId string) Quota {
+	if q, ok := l.quotas[clientId]; ok {
+		return q
+	}
+	return l.defQuota
+}
+
+// checkQuota add n bytes to client's quota usage, return error when quota used up.
+// caller should hold lock
+func (l *Ledger) checkQuota(clientId string, n uint64) error {
+	q := l.quota(clientId)
+	qu, ok := l.quotaUsage[clientId]
+	start := q.start(time.Now())
+	if !ok || !qu.Start.Equal(start) {
+		// new period
+		qu = &QuotaUsage{Start: start}
+		l.quotaUsage[clientId] = qu
+	}
+	qu.Bytes += n
+	if q.Bytes > 0 && qu.Bytes >= q.Bytes {
+		return ErrQuotaExceeded
+	}
+	return nil
+}
+
+func add(m map[string]*counter, key string, u Usage, now time.Time) {
+	v, ok := m[key]
+	if !ok {
+		v = &counter{}
+		m[key] = v
+	}
+	v.Add(u)
+	v.last = now
+}
+
+func get(m map[string]*counter, key string) Usage {
+	if v, ok := m[key]; ok {
+		return v.Usage
+	}
+	return Usage{}
+}
+
+// Client return total traffic of a client
+func (l *Ledger) Client(clientId string) Usage {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return get(l.clients, clientId)
+}
+
+// Session return total traffic of a session
+func (l *Ledger) Session(id []byte) Usage {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return get(l.sessions, base64.RawStdEncoding.EncodeToString(id))
+}
+
+// Destination return total traffic to a remote endpoint
+func (l *Ledger) Destination(dst string) Usage {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return get(l.destinations, dst)
+}
+
+// QuotaUsage return client's quota usage in current period
+func (l *Ledger) QuotaUsage(clientId string) QuotaUsage {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if qu, ok := l.quotaUsage[clientId]; ok {
+		return *qu
+	}
+	return QuotaUsage{}
+}
+
+// Snapshot return a copy of all counters
+func (l *Ledger) Snapshot() *Snapshot {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	snap := &Snapshot{
+		Clients:      copyUsage(l.clients),
+		Sessions:     copyUsage(l.sessions),
+		Destinations: copyUsage(l.destinations),
+		Quota:        map[string]QuotaUsage{},
+	}
+	for k, v := range l.quotaUsage {
+		snap.Quota[k] = *v
+	}
+	return snap
+}
+
+func (l *Ledger) restore(snap *Snapshot) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	// last update time is not saved, restored counters are treated as just updated
+	now := time.Now()
+	for k, v := range snap.Clients {
+		add(l.clients, k, v, now)
+	}
+	for k, v := range snap.Sessions {
+		add(l.sessions, k, v, now)
+	}
+	for k, v := range snap.Destinations {
+		add(l.destinations, k, v, now)
+	}
+	for k, v := range snap.Quota {
+		qu := v
+		l.quotaUsage[k] = &qu
+	}
+}
+
+func copyUsage(m map[string]*counter) map[string]Usage {
+	ret := make(map[string]Usage, len(m))
+	for k, v := range m {
+		ret[k] = v.Usage
+	}
+	return ret
+}
+
+// Flush save counters to store
+func (l *Ledger) Flush() error {
+	if l.store == nil {
+		return nil
+	}
+	return l.store.Save(l.Snapshot())
+}
+
+// Run flush counters to store periodically until ctx done
+func (l *Ledger) Run(ctx context.Context, interval time.Duration) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+		case <-ctx.Done():
+			return
+		}
+		if err := l.Flush(); err != nil {
+			lg.Warning("can't save accounting data", err)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package accounting_test
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/studentmain/socks6/accounting"
+)
+
+func TestLedger(t *testing.T) {
+	l, err := accounting.NewLedger(nil)
+	assert.NoError(t, err)
+	assert.NoError(t, l.Add(accounting.Record{
+		ClientId:    "alice",
+		Session:     []byte{1, 2},
+		Destination: "1.1.1.1:443",
+		Usage:       accounting.Usage{BytesUp: 10, BytesDown: 20},
+	}))
+	assert.NoError(t, l.Add(accounting.Record{
+		ClientId:    "alice",
+		Destination: "8.8.8.8:53",
+		Usage:       accounting.Usage{BytesUp: 30, PacketsUp: 1},
+	}))
+	assert.Equal(t, accounting.Usage{BytesUp: 40, BytesDown: 20, PacketsUp: 1}, l.Client("alice"))
+	assert.Equal(t, accounting.Usage{BytesUp: 10, BytesDown: 20}, l.Session([]byte{1, 2}))
+	assert.Equal(t, accounting.Usage{BytesUp: 30, PacketsUp: 1}, l.Destination("8.8.8.8:53"))
+	assert.Equal(t, accounting.Usage{}, l.Client("bob"))
+}
+
+func TestLedgerQuota(t *testing.T) {
+	l, err := accounting.NewLedger(nil)
+	assert.NoError(t, err)
+	l.SetDefaultQuota(accounting.Quota{Bytes: 100, Period: accounting.Daily})
+	l.SetQuota("vip", accounting.Quota{})
+
+	assert.NoError(t, l.Allow("alice"))
+	assert.NoError(t, l.Add(accounting.Record{ClientId: "alice", Usage: accounting.Usage{BytesUp: 60}}))
+	assert.ErrorIs(t, l.Add(accounting.Record{ClientId: "alice", Usage: accounting.Usage{BytesDown: 60}}), accounting.ErrQuotaExceeded)
+	assert.ErrorIs(t, l.Allow("alice"), accounting.ErrQuotaExceeded)
+
+	assert.NoError(t, l.Add(accounting.Record{ClientId: "vip", Usage: accounting.Usage{BytesUp: 1000}}))
+	assert.NoError(t, l.Allow("vip"))
+
+	l.ResetQuota("alice")
+	assert.NoError(t, l.Allow("alice"))
+	assert.EqualValues(t, 120, l.Client("alice").Bytes())
+}
+
+func TestLedgerStore(t *testing.T) {
+	store := accounting.FileStore{Path: filepath.Join(t.TempDir(), "acct.json")}
+	l, err := accounting.NewLedger(store)
+	assert.NoError(t, err)
+	l.SetDefaultQuota(accounting.Quota{Bytes: 100})
+	assert.Error(t, l.Add(accounting.Record{ClientId: "alice", Destination: "1.1.1.1:443", Usage: accounting.Usage{BytesUp: 100}}))
+	assert.NoError(t, l.Flush())
+
+	l2, err := accounting.NewLedger(store)
+	assert.NoError(t, err)
+	l2.SetDefaultQuota(accounting.Quota{Bytes: 100})
+	assert.EqualValues(t, 100, l2.Client("alice").BytesUp)
+	assert.EqualValues(t, 100, l2.Destination("1.1.1.1:443").BytesUp)
+	assert.ErrorIs(t, l2.Allow("alice"), accounting.ErrQuotaExceeded)
+}
+
+func TestLedgerPrune(t *testing.T) {
+	l, err := accounting.NewLedger(nil)
+	assert.NoError(t, err)
+	l.SetIdleTimeout(time.Hour)
+	l.SetDefaultQuota(accounting.Quota{Bytes: 100, Period: accounting.Daily})
+	l.SetQuota("forever", accounting.Quota{Bytes: 100})
+	for _, id := range []string{"alice", "forever"} {
+		assert.NoError(t, l.Add(accounting.Record{
+			ClientId:    id,
+			Session:     []byte(id),
+			Destination: id + ":443",
+			Usage:       accounting.Usage{BytesUp: 10},
+		}))
+	}
+
+	// still active
+	l.Prune(time.Now().Add(time.Minute))
+	assert.EqualValues(t, 10, l.Client("alice").BytesUp)
+	assert.EqualValues(t, 10, l.Session([]byte("alice")).BytesUp)
+	assert.EqualValues(t, 10, l.Destination("alice:443").BytesUp)
+
+	// idle counters and ended daily period are removed, never reset quota is kept
+	l.Prune(time.Now().Add(accounting.Daily + time.Hour))
+	snap := l.Snapshot()
+	assert.Empty(t, snap.Clients)
+	assert.Empty(t, snap.Sessions)
+	assert.Empty(t, snap.Destinations)
+	assert.Len(t, snap.Quota, 1)
+	assert.EqualValues(t, 10, l.QuotaUsage("forever").Bytes)
+}
@@ -0,0 +1,56 @@
+package accounting
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+)
+
+// Snapshot is persisted form of counters
+type Snapshot struct {
+	Clients      map[string]Usage      `json:"clients"`
+	Sessions     map[string]Usage      `json:"sessions"` // key is base64 encoded session id
+	Destinations map[string]Usage      `json:"destinations"`
+	Quota        map[string]QuotaUsage `json:"quota"`
+}
+
+// Store persist counters
+type Store interface {
+	// Load return saved snapshot, or nil when nothing saved
+	Load() (*Snapshot, error)
+	Save(s *Snapshot) error
+}
+
+// FileStore save snapshot to a JSON file
+type FileStore struct {
+	Path string
+}
+
+func (f FileStore) Load() (*Snapshot, error) {
+	b, err := os.ReadFile(f.Path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	s := &Snapshot{}
+	if err := json.Unmarshal(b, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Save write snapshot to a temporary file then rename it, so the file is never half written
+func (f FileStore) Save(s *Snapshot) error {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	tmp := f.Path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, f.Path)
+}
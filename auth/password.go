@@ -5,6 +5,7 @@ import (
 	"context"
 	"io"
 	"net"
+	"sync/atomic"
 
 	"github.com/studentmain/socks6/message"
 )
@@ -20,6 +21,45 @@ type passwordAuthenticationData struct {
 type PasswordServerAuthenticationMethod struct {
 	// Passwords is client password table, key is user name
 	Passwords map[string]string
+	// Table is a replaceable password table, used instead of Passwords when not nil
+	Table *PasswordTable
+}
+
+// PasswordTable is a password table which can be replaced while server running,
+// authentications in progress use the table when they started.
+// It's safe for concurrent use.
+type PasswordTable struct {
+	v atomic.Value // map[string]string
+}
+
+func NewPasswordTable(passwords map[string]string) *PasswordTable {
+	t := &PasswordTable{}
+	t.Set(passwords)
+	return t
+}
+
+// Set replace the table, key is user name.
+// passwords should not be modified after Set.
+func (t *PasswordTable) Set(passwords map[string]string) {
+	if passwords == nil {
+		passwords = map[string]string{}
+	}
+	t.v.Store(passwords)
+}
+
+// Lookup find the password of user
+func (t *PasswordTable) Lookup(user string) (string, bool) {
+	m, _ := t.v.Load().(map[string]string)
+	p, ok := m[user]
+	return p, ok
+}
+
+func (p PasswordServerAuthenticationMethod) lookup(user string) (string, bool) {
+	if p.Table != nil {
+		return p.Table.Lookup(user)
+	}
+	pass, ok := p.Passwords[user]
+	return pass, ok
 }
 
 func ParsePasswordAuthenticationData(buf []byte) (*passwordAuthenticationData, error) {
@@ -70,7 +110,7 @@ func (p PasswordServerAuthenticationMethod) Authenticate(
 		sac.Err <- err
 		return
 	}
-	expect, ok := p.Passwords[string(ad.Username)]
+	expect, ok := p.lookup(string(ad.Username))
 	failResult.MethodData = []byte{1, 1}
 	if !ok {
 		sac.Result <- failResult
@@ -87,6 +127,7 @@ func (p PasswordServerAuthenticationMethod) Authenticate(
 		Success:    true,
 		Continue:   false,
 		MethodData: []byte{1, 0},
+		ClientName: string(ad.Username),
 	}
 	sac.Err <- nil
 }
@@ -41,6 +41,9 @@ type DefaultServerAuthenticator struct {
 
 	DisableSession bool
 	DisableToken   bool
+	// SessionTimeout is how long a session is kept after its last connection closed,
+	// 0 means 5 minutes
+	SessionTimeout time.Duration
 
 	sessions common.SyncMap[string, *serverSession] // map[base64_rawstd(id)]*session
 }
@@ -167,6 +170,8 @@ func (d *DefaultServerAuthenticator) sessionCheck(
 		// mismatch session
 		return &sessionInvalid
 	}
+	session.lock.Lock()
+	defer session.lock.Unlock()
 
 	// requested teardown
 	if _, teardown := req.Options.GetData(message.OptionKindSessionTeardown); teardown {
@@ -177,7 +182,8 @@ func (d *DefaultServerAuthenticator) sessionCheck(
 	sar := ServerAuthenticationResult{
 		Continue: false,
 
-		SessionID: sid,
+		ClientName: session.clientName,
+		SessionID:  sid,
 		AdditionalOptions: []message.Option{
 			{Kind: message.OptionKindSessionOK, Data: message.SessionOKOptionData{}},
 		},
@@ -188,22 +194,6 @@ func (d *DefaultServerAuthenticator) sessionCheck(
 	// requested window
 	if requested && !d.DisableToken {
 		windowRequest = windowRequestData.(message.TokenRequestOptionData).WindowSize
-		// allocate when no window
-		if session.window.Length() == 0 {
-			if windowRequest > 2048 {
-				windowRequest = 2048
-			}
-			alloc, base, size := session.allocateWindow(uint32(windowRequest))
-			if alloc {
-				sar.AdditionalOptions = append(sar.AdditionalOptions, message.Option{
-					Kind: message.OptionKindIdempotenceWindow,
-					Data: message.IdempotenceWindowOptionData{
-						WindowBase: base,
-						WindowSize: size,
-					},
-				})
-			}
-		}
 	}
 
 	// token check
@@ -211,6 +201,11 @@ func (d *DefaultServerAuthenticator) sessionCheck(
 	if !spend {
 		// not used
 		sar.Success = true
+		session.connCount++
+		// client run out of token, tell it current window even not changed
+		if windowRequest > 0 {
+			addWindowOption(&sar, session, windowRequest, true)
+		}
 		return &sar
 	}
 	// spending token
@@ -236,26 +231,32 @@ func (d *DefaultServerAuthenticator) sessionCheck(
 
 	// token success
 	sar.Success = true
+	session.connCount++
 	sar.AdditionalOptions = append(sar.AdditionalOptions, message.Option{
 		Kind: message.OptionKindIdempotenceAccepted,
 		Data: message.IdempotenceAcceptedOptionData{},
 	})
 
 	// allocate when necessary/requested
-	alloc, base, size := session.allocateWindow(uint32(windowRequest))
-	if alloc {
-		sar.AdditionalOptions = append(sar.AdditionalOptions, message.Option{
-			Kind: message.OptionKindIdempotenceWindow,
-			Data: message.IdempotenceWindowOptionData{
-				WindowBase: base,
-				WindowSize: size,
-			},
-		})
-	}
-
+	addWindowOption(&sar, session, windowRequest, false)
 	return &sar
 }
 
+// addWindowOption allocate token window of session, add window option to result when window changed or always is true
+func addWindowOption(result *ServerAuthenticationResult, session *serverSession, size uint32, always bool) {
+	alloc, base, size := session.allocateWindow(size)
+	if !alloc && !(always && size > 0) {
+		return
+	}
+	result.AdditionalOptions = append(result.AdditionalOptions, message.Option{
+		Kind: message.OptionKindIdempotenceWindow,
+		Data: message.IdempotenceWindowOptionData{
+			WindowBase: base,
+			WindowSize: size,
+		},
+	})
+}
+
 func (d *DefaultServerAuthenticator) tryStartSesstion(
 	result *ServerAuthenticationResult,
 	req message.Request,
@@ -263,10 +264,15 @@ func (d *DefaultServerAuthenticator) tryStartSesstion(
 	if !result.Success {
 		return result
 	}
-	if _, requested := req.Options.GetData(message.OptionKindSessionRequest); !requested {
+	if _, requested := req.Options.GetData(message.OptionKindSessionRequest); !requested || d.DisableSession {
 		return result
 	}
 	s := newServerSession(8)
+	// requests in session are made by the client authenticated at start
+	s.clientName = result.ClientName
+	// the connection started session is counted, released by SessionConnClose
+	s.connCount = 1
+	d.sessions.Store(base64.RawStdEncoding.EncodeToString(s.id), s)
 	result.AdditionalOptions = append(result.AdditionalOptions, message.Option{
 		Kind: message.OptionKindSessionID,
 		Data: message.SessionIDOptionData{ID: s.id},
@@ -277,19 +283,9 @@ func (d *DefaultServerAuthenticator) tryStartSesstion(
 	})
 	result.SessionID = s.id
 
-	if tokenData, requestToken := req.Options.GetData(message.OptionKindTokenRequest); requestToken {
+	if tokenData, requestToken := req.Options.GetData(message.OptionKindTokenRequest); requestToken && !d.DisableToken {
 		// token
-		windowRequest := tokenData.(message.TokenRequestOptionData).WindowSize
-		alloc, base, size := s.allocateWindow(uint32(windowRequest))
-		if alloc {
-			result.AdditionalOptions = append(result.AdditionalOptions, message.Option{
-				Kind: message.OptionKindIdempotenceWindow,
-				Data: message.IdempotenceWindowOptionData{
-					WindowBase: base,
-					WindowSize: size,
-				},
-			})
-		}
+		addWindowOption(result, s, tokenData.(message.TokenRequestOptionData).WindowSize, false)
 	}
 	return result
 }
@@ -302,10 +298,18 @@ func (d *DefaultServerAuthenticator) SessionConnClose(id []byte) {
 	} else {
 		return
 	}
+	session.lock.Lock()
+	defer session.lock.Unlock()
 	session.connCount--
 	if session.connCount <= 0 {
+		timeout := d.SessionTimeout
+		if timeout <= 0 {
+			timeout = 5 * time.Minute
+		}
 		go func() {
-			<-time.After(5 * time.Minute)
+			<-time.After(timeout)
+			session.lock.Lock()
+			defer session.lock.Unlock()
 			if session.connCount <= 0 {
 				d.sessions.Delete(sk)
 			}
@@ -2,16 +2,23 @@ package auth
 
 import (
 	"math"
+	"sync"
 
 	"github.com/studentmain/socks6/common/arrayx"
 	"github.com/studentmain/socks6/common/rnd"
 )
 
+// maxWindowSize is the max token window size allocated to a session
+const maxWindowSize = 2048
+
 type serverSession struct {
+	// lock guards fields below id, connections in same session are processed concurrently
+	lock sync.Mutex
+
 	id         []byte
+	clientName string
 	windowBase uint32
 	window     arrayx.BoolArr
-	popcnt     int
 	connCount  int
 }
 
@@ -24,7 +31,7 @@ func newServerSession(idSize int) *serverSession {
 
 func (s *serverSession) checkToken(t uint32) bool {
 	offset := t - s.windowBase
-	if offset > uint32(s.window.Length()) {
+	if offset >= uint32(s.window.Length()) {
 		return false
 	}
 
@@ -33,38 +40,41 @@ func (s *serverSession) checkToken(t uint32) bool {
 	}
 
 	s.window.Set(int(offset), true)
-	s.popcnt++
 	return true
 }
 
+// allocateWindow create or advance token window, return whether window is changed and new window.
+// Window is advanced over leading fully spent bytes, so tokens in flight are never moved out of it.
 func (s *serverSession) allocateWindow(size uint32) (bool, uint32, uint32) {
-	origSize := s.window.Length()
+	if size > maxWindowSize {
+		size = maxWindowSize
+	}
+	origLen := len(s.window)
 	// zero window, alloc new window
-	if origSize == 0 {
+	if origLen == 0 {
+		if size == 0 {
+			return false, 0, 0
+		}
 		s.windowBase = rnd.RandUint32()
 		s.window = arrayx.NewBoolArr(int(size))
-		return true, s.windowBase, size
-	}
-	// first not spent, reject
-	if !s.window.Get(0) {
-		return false, s.windowBase, uint32(origSize)
+		return true, s.windowBase, uint32(s.window.Length())
 	}
 
-	// windowBase+=s.popcnt, align to 8
-	spentRatio := float64(s.popcnt) / float64(origSize)
-	baseOffsetF := math.Floor(spentRatio * float64(origSize))
-	baseOffset := arrayx.PaddedLen(int(baseOffsetF), 8) / 8
-	s.windowBase += uint32(baseOffset)
-	dst := s.window
-
-	// resize, alloc new
-	if size > uint32(origSize) {
-		dst = make(arrayx.BoolArr, size)
+	shift := 0
+	for shift < origLen && s.window[shift] == math.MaxUint8 {
+		shift++
+	}
+	newLen := arrayx.PaddedLen(int(size), 8) / 8
+	if newLen < origLen {
+		newLen = origLen
 	}
-	// resized or window shifted
-	if baseOffset > 0 || size > uint32(origSize) {
-		copy(dst, s.window[baseOffset:])
+	if shift == 0 && newLen == origLen {
+		return false, s.windowBase, uint32(s.window.Length())
 	}
+
+	dst := make(arrayx.BoolArr, newLen)
+	copy(dst, s.window[shift:])
 	s.window = dst
+	s.windowBase += uint32(shift * 8)
 	return true, s.windowBase, uint32(s.window.Length())
 }
@@ -0,0 +1,93 @@
+package auth
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/studentmain/socks6/message"
+)
+
+func TestServerSessionWindow(t *testing.T) {
+	s := newServerSession(8)
+	alloc, _, _ := s.allocateWindow(0)
+	assert.False(t, alloc)
+
+	alloc, base, size := s.allocateWindow(16)
+	assert.True(t, alloc)
+	assert.EqualValues(t, 16, size)
+	assert.False(t, s.checkToken(base+size))
+	assert.False(t, s.checkToken(base-1))
+	for i := uint32(0); i < 10; i++ {
+		assert.True(t, s.checkToken(base+i))
+	}
+	assert.False(t, s.checkToken(base))
+
+	// advance over fully spent first byte only
+	alloc, base2, size2 := s.allocateWindow(16)
+	assert.True(t, alloc)
+	assert.Equal(t, base+8, base2)
+	assert.EqualValues(t, 16, size2)
+	assert.False(t, s.checkToken(base+9))
+	assert.True(t, s.checkToken(base+10))
+	assert.True(t, s.checkToken(base2+15))
+
+	alloc, _, _ = s.allocateWindow(16)
+	assert.False(t, alloc)
+
+	_, _, size3 := s.allocateWindow(1 << 20)
+	assert.EqualValues(t, maxWindowSize, size3)
+}
+
+func sessionRequest(opts ...message.Option) message.Request {
+	req := *message.NewRequest()
+	req.Options.AddMany(opts)
+	return req
+}
+
+func TestServerAuthenticatorSession(t *testing.T) {
+	d := NewServerAuthenticator()
+	result := d.tryStartSesstion(&ServerAuthenticationResult{Success: true}, sessionRequest(
+		message.Option{Kind: message.OptionKindSessionRequest, Data: message.SessionRequestOptionData{}},
+		message.Option{Kind: message.OptionKindTokenRequest, Data: message.TokenRequestOptionData{WindowSize: 64}},
+	))
+	reply := message.NewOptionSet()
+	reply.AddMany(result.AdditionalOptions)
+	_, ok := reply.GetData(message.OptionKindSessionOK)
+	assert.True(t, ok)
+	sidData, ok := reply.GetData(message.OptionKindSessionID)
+	assert.True(t, ok)
+	sid := sidData.(message.SessionIDOptionData).ID
+	assert.Equal(t, sid, result.SessionID)
+	windowData, ok := reply.GetData(message.OptionKindIdempotenceWindow)
+	assert.True(t, ok)
+	window := windowData.(message.IdempotenceWindowOptionData)
+	assert.EqualValues(t, 64, window.WindowSize)
+
+	spend := func(token uint32) *ServerAuthenticationResult {
+		return d.sessionCheck(sessionRequest(
+			message.Option{Kind: message.OptionKindSessionID, Data: message.SessionIDOptionData{ID: sid}},
+			message.Option{Kind: message.OptionKindIdempotenceExpenditure, Data: message.IdempotenceExpenditureOptionData{Token: token}},
+		), sid)
+	}
+	assert.True(t, spend(window.WindowBase).Success)
+	assert.False(t, spend(window.WindowBase).Success)
+
+	// every token is spent exactly once by concurrent requests
+	accepted := int32(0)
+	wg := sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := uint32(1); j < window.WindowSize; j++ {
+				if spend(window.WindowBase + j).Success {
+					atomic.AddInt32(&accepted, 1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	assert.EqualValues(t, window.WindowSize-1, accepted)
+}
@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"context"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/studentmain/socks6/common/lg"
@@ -16,9 +18,13 @@ type backlogBindWorker struct {
 	listener net.Listener // listener used for accepting inbound connection
 	cc       SocksConn    // original ClientConn
 
-	sem   semaphore.Weighted // limiting server accepted connection count
-	queue chan net.Conn      // server accepted connection queue
-	alive bool               // indicate listener is working
+	sem       semaphore.Weighted // limiting server accepted connection count
+	queue     chan net.Conn      // server accepted connection queue
+	alive     int32              // indicate listener is working, accessed atomically, 1 is alive
+	closeOnce sync.Once          // close is called by reader, context and accept goroutines
+
+	timeouts Timeouts // timeouts of relays
+	onClose  func()   // called when listener closed
 }
 
 func newBacklogBindWorker(l net.Listener, cc SocksConn, backlog uint16) *backlogBindWorker {
@@ -28,7 +34,7 @@ func newBacklogBindWorker(l net.Listener, cc SocksConn, backlog uint16) *backlog
 
 		sem:   *semaphore.NewWeighted(int64(backlog)),
 		queue: make(chan net.Conn, backlog),
-		alive: true,
+		alive: 1,
 	}
 }
 
@@ -61,7 +67,8 @@ func (b *backlogBindWorker) handler(
 	cc.WriteReplyAddr(message.OperationReplySuccess, c.RemoteAddr())
 
 	// fwd
-	relay(ctx, cc.Conn, c, 10*time.Minute)
+	c = cc.accountConn(c, cc.Conn, c.RemoteAddr().String())
+	b.timeouts.relay(ctx, cc.Conn, c)
 }
 
 // accept accept an incoming connection, notify client, put connection to queue
@@ -93,7 +100,7 @@ func (b *backlogBindWorker) worker(ctx context.Context) {
 	go func() {
 		buf := make([]byte, 16)
 		b.cc.Conn.SetReadDeadline(time.Time{})
-		for b.alive {
+		for b.isAlive() {
 			if _, err := b.cc.Conn.Read(buf); err != nil {
 				lg.Trace(b.cc.ConnId(), "read fail, closing backlog listener")
 				b.close(err)
@@ -109,18 +116,25 @@ func (b *backlogBindWorker) worker(ctx context.Context) {
 		b.close(ctx.Err())
 	}()
 	// accept loop
-	for b.alive {
+	for b.isAlive() {
 		b.accept(ctx)
 	}
 }
 
-// close close listener and initial connection
+func (b *backlogBindWorker) isAlive() bool {
+	return atomic.LoadInt32(&b.alive) == 1
+}
+
+// close close listener and initial connection, only first call takes effect
 func (b *backlogBindWorker) close(err error) {
-	if !b.alive {
-		return
-	}
-	b.alive = false
-	lg.Warning("close backlog listener", err)
-	b.listener.Close()
-	b.cc.Conn.Close()
+	b.closeOnce.Do(func() {
+		atomic.StoreInt32(&b.alive, 0)
+		b.cc.collector().BacklogBindClose()
+		if b.onClose != nil {
+			b.onClose()
+		}
+		lg.Warning("close backlog listener", err)
+		b.listener.Close()
+		b.cc.Conn.Close()
+	})
 }
@@ -0,0 +1,306 @@
+package socks6
+
+import (
+	"context"
+	"encoding/base64"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/studentmain/socks6/common"
+	"github.com/studentmain/socks6/common/ratelimit"
+)
+
+// Bandwidth is upload and download speed limit in bytes per second, 0 means unlimited.
+// Upload is client to remote direction, download is remote to client direction.
+type Bandwidth struct {
+	Upload   int64
+	Download int64
+}
+
+// bandwidthBucket is a pair of token bucket shared by all connection with same key
+type bandwidthBucket struct {
+	up       *ratelimit.Bucket
+	down     *ratelimit.Bucket
+	explicit bool  // limit set by SetXxxLimit rather than default limit
+	refs     int32 // connections using this bucket
+}
+
+func newBandwidthBucket(bw Bandwidth, explicit bool) *bandwidthBucket {
+	return &bandwidthBucket{
+		up:       ratelimit.NewBucket(bw.Upload),
+		down:     ratelimit.NewBucket(bw.Download),
+		explicit: explicit,
+	}
+}
+
+func (b *bandwidthBucket) set(bw Bandwidth) {
+	b.up.SetRate(bw.Upload)
+	b.down.SetRate(bw.Download)
+}
+
+// bandwidthGroup is a group of buckets with a default limit
+type bandwidthGroup struct {
+	lock    sync.Mutex
+	buckets common.SyncMap[string, *bandwidthBucket]
+	def     Bandwidth
+}
+
+func newBandwidthGroup() *bandwidthGroup {
+	return &bandwidthGroup{
+		buckets: common.NewSyncMap[string, *bandwidthBucket](),
+	}
+}
+
+func (g *bandwidthGroup) setLimit(key string, bw Bandwidth) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if b, ok := g.buckets.Load(key); ok {
+		b.explicit = true
+		b.set(bw)
+		return
+	}
+	g.buckets.Store(key, newBandwidthBucket(bw, true))
+}
+
+func (g *bandwidthGroup) removeLimit(key string) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if b, ok := g.buckets.Load(key); ok {
+		b.explicit = false
+		b.set(g.def)
+	}
+}
+
+func (g *bandwidthGroup) setDefault(bw Bandwidth) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.def = bw
+	g.buckets.Range(func(key string, value *bandwidthBucket) bool {
+		if !value.explicit {
+			value.set(bw)
+		}
+		return true
+	})
+}
+
+// acquire get or create the bucket of key and add a reference
+func (g *bandwidthGroup) acquire(key string) *bandwidthBucket {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	b, ok := g.buckets.Load(key)
+	if !ok {
+		b = newBandwidthBucket(g.def, false)
+		g.buckets.Store(key, b)
+	}
+	atomic.AddInt32(&b.refs, 1)
+	return b
+}
+
+// clear delete unused buckets which use default limit
+func (g *bandwidthGroup) clear() {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.buckets.Range(func(key string, value *bandwidthBucket) bool {
+		if !value.explicit && atomic.LoadInt32(&value.refs) <= 0 {
+			g.buckets.Delete(key)
+		}
+		return true
+	})
+}
+
+// BandwidthLimiter limit relay speed per client, per session and per listener.
+// All CONNECT, BIND relays and UDP associations of same client share a budget,
+// same for session and listener.
+// Limits can be changed at anytime, existing relays follow new limit immediately.
+type BandwidthLimiter struct {
+	clients   *bandwidthGroup
+	sessions  *bandwidthGroup
+	listeners *bandwidthGroup
+}
+
+func NewBandwidthLimiter() *BandwidthLimiter {
+	return &BandwidthLimiter{
+		clients:   newBandwidthGroup(),
+		sessions:  newBandwidthGroup(),
+		listeners: newBandwidthGroup(),
+	}
+}
+
+// SetClientLimit set limit for a client identified by ClientId
+func (b *BandwidthLimiter) SetClientLimit(clientId string, bw Bandwidth) {
+	b.clients.setLimit(clientId, bw)
+}
+
+// RemoveClientLimit let a client use default client limit
+func (b *BandwidthLimiter) RemoveClientLimit(clientId string) {
+	b.clients.removeLimit(clientId)
+}
+
+// SetDefaultClientLimit set limit for every client without specific limit,
+// unauthenticated clients share the limit of empty ClientId
+func (b *BandwidthLimiter) SetDefaultClientLimit(bw Bandwidth) {
+	b.clients.setDefault(bw)
+}
+
+// SetSessionLimit set limit for a session
+func (b *BandwidthLimiter) SetSessionLimit(sessionId []byte, bw Bandwidth) {
+	b.sessions.setLimit(base64.RawStdEncoding.EncodeToString(sessionId), bw)
+}
+
+// SetDefaultSessionLimit set limit for every session without specific limit
+func (b *BandwidthLimiter) SetDefaultSessionLimit(bw Bandwidth) {
+	b.sessions.setDefault(bw)
+}
+
+// SetListenerLimit set total limit of connections accepted by listener on given port
+func (b *BandwidthLimiter) SetListenerLimit(port uint16, bw Bandwidth) {
+	b.listeners.setLimit(strconv.Itoa(int(port)), bw)
+}
+
+// RemoveListenerLimit remove total limit of listener on given port
+func (b *BandwidthLimiter) RemoveListenerLimit(port uint16) {
+	b.listeners.removeLimit(strconv.Itoa(int(port)))
+}
+
+// acquire create a trafficLimit contains all buckets applied to cc
+func (b *BandwidthLimiter) acquire(cc SocksConn) *trafficLimit {
+	buckets := []*bandwidthBucket{b.clients.acquire(cc.ClientId)}
+	if len(cc.Session) > 0 {
+		buckets = append(buckets, b.sessions.acquire(base64.RawStdEncoding.EncodeToString(cc.Session)))
+	}
+	if port, ok := addrPort(cc.Conn.LocalAddr()); ok {
+		buckets = append(buckets, b.listeners.acquire(strconv.Itoa(int(port))))
+	}
+	return &trafficLimit{buckets: buckets}
+}
+
+// clear delete unused buckets
+func (b *BandwidthLimiter) clear() {
+	b.clients.clear()
+	b.sessions.clear()
+	b.listeners.clear()
+}
+
+// trafficLimit is all bandwidth buckets applied to a connection or association
+type trafficLimit struct {
+	buckets []*bandwidthBucket
+	once    sync.Once
+}
+
+// waitUp wait until n bytes can be sent to remote, nil trafficLimit never wait
+func (t *trafficLimit) waitUp(ctx context.Context, n int) error {
+	if t == nil {
+		return nil
+	}
+	for _, b := range t.buckets {
+		if err := b.up.WaitN(ctx, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// waitDown wait until n bytes can be sent to client, nil trafficLimit never wait
+func (t *trafficLimit) waitDown(ctx context.Context, n int) error {
+	if t == nil {
+		return nil
+	}
+	for _, b := range t.buckets {
+		if err := b.down.WaitN(ctx, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// release remove reference to buckets, can be called multiple times
+func (t *trafficLimit) release() {
+	if t == nil {
+		return
+	}
+	t.once.Do(func() {
+		for _, b := range t.buckets {
+			atomic.AddInt32(&b.refs, -1)
+		}
+	})
+}
+
+// limitedConn is a client side net.Conn which obey bandwidth limit
+type limitedConn struct {
+	net.Conn
+	ctx   context.Context
+	limit *trafficLimit
+	owner bool // release limit when close
+}
+
+// Read read data from client, data read is counted as upload
+func (l *limitedConn) Read(b []byte) (int, error) {
+	n, err := l.Conn.Read(b)
+	if e := l.limit.waitUp(l.ctx, n); e != nil && err == nil {
+		err = e
+	}
+	return n, err
+}
+
+// Write write data to client, data written is counted as download
+func (l *limitedConn) Write(b []byte) (int, error) {
+	if err := l.limit.waitDown(l.ctx, len(b)); err != nil {
+		return 0, err
+	}
+	return l.Conn.Write(b)
+}
+
+func (l *limitedConn) unwrap() net.Conn {
+	return l.Conn
+}
+
+func (l *limitedConn) Close() error {
+	if l.owner {
+		l.limit.release()
+	}
+	return l.Conn.Close()
+}
+
+// applyLimit attach bandwidth limit to cc, and wrap cc.Conn with it.
+// limit is released when cc.Conn closed.
+func (s *ServerWorker) applyLimit(ctx context.Context, cc *SocksConn) {
+	if s.Bandwidth == nil {
+		return
+	}
+	cc.limit = s.Bandwidth.acquire(*cc)
+	cc.Conn = &limitedConn{
+		Conn:  cc.Conn,
+		ctx:   ctx,
+		limit: cc.limit,
+		owner: true,
+	}
+}
+
+// limitConn wrap another client side connection with cc's bandwidth limit
+func (c SocksConn) limitConn(ctx context.Context, conn net.Conn) net.Conn {
+	if c.limit == nil {
+		return conn
+	}
+	return &limitedConn{
+		Conn:  conn,
+		ctx:   ctx,
+		limit: c.limit,
+	}
+}
+
+func addrPort(a net.Addr) (uint16, bool) {
+	if a == nil {
+		return 0, false
+	}
+	_, p, err := net.SplitHostPort(a.String())
+	if err != nil {
+		return 0, false
+	}
+	port, err := strconv.ParseUint(p, 10, 16)
+	if err != nil {
+		return 0, false
+	}
+	return uint16(port), true
+}
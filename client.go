@@ -1,16 +1,15 @@
 package socks6
 
 import (
-	"bytes"
 	"context"
 	"crypto/tls"
-	"encoding/binary"
 	"errors"
-	"io"
 	"net"
+	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 
-	"github.com/lucas-clemente/quic-go"
 	"github.com/pion/dtls/v2"
 	"github.com/studentmain/socks6/auth"
 	"github.com/studentmain/socks6/common"
@@ -19,14 +18,21 @@ import (
 	"github.com/studentmain/socks6/message"
 )
 
-// Client is a SOCKS 6 client, implements net.Dialer, net.Listener
+// Client is a SOCKS 6 client, implements net.Dialer, net.Listener.
+// It is safe for concurrent use, fields must not be changed after first request.
 type Client struct {
 	// server address
 	Server string
 	// use TLS and DTLS when connect to server
 	Encrypted bool
-	// use QUIC
+	// use QUIC, requests share a QUIC connection.
+	// When the connection is lost, UDP associations and backlogged listeners are recovered on a new one.
 	QUIC bool
+	// QUICRecoveryTimeout is how long client try to recover objects after QUIC connection lost, 0 means 10s
+	QUICRecoveryTimeout time.Duration
+	// TLSConfig is used by TLS, DTLS and QUIC, nil means default config.
+	// When ServerName is empty, host of Server is used.
+	TLSConfig *tls.Config
 	// send datagram over TCP, when use QUIC, send datagram over QUIC stream instead of QUIC datagram
 	UDPOverTCP bool
 	// function to create underlying connection, net.Dial will used when it is nil
@@ -43,76 +49,36 @@ type Client struct {
 
 	EnableICMP bool
 
-	session  []byte
-	token    uint32
-	maxToken uint32
+	// DNSServer is DNS server queried through proxy by Resolver,
+	// empty means use servers chosen by Go resolver, which come from system config
+	DNSServer string
 
-	qc       nt.DualModeMultiplexedConn
+	// lock guards session and token state
+	lock    sync.Mutex
+	session []byte
+	// next token to spend
+	token uint32
+	// end of token window, exclusive
+	maxToken uint32
+	// closed when pending session establishment finished, nil when none pending
+	sessionWait chan struct{}
+	// set when server didn't start session, requests don't wait for session establishment
+	sessionDeclined bool
+	// set by Close
+	closed bool
+
+	// qlock guards qc, held during QUIC dial so only one connection is created
+	qlock    sync.Mutex
+	qc       *clientQuicConn
+	qinit    sync.Once
 	qudpconn common.SyncMap[uint64, *muxSeqPacket]
 	qbind    common.SyncMap[uint32, *ProxyTCPListener]
-	qsid     uint32
-}
-
-type muxSeqPacket struct {
-	nt.SeqPacket
-	ch  chan nt.Datagram
-	err error
-}
-
-func (m *muxSeqPacket) NextDatagram() (nt.Datagram, error) {
-	d, ok := <-m.ch
-	if !ok {
-		return nil, m.err
-	}
-	return d, nil
-}
-
-func (c *Client) muxAccept() {
-	for {
-		conn, err := c.qc.Accept()
-		if err != nil {
-			c.qc.Close()
-			c.qc = nil
-			return
-		}
-		buf := &bytes.Buffer{}
-		r := io.TeeReader(conn, buf)
-
-		rep, err := message.ParseOperationReplyFrom(r)
-		if err != nil {
-			continue
-		}
-		sidop, ok := rep.Options.GetData(message.OptionKindStreamID)
-		if !ok {
-			continue
-		}
-		sid := sidop.(message.StreamIDOptionData).ID
-		ptl, ok := c.qbind.Load(sid)
-		if !ok {
-			continue
-		}
-		ptl.qch <- nt.NewBufferPrefixedConn(conn, buf.Bytes())
-	}
-}
-
-func (c *Client) muxUdp() {
-	for {
-		d, err := c.qc.NextDatagram()
-		if err != nil {
-			c.qc.Close()
-			c.qc = nil
-			return
-		}
-		if len(d.Data()) < 12 {
-			continue
-		}
-		id := binary.BigEndian.Uint64(d.Data()[4:])
-		msp, ok := c.qudpconn.Load(id)
-		if !ok {
-			continue
-		}
-		msp.ch <- d
-	}
+	// UDP associations over QUIC, recovered when connection lost
+	qassoc common.SyncMap[*ProxyUDPConn, struct{}]
+	// old QUIC connections waiting their streams closed after ReconnectQUIC
+	qdrain common.SyncMap[*clientQuicConn, struct{}]
+	// next stream id for backlog bind, allocated atomically
+	qsid uint32
 }
 
 // impl
@@ -167,64 +133,31 @@ func (c *Client) ConnectRequest(ctx context.Context, addr net.Addr, initData []b
 			local:  opr.Endpoint,
 			remote: addr,
 		},
+		applied: message.GetStackOptionInfo(opr.Options, false),
 	}, nil
 }
 
 func (c *Client) BindRequest(ctx context.Context, addr net.Addr, option *message.OptionSet) (*ProxyTCPListener, error) {
-	if option == nil {
-		option = message.NewOptionSet()
+	ret := &ProxyTCPListener{
+		client: c,
+		op:     option,
 	}
-	if c.Backlog > 0 {
-		option.Add(message.Option{
-			Kind: message.OptionKindStack,
-			Data: message.BaseStackOptionData{
-				ClientLeg: false,
-				RemoteLeg: true,
-				Level:     message.StackOptionLevelTCP,
-				Code:      message.StackOptionCodeBacklog,
-				Data: &message.BacklogOptionData{
-					Backlog: uint16(c.Backlog),
-				},
-			},
-		})
-		// quic downstream, streamid
-		if c.QUIC {
-			option.Add(message.Option{
-				Kind: message.OptionKindStreamID,
-				Data: message.StreamIDOptionData{
-					ID: c.qsid,
-				},
-			})
-		}
+	// quic downstream, streamid
+	if c.Backlog > 0 && c.useQuic() {
+		ret.sid = atomic.AddUint32(&c.qsid, 1) - 1
 	}
-
-	sconn, opr, err := c.handshake(ctx, message.CommandBind, addr, []byte{}, option)
-	if err != nil {
+	if err := ret.request(ctx, addr); err != nil {
 		return nil, err
 	}
-	rso := message.GetStackOptionInfo(opr.Options, false)
-	backlog := uint16(0)
-	if ibl, ok := rso[message.StackOptionTCPBacklog]; ok {
-		backlog = ibl.(uint16)
-	}
-	ret := &ProxyTCPListener{
-		netConn: sconn,
-		backlog: backlog,
-		bind:    opr.Endpoint,
-		client:  c,
-		used:    false,
-		op:      option,
-	}
-	if c.QUIC && ret.backlog > 0 {
-		ret.qch = make(chan net.Conn, ret.backlog)
-		c.qbind.Store(c.qsid, ret)
-		c.qsid++
-	}
 	return ret, nil
 }
 
 func (c *Client) UDPAssociateRequest(ctx context.Context, addr net.Addr, option *message.OptionSet) (*ProxyUDPConn, error) {
 	opset := message.NewOptionSet()
+	if option != nil {
+		// request is sent again when association recovered
+		opset = option.Clone()
+	}
 	if c.EnableICMP {
 		opset.Add(message.Option{
 			Kind: message.OptionKindStack,
@@ -239,35 +172,19 @@ func (c *Client) UDPAssociateRequest(ctx context.Context, addr net.Addr, option
 		})
 	}
 
-	sconn, opr, err := c.handshake(
-		ctx,
-		message.CommandUdpAssociate,
-		addr,
-		[]byte{},
-		opset,
-	)
-	if err != nil {
-		return nil, err
+	pconn := &ProxyUDPConn{
+		overTcp:   c.UDPOverTCP,
+		c:         c,
+		reqAddr:   addr,
+		reqOption: opset,
 	}
-	pconn := ProxyUDPConn{
-		overTcp:  c.UDPOverTCP,
-		origConn: sconn,
-		rbind:    opr.Endpoint,
-	}
-	if pconn.overTcp {
-		pconn.dataConn = nt.WrapNetConnUDP(pconn.origConn)
-	} else {
-		dconn, err2 := c.connectDatagram(ctx)
-		if err2 != nil {
-			return nil, &net.OpError{Op: "dial", Net: "socks6", Addr: addr, Err: err2}
-		}
-		pconn.dataConn = dconn
+	if err := pconn.associate(ctx); err != nil {
+		return nil, err
 	}
-	err = pconn.init()
-	if err != nil {
-		return nil, &net.OpError{Op: "dial", Net: "socks6", Addr: addr, Source: pconn.LocalAddr(), Err: err}
+	if pconn.overQuic() {
+		c.qassoc.Store(pconn, struct{}{})
 	}
-	return &pconn, nil
+	return pconn, nil
 }
 
 // NoopRequest send a NOOP request
@@ -280,45 +197,98 @@ func (c *Client) NoopRequest(ctx context.Context) error {
 	return nil
 }
 
-// common
+// Resolve ask server to resolve host to addresses, server's DNS view is used.
+// It's experimental, server should have CommandResolve handler registered.
+func (c *Client) Resolve(ctx context.Context, host string) ([]net.IP, error) {
+	addr, err := message.NewAddr(net.JoinHostPort(host, "0"))
+	if err != nil {
+		return nil, err
+	}
+	result, err := c.resolveRequest(ctx, message.CommandResolve, addr)
+	if err != nil {
+		return nil, err
+	}
+	ips := []net.IP{}
+	for _, a := range result {
+		if a.AddressType != message.AddressTypeDomainName {
+			ips = append(ips, net.IP(a.Address))
+		}
+	}
+	return ips, nil
+}
 
-func (c *Client) getQuicConn(ctx context.Context, addr string) (nt.DualModeMultiplexedConn, error) {
-	if c.qc == nil {
-		q, err := quic.DialAddrEarlyContext(ctx, addr, &tls.Config{ServerName: c.Server}, nil)
-		if err != nil {
-			return nil, err
+// ResolvePTR ask server to reverse lookup ip, returned names has no trailing dot.
+// It's experimental, server should have CommandResolvePTR handler registered.
+func (c *Client) ResolvePTR(ctx context.Context, ip net.IP) ([]string, error) {
+	result, err := c.resolveRequest(ctx, message.CommandResolvePTR, message.ConvertAddr(&net.TCPAddr{IP: ip}))
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, a := range result {
+		if a.AddressType == message.AddressTypeDomainName {
+			names = append(names, string(a.Address))
 		}
-		c.qc = nt.WrapQUICConn(q)
-		go c.muxAccept()
-		go c.muxUdp()
 	}
-	return c.qc, nil
+	return names, nil
 }
 
-func (c *Client) dialQuicT(ctx context.Context, network, address string) (net.Conn, error) {
-	q, err := c.getQuicConn(ctx, address)
+// resolveRequest send a resolve command, return addresses in reply
+func (c *Client) resolveRequest(ctx context.Context, cmd message.CommandCode, addr *message.SocksAddr) ([]*message.SocksAddr, error) {
+	sconn, opr, err := c.handshake(ctx, cmd, addr, []byte{}, nil)
 	if err != nil {
 		return nil, err
 	}
-	return q.Dial()
+	sconn.Close()
+	if d, ok := opr.Options.GetData(message.OptionKindResolveResult); ok {
+		return d.(message.ResolveResultOptionData).Addresses, nil
+	}
+	return nil, nil
 }
 
+// common
+
 func (c *Client) dialEncrypted(ctx context.Context, network, address string) (net.Conn, error) {
 	switch network {
 	case "tcp", "tcp4", "tcp6":
-		d := tls.Dialer{NetDialer: &net.Dialer{}, Config: &tls.Config{ServerName: c.Server}}
+		d := tls.Dialer{NetDialer: &net.Dialer{}, Config: c.tlsConfig()}
 		return d.DialContext(ctx, network, address)
 	case "udp", "udp4", "udp6":
 		a, err := net.ResolveUDPAddr(network, address)
 		if err != nil {
 			return nil, err
 		}
-		return dtls.DialWithContext(ctx, network, a, &dtls.Config{ServerName: c.Server})
+		conf, err := createDTLSConfig(*c.tlsConfig())
+		if err != nil {
+			return nil, err
+		}
+		return dtls.DialWithContext(ctx, network, a, &conf)
 	default:
 		return nil, net.UnknownNetworkError(network)
 	}
 }
 
+// tlsConfig return a copy of TLSConfig with ServerName filled
+func (c *Client) tlsConfig() *tls.Config {
+	conf := &tls.Config{}
+	if c.TLSConfig != nil {
+		conf = c.TLSConfig.Clone()
+	}
+	if conf.ServerName == "" {
+		host, _, err := net.SplitHostPort(c.Server)
+		if err != nil {
+			host = c.Server
+		}
+		conf.ServerName = host
+	}
+	return conf
+}
+
+// useQuic report whether requests are sent over shared QUIC connection
+func (c *Client) useQuic() bool {
+	return c.QUIC && c.DialFunc == nil
+}
+
 func (c *Client) connectStream(ctx context.Context) (net.Conn, error) {
 	dial := (&net.Dialer{}).DialContext
 	if c.DialFunc != nil {
@@ -340,9 +310,6 @@ func (c *Client) connectDatagram(ctx context.Context) (nt.SeqPacket, error) {
 	dial := (&net.Dialer{}).DialContext
 	if c.DialFunc != nil {
 		dial = c.DialFunc
-	} else if c.QUIC {
-		// only udp assoc can setup demux param (assoc id)
-		return c.getQuicConn(ctx, c.Server)
 	} else if c.Encrypted {
 		dial = c.dialEncrypted
 	}
@@ -354,20 +321,27 @@ func (c *Client) connectDatagram(ctx context.Context) (nt.SeqPacket, error) {
 	return nt.WrapNetConnUDP(conn), nil
 }
 
-func (c *Client) createAuthnOption(ctx context.Context, sconn net.Conn, id byte, dataLen int) ([]message.Option, *auth.ClientAuthenticationChannels) {
+func (c *Client) createAuthnOption(
+	ctx context.Context,
+	sconn net.Conn,
+	method auth.ClientAuthenticationMethod,
+	session []byte,
+	dataLen int,
+) ([]message.Option, *auth.ClientAuthenticationChannels) {
 	var cac *auth.ClientAuthenticationChannels
+	id := method.ID()
 	opts := []message.Option{}
-	if len(c.session) > 0 {
+	if len(session) > 0 {
 		// use session
-		opts = append(opts, message.Option{Kind: message.OptionKindSessionID, Data: message.SessionIDOptionData{ID: c.session}})
-		if c.maxToken-c.token > 0 {
+		opts = append(opts, message.Option{Kind: message.OptionKindSessionID, Data: message.SessionIDOptionData{ID: session}})
+		token, ok, refill := c.spendToken(session)
+		if ok {
 			// use token
-			opts = append(opts, message.Option{Kind: message.OptionKindIdempotenceExpenditure, Data: message.IdempotenceExpenditureOptionData{Token: c.token}})
-			c.token++
-			// request token when necessary
-			if c.maxToken-c.token < c.UseToken/8 {
-				opts = append(opts, message.Option{Kind: message.OptionKindTokenRequest, Data: message.TokenRequestOptionData{WindowSize: c.UseToken}})
-			}
+			opts = append(opts, message.Option{Kind: message.OptionKindIdempotenceExpenditure, Data: message.IdempotenceExpenditureOptionData{Token: token}})
+		}
+		// request token when necessary
+		if refill {
+			opts = append(opts, message.Option{Kind: message.OptionKindTokenRequest, Data: message.TokenRequestOptionData{WindowSize: c.UseToken}})
 		}
 	} else {
 		// use original authn method
@@ -382,7 +356,7 @@ func (c *Client) createAuthnOption(ctx context.Context, sconn net.Conn, id byte,
 		}
 		if id != 0 {
 			cac = auth.NewClientAuthenticationChannels()
-			go c.AuthenticationMethod.Authenticate(ctx, sconn, *cac)
+			go method.Authenticate(ctx, sconn, *cac)
 			data := <-cac.Data
 			if len(data) > 0 {
 				opts = append(opts, message.Option{Kind: message.OptionKindAuthenticationData, Data: message.AuthenticationDataOptionData{
@@ -403,59 +377,63 @@ func (c *Client) createAuthnOption(ctx context.Context, sconn net.Conn, id byte,
 	return opts, cac
 }
 
-func (c *Client) checkAuthnReply(finalRep *message.AuthenticationReply) error {
-	fail := finalRep.Type != message.AuthenticationReplySuccess
-
+func (c *Client) checkAuthnReply(session []byte, finalRep *message.AuthenticationReply) error {
 	if _, f := finalRep.Options.GetData(message.OptionKindSessionInvalid); f {
-		c.session = []byte{}
-		fail = true
+		c.clearSession(session)
+		return ErrSessionInvalid
 	}
 	if _, f := finalRep.Options.GetData(message.OptionKindIdempotenceRejected); f {
-		c.maxToken = 0
-		fail = true
+		c.exhaustTokens(session)
+		return ErrTokenRejected
 	}
-	if fail {
-		return errors.New("authn fail")
+	if finalRep.Type != message.AuthenticationReplySuccess {
+		return ErrAuthenticationFailed
 	}
 	if !c.UseSession {
 		return nil
 	}
 	if _, f := finalRep.Options.GetData(message.OptionKindSessionOK); !f {
 		// no session is not really a problem
+		if len(session) == 0 {
+			c.declineSession()
+		}
 		return nil
 	}
 
-	if c.UseToken > 0 {
-		if _, f := finalRep.Options.GetData(message.OptionKindIdempotenceAccepted); !f {
-			return nil
-		}
-		if d, ok := finalRep.Options.GetData(message.OptionKindIdempotenceWindow); ok {
-			dd := d.(message.IdempotenceWindowOptionData)
-			c.token = dd.WindowBase
-			c.maxToken = dd.WindowSize
-		} else {
-			if c.maxToken == 0 {
-				return errors.New("token fail")
-			}
+	if len(session) == 0 {
+		// new session, window is allocated with session id
+		if d, ok := finalRep.Options.GetData(message.OptionKindSessionID); ok {
+			session = d.(message.SessionIDOptionData).ID
+			c.setSession(session)
 		}
 	}
+	if c.UseToken == 0 {
+		return nil
+	}
+	if d, ok := finalRep.Options.GetData(message.OptionKindIdempotenceWindow); ok {
+		dd := d.(message.IdempotenceWindowOptionData)
+		c.setTokenWindow(session, dd.WindowBase, dd.WindowSize)
+	}
 	return nil
 }
 
 // authn running authentication in handshake
-func (c *Client) authn(ctx context.Context, req message.Request, sconn net.Conn, initData []byte) error {
-	if c.AuthenticationMethod == nil {
-		c.AuthenticationMethod = auth.NoneClientAuthenticationMethod{}
+func (c *Client) authn(ctx context.Context, req message.Request, sconn net.Conn, session []byte, initData []byte) error {
+	var method auth.ClientAuthenticationMethod = auth.NoneClientAuthenticationMethod{}
+	if c.AuthenticationMethod != nil {
+		method = c.AuthenticationMethod
 	}
 	// add authn options
-	id := c.AuthenticationMethod.ID()
+	id := method.ID()
 	if id == 6 {
 		lg.Panic("SSL authentication is prohibited")
 	}
-	ops, cac := c.createAuthnOption(ctx, sconn, id, len(initData))
+	ops, cac := c.createAuthnOption(ctx, sconn, method, session, len(initData))
+	// caller's option set is reused when retry
+	req.Options = req.Options.Clone()
 	req.Options.AddMany(ops)
-	// io
-	if _, err := sconn.Write(req.Marshal()); err != nil {
+	// io, initial data follows request
+	if _, err := sconn.Write(append(req.Marshal(), initData...)); err != nil {
 		return err
 	}
 	aurep1, err := message.ParseAuthenticationReplyFrom(sconn)
@@ -493,25 +471,73 @@ func (c *Client) authn(ctx context.Context, req message.Request, sconn net.Conn,
 	}
 
 	// check final reply
-	return c.checkAuthnReply(finalRep)
+	return c.checkAuthnReply(session, finalRep)
+}
+
+// writeRequest send request without authentication,
+// it's used by streams of authenticated QUIC connection
+func (c *Client) writeRequest(sconn net.Conn, req message.Request, initData []byte) error {
+	if len(initData) > 0 {
+		req.Options = req.Options.Clone()
+		req.Options.Add(message.Option{
+			Kind: message.OptionKindAuthenticationMethodAdvertisement,
+			Data: message.AuthenticationMethodAdvertisementOptionData{
+				InitialDataLength: uint16(len(initData)),
+				Methods:           []byte{},
+			},
+		})
+	}
+	_, err := sconn.Write(append(req.Marshal(), initData...))
+	return err
 }
 
-// handshake handle the common handshake part of protocol
+// handshake handle the common handshake part of protocol,
+// request is retried when server rejected session or token, it's not processed by server in this case
 func (c *Client) handshake(
 	ctx context.Context,
 	op message.CommandCode,
 	addr net.Addr,
 	initData []byte,
 	option *message.OptionSet,
+) (net.Conn, *message.OperationReply, error) {
+	for i := 0; ; i++ {
+		sconn, opr, err := c.handshakeOnce(ctx, op, addr, initData, option)
+		if i < maxSessionRetry && (errors.Is(err, ErrSessionInvalid) || errors.Is(err, ErrTokenRejected)) {
+			lg.Debug("retry request", err)
+			continue
+		}
+		return sconn, opr, err
+	}
+}
+
+func (c *Client) handshakeOnce(
+	ctx context.Context,
+	op message.CommandCode,
+	addr net.Addr,
+	initData []byte,
+	option *message.OptionSet,
 ) (net.Conn, *message.OperationReply, error) {
 	netErr := net.OpError{
 		Op:   "dial",
 		Net:  "socks6",
 		Addr: addr,
 	}
+	session, lead, err := c.acquireSession(ctx)
+	if err != nil {
+		netErr.Err = err
+		return nil, nil, &netErr
+	}
+	if lead {
+		// released early when authentication reply is handled
+		defer func() {
+			if lead {
+				c.releaseSessionLead()
+			}
+		}()
+	}
 	sconn, err := c.connectStream(ctx)
 	if err != nil {
-		netErr.Source = sconn.LocalAddr()
+		netErr.Err = err
 		return nil, nil, &netErr
 	}
 	netErr.Source = sconn.LocalAddr()
@@ -530,7 +556,25 @@ func (c *Client) handshake(
 		Options:     option,
 	}
 
-	if err = c.authn(ctx, req, sconn, initData); err != nil {
+	if qs, ok := sconn.(*quicStream); ok && !qs.lead {
+		// server only authenticate first stream of QUIC connection
+		err = c.writeRequest(sconn, req, initData)
+	} else {
+		err = c.authn(ctx, req, sconn, session, initData)
+		if ok {
+			qs.q.finishAuth(err == nil)
+			if err != nil {
+				// server close connection when first stream failed authentication
+				qs.q.Close()
+			}
+		}
+	}
+	if lead {
+		// session is established or declined, waiting requests needn't wait operation reply
+		c.releaseSessionLead()
+		lead = false
+	}
+	if err != nil {
 		netErr.Err = err
 		return nil, nil, &netErr
 	}
@@ -543,15 +587,9 @@ func (c *Client) handshake(
 		netErr.Err = convertReplyError(opr.ReplyCode)
 		return nil, nil, &netErr
 	}
-	if c.UseSession {
-		if d, ok := opr.Options.GetData(message.OptionKindSessionID); ok {
-			c.session = d.(message.SessionIDOptionData).ID
-		} else {
-			if len(c.session) == 0 {
-				netErr.Err = errors.New("session fail")
-				return nil, nil, &netErr
-			}
-		}
+	// server may not support session, request continues without it
+	if d, ok := opr.Options.GetData(message.OptionKindSessionID); ok && c.UseSession && len(session) == 0 {
+		c.setSession(d.(message.SessionIDOptionData).ID)
 	}
 
 	cd.Cancel()
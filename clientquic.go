@@ -0,0 +1,457 @@
+package socks6
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/lucas-clemente/quic-go"
+	"github.com/studentmain/socks6/common"
+	"github.com/studentmain/socks6/common/lg"
+	"github.com/studentmain/socks6/common/nt"
+	"github.com/studentmain/socks6/message"
+)
+
+// defaultQUICRecoveryTimeout is used when Client.QUICRecoveryTimeout is 0
+const defaultQUICRecoveryTimeout = 10 * time.Second
+
+// quicRecoveryInterval is the delay between failed recovery attempts
+const quicRecoveryInterval = 200 * time.Millisecond
+
+// clientQuicConn is the QUIC connection shared by client's requests.
+// Server only authenticate the first stream, streams opened after it's authenticated skip authentication.
+type clientQuicConn struct {
+	nt.DualModeMultiplexedConn
+	conn quic.Connection
+
+	// authSem is held by the stream authenticating connection
+	authSem chan struct{}
+	// closed after connection authenticated
+	authed   chan struct{}
+	authOnce sync.Once
+
+	// slock guards streams and draining
+	slock    sync.Mutex
+	streams  int
+	draining bool
+}
+
+func newClientQuicConn(conn quic.Connection) *clientQuicConn {
+	return &clientQuicConn{
+		DualModeMultiplexedConn: nt.WrapQUICConn(conn),
+		conn:                    conn,
+		authSem:                 make(chan struct{}, 1),
+		authed:                  make(chan struct{}),
+	}
+}
+
+// Close close connection and streams on it
+func (q *clientQuicConn) Close() error {
+	return q.conn.CloseWithError(0, "")
+}
+
+// track count stream s on connection until it closed
+func (q *clientQuicConn) track(s net.Conn, lead bool) *quicStream {
+	q.slock.Lock()
+	defer q.slock.Unlock()
+	q.streams++
+	return &quicStream{Conn: s, q: q, lead: lead}
+}
+
+// untrack is called when a stream closed, connection is closed after last stream when draining
+func (q *clientQuicConn) untrack() {
+	q.slock.Lock()
+	q.streams--
+	drained := q.draining && q.streams == 0
+	q.slock.Unlock()
+	if drained {
+		q.Close()
+	}
+}
+
+// drain close connection after its streams closed, new streams should be opened on other connection
+func (q *clientQuicConn) drain() {
+	q.slock.Lock()
+	q.draining = true
+	drained := q.streams == 0
+	q.slock.Unlock()
+	if drained {
+		q.Close()
+	}
+}
+
+// lost report whether connection is closed
+func (q *clientQuicConn) lost() bool {
+	return q.conn.Context().Err() != nil
+}
+
+// lostBy report whether err is caused by connection close,
+// streams get the close error slightly before connection context is done
+func (q *clientQuicConn) lostBy(err error) bool {
+	return q.lost() || errors.Is(err, net.ErrClosed)
+}
+
+// waitAuth wait until connection authenticated, lead is true when caller should authenticate it
+func (q *clientQuicConn) waitAuth(ctx context.Context) (lead bool, err error) {
+	select {
+	case <-q.authed:
+		return false, nil
+	case q.authSem <- struct{}{}:
+		select {
+		case <-q.authed:
+			// authenticated by previous lead
+			<-q.authSem
+			return false, nil
+		default:
+			return true, nil
+		}
+	case <-q.conn.Context().Done():
+		return false, ErrConnectionLost
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+}
+
+// finishAuth is called by lead after authentication, next waiter take the lead when it failed
+func (q *clientQuicConn) finishAuth(ok bool) {
+	if ok {
+		q.authOnce.Do(func() { close(q.authed) })
+	}
+	<-q.authSem
+}
+
+// quicStream is a stream of shared QUIC connection
+type quicStream struct {
+	net.Conn
+	q *clientQuicConn
+	// stream should authenticate connection
+	lead      bool
+	closeOnce sync.Once
+}
+
+func (s *quicStream) Close() error {
+	err := s.Conn.Close()
+	s.closeOnce.Do(s.q.untrack)
+	return err
+}
+
+// muxSeqPacket is an association's datagram channel on shared QUIC connection,
+// it's kept when association is moved to another connection
+type muxSeqPacket struct {
+	lock     sync.Mutex
+	conn     nt.SeqPacket
+	deadline time.Time
+
+	ch       chan nt.Datagram
+	done     chan struct{}
+	err      error
+	failOnce sync.Once
+}
+
+func newMuxSeqPacket(conn nt.SeqPacket) *muxSeqPacket {
+	return &muxSeqPacket{
+		conn: conn,
+		ch:   make(chan nt.Datagram, 64),
+		done: make(chan struct{}),
+	}
+}
+
+func (m *muxSeqPacket) setConn(conn nt.SeqPacket) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.conn = conn
+}
+
+func (m *muxSeqPacket) getConn() nt.SeqPacket {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.conn
+}
+
+// fail stop receiving, pending and later reads return err
+func (m *muxSeqPacket) fail(err error) {
+	m.failOnce.Do(func() {
+		m.err = err
+		close(m.done)
+	})
+}
+
+func (m *muxSeqPacket) NextDatagram() (nt.Datagram, error) {
+	m.lock.Lock()
+	deadline := m.deadline
+	m.lock.Unlock()
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		t := time.NewTimer(time.Until(deadline))
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	case d := <-m.ch:
+		return d, nil
+	case <-m.done:
+		return nil, m.err
+	case <-timeout:
+		return nil, os.ErrDeadlineExceeded
+	}
+}
+
+func (m *muxSeqPacket) Reply(b []byte) error {
+	return m.getConn().Reply(b)
+}
+
+// Close stop receiving, shared connection is not closed
+func (m *muxSeqPacket) Close() error {
+	m.fail(net.ErrClosed)
+	return nil
+}
+
+func (m *muxSeqPacket) LocalAddr() net.Addr {
+	return m.getConn().LocalAddr()
+}
+
+func (m *muxSeqPacket) RemoteAddr() net.Addr {
+	return m.getConn().RemoteAddr()
+}
+
+func (m *muxSeqPacket) SetDeadline(t time.Time) error {
+	return m.SetReadDeadline(t)
+}
+
+func (m *muxSeqPacket) SetReadDeadline(t time.Time) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.deadline = t
+	return nil
+}
+
+// SetWriteDeadline is no-op, datagram write won't block
+func (m *muxSeqPacket) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// ReconnectQUIC dial a new QUIC connection and move UDP associations and backlogged listeners to it,
+// it should be called after local address changed.
+// quic-go can't migrate connection, so the new connection is dialed from current local address.
+// The old connection is closed after other streams on it closed, new requests use the new connection.
+// Associations and listeners failed to move are closed, their operations return error.
+func (c *Client) ReconnectQUIC(ctx context.Context) error {
+	c.qlock.Lock()
+	old := c.qc
+	c.qc = nil
+	c.qlock.Unlock()
+
+	if _, err := c.getQuicConn(ctx); err != nil {
+		c.qlock.Lock()
+		if c.qc == nil && old != nil && !old.lost() {
+			c.qc = old
+		}
+		c.qlock.Unlock()
+		return err
+	}
+	if old == nil {
+		return nil
+	}
+	c.recoverQuic(old)
+	c.qdrain.Store(old, struct{}{})
+	go func() {
+		<-old.conn.Context().Done()
+		c.qdrain.Delete(old)
+	}()
+	old.drain()
+	return nil
+}
+
+// initQuic create maps used by QUIC
+func (c *Client) initQuic() {
+	c.qinit.Do(func() {
+		c.qudpconn = common.NewSyncMap[uint64, *muxSeqPacket]()
+		c.qbind = common.NewSyncMap[uint32, *ProxyTCPListener]()
+		c.qassoc = common.NewSyncMap[*ProxyUDPConn, struct{}]()
+		c.qdrain = common.NewSyncMap[*clientQuicConn, struct{}]()
+	})
+}
+
+func (c *Client) getQuicConn(ctx context.Context) (*clientQuicConn, error) {
+	c.initQuic()
+
+	c.qlock.Lock()
+	defer c.qlock.Unlock()
+	if c.qc != nil && !c.qc.lost() {
+		return c.qc, nil
+	}
+	if c.isClosed() {
+		return nil, net.ErrClosed
+	}
+	conn, err := quic.DialAddrEarlyContext(ctx, c.Server, quicTLSConfig(c.tlsConfig()), &quic.Config{
+		EnableDatagrams: true,
+		KeepAlive:       true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	q := newClientQuicConn(conn)
+	c.qc = q
+	go c.muxAccept(q)
+	go c.muxUdp(q)
+	go func() {
+		<-conn.Context().Done()
+		c.quicConnLost(q)
+	}()
+	return q, nil
+}
+
+// closeQuicConn close current QUIC connection and draining old connections
+func (c *Client) closeQuicConn() {
+	c.qlock.Lock()
+	q := c.qc
+	c.qc = nil
+	c.qlock.Unlock()
+	if q != nil {
+		q.Close()
+	}
+	c.initQuic()
+	c.qdrain.Range(func(old *clientQuicConn, _ struct{}) bool {
+		old.Close()
+		return true
+	})
+}
+
+// quicConnLost forget closed QUIC connection q, objects on it are recovered on a new connection
+func (c *Client) quicConnLost(q *clientQuicConn) {
+	c.qlock.Lock()
+	// another goroutine may already replaced it
+	if c.qc == q {
+		c.qc = nil
+	}
+	c.qlock.Unlock()
+	c.recoverQuic(q)
+}
+
+// recoverQuic move UDP associations and backlogged listeners on q to current QUIC connection,
+// return after all of them moved or failed
+func (c *Client) recoverQuic(q *clientQuicConn) {
+	waits := []chan struct{}{}
+	c.qassoc.Range(func(u *ProxyUDPConn, _ struct{}) bool {
+		if ch := u.startRecovery(q); ch != nil {
+			waits = append(waits, ch)
+		}
+		return true
+	})
+	c.qbind.Range(func(_ uint32, t *ProxyTCPListener) bool {
+		if ch := t.startRecovery(q); ch != nil {
+			waits = append(waits, ch)
+		}
+		return true
+	})
+	for _, ch := range waits {
+		<-ch
+	}
+}
+
+// retryRecovery call f until it succeed, client closed or recovery timeout reached
+func (c *Client) retryRecovery(f func(ctx context.Context) error) error {
+	timeout := c.QUICRecoveryTimeout
+	if timeout == 0 {
+		timeout = defaultQUICRecoveryTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	for {
+		err := f(ctx)
+		if err == nil {
+			return nil
+		}
+		lg.Info("QUIC recovery attempt failed", err)
+		if c.isClosed() {
+			return net.ErrClosed
+		}
+		select {
+		case <-time.After(quicRecoveryInterval):
+		case <-ctx.Done():
+			return ErrConnectionLost
+		}
+	}
+}
+
+func (c *Client) muxAccept(q *clientQuicConn) {
+	for {
+		// connection close is handled by quicConnLost
+		conn, err := q.Accept()
+		if err != nil {
+			return
+		}
+		rep, err := message.ParseOperationReplyFrom(conn)
+		if err != nil {
+			conn.Close()
+			continue
+		}
+		sidop, ok := rep.Options.GetData(message.OptionKindStreamID)
+		if !ok {
+			conn.Close()
+			continue
+		}
+		sid := sidop.(message.StreamIDOptionData).ID
+		ptl, ok := c.qbind.Load(sid)
+		if !ok {
+			conn.Close()
+			continue
+		}
+		ptl.deliver(&ProxyTCPConn{
+			netConn: q.track(conn, false),
+			addrPair: addrPair{
+				local:  ptl.Addr(),
+				remote: rep.Endpoint,
+			},
+		})
+	}
+}
+
+func (c *Client) muxUdp(q *clientQuicConn) {
+	for {
+		d, err := q.NextDatagram()
+		if err != nil {
+			return
+		}
+		if len(d.Data()) < 12 {
+			continue
+		}
+		id := binary.BigEndian.Uint64(d.Data()[4:])
+		msp, ok := c.qudpconn.Load(id)
+		if !ok {
+			continue
+		}
+		select {
+		case msp.ch <- d:
+		default:
+			// reader is too slow, drop it like a full socket buffer does
+		}
+	}
+}
+
+func (c *Client) dialQuicT(ctx context.Context, network, address string) (net.Conn, error) {
+	for i := 0; ; i++ {
+		q, err := c.getQuicConn(ctx)
+		if err != nil {
+			return nil, err
+		}
+		lead, err := q.waitAuth(ctx)
+		if err == nil {
+			var s net.Conn
+			if s, err = q.Dial(); err == nil {
+				return q.track(s, lead), nil
+			}
+			if lead {
+				q.finishAuth(false)
+			}
+		}
+		// retry once on a new connection
+		if i > 0 || !q.lostBy(err) {
+			return nil, err
+		}
+	}
+}
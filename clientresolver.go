@@ -0,0 +1,37 @@
+package socks6
+
+import (
+	"context"
+	"net"
+	"strings"
+
+	"github.com/studentmain/socks6/common/lg"
+)
+
+// Resolver create a resolver whose DNS queries are sent to DNSServer through proxy server,
+// so destination names are not leaked to local network.
+// Queries are sent in UDP associations, TCP connections are used when association failed or response truncated.
+func (c *Client) Resolver() *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial:     c.dialDNS,
+	}
+}
+
+// dialDNS connect to DNS server through proxy, udp conn implements net.PacketConn as Go resolver required
+func (c *Client) dialDNS(ctx context.Context, network string, address string) (net.Conn, error) {
+	if c.DNSServer != "" {
+		address = c.DNSServer
+	}
+	if strings.HasPrefix(network, "udp") {
+		conn, err := c.DialContext(ctx, "udp", address)
+		if err == nil {
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		lg.Info("can't query dns over udp association, fallback to tcp", err)
+	}
+	return c.DialContext(ctx, "tcp", address)
+}
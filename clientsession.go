@@ -0,0 +1,232 @@
+package socks6
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"time"
+
+	"github.com/studentmain/socks6/message"
+)
+
+// maxSessionRetry is how many times a request is retried with fresh session or token
+const maxSessionRetry = 2
+
+// sessionTeardownTimeout limit the time Client.Close wait for server
+const sessionTeardownTimeout = 5 * time.Second
+
+// SessionState is a snapshot of Client's session and idempotence token window
+type SessionState struct {
+	// ID is current session id, empty when no session established
+	ID []byte
+	// Establishing is true when a request is establishing new session
+	Establishing bool
+	// NextToken is the next token to spend
+	NextToken uint32
+	// Tokens is how many tokens can be spent before window refilled
+	Tokens uint32
+	// Closed is true after Client.Close called
+	Closed bool
+}
+
+// SessionState return current session state
+func (c *Client) SessionState() SessionState {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return SessionState{
+		ID:           append([]byte(nil), c.session...),
+		Establishing: c.sessionWait != nil,
+		NextToken:    c.token,
+		Tokens:       c.maxToken - c.token,
+		Closed:       c.closed,
+	}
+}
+
+// Close tear down current session, requests after Close fail with net.ErrClosed.
+// Established connections, listeners and associations are not closed,
+// except when QUIC is used, the shared QUIC connection and everything on it are closed,
+// server remove the session after it expired.
+func (c *Client) Close() error {
+	c.lock.Lock()
+	if c.closed {
+		c.lock.Unlock()
+		return net.ErrClosed
+	}
+	c.closed = true
+	session := c.session
+	c.session = nil
+	c.token = 0
+	c.maxToken = 0
+	c.lock.Unlock()
+
+	if c.useQuic() {
+		// server only authenticate first stream, teardown can't be sent in other streams
+		c.closeQuicConn()
+		return nil
+	}
+	if len(session) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), sessionTeardownTimeout)
+	defer cancel()
+	return c.teardownSession(ctx, session)
+}
+
+// teardownSession ask server to remove session
+func (c *Client) teardownSession(ctx context.Context, session []byte) error {
+	netErr := net.OpError{
+		Op:   "close",
+		Net:  "socks6",
+		Addr: message.DefaultAddr,
+	}
+	sconn, err := c.connectStream(ctx)
+	if err != nil {
+		netErr.Err = err
+		return &netErr
+	}
+	defer sconn.Close()
+	netErr.Source = sconn.LocalAddr()
+	if deadline, ok := ctx.Deadline(); ok {
+		sconn.SetDeadline(deadline)
+	}
+
+	req := message.Request{
+		CommandCode: message.CommandNoop,
+		Endpoint:    message.DefaultAddr,
+		Options:     message.NewOptionSet(),
+	}
+	req.Options.Add(message.Option{Kind: message.OptionKindSessionID, Data: message.SessionIDOptionData{ID: session}})
+	req.Options.Add(message.Option{Kind: message.OptionKindSessionTeardown, Data: message.SessionTeardownOptionData{}})
+	if _, err = sconn.Write(req.Marshal()); err != nil {
+		netErr.Err = err
+		return &netErr
+	}
+	// server reply session invalid after session removed
+	if _, err = message.ParseAuthenticationReplyFrom(sconn); err != nil {
+		netErr.Err = err
+		return &netErr
+	}
+	return nil
+}
+
+// isClosed report whether Close is called
+func (c *Client) isClosed() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.closed
+}
+
+// acquireSession return session to be used in request.
+// When session is wanted but not established, only one caller get lead == true and establish it,
+// others wait until it's done, then use the new session or take the lead if it failed.
+// Nobody waits after server declined session.
+func (c *Client) acquireSession(ctx context.Context) (session []byte, lead bool, err error) {
+	for {
+		c.lock.Lock()
+		if c.closed {
+			c.lock.Unlock()
+			return nil, false, net.ErrClosed
+		}
+		if !c.UseSession || len(c.session) > 0 || c.sessionDeclined {
+			session = c.session
+			c.lock.Unlock()
+			return session, false, nil
+		}
+		wait := c.sessionWait
+		if wait == nil {
+			c.sessionWait = make(chan struct{})
+			c.lock.Unlock()
+			return nil, true, nil
+		}
+		c.lock.Unlock()
+
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		}
+	}
+}
+
+// releaseSessionLead wake callers waiting for session establishment
+func (c *Client) releaseSessionLead() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	close(c.sessionWait)
+	c.sessionWait = nil
+}
+
+// setSession save session id returned by server
+func (c *Client) setSession(id []byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		return
+	}
+	c.sessionDeclined = false
+	if !bytes.Equal(c.session, id) {
+		c.session = id
+		c.token = 0
+		c.maxToken = 0
+	}
+}
+
+// declineSession stop waiting for session establishment after server didn't start session,
+// following requests still ask for it
+func (c *Client) declineSession() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.sessionDeclined = true
+}
+
+// clearSession forget session, it's no-op when session is already replaced
+func (c *Client) clearSession(session []byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if bytes.Equal(c.session, session) {
+		c.session = nil
+		c.token = 0
+		c.maxToken = 0
+	}
+}
+
+// spendToken allocate a token in session, ok is false when no token left.
+// refill is true when token window should be extended, it's requested when half of window is used,
+// so the new window usually arrives before tokens run out.
+func (c *Client) spendToken(session []byte) (token uint32, ok bool, refill bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.UseToken == 0 || !bytes.Equal(c.session, session) {
+		return 0, false, false
+	}
+	if c.maxToken == c.token {
+		return 0, false, true
+	}
+	token = c.token
+	c.token++
+	return token, true, c.maxToken-c.token <= c.UseToken/2
+}
+
+// exhaustTokens stop spending tokens in current window after a token rejected,
+// next request ask server for window, tokens before c.token are never reused
+func (c *Client) exhaustTokens(session []byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if bytes.Equal(c.session, session) {
+		c.maxToken = c.token
+	}
+}
+
+// setTokenWindow apply token window returned by server
+func (c *Client) setTokenWindow(session []byte, base uint32, size uint32) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if !bytes.Equal(c.session, session) {
+		return
+	}
+	// tokens before c.token may be in flight, don't reuse them
+	if c.token-base >= size {
+		c.token = base
+	}
+	c.maxToken = base + size
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/studentmain/socks6"
+	"github.com/studentmain/socks6/auth"
+	"github.com/studentmain/socks6/common/lg"
+	"github.com/studentmain/socks6/internal/yamlpath"
+	"github.com/studentmain/socks6/rule"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the client config file, in YAML or JSON
+type Config struct {
+	// LogLevel is one of fatal, panic, error, warning, info, trace and debug
+	LogLevel string `yaml:"log_level"`
+	// Listen is local address serving SOCKS 5, SOCKS 4a and HTTP proxy clients, default is 127.0.0.1:1080
+	Listen string `yaml:"listen"`
+	// DisableHTTP stop serving HTTP CONNECT and forward proxy clients
+	DisableHTTP bool `yaml:"disable_http"`
+	// Bypass is destinations connected directly instead of through server,
+	// IP address, CIDR, exact domain, domain suffix start with . or domain glob
+	Bypass []string `yaml:"bypass"`
+
+	// Server is SOCKS 6 server address
+	Server string `yaml:"server"`
+	// Transport is tcp, tls or quic, datagrams are sent over UDP, DTLS or QUIC datagram
+	Transport string    `yaml:"transport"`
+	TLS       TLSConfig `yaml:"tls"`
+	// UDPOverTCP send datagrams over the association's TCP, TLS or QUIC stream
+	UDPOverTCP bool `yaml:"udp_over_tcp"`
+
+	Auth    AuthConfig    `yaml:"auth"`
+	Session SessionConfig `yaml:"session"`
+	DNS     DNSConfig     `yaml:"dns"`
+
+	file string
+	root *yaml.Node
+}
+
+type TLSConfig struct {
+	// ServerName is used to verify server certificate, default is host of server
+	ServerName string `yaml:"server_name"`
+	// CAFile is PEM encoded CA certificates, system roots are used when empty
+	CAFile string `yaml:"ca_file"`
+	// InsecureSkipVerify accept any server certificate, only for testing
+	InsecureSkipVerify bool `yaml:"insecure_skip_verify"`
+}
+
+type AuthConfig struct {
+	// Username and Password are used for password authentication, empty Username means no authentication
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+type SessionConfig struct {
+	// Enable request a session, following requests are authenticated by it
+	Enable bool `yaml:"enable"`
+	// Token is number of idempotence tokens requested, 0 means not used, requires session
+	Token uint32 `yaml:"token"`
+}
+
+type DNSConfig struct {
+	// Listen is local UDP and TCP address of DNS forwarder, empty means disabled
+	Listen string `yaml:"listen"`
+	// Server is DNS server queried through SOCKS 6 server
+	Server string `yaml:"server"`
+	// DisableCache forward every query instead of answer from cached responses
+	DisableCache bool `yaml:"disable_cache"`
+}
+
+var logLevelName = map[string]lg.Level{
+	"fatal":   lg.LvFatal,
+	"panic":   lg.LvPanic,
+	"error":   lg.LvError,
+	"warning": lg.LvWarning,
+	"info":    lg.LvInfo,
+	"trace":   lg.LvTrace,
+	"debug":   lg.LvDebug,
+}
+
+// LoadConfig read and check config file, YAML and JSON are both accepted
+func LoadConfig(filename string) (*Config, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return ParseConfig(filename, b)
+}
+
+// ParseConfig parse and check config, filename is used in error message
+func ParseConfig(filename string, b []byte) (*Config, error) {
+	c := &Config{file: filename}
+	root := &yaml.Node{}
+	if err := yaml.Unmarshal(b, root); err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	c.root = root
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Level return minimal log level in config
+func (c *Config) Level() lg.Level {
+	return logLevelName[c.LogLevel]
+}
+
+// errorf create an error of value at path, path is keys and indexes from root
+func (c *Config) errorf(path []interface{}, format string, v ...interface{}) error {
+	return yamlpath.Errorf(c.file, c.root, path, format, v...)
+}
+
+func path(p ...interface{}) []interface{} {
+	return p
+}
+
+// validate check values and fill defaults
+func (c *Config) validate() error {
+	if c.LogLevel == "" {
+		c.LogLevel = "info"
+	}
+	if _, ok := logLevelName[c.LogLevel]; !ok {
+		return c.errorf(path("log_level"), "unknown log level %q", c.LogLevel)
+	}
+	if c.Listen == "" {
+		c.Listen = "127.0.0.1:1080"
+	}
+	if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+		return c.errorf(path("listen"), "%v", err)
+	}
+
+	if c.Server == "" {
+		return c.errorf(path("server"), "server address is required")
+	}
+	if _, _, err := net.SplitHostPort(c.Server); err != nil {
+		return c.errorf(path("server"), "%v", err)
+	}
+	if c.Transport == "" {
+		c.Transport = "tcp"
+	}
+	switch c.Transport {
+	case "tcp":
+		if c.TLS != (TLSConfig{}) {
+			return c.errorf(path("tls"), "tcp transport doesn't use tls")
+		}
+	case "tls", "quic":
+	default:
+		return c.errorf(path("transport"), "unknown transport %q, should be tcp, tls or quic", c.Transport)
+	}
+	if c.TLS.InsecureSkipVerify && c.TLS.CAFile != "" {
+		return c.errorf(path("tls", "insecure_skip_verify"), "can't be used with ca_file")
+	}
+
+	if c.Auth.Username == "" && c.Auth.Password != "" {
+		return c.errorf(path("auth", "password"), "username is required")
+	}
+	if len(c.Auth.Username) > 255 || len(c.Auth.Password) > 255 {
+		return c.errorf(path("auth"), "username and password should be shorter than 256 bytes")
+	}
+	if c.Session.Token > 0 && !c.Session.Enable {
+		return c.errorf(path("session", "token"), "token requires session")
+	}
+	for i, b := range c.Bypass {
+		if _, err := bypassMatcher(b); err != nil {
+			return c.errorf(path("bypass", i), "%v", err)
+		}
+	}
+
+	if c.DNS.Listen == "" {
+		if c.DNS != (DNSConfig{}) {
+			return c.errorf(path("dns"), "listen is required")
+		}
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(c.DNS.Listen); err != nil {
+		return c.errorf(path("dns", "listen"), "%v", err)
+	}
+	if c.DNS.Server == "" {
+		return c.errorf(path("dns"), "server is required")
+	}
+	if _, _, err := net.SplitHostPort(c.DNS.Server); err != nil {
+		return c.errorf(path("dns", "server"), "%v", err)
+	}
+	return nil
+}
+
+// bypassMatcher convert a bypass entry to destination matcher, IP and CIDR match IP destinations, others match domains
+func bypassMatcher(b string) (*rule.Matcher, error) {
+	r := rule.Rule{Name: "bypass " + b}
+	if strings.Contains(b, "/") {
+		r.Destination = []string{b}
+	} else if ip := net.ParseIP(b); ip != nil {
+		bits := 128
+		if ip.To4() != nil {
+			bits = 32
+		}
+		r.Destination = []string{fmt.Sprintf("%s/%d", b, bits)}
+	} else if b != "" {
+		r.Domain = []string{strings.ToLower(b)}
+	} else {
+		return nil, errors.New("empty bypass entry")
+	}
+	return rule.NewMatcher(r)
+}
+
+// Build create the local server, it forwards requests through a socks6.Client unless destination is bypassed.
+// DNS forwarder use same client, it's nil when not enabled.
+func (c *Config) Build() (*socks6.Server, *DNSForwarder, error) {
+	client, err := c.client()
+	if err != nil {
+		return nil, nil, err
+	}
+	w := socks6.NewServerWorker()
+	authn := auth.NewServerAuthenticator()
+	authn.AddMethod(auth.NoneServerAuthenticationMethod{})
+	w.Authenticator = authn
+	w.Outbound = socks6.Socks6ServerOutbound{Client: client}
+	if len(c.Bypass) > 0 {
+		if w.Outbound, err = c.router(w.Outbound); err != nil {
+			return nil, nil, err
+		}
+	}
+	// server decide which destination can be reached
+	w.DestinationPolicy = nil
+	w.EnableSocks5 = true
+	w.EnableSocks4 = true
+	w.EnableHTTP = !c.DisableHTTP
+	s := &socks6.Server{
+		Listeners: []socks6.ListenerConfig{{Transport: "tcp", Address: c.Listen}},
+		Worker:    w,
+	}
+	if c.DNS.Listen == "" {
+		return s, nil, nil
+	}
+	client.DNSServer = c.DNS.Server
+	return s, &DNSForwarder{
+		Listen:  c.DNS.Listen,
+		Server:  c.DNS.Server,
+		Dial:    client.Resolver().Dial,
+		NoCache: c.DNS.DisableCache,
+	}, nil
+}
+
+// router send bypassed destinations to direct outbound, others to proxy
+func (c *Config) router(proxy socks6.ServerOutbound) (*socks6.RouterServerOutbound, error) {
+	outbounds := map[string]socks6.ServerOutbound{
+		"proxy":  proxy,
+		"direct": socks6.InternetServerOutbound{},
+	}
+	routes := []socks6.OutboundRoute{}
+	for i, b := range c.Bypass {
+		m, err := bypassMatcher(b)
+		if err != nil {
+			return nil, c.errorf(path("bypass", i), "%v", err)
+		}
+		routes = append(routes, socks6.OutboundRoute{Name: "bypass " + b, Match: m, Outbounds: []string{"direct"}})
+	}
+	return socks6.NewRouterServerOutbound(outbounds, routes, []string{"proxy"})
+}
+
+// client create SOCKS 6 client connect to server
+func (c *Config) client() (*socks6.Client, error) {
+	client := &socks6.Client{
+		Server:     c.Server,
+		Encrypted:  c.Transport == "tls",
+		QUIC:       c.Transport == "quic",
+		UDPOverTCP: c.UDPOverTCP,
+		UseSession: c.Session.Enable,
+		UseToken:   c.Session.Token,
+	}
+	if c.Auth.Username != "" {
+		client.AuthenticationMethod = auth.PasswordClientAuthenticationMethod{
+			Username: c.Auth.Username,
+			Password: c.Auth.Password,
+		}
+	}
+	if c.Transport == "tcp" {
+		return client, nil
+	}
+	client.TLSConfig = &tls.Config{
+		ServerName:         c.TLS.ServerName,
+		InsecureSkipVerify: c.TLS.InsecureSkipVerify,
+	}
+	if c.TLS.CAFile != "" {
+		b, err := os.ReadFile(c.TLS.CAFile)
+		if err != nil {
+			return nil, c.errorf(path("tls", "ca_file"), "%v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, c.errorf(path("tls", "ca_file"), "no certificate found")
+		}
+		client.TLSConfig.RootCAs = pool
+	}
+	return client, nil
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/studentmain/socks6"
+	"github.com/studentmain/socks6/auth"
+	"github.com/studentmain/socks6/common/lg"
+	"github.com/studentmain/socks6/e2e/e2etool"
+	"github.com/studentmain/socks6/message"
+)
+
+func TestParseConfig(t *testing.T) {
+	y := `
+server: 192.0.2.1:8389
+transport: quic
+tls:
+  server_name: proxy.example
+auth:
+  username: alice
+  password: "123456"
+session:
+  enable: true
+  token: 16
+bypass: [localhost, 10.0.0.0/8, "::1"]
+dns:
+  listen: 127.0.0.1:5353
+  server: 192.0.2.53:53
+`
+	c, err := ParseConfig("test.yaml", []byte(y))
+	assert.NoError(t, err)
+	assert.Equal(t, "127.0.0.1:1080", c.Listen)
+	assert.Equal(t, lg.LvInfo, c.Level())
+
+	s, dns, err := c.Build()
+	assert.NoError(t, err)
+	assert.Equal(t, "192.0.2.53:53", dns.Server)
+	assert.False(t, dns.NoCache)
+	assert.Equal(t, []socks6.ListenerConfig{{Transport: "tcp", Address: "127.0.0.1:1080"}}, s.Listeners)
+	assert.True(t, s.Worker.EnableSocks5)
+	assert.True(t, s.Worker.EnableSocks4)
+	assert.True(t, s.Worker.EnableHTTP)
+	assert.Nil(t, s.Worker.DestinationPolicy)
+	router := s.Worker.Outbound.(*socks6.RouterServerOutbound)
+	assert.Len(t, router.Routes, 3)
+	assert.Equal(t, []string{"proxy"}, router.Default)
+	client := router.Outbounds["proxy"].(socks6.Socks6ServerOutbound).Client
+	assert.True(t, client.QUIC)
+	assert.Equal(t, "proxy.example", client.TLSConfig.ServerName)
+	assert.True(t, client.UseSession)
+	assert.EqualValues(t, 16, client.UseToken)
+	assert.Equal(t, "192.0.2.53:53", client.DNSServer)
+	assert.Equal(t, "alice", client.AuthenticationMethod.(auth.PasswordClientAuthenticationMethod).Username)
+
+	c, err = ParseConfig("test.json", []byte(`{"server": "127.0.0.1:1080", "listen": ":1081", "disable_http": true}`))
+	assert.NoError(t, err)
+	assert.Equal(t, "tcp", c.Transport)
+	s, dns, err = c.Build()
+	assert.NoError(t, err)
+	assert.Nil(t, dns)
+	assert.False(t, s.Worker.EnableHTTP)
+	assert.IsType(t, socks6.Socks6ServerOutbound{}, s.Worker.Outbound)
+	client, err = c.client()
+	assert.NoError(t, err)
+	assert.Nil(t, client.TLSConfig)
+	assert.Nil(t, client.AuthenticationMethod)
+}
+
+func TestParseConfigError(t *testing.T) {
+	tests := []struct {
+		conf string
+		err  string
+	}{
+		{"listen: :1080\n", "server address is required"},
+		{"server: 1080\n", "test.yaml:1: server"},
+		{"server: :1080\ntransport: udp\n", "test.yaml:2: transport"},
+		{"server: :1080\ntls:\n  server_name: a\n", "tcp transport doesn't use tls"},
+		{"server: :1080\ntransport: tls\ntls:\n  ca_file: a.pem\n  insecure_skip_verify: true\n", "test.yaml:5: tls.insecure_skip_verify"},
+		{"server: :1080\nauth:\n  password: a\n", "test.yaml:3: auth.password"},
+		{"server: :1080\nsession:\n  token: 8\n", "token requires session"},
+		{"server: :1080\nlog_level: verbose\n", "unknown log level"},
+		{"server: :1080\nlisten: 1080\n", "test.yaml:2: listen"},
+		{"server: :1080\nsocks: true\n", "line 2"},
+		{"server: :1080\nbypass:\n  - localhost\n  - 10.0.0.0/33\n", "test.yaml:4: bypass[1]"},
+		{"server: :1080\nbypass: [\"\"]\n", "empty bypass entry"},
+		{"server: :1080\ndns:\n  server: 1.1.1.1:53\n", "listen is required"},
+		{"server: :1080\ndns:\n  listen: :53\n", "server is required"},
+		{"server: :1080\ndns:\n  listen: :53\n  server: 1.1.1.1\n", "test.yaml:4: dns.server"},
+	}
+	for _, tt := range tests {
+		_, err := ParseConfig("test.yaml", []byte(tt.conf))
+		if assert.Error(t, err, tt.conf) {
+			assert.Contains(t, err.Error(), tt.err, tt.conf)
+		}
+	}
+}
+
+func TestExampleConfig(t *testing.T) {
+	_, err := LoadConfig("config.example.yaml")
+	assert.NoError(t, err)
+}
+
+// shutdown close server and its remaining connections
+func shutdown(s *socks6.Server) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s.Shutdown(ctx)
+}
+
+func TestForward(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echoAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeTCP(ctx, echoAddr, e2etool.Echo)
+	uechoAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeUDP(ctx, uechoAddr, e2etool.UEcho)
+
+	sAddr, sPort := e2etool.GetAddr()
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        e2etool.NewServerWorker(),
+	}
+	sa := auth.NewServerAuthenticator()
+	sa.AddMethod(auth.PasswordServerAuthenticationMethod{Passwords: map[string]string{"alice": "123456"}})
+	server.Worker.Authenticator = sa
+	server.Start(ctx)
+	defer shutdown(&server)
+
+	lAddr, _ := e2etool.GetAddr()
+	c, err := ParseConfig("test.yaml", []byte("server: "+sAddr+"\nlisten: "+lAddr+"\nauth: {username: alice, password: \"123456\"}\n"))
+	assert.NoError(t, err)
+	local, _, err := c.Build()
+	assert.NoError(t, err)
+	local.Start(ctx)
+	defer shutdown(local)
+
+	s5 := socks6.Socks5ServerOutbound{Server: lAddr}
+	fd, _, err := s5.Dial(ctx, message.StackOptionInfo{}, message.ParseAddr(echoAddr))
+	if assert.NoError(t, err) {
+		e2etool.AssertForward(t, fd, fd)
+		fd.Close()
+	}
+	pc, _, err := s5.ListenPacket(ctx, message.StackOptionInfo{}, message.ParseAddr("0.0.0.0:0"))
+	if assert.NoError(t, err) {
+		ua := message.ParseAddr(uechoAddr)
+		pc.WriteTo([]byte{1, 2, 3}, ua)
+		buf := make([]byte, 10)
+		n, a, err := pc.ReadFrom(buf)
+		if assert.NoError(t, err) {
+			assert.Equal(t, []byte{1, 2, 3}, buf[:n])
+			assert.Equal(t, ua.String(), a.String())
+		}
+		pc.Close()
+	}
+
+	// socks 4a connect to domain name
+	conn, err := net.Dial("tcp", lAddr)
+	if assert.NoError(t, err) {
+		_, port, _ := net.SplitHostPort(echoAddr)
+		p, _ := strconv.Atoi(port)
+		req := []byte{4, 1, byte(p >> 8), byte(p), 0, 0, 0, 1, 'u', 0}
+		req = append(req, []byte("localhost\x00")...)
+		conn.Write(req)
+		rep := make([]byte, 8)
+		_, err = conn.Read(rep)
+		if assert.NoError(t, err) {
+			assert.EqualValues(t, 90, rep[1])
+			e2etool.AssertForward(t, conn, conn)
+		}
+		conn.Close()
+	}
+
+	// http connect
+	h := socks6.HTTPServerOutbound{Server: lAddr}
+	fd, _, err = h.Dial(ctx, message.StackOptionInfo{}, message.ParseAddr(echoAddr))
+	if assert.NoError(t, err) {
+		e2etool.AssertForward(t, fd, fd)
+		fd.Close()
+	}
+
+	// http forward, request is sent as initial data
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		w.Write(append([]byte(r.Method+" "), b...))
+	}))
+	defer web.Close()
+	hc := http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(&url.URL{Scheme: "http", Host: lAddr})}}
+	resp, err := hc.Post(web.URL, "text/plain", strings.NewReader("hello"))
+	if assert.NoError(t, err) {
+		b, _ := io.ReadAll(resp.Body)
+		assert.Equal(t, "POST hello", string(b))
+		resp.Body.Close()
+	}
+}
+
+func TestBypass(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echoAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeTCP(ctx, echoAddr, e2etool.Echo)
+
+	// nothing listen on server address, only bypassed destinations can be reached
+	sAddr, _ := e2etool.GetAddr()
+	lAddr, _ := e2etool.GetAddr()
+	c, err := ParseConfig("test.yaml", []byte("server: "+sAddr+"\nlisten: "+lAddr+"\nbypass: [127.0.0.1, .localhost]\n"))
+	assert.NoError(t, err)
+	local, _, err := c.Build()
+	assert.NoError(t, err)
+	local.Start(ctx)
+	defer shutdown(local)
+
+	_, port, _ := net.SplitHostPort(echoAddr)
+	h := socks6.HTTPServerOutbound{Server: lAddr}
+	fd, _, err := h.Dial(ctx, message.StackOptionInfo{}, message.ParseAddr(echoAddr))
+	if assert.NoError(t, err) {
+		e2etool.AssertForward(t, fd, fd)
+		fd.Close()
+	}
+	fd, _, err = h.Dial(ctx, message.StackOptionInfo{}, message.ParseAddr("localhost:"+port))
+	if assert.NoError(t, err) {
+		e2etool.AssertForward(t, fd, fd)
+		fd.Close()
+	}
+	_, _, err = h.Dial(ctx, message.StackOptionInfo{}, message.ParseAddr("localhost.example:"+port))
+	assert.Error(t, err)
+}
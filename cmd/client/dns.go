@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/studentmain/socks6/common/lg"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// maxDNSCacheSize is number of cached responses which trigger expired responses cleanup
+const maxDNSCacheSize = 4096
+
+// dnsTimeout is max time of forwarding a query
+const dnsTimeout = 5 * time.Second
+
+// DNSForwarder serve DNS queries on UDP and TCP, forward them to Server by Dial, responses are cached by TTL
+type DNSForwarder struct {
+	// Listen is local address of UDP and TCP server
+	Listen string
+	// Server is upstream DNS server
+	Server string
+	// Dial connect to Server, socks6.Client's resolver Dial is used
+	Dial func(ctx context.Context, network string, address string) (net.Conn, error)
+	// NoCache forward every query to Server
+	NoCache bool
+
+	lock  sync.Mutex
+	cache map[dnsCacheKey]dnsCacheEntry
+}
+
+type dnsCacheKey struct {
+	name   string
+	qtype  dnsmessage.Type
+	qclass dnsmessage.Class
+	// response to tcp query may be too long for udp
+	tcp bool
+}
+
+type dnsCacheEntry struct {
+	msg     *dnsmessage.Message
+	created time.Time
+	expires time.Time
+}
+
+// Start listen on UDP and TCP, serve until ctx done
+func (f *DNSForwarder) Start(ctx context.Context) error {
+	pc, err := net.ListenPacket("udp", f.Listen)
+	if err != nil {
+		return err
+	}
+	l, err := net.Listen("tcp", f.Listen)
+	if err != nil {
+		pc.Close()
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		pc.Close()
+		l.Close()
+	}()
+	go f.serveUDP(ctx, pc)
+	go f.serveTCP(ctx, l)
+	return nil
+}
+
+func (f *DNSForwarder) serveUDP(ctx context.Context, pc net.PacketConn) {
+	buf := make([]byte, 65535)
+	for {
+		n, a, err := pc.ReadFrom(buf)
+		if err != nil {
+			lg.Info("stop dns udp server", err)
+			return
+		}
+		q := append([]byte{}, buf[:n]...)
+		go func() {
+			r, err := f.forward(ctx, q, false)
+			if err != nil {
+				lg.Info("dns query from", a, "failed", err)
+				return
+			}
+			pc.WriteTo(r, a)
+		}()
+	}
+}
+
+func (f *DNSForwarder) serveTCP(ctx context.Context, l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			lg.Info("stop dns tcp server", err)
+			return
+		}
+		go func() {
+			defer conn.Close()
+			for {
+				conn.SetReadDeadline(time.Now().Add(2 * dnsTimeout))
+				q, err := readDNSStream(conn)
+				if err != nil {
+					return
+				}
+				r, err := f.forward(ctx, q, true)
+				if err != nil {
+					lg.Info("dns query from", conn.RemoteAddr(), "failed", err)
+					return
+				}
+				if err = writeDNSStream(conn, r); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+// forward answer query q from cache or upstream
+func (f *DNSForwarder) forward(ctx context.Context, q []byte, tcp bool) ([]byte, error) {
+	qm := &dnsmessage.Message{}
+	if err := qm.Unpack(q); err != nil {
+		return nil, err
+	}
+	if qm.Response || len(qm.Questions) != 1 {
+		return nil, errors.New("not a dns query")
+	}
+	question := qm.Questions[0]
+	key := dnsCacheKey{
+		name:   strings.ToLower(question.Name.String()),
+		qtype:  question.Type,
+		qclass: question.Class,
+		tcp:    tcp,
+	}
+	if r := f.cached(key, qm); r != nil {
+		return r, nil
+	}
+
+	qctx, cancel := context.WithTimeout(ctx, dnsTimeout)
+	defer cancel()
+	rm, err := f.exchange(qctx, q, qm.ID, tcp)
+	if err != nil {
+		return nil, err
+	}
+	f.store(key, rm)
+	return rm.Pack()
+}
+
+// exchange send query to server through proxy, use datagram when conn is a packet conn
+func (f *DNSForwarder) exchange(ctx context.Context, q []byte, id uint16, tcp bool) (*dnsmessage.Message, error) {
+	network := "udp"
+	if tcp {
+		network = "tcp"
+	}
+	conn, err := f.Dial(ctx, network, f.Server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if d, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(d)
+	}
+
+	_, packet := conn.(net.PacketConn)
+	if packet {
+		_, err = conn.Write(q)
+	} else {
+		err = writeDNSStream(conn, q)
+	}
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 65535)
+	for {
+		var b []byte
+		if packet {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return nil, err
+			}
+			b = buf[:n]
+		} else if b, err = readDNSStream(conn); err != nil {
+			return nil, err
+		}
+		m := &dnsmessage.Message{}
+		if err = m.Unpack(b); err != nil || m.ID != id || !m.Response {
+			if !packet {
+				return nil, errors.New("dns response mismatch")
+			}
+			// not our response, keep waiting
+			continue
+		}
+		return m, nil
+	}
+}
+
+// cached return packed response for query qm, nil when not cached
+func (f *DNSForwarder) cached(key dnsCacheKey, qm *dnsmessage.Message) []byte {
+	if f.NoCache {
+		return nil
+	}
+	f.lock.Lock()
+	e, ok := f.cache[key]
+	f.lock.Unlock()
+	now := time.Now()
+	if !ok || now.After(e.expires) {
+		return nil
+	}
+
+	m := *e.msg
+	m.ID = qm.ID
+	m.RecursionDesired = qm.RecursionDesired
+	// keep query's name case
+	m.Questions = qm.Questions
+	elapsed := uint32(now.Sub(e.created) / time.Second)
+	m.Answers = agedResources(m.Answers, elapsed)
+	m.Authorities = agedResources(m.Authorities, elapsed)
+	m.Additionals = agedResources(m.Additionals, elapsed)
+	b, err := m.Pack()
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+// store cache successful and name error response until its smallest TTL expired
+func (f *DNSForwarder) store(key dnsCacheKey, m *dnsmessage.Message) {
+	if f.NoCache || m.Truncated {
+		return
+	}
+	if m.RCode != dnsmessage.RCodeSuccess && m.RCode != dnsmessage.RCodeNameError {
+		return
+	}
+	ttl, ok := minTTL(m)
+	if !ok || ttl == 0 {
+		return
+	}
+	now := time.Now()
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.cache == nil {
+		f.cache = map[dnsCacheKey]dnsCacheEntry{}
+	}
+	if len(f.cache) >= maxDNSCacheSize {
+		f.cleanup()
+	}
+	f.cache[key] = dnsCacheEntry{
+		msg:     m,
+		created: now,
+		expires: now.Add(time.Duration(ttl) * time.Second),
+	}
+}
+
+// cleanup remove expired responses, drop all when still too many, lock should be held
+func (f *DNSForwarder) cleanup() {
+	now := time.Now()
+	for k, e := range f.cache {
+		if now.After(e.expires) {
+			delete(f.cache, k)
+		}
+	}
+	if len(f.cache) >= maxDNSCacheSize {
+		f.cache = map[dnsCacheKey]dnsCacheEntry{}
+	}
+}
+
+// minTTL find smallest TTL of records except OPT, false when there is no record
+func minTTL(m *dnsmessage.Message) (uint32, bool) {
+	var ttl uint32
+	found := false
+	for _, rrs := range [][]dnsmessage.Resource{m.Answers, m.Authorities, m.Additionals} {
+		for _, rr := range rrs {
+			if rr.Header.Type == dnsmessage.TypeOPT {
+				continue
+			}
+			if !found || rr.Header.TTL < ttl {
+				ttl = rr.Header.TTL
+			}
+			found = true
+		}
+	}
+	return ttl, found
+}
+
+// agedResources copy rrs with TTL reduced by elapsed seconds, OPT's TTL field is flags and untouched
+func agedResources(rrs []dnsmessage.Resource, elapsed uint32) []dnsmessage.Resource {
+	ret := make([]dnsmessage.Resource, len(rrs))
+	copy(ret, rrs)
+	for i := range ret {
+		if ret[i].Header.Type == dnsmessage.TypeOPT {
+			continue
+		}
+		if ret[i].Header.TTL > elapsed {
+			ret[i].Header.TTL -= elapsed
+		} else {
+			ret[i].Header.TTL = 0
+		}
+	}
+	return ret
+}
+
+// readDNSStream read a 2 byte length prefixed message
+func readDNSStream(r io.Reader) ([]byte, error) {
+	lb := make([]byte, 2)
+	if _, err := io.ReadFull(r, lb); err != nil {
+		return nil, err
+	}
+	b := make([]byte, binary.BigEndian.Uint16(lb))
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// writeDNSStream write a 2 byte length prefixed message
+func writeDNSStream(w io.Writer, b []byte) error {
+	msg := make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(msg, uint16(len(b)))
+	copy(msg[2:], b)
+	_, err := w.Write(msg)
+	return err
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/studentmain/socks6"
+	"github.com/studentmain/socks6/e2e/e2etool"
+)
+
+func TestDNSForwarder(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	records := map[string][]net.IP{"example.test.": {net.ParseIP("192.0.2.1")}}
+	dctx, dcancel := context.WithCancel(ctx)
+	dnsAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeTCP(dctx, dnsAddr, e2etool.DNS(records))
+	go e2etool.ServeUDP(dctx, dnsAddr, e2etool.UDNS(records))
+
+	sAddr, sPort := e2etool.GetAddr()
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        e2etool.NewServerWorker(),
+	}
+	server.Start(ctx)
+	defer shutdown(&server)
+
+	lAddr, _ := e2etool.GetAddr()
+	fAddr, _ := e2etool.GetAddr()
+	c, err := ParseConfig("test.yaml", []byte("server: "+sAddr+"\nlisten: "+lAddr+"\ndns: {listen: \""+fAddr+"\", server: \""+dnsAddr+"\"}\n"))
+	assert.NoError(t, err)
+	_, fwd, err := c.Build()
+	assert.NoError(t, err)
+	assert.NoError(t, fwd.Start(ctx))
+
+	lookup := func(network string) ([]net.IP, error) {
+		r := net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				d := net.Dialer{}
+				return d.DialContext(ctx, network, fAddr)
+			},
+		}
+		return r.LookupIP(ctx, "ip4", "example.test")
+	}
+	for _, network := range []string{"udp", "tcp"} {
+		ips, err := lookup(network)
+		if assert.NoError(t, err, network) {
+			assert.Equal(t, "192.0.2.1", ips[0].String())
+		}
+	}
+
+	// answered from cache after upstream stopped
+	dcancel()
+	for {
+		conn, err := net.Dial("tcp", dnsAddr)
+		if err != nil {
+			break
+		}
+		conn.Close()
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, network := range []string{"udp", "tcp"} {
+		ips, err := lookup(network)
+		if assert.NoError(t, err, network) {
+			assert.Equal(t, "192.0.2.1", ips[0].String())
+		}
+	}
+}
@@ -0,0 +1,57 @@
+// Command client is a local SOCKS 5, SOCKS 4a and HTTP proxy, which forward requests through a SOCKS 6 server.
+// HTTP requests are sent in SOCKS 6 initial data, so they don't wait for server's reply.
+// It can also forward DNS queries through SOCKS 6 server, responses are cached.
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"time"
+
+	"github.com/studentmain/socks6/common/lg"
+)
+
+func main() {
+	log.SetFlags(log.LstdFlags | log.Lshortfile | log.Lmicroseconds)
+	lg.MinimalLevel = lg.LvDebug
+
+	conf := flag.String("config", "", "config file in YAML or JSON")
+	flag.Parse()
+	if *conf == "" {
+		lg.Fatal("config file is required, see config.example.yaml")
+	}
+
+	c, err := LoadConfig(*conf)
+	if err != nil {
+		lg.Fatal(err)
+	}
+	lg.MinimalLevel = c.Level()
+	s, dns, err := c.Build()
+	if err != nil {
+		lg.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s.Start(ctx)
+	if dns != nil {
+		if err := dns.Start(ctx); err != nil {
+			lg.Fatal(err)
+		}
+		lg.Info("forwarding DNS queries at", dns.Listen, "to", dns.Server)
+	}
+	lg.Info("forwarding proxy requests at", c.Listen, "to", c.Server, ", close input stream (ctrl-d) to stop")
+
+	b := []byte{0}
+	for {
+		if _, err := os.Stdin.Read(b); err != nil {
+			break
+		}
+	}
+	sctx, scancel := context.WithTimeout(context.Background(), 10*time.Second)
+	if n, _ := s.Shutdown(sctx); n > 0 {
+		lg.Warning(n, "connections closed by shutdown")
+	}
+	scancel()
+	cancel()
+}
@@ -1,12 +1,807 @@
 package main
 
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/studentmain/socks6"
+	"github.com/studentmain/socks6/accounting"
+	"github.com/studentmain/socks6/auth"
+	"github.com/studentmain/socks6/common"
+	"github.com/studentmain/socks6/common/lg"
+	"github.com/studentmain/socks6/internal/yamlpath"
+	"github.com/studentmain/socks6/message"
+	"github.com/studentmain/socks6/resolver"
+	"github.com/studentmain/socks6/rule"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the server config file, in YAML or JSON
 type Config struct {
-	CleartextPort uint16
-	EncryptedPort uint16
+	// LogLevel is one of fatal, panic, error, warning, info, trace and debug
+	LogLevel string `yaml:"log_level"`
+
+	// Listeners is transports and addresses to listen, when empty,
+	// TCP and UDP listen at 0.0.0.0:1080, TLS and DTLS listen at 0.0.0.0:8389 if certificate provided
+	Listeners []ListenerConfig `yaml:"listeners"`
+	TLS       TLSConfig        `yaml:"tls"`
+
+	Auth    AuthConfig    `yaml:"auth"`
+	Session SessionConfig `yaml:"session"`
+
+	// NatFiltering is UDP association filtering behavior, endpoint_independent or address_dependent
+	NatFiltering            string `yaml:"nat_filtering"`
+	ICMP                    bool   `yaml:"icmp"`
+	IgnoreFragmentedRequest bool   `yaml:"ignore_fragmented_request"`
+	// EnableSocks5 serve SOCKS 5 clients on SOCKS 6 listeners
+	EnableSocks5 bool `yaml:"enable_socks5"`
+	// EnableSocks4 serve SOCKS 4 and 4a clients on SOCKS 6 listeners, they can only use none method
+	EnableSocks4 bool `yaml:"enable_socks4"`
+	// EnableHTTP serve HTTP proxy clients on SOCKS 6 listeners
+	EnableHTTP bool `yaml:"enable_http"`
+	// ExperimentalResolve accept experimental RESOLVE and RESOLVE_PTR commands, names are resolved by outbound
+	ExperimentalResolve bool `yaml:"experimental_resolve"`
+
+	Outbound OutboundConfig `yaml:"outbound"`
+	// DNS resolve destination domain names of direct outbounds
+	DNS DNSConfig `yaml:"dns"`
+	// Destinations control which destination addresses can be reached,
+	// loopback, private, link-local and multicast addresses are denied by default
+	Destinations DestinationsConfig `yaml:"destinations"`
+	// Outbounds is named outbounds used by Routes,
+	// "direct" (configured by Outbound) and "blackhole" are always available
+	Outbounds map[string]NamedOutboundConfig `yaml:"outbounds"`
+	// Routes choose outbounds for each request, first matched route is used,
+	// requests not matched by any route use direct outbound
+	Routes []RouteConfig `yaml:"routes"`
+
+	// RuleFile is a JSON rule set file, can't be used with Rules
+	RuleFile string `yaml:"rule_file"`
+	// Rules is inline rule set, see rule.Config
+	Rules yaml.Node `yaml:"rules"`
+
+	Timeouts TimeoutsConfig `yaml:"timeouts"`
+
+	Accounting AccountingConfig `yaml:"accounting"`
+	Metrics    MetricsConfig    `yaml:"metrics"`
+
+	// ReloadInterval is how often config file and files referenced by it are checked,
+	// users, rules and certificate are reloaded when any of them modified.
+	// 0 means only reload on SIGHUP.
+	ReloadInterval time.Duration `yaml:"reload_interval"`
+
+	file string     // file name used in error message
+	root *yaml.Node // parsed document, used to find line number
+}
+
+type ListenerConfig struct {
+	// Transport is one of tcp, tls, udp, dtls and quic
+	Transport string `yaml:"transport"`
+	// Address is host:port, empty host means all interfaces
+	Address string `yaml:"address"`
+}
+
+type TLSConfig struct {
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	// InsecureDebugKey use the private key embedded in program, which is public.
+	// Only for testing.
+	InsecureDebugKey bool `yaml:"insecure_debug_key"`
+}
+
+type AuthConfig struct {
+	// Methods is enabled authentication methods, none and password, default is none
+	Methods []string `yaml:"methods"`
+	// Users is password method's user name and password
+	Users map[string]string `yaml:"users"`
+	// UserFile is password method's user database, one "name:password" per line
+	UserFile string `yaml:"user_file"`
+}
+
+type SessionConfig struct {
+	Disable      bool `yaml:"disable"`
+	DisableToken bool `yaml:"disable_token"`
+}
+
+type OutboundConfig struct {
+	// IPv4 and IPv6 is address used when UDP association request didn't provide one
+	IPv4               string `yaml:"ipv4"`
+	IPv6               string `yaml:"ipv6"`
+	MulticastInterface string `yaml:"multicast_interface"`
+}
+
+type NamedOutboundConfig struct {
+	// Type is one of socks6, socks5, http, direct and blackhole
+	Type string `yaml:"type"`
+	// Server is upstream proxy address, used by socks6, socks5 and http
+	Server   string `yaml:"server"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	// Encrypted use TLS and DTLS to connect socks6 upstream
+	Encrypted bool `yaml:"encrypted"`
+	// SourceIP is local address used by direct outbound
+	SourceIP string `yaml:"source_ip"`
+	// DNS override top level dns for direct outbound
+	DNS *DNSConfig `yaml:"dns"`
+}
+
+type DestinationsConfig struct {
+	// Allow is IP addresses and CIDR networks allowed even though denied by default
+	Allow []string `yaml:"allow"`
+	// AllowAll disable destination check
+	AllowAll bool `yaml:"allow_all"`
+}
+
+// parseNetwork parse CIDR network or single IP address
+func parseNetwork(s string) (*net.IPNet, error) {
+	if ip := net.ParseIP(s); ip != nil {
+		bits := 128
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 32
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, n, err := net.ParseCIDR(s)
+	return n, err
+}
+
+// DNSConfig is resolver.Resolver, system resolver without cache is used when empty
+type DNSConfig struct {
+	// Servers is upstream DNS servers, tried in order
+	Servers []resolver.Server `yaml:"servers"`
+	// Hosts is static addresses of names, override DNS
+	Hosts map[string][]string `yaml:"hosts"`
+	// Prefer is prefer_ipv6, prefer_ipv4, ipv4_only or ipv6_only, default is prefer_ipv6
+	Prefer string `yaml:"prefer"`
+	// Timeout is max time of a query to one server
+	Timeout time.Duration `yaml:"timeout"`
+	// NegativeTTL is how long a failed lookup is cached, negative means not cached
+	NegativeTTL time.Duration `yaml:"negative_ttl"`
+	// MaxTTL cap TTL of cached records
+	MaxTTL time.Duration `yaml:"max_ttl"`
+}
+
+func (d DNSConfig) isZero() bool {
+	return len(d.Servers) == 0 && len(d.Hosts) == 0 && d.Prefer == ""
+}
+
+// RouteConfig is conditions same as rule.Rule, and outbounds used by matched request
+type RouteConfig struct {
+	Name        string   `yaml:"name"`
+	Source      []string `yaml:"source"`
+	ClientId    []string `yaml:"client"`
+	Session     *bool    `yaml:"session"`
+	Command     []string `yaml:"command"`
+	Destination []string `yaml:"destination"`
+	Domain      []string `yaml:"domain"`
+	Port        []string `yaml:"port"`
+	// Outbound is outbound names, when one failed, next one is tried
+	Outbound []string `yaml:"outbound"`
+}
+
+func (r RouteConfig) matcher() (*rule.Matcher, error) {
+	return rule.NewMatcher(rule.Rule{
+		Name:        r.Name,
+		Source:      r.Source,
+		ClientId:    r.ClientId,
+		Session:     r.Session,
+		Command:     r.Command,
+		Destination: r.Destination,
+		Domain:      r.Domain,
+		Port:        r.Port,
+	})
+}
+
+// TimeoutValues is socks6.Timeouts, 0 means default, negative means no timeout
+type TimeoutValues struct {
+	Handshake      time.Duration `yaml:"handshake"`
+	Authentication time.Duration `yaml:"authentication"`
+	Dial           time.Duration `yaml:"dial"`
+	Idle           time.Duration `yaml:"idle"`
+	Lifetime       time.Duration `yaml:"lifetime"`
+	BindAccept     time.Duration `yaml:"bind_accept"`
+	UDPEstablish   time.Duration `yaml:"udp_establish"`
+	UDPIdle        time.Duration `yaml:"udp_idle"`
+}
+
+func (t TimeoutValues) build() socks6.Timeouts {
+	return socks6.Timeouts{
+		Handshake:      t.Handshake,
+		Authentication: t.Authentication,
+		Dial:           t.Dial,
+		Idle:           t.Idle,
+		Lifetime:       t.Lifetime,
+		BindAccept:     t.BindAccept,
+		UDPEstablish:   t.UDPEstablish,
+		UDPIdle:        t.UDPIdle,
+	}
+}
+
+type TimeoutsConfig struct {
+	TimeoutValues `yaml:",inline"`
+	// Session is how long a session is kept after its last connection closed
+	Session time.Duration `yaml:"session"`
+	// Commands override timeouts for connect, bind and udp_associate command
+	Commands map[string]TimeoutValues `yaml:"commands"`
+}
+
+type AccountingConfig struct {
+	// File is where traffic counters saved, empty means no accounting
+	File string `yaml:"file"`
+	// DailyQuota is bytes per day for each client, 0 means unlimited
+	DailyQuota uint64 `yaml:"daily_quota"`
+}
+
+type MetricsConfig struct {
+	// Address is Prometheus metrics endpoint address, empty means disabled
+	Address string `yaml:"address"`
+}
+
+var commandName = map[string]message.CommandCode{
+	"noop":          message.CommandNoop,
+	"connect":       message.CommandConnect,
+	"bind":          message.CommandBind,
+	"udp_associate": message.CommandUdpAssociate,
+}
+
+var logLevelName = map[string]lg.Level{
+	"fatal":   lg.LvFatal,
+	"panic":   lg.LvPanic,
+	"error":   lg.LvError,
+	"warning": lg.LvWarning,
+	"info":    lg.LvInfo,
+	"trace":   lg.LvTrace,
+	"debug":   lg.LvDebug,
+}
+
+// transportNetwork is the socket type used by transport
+var transportNetwork = map[string]string{
+	"tcp":  "tcp",
+	"tls":  "tcp",
+	"udp":  "udp",
+	"dtls": "udp",
+	"quic": "udp",
+}
+
+// LoadConfig read and validate a config file
+func LoadConfig(filename string) (*Config, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return ParseConfig(filename, b)
+}
+
+// ParseConfig parse and validate a YAML or JSON config, filename is used in error message
+func ParseConfig(filename string, b []byte) (*Config, error) {
+	c := &Config{file: filename}
+	root := &yaml.Node{}
+	if err := yaml.Unmarshal(b, root); err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	c.root = root
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Level return minimal log level in config
+func (c *Config) Level() lg.Level {
+	return logLevelName[c.LogLevel]
+}
+
+// DefaultConfig is the config used when no config file provided
+func DefaultConfig() *Config {
+	c := &Config{}
+	c.validate()
+	return c
+}
+
+// errorf create an error of value at path, path is keys and indexes from root
+func (c *Config) errorf(path []interface{}, format string, v ...interface{}) error {
+	return yamlpath.Errorf(c.file, c.root, path, format, v...)
+}
+
+func path(p ...interface{}) []interface{} {
+	return p
+}
+
+// validate check values and fill defaults
+func (c *Config) validate() error {
+	if c.LogLevel == "" {
+		c.LogLevel = "info"
+	}
+	if _, ok := logLevelName[c.LogLevel]; !ok {
+		return c.errorf(path("log_level"), "unknown log level %q", c.LogLevel)
+	}
+
+	if c.TLS.InsecureDebugKey && (c.TLS.CertFile != "" || c.TLS.KeyFile != "") {
+		return c.errorf(path("tls", "insecure_debug_key"), "can't be used with cert_file and key_file")
+	}
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		return c.errorf(path("tls"), "cert_file and key_file should be provided together")
+	}
+	hasCert := c.TLS.CertFile != "" || c.TLS.InsecureDebugKey
+
+	if len(c.Listeners) == 0 {
+		cleartext := net.JoinHostPort("0.0.0.0", strconv.Itoa(common.CleartextPort))
+		c.Listeners = []ListenerConfig{{"tcp", cleartext}, {"udp", cleartext}}
+		if hasCert {
+			encrypted := net.JoinHostPort("0.0.0.0", strconv.Itoa(common.EncryptedPort))
+			c.Listeners = append(c.Listeners, ListenerConfig{"tls", encrypted}, ListenerConfig{"dtls", encrypted})
+		}
+	}
+	used := map[string]int{}
+	for i, l := range c.Listeners {
+		network, ok := transportNetwork[l.Transport]
+		if !ok {
+			return c.errorf(path("listeners", i, "transport"), "unknown transport %q, should be tcp, tls, udp, dtls or quic", l.Transport)
+		}
+		if network != l.Transport && !hasCert {
+			return c.errorf(path("listeners", i, "transport"), "%s listener requires tls.cert_file and tls.key_file, or tls.insecure_debug_key", l.Transport)
+		}
+		_, port, err := net.SplitHostPort(l.Address)
+		if err != nil {
+			return c.errorf(path("listeners", i, "address"), "%v", err)
+		}
+		if p, err := strconv.ParseUint(port, 10, 16); err != nil || p == 0 {
+			return c.errorf(path("listeners", i, "address"), "invalid port %q", port)
+		}
+		key := network + " " + l.Address
+		if j, ok := used[key]; ok {
+			return c.errorf(path("listeners", i, "address"), "%s address already used by listeners[%d]", network, j)
+		}
+		used[key] = i
+	}
+
+	if len(c.Auth.Methods) == 0 {
+		c.Auth.Methods = []string{"none"}
+	}
+	password := false
+	for i, m := range c.Auth.Methods {
+		switch m {
+		case "none":
+		case "password":
+			password = true
+		default:
+			return c.errorf(path("auth", "methods", i), "unknown authentication method %q, should be none or password", m)
+		}
+	}
+	hasUser := len(c.Auth.Users) > 0 || c.Auth.UserFile != ""
+	if password && !hasUser {
+		return c.errorf(path("auth", "methods"), "password method requires auth.users or auth.user_file")
+	}
+	if !password && hasUser {
+		return c.errorf(path("auth"), "users provided but password method not enabled")
+	}
+
+	switch c.NatFiltering {
+	case "":
+		c.NatFiltering = "endpoint_independent"
+	case "endpoint_independent", "address_dependent":
+	default:
+		return c.errorf(path("nat_filtering"), "unknown filtering behavior %q, should be endpoint_independent or address_dependent", c.NatFiltering)
+	}
+
+	if c.Outbound.IPv4 != "" {
+		if ip := net.ParseIP(c.Outbound.IPv4); ip == nil || ip.To4() == nil {
+			return c.errorf(path("outbound", "ipv4"), "invalid IPv4 address %q", c.Outbound.IPv4)
+		}
+	}
+	if c.Outbound.IPv6 != "" {
+		if ip := net.ParseIP(c.Outbound.IPv6); ip == nil || ip.To4() != nil {
+			return c.errorf(path("outbound", "ipv6"), "invalid IPv6 address %q", c.Outbound.IPv6)
+		}
+	}
+
+	for i, a := range c.Destinations.Allow {
+		if _, err := parseNetwork(a); err != nil {
+			return c.errorf(path("destinations", "allow", i), "invalid IP address or network %q", a)
+		}
+	}
+	if c.Destinations.AllowAll && len(c.Destinations.Allow) > 0 {
+		return c.errorf(path("destinations", "allow_all"), "can't be used with allow")
+	}
+
+	if err := c.validateDNS(path("dns"), c.DNS); err != nil {
+		return err
+	}
+	if err := c.validateRoutes(); err != nil {
+		return err
+	}
+
+	if c.RuleFile != "" && !c.Rules.IsZero() {
+		return c.errorf(path("rules"), "can't be used with rule_file")
+	}
+
+	if c.Metrics.Address != "" {
+		if _, _, err := net.SplitHostPort(c.Metrics.Address); err != nil {
+			return c.errorf(path("metrics", "address"), "%v", err)
+		}
+	}
 
-	Address  string
-	LogLevel int
+	if c.Timeouts.Session < 0 {
+		return c.errorf(path("timeouts", "session"), "should not be negative")
+	}
+	for name, t := range c.Timeouts.Commands {
+		if _, ok := commandName[name]; !ok {
+			return c.errorf(path("timeouts", "commands", name), "unknown command %q, should be noop, connect, bind or udp_associate", name)
+		}
+		if t.Handshake != 0 || t.Authentication != 0 {
+			return c.errorf(path("timeouts", "commands", name), "handshake and authentication timeout can't be set per command")
+		}
+	}
+
+	if c.ReloadInterval < 0 {
+		return c.errorf(path("reload_interval"), "should not be negative")
+	}
+	return nil
+}
+
+// validateRoutes check outbounds and routes
+func (c *Config) validateRoutes() error {
+	for name, o := range c.Outbounds {
+		p := path("outbounds", name)
+		if name == "direct" || name == "blackhole" {
+			return c.errorf(p, "%q is a built-in outbound", name)
+		}
+		switch o.Type {
+		case "socks6", "socks5", "http":
+			if _, _, err := net.SplitHostPort(o.Server); err != nil {
+				return c.errorf(append(p, "server"), "%v", err)
+			}
+			if o.Type != "socks6" && o.Encrypted {
+				return c.errorf(append(p, "encrypted"), "only supported by socks6")
+			}
+			if o.SourceIP != "" {
+				return c.errorf(append(p, "source_ip"), "only supported by direct")
+			}
+			if o.DNS != nil {
+				return c.errorf(append(p, "dns"), "only supported by direct")
+			}
+		case "direct":
+			if o.Server != "" || o.Username != "" || o.Encrypted {
+				return c.errorf(p, "direct outbound only accept source_ip and dns")
+			}
+			if o.SourceIP != "" && net.ParseIP(o.SourceIP) == nil {
+				return c.errorf(append(p, "source_ip"), "invalid IP address %q", o.SourceIP)
+			}
+			if o.DNS != nil {
+				if err := c.validateDNS(append(p, "dns"), *o.DNS); err != nil {
+					return err
+				}
+			}
+		case "blackhole":
+		default:
+			return c.errorf(append(p, "type"), "unknown outbound type %q, should be socks6, socks5, http, direct or blackhole", o.Type)
+		}
+	}
+	for i, r := range c.Routes {
+		if _, err := r.matcher(); err != nil {
+			return c.errorf(path("routes", i), "%v", err)
+		}
+		if len(r.Outbound) == 0 {
+			return c.errorf(path("routes", i), "outbound is required")
+		}
+		for j, name := range r.Outbound {
+			if _, ok := c.Outbounds[name]; !ok && name != "direct" && name != "blackhole" {
+				return c.errorf(path("routes", i, "outbound", j), "unknown outbound %q", name)
+			}
+		}
+	}
+	return nil
+}
+
+// validateDNS check dns section at p
+func (c *Config) validateDNS(p []interface{}, d DNSConfig) error {
+	for i, s := range d.Servers {
+		switch s.Network {
+		case "", "udp", "tcp", "tls":
+		default:
+			return c.errorf(append(p, "servers", i, "network"), "unknown network %q, should be udp, tcp or tls", s.Network)
+		}
+		if _, _, err := net.SplitHostPort(s.Address); err != nil {
+			return c.errorf(append(p, "servers", i, "address"), "%v", err)
+		}
+	}
+	for name, addrs := range d.Hosts {
+		for _, a := range addrs {
+			if net.ParseIP(a) == nil {
+				return c.errorf(append(p, "hosts", name), "invalid IP address %q", a)
+			}
+		}
+	}
+	if d.Prefer != "" {
+		var pref resolver.Preference
+		if err := pref.UnmarshalText([]byte(d.Prefer)); err != nil {
+			return c.errorf(append(p, "prefer"), "%v, should be prefer_ipv6, prefer_ipv4, ipv4_only or ipv6_only", err)
+		}
+	}
+	if d.Timeout < 0 {
+		return c.errorf(append(p, "timeout"), "should not be negative")
+	}
+	if d.MaxTTL < 0 {
+		return c.errorf(append(p, "max_ttl"), "should not be negative")
+	}
+	return nil
+}
+
+// resolver create resolver of d, return nil when system resolver should be used
+func (d DNSConfig) resolver() *resolver.Resolver {
+	if d.isZero() {
+		return nil
+	}
+	r := &resolver.Resolver{
+		Servers:     d.Servers,
+		Hosts:       map[string][]net.IP{},
+		Timeout:     d.Timeout,
+		NegativeTTL: d.NegativeTTL,
+		MaxTTL:      d.MaxTTL,
+	}
+	if d.Prefer != "" {
+		r.Prefer.UnmarshalText([]byte(d.Prefer))
+	}
+	for name, addrs := range d.Hosts {
+		ips := []net.IP{}
+		for _, a := range addrs {
+			ips = append(ips, net.ParseIP(a))
+		}
+		r.Hosts[strings.ToLower(strings.TrimSuffix(name, "."))] = ips
+	}
+	return r
+}
+
+// files return config file and files referenced by config which can be reloaded
+func (c *Config) files() []string {
+	ret := []string{}
+	for _, f := range []string{c.file, c.TLS.CertFile, c.TLS.KeyFile, c.Auth.UserFile, c.RuleFile} {
+		if f != "" {
+			ret = append(ret, f)
+		}
+	}
+	return ret
+}
+
+// Build create a server from config, files referenced by config are loaded
+func (c *Config) Build() (*instance, error) {
+	s := &socks6.Server{
+		Worker: socks6.NewServerWorker(),
+	}
+	in := &instance{
+		server: s,
+		users:  auth.NewPasswordTable(nil),
+		rules:  rule.NewAtomicChecker(nil),
+	}
+	for _, l := range c.Listeners {
+		s.Listeners = append(s.Listeners, socks6.ListenerConfig{Transport: l.Transport, Address: l.Address})
+	}
+
+	cert, err := c.certificate()
+	if err != nil {
+		return nil, err
+	}
+	if cert != nil {
+		in.cert = &certificate{}
+		in.cert.set(cert)
+		s.TlsConfig = &tls.Config{GetCertificate: in.cert.get}
+	}
+
+	w := s.Worker
+	authn := auth.NewServerAuthenticator()
+	authn.DisableSession = c.Session.Disable
+	authn.DisableToken = c.Session.DisableToken
+	authn.SessionTimeout = c.Timeouts.Session
+	for _, m := range c.Auth.Methods {
+		switch m {
+		case "none":
+			authn.AddMethod(auth.NoneServerAuthenticationMethod{})
+		case "password":
+			users, err := c.users()
+			if err != nil {
+				return nil, err
+			}
+			in.users.Set(users)
+			authn.AddMethod(auth.PasswordServerAuthenticationMethod{Table: in.users})
+		}
+	}
+	w.Authenticator = authn
+
+	w.AddressDependentFiltering = c.NatFiltering == "address_dependent"
+	w.EnableICMP = c.ICMP
+	w.IgnoreFragmentedRequest = c.IgnoreFragmentedRequest
+	w.EnableSocks5 = c.EnableSocks5
+	w.EnableSocks4 = c.EnableSocks4
+	w.EnableHTTP = c.EnableHTTP
+	if c.ExperimentalResolve {
+		w.CommandHandlers[message.CommandResolve] = w.ResolveHandler
+		w.CommandHandlers[message.CommandResolvePTR] = w.ResolvePTRHandler
+	}
+	if c.Destinations.AllowAll {
+		w.DestinationPolicy = nil
+	} else {
+		for _, a := range c.Destinations.Allow {
+			n, _ := parseNetwork(a)
+			w.DestinationPolicy.Allow = append(w.DestinationPolicy.Allow, n)
+		}
+	}
+	w.Timeouts = c.Timeouts.build()
+	if len(c.Timeouts.Commands) > 0 {
+		w.CommandTimeouts = map[message.CommandCode]socks6.Timeouts{}
+		for name, t := range c.Timeouts.Commands {
+			w.CommandTimeouts[commandName[name]] = t.build()
+		}
+	}
+
+	ob := w.Outbound.(socks6.InternetServerOutbound)
+	if c.Outbound.IPv4 != "" {
+		ob.DefaultIPv4 = net.ParseIP(c.Outbound.IPv4)
+	}
+	if c.Outbound.IPv6 != "" {
+		ob.DefaultIPv6 = net.ParseIP(c.Outbound.IPv6)
+	}
+	if c.Outbound.MulticastInterface != "" {
+		ifce, err := net.InterfaceByName(c.Outbound.MulticastInterface)
+		if err != nil {
+			return nil, c.errorf(path("outbound", "multicast_interface"), "%v", err)
+		}
+		ob.MulticastInterface = ifce
+	}
+	ob.Resolver = c.DNS.resolver()
+	w.Outbound = ob
+	if len(c.Routes) > 0 {
+		w.Outbound, err = c.router(ob)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	rs, err := c.ruleSet()
+	if err != nil {
+		return nil, err
+	}
+	in.rules.Set(rs)
+	w.Rule = in.rules
+
+	if c.Accounting.File != "" {
+		in.ledger, err = accounting.NewLedger(accounting.FileStore{Path: c.Accounting.File})
+		if err != nil {
+			return nil, c.errorf(path("accounting", "file"), "%v", err)
+		}
+		in.ledger.SetDefaultQuota(accounting.Quota{Bytes: c.Accounting.DailyQuota, Period: accounting.Daily})
+		w.Accounting = in.ledger
+	}
+	return in, nil
+}
+
+// router create outbounds and routes, direct is the outbound configured by outbound section
+func (c *Config) router(direct socks6.InternetServerOutbound) (*socks6.RouterServerOutbound, error) {
+	outbounds := map[string]socks6.ServerOutbound{
+		"direct":    direct,
+		"blackhole": socks6.BlackholeServerOutbound{},
+	}
+	for name, o := range c.Outbounds {
+		switch o.Type {
+		case "socks6":
+			client := &socks6.Client{Server: o.Server, Encrypted: o.Encrypted}
+			if o.Username != "" {
+				client.AuthenticationMethod = auth.PasswordClientAuthenticationMethod{Username: o.Username, Password: o.Password}
+			}
+			outbounds[name] = socks6.Socks6ServerOutbound{Client: client}
+		case "socks5":
+			outbounds[name] = socks6.Socks5ServerOutbound{Server: o.Server, Username: o.Username, Password: o.Password}
+		case "http":
+			outbounds[name] = socks6.HTTPServerOutbound{Server: o.Server, Username: o.Username, Password: o.Password}
+		case "direct":
+			d := direct
+			d.SourceIP = net.ParseIP(o.SourceIP)
+			if o.DNS != nil {
+				d.Resolver = o.DNS.resolver()
+			}
+			outbounds[name] = d
+		case "blackhole":
+			outbounds[name] = socks6.BlackholeServerOutbound{}
+		}
+	}
+	routes := []socks6.OutboundRoute{}
+	for i, r := range c.Routes {
+		m, err := r.matcher()
+		if err != nil {
+			return nil, c.errorf(path("routes", i), "%v", err)
+		}
+		routes = append(routes, socks6.OutboundRoute{Name: r.Name, Match: m, Outbounds: r.Outbound})
+	}
+	return socks6.NewRouterServerOutbound(outbounds, routes, []string{"direct"})
+}
+
+// certificate load TLS certificate, return nil when not provided
+func (c *Config) certificate() (*tls.Certificate, error) {
+	if c.TLS.InsecureDebugKey {
+		lg.Warning("using insecure debug key, connections are NOT protected")
+		kp, err := tls.X509KeyPair([]byte(debugPem), []byte(debugKey))
+		if err != nil {
+			return nil, err
+		}
+		return &kp, nil
+	}
+	if c.TLS.CertFile == "" {
+		return nil, nil
+	}
+	kp, err := tls.LoadX509KeyPair(c.TLS.CertFile, c.TLS.KeyFile)
+	if err != nil {
+		return nil, c.errorf(path("tls", "cert_file"), "%v", err)
+	}
+	return &kp, nil
+}
+
+// users merge auth.users and auth.user_file
+func (c *Config) users() (map[string]string, error) {
+	users := map[string]string{}
+	for k, v := range c.Auth.Users {
+		users[k] = v
+	}
+	if c.Auth.UserFile == "" {
+		return users, nil
+	}
+	f, err := os.Open(c.Auth.UserFile)
+	if err != nil {
+		return nil, c.errorf(path("auth", "user_file"), "%v", err)
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for line := 1; sc.Scan(); line++ {
+		s := strings.TrimSpace(sc.Text())
+		if s == "" || strings.HasPrefix(s, "#") {
+			continue
+		}
+		name, pass, ok := strings.Cut(s, ":")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("%s:%d: expect name:password", c.Auth.UserFile, line)
+		}
+		if _, dup := users[name]; dup {
+			return nil, fmt.Errorf("%s:%d: duplicated user %q", c.Auth.UserFile, line, name)
+		}
+		users[name] = pass
+	}
+	if err := sc.Err(); err != nil {
+		return nil, c.errorf(path("auth", "user_file"), "%v", err)
+	}
+	return users, nil
+}
 
-	CertFile string
-	KeyFile  string
+// ruleSet load rule_file or inline rules, return nil when neither provided
+func (c *Config) ruleSet() (rule.Checker, error) {
+	if c.RuleFile != "" {
+		rs, err := rule.Load(c.RuleFile)
+		if err != nil {
+			return nil, c.errorf(path("rule_file"), "%v", err)
+		}
+		return rs, nil
+	}
+	if c.Rules.IsZero() {
+		return nil, nil
+	}
+	rc := rule.Config{}
+	if err := c.Rules.Decode(&rc); err != nil {
+		return nil, c.errorf(path("rules"), "%v", err)
+	}
+	rs, err := rc.Build()
+	if err != nil {
+		return nil, c.errorf(path("rules"), "%v", err)
+	}
+	return rs, nil
 }
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/studentmain/socks6"
+	"github.com/studentmain/socks6/common/lg"
+	"github.com/studentmain/socks6/message"
+	"github.com/studentmain/socks6/resolver"
+)
+
+func TestParseConfig(t *testing.T) {
+	y := `
+log_level: debug
+listeners:
+  - transport: tcp
+    address: 127.0.0.1:1080
+  - transport: quic
+    address: 127.0.0.1:8389
+tls:
+  insecure_debug_key: true
+auth:
+  methods: [none, password]
+  users:
+    alice: secret
+session:
+  disable_token: true
+nat_filtering: address_dependent
+ignore_fragmented_request: true
+enable_socks5: true
+enable_socks4: true
+enable_http: true
+experimental_resolve: true
+outbound:
+  ipv4: 192.0.2.1
+rules:
+  default: deny
+  rules:
+    - action: allow
+      port: ["443"]
+`
+	c, err := ParseConfig("test.yaml", []byte(y))
+	assert.NoError(t, err)
+	assert.Equal(t, []ListenerConfig{{"tcp", "127.0.0.1:1080"}, {"quic", "127.0.0.1:8389"}}, c.Listeners)
+
+	in, err := c.Build()
+	assert.NoError(t, err)
+	assert.Nil(t, in.ledger)
+	s := in.server
+	assert.NotNil(t, s.TlsConfig)
+	assert.Len(t, s.Listeners, 2)
+	assert.True(t, s.Worker.AddressDependentFiltering)
+	assert.True(t, s.Worker.IgnoreFragmentedRequest)
+	assert.True(t, s.Worker.EnableSocks5)
+	assert.True(t, s.Worker.EnableSocks4)
+	assert.True(t, s.Worker.EnableHTTP)
+	assert.Contains(t, s.Worker.CommandHandlers, message.CommandResolve)
+	assert.Equal(t, "192.0.2.1", s.Worker.Outbound.(socks6.InternetServerOutbound).DefaultIPv4.String())
+	assert.NotNil(t, s.Worker.Rule)
+
+	j := `{"listeners": [{"transport": "udp", "address": ":1080"}], "log_level": "warning"}`
+	c, err = ParseConfig("test.json", []byte(j))
+	assert.NoError(t, err)
+	assert.Equal(t, "endpoint_independent", c.NatFiltering)
+	assert.Equal(t, []string{"none"}, c.Auth.Methods)
+	assert.Equal(t, lg.LvWarning, c.Level())
+}
+
+func TestParseConfigError(t *testing.T) {
+	tests := []struct {
+		conf string
+		err  string
+	}{
+		{"log_level: info\nlisten: []\n", "line 2"},
+		{"listeners:\n  - transport: tcp\n    address: 1080\n", "test.yaml:3: listeners[0].address"},
+		{"listeners:\n  - transport: tpc\n    address: :1080\n", "test.yaml:2: listeners[0].transport"},
+		{"listeners:\n  - {transport: tls, address: \":8389\"}\n", "requires tls.cert_file"},
+		{"listeners:\n  - {transport: udp, address: \":1080\"}\n  - {transport: udp, address: \":1080\"}\n", "already used by listeners[0]"},
+		{"auth:\n  methods: [password]\n", "test.yaml:2: auth.methods"},
+		{"auth:\n  users: {a: b}\n", "password method not enabled"},
+		{"nat_filtering: full_cone\n", "test.yaml:1: nat_filtering"},
+		{"outbound:\n  ipv6: 1.2.3.4\n", "test.yaml:2: outbound.ipv6"},
+		{"tls:\n  cert_file: a.pem\n  insecure_debug_key: true\n", "test.yaml:3: tls.insecure_debug_key"},
+		{"log_level: 3\n", "unknown log level"},
+		{"icmp: maybe\n", "line 1"},
+	}
+	for _, tt := range tests {
+		_, err := ParseConfig("test.yaml", []byte(tt.conf))
+		if assert.Error(t, err, tt.conf) {
+			assert.Contains(t, err.Error(), tt.err, tt.conf)
+		}
+	}
+}
+
+func TestTimeoutsConfig(t *testing.T) {
+	y := `
+timeouts:
+  idle: 1h
+  lifetime: -1s
+  session: 10m
+  commands:
+    bind:
+      bind_accept: 2m
+`
+	c, err := ParseConfig("test.yaml", []byte(y))
+	assert.NoError(t, err)
+	in, err := c.Build()
+	assert.NoError(t, err)
+	w := in.server.Worker
+	assert.Equal(t, time.Hour, w.Timeouts.Idle)
+	assert.Equal(t, -time.Second, w.Timeouts.Lifetime)
+	assert.Equal(t, time.Duration(0), w.Timeouts.Dial)
+	assert.Equal(t, 2*time.Minute, w.CommandTimeouts[message.CommandBind].BindAccept)
+
+	for _, bad := range []string{
+		"timeouts:\n  commands:\n    resolve: {idle: 1s}\n",
+		"timeouts:\n  commands:\n    connect: {handshake: 1s}\n",
+		"timeouts:\n  idle: soon\n",
+	} {
+		_, err := ParseConfig("test.yaml", []byte(bad))
+		if assert.Error(t, err, bad) {
+			assert.Contains(t, err.Error(), "test.yaml:", bad)
+		}
+	}
+}
+
+func TestRoutesConfig(t *testing.T) {
+	y := `
+outbound:
+  ipv4: 192.0.2.1
+outbounds:
+  upstream:
+    type: socks5
+    server: 127.0.0.1:1081
+  lan:
+    type: direct
+    source_ip: 192.0.2.2
+routes:
+  - name: ads
+    domain: [.ads.example]
+    outbound: [blackhole]
+  - client: [office-*]
+    outbound: [upstream, lan]
+`
+	c, err := ParseConfig("test.yaml", []byte(y))
+	assert.NoError(t, err)
+	in, err := c.Build()
+	assert.NoError(t, err)
+	r := in.server.Worker.Outbound.(*socks6.RouterServerOutbound)
+	assert.Len(t, r.Routes, 2)
+	assert.Equal(t, []string{"direct"}, r.Default)
+	assert.Equal(t, "192.0.2.1", r.Outbounds["direct"].(socks6.InternetServerOutbound).DefaultIPv4.String())
+	assert.Equal(t, "192.0.2.2", r.Outbounds["lan"].(socks6.InternetServerOutbound).SourceIP.String())
+
+	for _, tt := range []struct {
+		conf string
+		err  string
+	}{
+		{"outbounds:\n  direct: {type: direct}\n", "test.yaml:2: outbounds.direct"},
+		{"outbounds:\n  up: {type: socks4, server: a:1}\n", "test.yaml:2: outbounds.up.type"},
+		{"outbounds:\n  up: {type: http, server: a}\n", "outbounds.up.server"},
+		{"outbounds:\n  up: {type: socks5, server: a:1, encrypted: true}\n", "outbounds.up.encrypted"},
+		{"routes:\n  - outbound: [direct]\n    port: [http]\n", "test.yaml:2: routes[0]"},
+		{"routes:\n  - port: [\"80\"]\n", "outbound is required"},
+		{"routes:\n  - outbound: [direct, nowhere]\n", "test.yaml:2: routes[0].outbound[1]"},
+		{"routes:\n  - action: deny\n    outbound: [direct]\n", "line 2"},
+	} {
+		_, err := ParseConfig("test.yaml", []byte(tt.conf))
+		if assert.Error(t, err, tt.conf) {
+			assert.Contains(t, err.Error(), tt.err, tt.conf)
+		}
+	}
+}
+
+func TestDNSConfig(t *testing.T) {
+	y := `
+dns:
+  servers:
+    - address: 192.0.2.53:53
+    - network: tls
+      address: 192.0.2.53:853
+      server_name: dns.example
+  hosts:
+    Intranet.example.: [10.0.0.10, "2001:db8::10"]
+  prefer: prefer_ipv4
+  max_ttl: 1h
+outbounds:
+  v6:
+    type: direct
+    dns:
+      prefer: ipv6_only
+routes:
+  - client: [v6-*]
+    outbound: [v6]
+`
+	c, err := ParseConfig("test.yaml", []byte(y))
+	assert.NoError(t, err)
+	in, err := c.Build()
+	assert.NoError(t, err)
+	r := in.server.Worker.Outbound.(*socks6.RouterServerOutbound)
+	res := r.Outbounds["direct"].(socks6.InternetServerOutbound).Resolver
+	if assert.NotNil(t, res) {
+		assert.Len(t, res.Servers, 2)
+		assert.Equal(t, "dns.example", res.Servers[1].ServerName)
+		assert.Len(t, res.Hosts["intranet.example"], 2)
+		assert.Equal(t, resolver.PreferIPv4, res.Prefer)
+		assert.Equal(t, time.Hour, res.MaxTTL)
+	}
+	res = r.Outbounds["v6"].(socks6.InternetServerOutbound).Resolver
+	if assert.NotNil(t, res) {
+		assert.Empty(t, res.Servers)
+		assert.Equal(t, resolver.IPv6Only, res.Prefer)
+	}
+
+	// system resolver by default
+	in, err = DefaultConfig().Build()
+	assert.NoError(t, err)
+	assert.Nil(t, in.server.Worker.Outbound.(socks6.InternetServerOutbound).Resolver)
+
+	for _, tt := range []struct {
+		conf string
+		err  string
+	}{
+		{"dns:\n  servers:\n    - network: https\n      address: a:443\n", "test.yaml:3: dns.servers[0].network"},
+		{"dns:\n  servers:\n    - address: a\n", "dns.servers[0].address"},
+		{"dns:\n  hosts:\n    a: [a]\n", "test.yaml:3: dns.hosts.a"},
+		{"dns:\n  prefer: ipv5\n", "dns.prefer"},
+		{"dns:\n  timeout: -1s\n", "dns.timeout"},
+		{"outbounds:\n  up:\n    type: socks5\n    server: a:1\n    dns: {prefer: ipv4_only}\n", "outbounds.up.dns"},
+		{"outbounds:\n  d:\n    type: direct\n    dns: {prefer: ipv5}\n", "outbounds.d.dns.prefer"},
+	} {
+		_, err := ParseConfig("test.yaml", []byte(tt.conf))
+		if assert.Error(t, err, tt.conf) {
+			assert.Contains(t, err.Error(), tt.err, tt.conf)
+		}
+	}
+}
+
+func TestDestinationsConfig(t *testing.T) {
+	c, err := ParseConfig("test.yaml", []byte("destinations:\n  allow: [10.0.0.0/8, 192.168.1.1, \"fd00::1\"]\n"))
+	assert.NoError(t, err)
+	in, err := c.Build()
+	assert.NoError(t, err)
+	allow := in.server.Worker.DestinationPolicy.Allow
+	if assert.Len(t, allow, 3) {
+		assert.Equal(t, "10.0.0.0/8", allow[0].String())
+		assert.Equal(t, "192.168.1.1/32", allow[1].String())
+		assert.Equal(t, "fd00::1/128", allow[2].String())
+	}
+
+	c, err = ParseConfig("test.yaml", []byte("destinations:\n  allow_all: true\n"))
+	assert.NoError(t, err)
+	in, err = c.Build()
+	assert.NoError(t, err)
+	assert.Nil(t, in.server.Worker.DestinationPolicy)
+
+	// denied by default
+	in, err = DefaultConfig().Build()
+	assert.NoError(t, err)
+	assert.NotNil(t, in.server.Worker.DestinationPolicy)
+
+	_, err = ParseConfig("test.yaml", []byte("destinations:\n  allow: [10.0.0.0/33]\n"))
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "test.yaml:2: destinations.allow[0]")
+	}
+}
+
+func TestConfigBuildError(t *testing.T) {
+	c, err := ParseConfig("test.yaml", []byte("log_level: info\nrules:\n  rules:\n    - action: drop\n"))
+	assert.NoError(t, err)
+	_, err = c.Build()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "test.yaml:3: rules")
+	}
+}
+
+func TestDefaultConfig(t *testing.T) {
+	c := DefaultConfig()
+	in, err := c.Build()
+	assert.NoError(t, err)
+	s := in.server
+	assert.Nil(t, s.TlsConfig)
+	assert.False(t, s.Worker.EnableSocks5)
+	assert.False(t, s.Worker.EnableHTTP)
+	for _, l := range s.Listeners {
+		assert.Contains(t, []string{"tcp", "udp"}, l.Transport)
+	}
+}
+
+func TestExampleConfig(t *testing.T) {
+	_, err := LoadConfig("config.example.yaml")
+	assert.NoError(t, err)
+}
@@ -2,15 +2,15 @@ package main
 
 import (
 	"context"
-	"crypto/tls"
-	"encoding/json"
 	"flag"
 	"log"
+	"net/http"
 	"os"
+	"time"
 
 	"github.com/studentmain/socks6"
-	"github.com/studentmain/socks6/common"
 	"github.com/studentmain/socks6/common/lg"
+	"github.com/studentmain/socks6/metrics"
 )
 
 const (
@@ -69,39 +69,121 @@ func main() {
 	log.SetFlags(log.LstdFlags | log.Lshortfile | log.Lmicroseconds)
 	lg.MinimalLevel = lg.LvDebug
 
-	conf := flag.String("config", "config.json", "config file")
+	conf := flag.String("config", "", "config file in YAML or JSON, default is cleartext only server at port 1080")
 	flag.Parse()
 
-	kp, _ := tls.X509KeyPair([]byte(debugPem), []byte(debugKey))
-	s := socks6.Server{
-		CleartextPort: common.CleartextPort,
-		EncryptedPort: common.EncryptedPort,
-		Address:       "0.0.0.0",
-		TlsConfig: &tls.Config{
-			Certificates: []tls.Certificate{kp},
-		},
+	c := DefaultConfig()
+	if *conf != "" {
+		var err error
+		c, err = LoadConfig(*conf)
+		if err != nil {
+			lg.Fatal(err)
+		}
 	}
-
-	c, err := os.ReadFile(*conf)
-	c2 := Config{}
-	if err == nil {
-		json.Unmarshal(c, &c2)
-		s.Address = c2.Address
-		kp2, _ := tls.LoadX509KeyPair(c2.CertFile, c2.KeyFile)
-		s.TlsConfig.Certificates[0] = kp2
-		s.CleartextPort = c2.CleartextPort
-		s.EncryptedPort = c2.EncryptedPort
-		lg.MinimalLevel = lg.Level(c2.LogLevel)
+	lg.MinimalLevel = c.Level()
+	in, err := c.Build()
+	if err != nil {
+		lg.Fatal(err)
+	}
+	s := in.server
+	if c.Metrics.Address != "" {
+		p := metrics.NewPrometheus()
+		s.Worker.Metrics = p
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", p)
+		go func() {
+			lg.Info("metrics endpoint listening at", c.Metrics.Address)
+			if err := http.ListenAndServe(c.Metrics.Address, mux); err != nil {
+				lg.Error("metrics endpoint stopped", err)
+			}
+		}()
 	}
 	ctx, cancel := context.WithCancel(context.Background())
+	if in.ledger != nil {
+		go in.ledger.Run(ctx, time.Minute)
+	}
+	fileChanged := make(chan struct{}, 1)
+	watcher := &fileWatcher{}
+	watcher.set(c.files())
+	if *conf != "" && c.ReloadInterval > 0 {
+		go watcher.run(ctx, c.ReloadInterval, fileChanged)
+	}
+	// sockets from systemd or previous process
+	s.InheritedFiles = socks6.ListenFDs()
 	s.Start(ctx)
-	lg.Info("server is running, close input stream (ctrl-d) to stop")
-	b := []byte{0}
-	for {
-		_, err := os.Stdin.Read(b)
+	lg.Info("server is running, close input stream (ctrl-d) or send SIGTERM to stop, send SIGHUP to reload, send SIGUSR2 to restart")
+	stop := make(chan struct{})
+	// restarted process has no input stream, it's stopped by SIGTERM only
+	if !stdinIsNull() {
+		go func() {
+			b := []byte{0}
+			for {
+				_, err := os.Stdin.Read(b)
+				if err != nil {
+					close(stop)
+					return
+				}
+			}
+		}()
+	}
+	reloadConfig := func() {
+		if *conf == "" {
+			lg.Warning("no config file to reload")
+			return
+		}
+		c2, err := LoadConfig(*conf)
+		if err == nil {
+			err = in.reload(c2)
+		}
 		if err != nil {
-			cancel()
-			break
+			lg.Error("can't reload, keep using previous config", err)
+			return
 		}
+		watcher.set(c2.files())
+	}
+	restart := restartSignal()
+	reload := reloadSignal()
+	term := stopSignal()
+	for running := true; running; {
+		select {
+		case <-stop:
+			running = false
+		case <-term:
+			running = false
+		case <-reload:
+			reloadConfig()
+		case <-fileChanged:
+			reloadConfig()
+		case <-restart:
+			if err := handoff(s); err != nil {
+				lg.Error("can't restart", err)
+				continue
+			}
+			running = false
+		}
+	}
+	sctx, scancel := context.WithTimeout(context.Background(), 30*time.Second)
+	if n, _ := s.Shutdown(sctx); n > 0 {
+		lg.Warning(n, "connections closed by shutdown")
+	}
+	scancel()
+	cancel()
+	if in.ledger != nil {
+		if err := in.ledger.Flush(); err != nil {
+			lg.Error("can't save accounting file", err)
+		}
+	}
+}
+
+// stdinIsNull report whether stdin is null device, e.g. in process started by handoff
+func stdinIsNull() bool {
+	fi, err := os.Stdin.Stat()
+	if err != nil {
+		return false
+	}
+	null, err := os.Stat(os.DevNull)
+	if err != nil {
+		return false
 	}
+	return os.SameFile(fi, null)
 }
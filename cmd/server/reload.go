@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/studentmain/socks6"
+	"github.com/studentmain/socks6/accounting"
+	"github.com/studentmain/socks6/auth"
+	"github.com/studentmain/socks6/common/lg"
+	"github.com/studentmain/socks6/rule"
+)
+
+// instance is a server built from config, its users, rules and certificate can be reloaded
+type instance struct {
+	server *socks6.Server
+	ledger *accounting.Ledger // nil when accounting disabled
+
+	users *auth.PasswordTable
+	rules *rule.AtomicChecker
+	cert  *certificate // nil when TLS disabled
+}
+
+// reload apply users, rules and certificate of c to running server,
+// they are used by new handshakes and requests, existing relays and sessions are untouched.
+// Nothing is changed when any of them can't be loaded.
+// Other settings take effect after restart.
+func (in *instance) reload(c *Config) error {
+	users, err := c.users()
+	if err != nil {
+		return err
+	}
+	rs, err := c.ruleSet()
+	if err != nil {
+		return err
+	}
+	cert, err := c.certificate()
+	if err != nil {
+		return err
+	}
+
+	in.users.Set(users)
+	in.rules.Set(rs)
+	if cert != nil {
+		if in.cert == nil {
+			lg.Warning("TLS is not enabled at start, certificate is ignored until restart")
+		} else {
+			in.cert.set(cert)
+		}
+	}
+	lg.Info("users, rules and certificate reloaded, other settings take effect after restart")
+	return nil
+}
+
+// certificate is a TLS certificate which can be replaced while server running
+type certificate struct {
+	v atomic.Value // *tls.Certificate
+}
+
+func (c *certificate) set(cert *tls.Certificate) {
+	c.v.Store(cert)
+}
+
+// get is used as tls.Config.GetCertificate
+func (c *certificate) get(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.v.Load().(*tls.Certificate), nil
+}
+
+// reloadSignal notify when reload requested by SIGHUP
+func reloadSignal() <-chan os.Signal {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	return ch
+}
+
+// stopSignal notify when stop requested by SIGTERM
+func stopSignal() <-chan os.Signal {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGTERM)
+	return ch
+}
+
+// fileWatcher report file modification by polling modification time
+type fileWatcher struct {
+	lock  sync.Mutex
+	files map[string]time.Time
+}
+
+// set replace watched files, current modification time is recorded
+func (w *fileWatcher) set(files []string) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.files = map[string]time.Time{}
+	for _, f := range files {
+		w.files[f] = modTime(f)
+	}
+}
+
+// changed check whether any file modified since last check
+func (w *fileWatcher) changed() bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	ret := false
+	for f, t := range w.files {
+		t2 := modTime(f)
+		if !t2.Equal(t) {
+			w.files[f] = t2
+			ret = true
+		}
+	}
+	return ret
+}
+
+// run send to ch when any file modified, until ctx done
+func (w *fileWatcher) run(ctx context.Context, interval time.Duration, ch chan<- struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if !w.changed() {
+				continue
+			}
+			select {
+			case ch <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// modTime return file's modification time, zero when file can't be accessed
+func modTime(name string) time.Time {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return time.Time{}
+	}
+	return fi.ModTime()
+}
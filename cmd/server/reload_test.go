@@ -0,0 +1,71 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/studentmain/socks6/message"
+	"github.com/studentmain/socks6/rule"
+)
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	conf := filepath.Join(dir, "config.yaml")
+	users := filepath.Join(dir, "users.txt")
+	rules := filepath.Join(dir, "rules.json")
+	write := func(name, content string) {
+		assert.NoError(t, os.WriteFile(name, []byte(content), 0o600))
+	}
+	write(users, "# comment\nalice:old\n")
+	write(rules, `{"default": "allow", "rules": []}`)
+	write(conf, "auth:\n  methods: [password]\n  user_file: "+users+"\nrule_file: "+rules+"\ntls:\n  insecure_debug_key: true\n")
+
+	c, err := LoadConfig(conf)
+	assert.NoError(t, err)
+	in, err := c.Build()
+	assert.NoError(t, err)
+	cert, err := in.server.TlsConfig.GetCertificate(nil)
+	assert.NoError(t, err)
+	assert.NotNil(t, cert)
+
+	req := rule.Request{Destination: message.ParseAddr("1.1.1.1:25")}
+	p, ok := in.users.Lookup("alice")
+	assert.True(t, ok)
+	assert.Equal(t, "old", p)
+	assert.True(t, in.rules.Check(req).Allow)
+
+	w := &fileWatcher{}
+	w.set(c.files())
+	assert.False(t, w.changed())
+
+	write(users, "alice:new\nbob:pass\n")
+	write(rules, `{"default": "allow", "rules": [{"action": "deny", "port": ["25"]}]}`)
+	// make sure modification time changed on coarse timestamp file system
+	later := time.Now().Add(time.Second)
+	assert.NoError(t, os.Chtimes(users, later, later))
+	assert.True(t, w.changed())
+	assert.False(t, w.changed())
+
+	c2, err := LoadConfig(conf)
+	assert.NoError(t, err)
+	assert.NoError(t, in.reload(c2))
+	p, _ = in.users.Lookup("alice")
+	assert.Equal(t, "new", p)
+	_, ok = in.users.Lookup("bob")
+	assert.True(t, ok)
+	assert.False(t, in.rules.Check(req).Allow)
+	cert2, _ := in.server.TlsConfig.GetCertificate(nil)
+	assert.NotSame(t, cert, cert2)
+
+	// broken file keeps previous config
+	write(rules, `{"rules": [{"action": "drop"}]}`)
+	c3, err := LoadConfig(conf)
+	assert.NoError(t, err)
+	assert.Error(t, in.reload(c3))
+	_, ok = in.users.Lookup("bob")
+	assert.True(t, ok)
+	assert.False(t, in.rules.Check(req).Allow)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/studentmain/socks6"
+	"github.com/studentmain/socks6/common/lg"
+)
+
+// restartSignal notify when restart requested by SIGUSR2
+func restartSignal() <-chan os.Signal {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR2)
+	return ch
+}
+
+// handoff start a new server process with same arguments and pass listener sockets to it,
+// new process accept new connections on same ports
+func handoff(s *socks6.Server) error {
+	files, err := s.Files()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	env := []string{}
+	for _, e := range os.Environ() {
+		if !strings.HasPrefix(e, "LISTEN_") {
+			env = append(env, e)
+		}
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	// this process keep reading stdin until drained, new process get null device
+	cmd.Stdin = nil
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(env, "LISTEN_FDS="+strconv.Itoa(len(files)))
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	lg.Info("new server process started, pid", cmd.Process.Pid)
+	// new process read datagrams from now, existing streams are drained by Shutdown
+	s.ReleasePacketSockets()
+	return nil
+}
@@ -0,0 +1,19 @@
+//go:build !linux && !windows
+
+package main
+
+import (
+	"errors"
+	"os"
+
+	"github.com/studentmain/socks6"
+)
+
+// restartSignal never notify, restart is not supported on this platform
+func restartSignal() <-chan os.Signal {
+	return nil
+}
+
+func handoff(s *socks6.Server) error {
+	return errors.New("restart is not supported on this platform")
+}
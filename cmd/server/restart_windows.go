@@ -0,0 +1,17 @@
+package main
+
+import (
+	"errors"
+	"os"
+
+	"github.com/studentmain/socks6"
+)
+
+// restartSignal never notify, restart is not supported on windows
+func restartSignal() <-chan os.Signal {
+	return nil
+}
+
+func handoff(s *socks6.Server) error {
+	return errors.New("restart is not supported on windows")
+}
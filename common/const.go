@@ -12,3 +12,8 @@ const (
 	// TODO: waiting for IANA consideration
 	EncryptedPort = 8389
 )
+
+// QUICProtocol is ALPN protocol ID of SOCKS 6 over QUIC
+//
+// TODO: waiting for IANA consideration
+const QUICProtocol = "socks6"
@@ -0,0 +1,208 @@
+package nt
+
+import (
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/studentmain/socks6/common/arrayx"
+	"github.com/studentmain/socks6/internal"
+)
+
+// packetListener is a net.Listener over a net.PacketConn,
+// each remote address is accepted as a net.Conn
+type packetListener struct {
+	pc     net.PacketConn
+	filter func(b []byte) bool
+
+	lock   sync.Mutex
+	conns  map[string]*packetConn
+	closed bool
+
+	acceptCh chan *packetConn
+	closeCh  chan struct{} // closed when listener closed
+	readDone chan struct{} // closed when pc read failed
+	readErr  error
+}
+
+// NewPacketListener create a net.Listener which demultiplex pc by remote address.
+// filter decide whether a packet from unknown address create a new connection, nil means always.
+// pc is closed after listener and all accepted connections closed.
+func NewPacketListener(pc net.PacketConn, filter func(b []byte) bool) net.Listener {
+	l := &packetListener{
+		pc:       pc,
+		filter:   filter,
+		conns:    map[string]*packetConn{},
+		acceptCh: make(chan *packetConn, 128),
+		closeCh:  make(chan struct{}),
+		readDone: make(chan struct{}),
+	}
+	go l.readLoop()
+	return l
+}
+
+func (l *packetListener) readLoop() {
+	defer close(l.readDone)
+	buf := internal.BytesPool4k.Rent()
+	defer internal.BytesPool4k.Return(buf)
+	for {
+		n, addr, err := l.pc.ReadFrom(buf)
+		if err != nil {
+			l.readErr = err
+			return
+		}
+		data := arrayx.Dup(buf[:n])
+		c := l.getConn(addr, data)
+		if c == nil {
+			continue
+		}
+		select {
+		case c.in <- data:
+		default:
+			// drop packet when reader is slow, like what a UDP socket does
+		}
+	}
+}
+
+// getConn find or create connection of addr, return nil when packet should be dropped
+func (l *packetListener) getConn(addr net.Addr, data []byte) *packetConn {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	key := addr.String()
+	if c, ok := l.conns[key]; ok {
+		return c
+	}
+	if l.closed || (l.filter != nil && !l.filter(data)) {
+		return nil
+	}
+	c := &packetConn{
+		l:       l,
+		raddr:   addr,
+		in:      make(chan []byte, 64),
+		closeCh: make(chan struct{}),
+	}
+	select {
+	case l.acceptCh <- c:
+	default:
+		// accept backlog full
+		return nil
+	}
+	l.conns[key] = c
+	return c
+}
+
+func (l *packetListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.acceptCh:
+		return c, nil
+	case <-l.closeCh:
+		return nil, net.ErrClosed
+	case <-l.readDone:
+		return nil, l.readErr
+	}
+}
+
+// Close stop accepting new connection, accepted connections still work
+func (l *packetListener) Close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.closed {
+		return net.ErrClosed
+	}
+	l.closed = true
+	close(l.closeCh)
+	if len(l.conns) == 0 {
+		return l.pc.Close()
+	}
+	return nil
+}
+
+func (l *packetListener) Addr() net.Addr {
+	return l.pc.LocalAddr()
+}
+
+func (l *packetListener) remove(c *packetConn) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	delete(l.conns, c.raddr.String())
+	if l.closed && len(l.conns) == 0 {
+		l.pc.Close()
+	}
+}
+
+// packetConn is a connected view of packetListener's PacketConn
+type packetConn struct {
+	l     *packetListener
+	raddr net.Addr
+
+	in        chan []byte
+	closeCh   chan struct{}
+	closeOnce sync.Once
+
+	ddlLock      sync.Mutex
+	readDeadline time.Time
+}
+
+func (c *packetConn) Read(b []byte) (int, error) {
+	c.ddlLock.Lock()
+	ddl := c.readDeadline
+	c.ddlLock.Unlock()
+
+	var timeout <-chan time.Time
+	if !ddl.IsZero() {
+		t := time.NewTimer(time.Until(ddl))
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	case d := <-c.in:
+		return copy(b, d), nil
+	case <-c.closeCh:
+		return 0, net.ErrClosed
+	case <-c.l.readDone:
+		return 0, c.l.readErr
+	case <-timeout:
+		return 0, os.ErrDeadlineExceeded
+	}
+}
+
+func (c *packetConn) Write(b []byte) (int, error) {
+	select {
+	case <-c.closeCh:
+		return 0, net.ErrClosed
+	default:
+	}
+	return c.l.pc.WriteTo(b, c.raddr)
+}
+
+func (c *packetConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closeCh)
+		c.l.remove(c)
+	})
+	return nil
+}
+
+func (c *packetConn) LocalAddr() net.Addr {
+	return c.l.pc.LocalAddr()
+}
+
+func (c *packetConn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+func (c *packetConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *packetConn) SetReadDeadline(t time.Time) error {
+	c.ddlLock.Lock()
+	defer c.ddlLock.Unlock()
+	c.readDeadline = t
+	return nil
+}
+
+func (c *packetConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
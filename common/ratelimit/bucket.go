@@ -0,0 +1,111 @@
+// ratelimit contains a token bucket rate limiter
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Bucket is a token bucket, usually one token represents one byte.
+// Bucket is safe for concurrent use, rate can be changed at anytime.
+type Bucket struct {
+	lock   sync.Mutex
+	rate   float64 // tokens per second, 0 means unlimited
+	tokens float64
+	last   time.Time
+
+	now func() time.Time // clock, replaced in tests
+}
+
+// NewBucket create a full bucket with given rate, rate <= 0 means unlimited.
+// Bucket capacity (burst size) is 1 second's tokens.
+func NewBucket(rate int64) *Bucket {
+	b := &Bucket{now: time.Now}
+	b.last = b.now()
+	b.SetRate(rate)
+	b.tokens = b.rate
+	return b
+}
+
+// Rate return current rate, 0 means unlimited
+func (b *Bucket) Rate() int64 {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return int64(b.rate)
+}
+
+// SetRate change bucket rate, rate <= 0 means unlimited
+func (b *Bucket) SetRate(rate int64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.refill(b.now())
+	if rate < 0 {
+		rate = 0
+	}
+	b.rate = float64(rate)
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+}
+
+// refill add tokens generated since last refill, caller should hold lock
+func (b *Bucket) refill(now time.Time) {
+	elapsed := now.Sub(b.last).Seconds()
+	b.last = now
+	if elapsed <= 0 {
+		return
+	}
+	b.tokens += elapsed * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+}
+
+// reserve take n tokens from bucket, return how long caller should wait before use them
+func (b *Bucket) reserve(n int) time.Duration {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.rate == 0 {
+		return 0
+	}
+	b.refill(b.now())
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// cancel return n tokens to bucket
+func (b *Bucket) cancel(n int) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.rate == 0 {
+		return
+	}
+	b.tokens += float64(n)
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+}
+
+// WaitN block until n tokens available or ctx done
+func (b *Bucket) WaitN(ctx context.Context, n int) error {
+	if n <= 0 {
+		return nil
+	}
+	wait := b.reserve(n)
+	if wait == 0 {
+		return nil
+	}
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		b.cancel(n)
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,79 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeClock is a clock only moved by test
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	return c.t
+}
+
+func newTestBucket(rate int64) (*Bucket, *fakeClock) {
+	c := &fakeClock{t: time.Unix(0, 0)}
+	b := NewBucket(rate)
+	b.now = c.now
+	b.last = c.t
+	return b, c
+}
+
+func TestBucketRefill(t *testing.T) {
+	b, c := newTestBucket(1000)
+	// full bucket is burst
+	assert.Zero(t, b.reserve(1000))
+	assert.Equal(t, 500*time.Millisecond, b.reserve(500))
+
+	// each second refill rate tokens
+	c.t = c.t.Add(time.Second)
+	assert.Zero(t, b.reserve(500))
+	assert.Equal(t, 100*time.Millisecond, b.reserve(100))
+
+	// tokens are capped by 1 second's tokens
+	c.t = c.t.Add(10 * time.Second)
+	assert.Zero(t, b.reserve(1000))
+	assert.Equal(t, 10*time.Millisecond, b.reserve(10))
+
+	// returned tokens are usable again
+	b.cancel(10)
+	c.t = c.t.Add(time.Second)
+	assert.Zero(t, b.reserve(1000))
+}
+
+func TestBucketSetRate(t *testing.T) {
+	b, _ := newTestBucket(1000)
+	// lower rate cap existing tokens
+	b.SetRate(100)
+	assert.EqualValues(t, 100, b.Rate())
+	assert.Zero(t, b.reserve(100))
+	assert.Equal(t, time.Second, b.reserve(100))
+
+	// unlimited
+	b.SetRate(0)
+	assert.Zero(t, b.reserve(1<<30))
+
+	// tokens generated before rate change use old rate
+	b, c := newTestBucket(100)
+	assert.Zero(t, b.reserve(100))
+	c.t = c.t.Add(500 * time.Millisecond)
+	b.SetRate(1000)
+	assert.Zero(t, b.reserve(50))
+	assert.Equal(t, 10*time.Millisecond, b.reserve(10))
+}
+
+func TestBucketWaitN(t *testing.T) {
+	b, _ := newTestBucket(1000)
+	ctx, cancel := context.WithCancel(context.Background())
+	assert.NoError(t, b.WaitN(ctx, 1000))
+	cancel()
+	// cancelled wait return tokens
+	assert.ErrorIs(t, b.WaitN(ctx, 1000), context.Canceled)
+	assert.Equal(t, time.Second, b.reserve(1000))
+}
@@ -0,0 +1,11 @@
+//go:build !linux && !windows
+
+package common
+
+import (
+	"syscall"
+)
+
+func ConvertSocketErrno(e syscall.Errno) syscall.Errno {
+	return e
+}
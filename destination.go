@@ -0,0 +1,111 @@
+package socks6
+
+import (
+	"context"
+	"net"
+	"syscall"
+)
+
+// DestinationPolicy decide which address can be reached through server,
+// prevent clients from accessing internal services of server's network.
+//
+// Loopback, private (RFC 1918 and IPv6 ULA), shared (RFC 6598, CGNAT), link-local, multicast,
+// unspecified addresses and addresses server listening at are denied, unless allowed by Allow.
+// Destination is checked after DNS resolution, right before connect, so DNS rebinding can't bypass it.
+type DestinationPolicy struct {
+	// Allow is networks which can be reached even though denied by default,
+	// server's own listening addresses are always denied.
+	Allow []*net.IPNet
+}
+
+// denied check whether ip is in a default denied network
+func (p *DestinationPolicy) denied(ip net.IP) bool {
+	for _, n := range p.Allow {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		if ip4[0] == 0 {
+			// 0.0.0.0/8, "this network"
+			return true
+		}
+		if ip4[0] == 100 && ip4[1]&0xc0 == 64 {
+			// 100.64.0.0/10, shared address space, used by CGNAT and some providers' internal services
+			return true
+		}
+	}
+	return ip.IsLoopback() ||
+		ip.IsPrivate() ||
+		ip.IsLinkLocalUnicast() ||
+		ip.IsMulticast() ||
+		ip.IsUnspecified()
+}
+
+// checkDestination return an error when ip:port is denied by DestinationPolicy
+func (s *ServerWorker) checkDestination(ip net.IP, port int) error {
+	if s.DestinationPolicy == nil {
+		return nil
+	}
+	if s.DestinationPolicy.denied(ip) || s.isListenerAddr(ip, port) {
+		return syscall.EACCES
+	}
+	return nil
+}
+
+// addListenerAddr record an address server listening at, connect to it will loop back to server
+func (s *ServerWorker) addListenerAddr(addr net.Addr) {
+	var a *net.TCPAddr
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		a = addr
+	case *net.UDPAddr:
+		a = &net.TCPAddr{IP: addr.IP, Port: addr.Port}
+	default:
+		return
+	}
+	s.listenerAddr.Store(a.String(), a)
+}
+
+// isListenerAddr check whether ip:port is an address server listening at
+func (s *ServerWorker) isListenerAddr(ip net.IP, port int) bool {
+	found := false
+	var local []net.Addr
+	s.listenerAddr.Range(func(_ string, a *net.TCPAddr) bool {
+		if a.Port != port {
+			return true
+		}
+		if a.IP.Equal(ip) {
+			found = true
+			return false
+		}
+		if !a.IP.IsUnspecified() {
+			return true
+		}
+		// listening at all interfaces, compare with every local address
+		if local == nil {
+			local, _ = net.InterfaceAddrs()
+		}
+		for _, la := range local {
+			if n, ok := la.(*net.IPNet); ok && n.IP.Equal(ip) {
+				found = true
+				return false
+			}
+		}
+		return true
+	})
+	return found
+}
+
+type destinationCheckContextKey struct{}
+
+// withDestinationCheck attach destination check to ctx, used by outbound after destination resolved
+func withDestinationCheck(ctx context.Context, check func(ip net.IP, port int) error) context.Context {
+	return context.WithValue(ctx, destinationCheckContextKey{}, check)
+}
+
+// destinationCheckFromContext return the destination check of request being processed, nil when not available
+func destinationCheckFromContext(ctx context.Context) func(ip net.IP, port int) error {
+	check, _ := ctx.Value(destinationCheckContextKey{}).(func(ip net.IP, port int) error)
+	return check
+}
@@ -0,0 +1,97 @@
+package socks6
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/studentmain/socks6/common/lg"
+)
+
+// activeSet contains close function of in-flight works, e.g. relays, backlog binds and UDP associations
+type activeSet struct {
+	lock  sync.Mutex
+	items map[uint64]func()
+	next  uint64
+}
+
+func newActiveSet() *activeSet {
+	return &activeSet{
+		items: map[uint64]func(){},
+	}
+}
+
+// add register a work, closeFn is called when work need to be force closed.
+// returned function unregister the work, it can be called multiple times.
+func (a *activeSet) add(closeFn func()) func() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.next++
+	id := a.next
+	a.items[id] = closeFn
+	return func() {
+		a.lock.Lock()
+		defer a.lock.Unlock()
+		delete(a.items, id)
+	}
+}
+
+func (a *activeSet) count() int {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return len(a.items)
+}
+
+// closeAll call every registered close function, return how many works closed
+func (a *activeSet) closeAll() int {
+	a.lock.Lock()
+	fns := make([]func(), 0, len(a.items))
+	for _, f := range a.items {
+		fns = append(fns, f)
+	}
+	a.items = map[uint64]func(){}
+	a.lock.Unlock()
+
+	for _, f := range fns {
+		f()
+	}
+	return len(fns)
+}
+
+// track register a work to ServerWorker, see activeSet.add
+func (s *ServerWorker) track(closeFn func()) func() {
+	if s.active == nil {
+		return func() {}
+	}
+	return s.active.add(closeFn)
+}
+
+// Draining report whether Shutdown is called
+func (s *ServerWorker) Draining() bool {
+	return atomic.LoadInt32(&s.draining) != 0
+}
+
+// Shutdown refuse new requests, wait existing relays, backlog binds and UDP associations finish.
+// When ctx done, close all remaining works and return how many works closed and ctx's error.
+func (s *ServerWorker) Shutdown(ctx context.Context) (int, error) {
+	atomic.StoreInt32(&s.draining, 1)
+	if s.active == nil {
+		return 0, nil
+	}
+	lg.Infof("waiting %d active works to finish", s.active.count())
+	tick := time.NewTicker(100 * time.Millisecond)
+	defer tick.Stop()
+	for {
+		if s.active.count() == 0 {
+			return 0, nil
+		}
+		select {
+		case <-tick.C:
+		case <-ctx.Done():
+			n := s.active.closeAll()
+			lg.Warningf("shutdown timeout, %d active works closed", n)
+			return n, ctx.Err()
+		}
+	}
+}
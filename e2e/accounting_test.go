@@ -0,0 +1,49 @@
+package e2e_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/studentmain/socks6"
+	"github.com/studentmain/socks6/accounting"
+	"github.com/studentmain/socks6/e2e/e2etool"
+)
+
+func TestAccountingQuota(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echoAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeTCP(ctx, echoAddr, e2etool.Echo)
+	sAddr, sPort := e2etool.GetAddr()
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        e2etool.NewServerWorker(),
+	}
+	ledger, err := accounting.NewLedger(nil)
+	assert.NoError(t, err)
+	ledger.SetDefaultQuota(accounting.Quota{Bytes: 3 * 1024 * 1024, Period: accounting.Daily})
+	server.Worker.Accounting = ledger
+	server.Start(ctx)
+	client := socks6.Client{
+		Server: sAddr,
+	}
+	fd, err := client.Dial("tcp", echoAddr)
+	assert.NoError(t, err)
+	e2etool.AssertForward(t, fd, fd)
+	assert.NotZero(t, ledger.Destination(echoAddr).BytesUp)
+	assert.Equal(t, ledger.Client("").BytesUp, ledger.Client("").BytesDown)
+
+	// use up quota, relay closed
+	go fd.Write(make([]byte, 1024*1024))
+	io.Copy(io.Discard, fd)
+	assert.ErrorIs(t, ledger.Allow(""), accounting.ErrQuotaExceeded)
+
+	_, err = client.Dial("tcp", echoAddr)
+	assert.True(t, errors.Is(err, syscall.EACCES))
+}
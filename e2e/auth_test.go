@@ -21,7 +21,7 @@ func TestUserPassAuth(t *testing.T) {
 	proxy := socks6.Server{
 		Address:       "127.0.0.1",
 		CleartextPort: sPort,
-		Worker:        socks6.NewServerWorker(),
+		Worker:        e2etool.NewServerWorker(),
 	}
 	sa := auth.NewServerAuthenticator()
 	sa.AddMethod(auth.PasswordServerAuthenticationMethod{
@@ -71,7 +71,7 @@ func TestAsyncAuth(t *testing.T) {
 	proxy := socks6.Server{
 		Address:       "127.0.0.1",
 		CleartextPort: sPort,
-		Worker:        socks6.NewServerWorker(),
+		Worker:        e2etool.NewServerWorker(),
 	}
 	sa := auth.NewServerAuthenticator()
 	sa.AddMethod(e2etool.FakeEchoServerAuthenticationMethod{})
@@ -0,0 +1,50 @@
+package e2e_test
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/studentmain/socks6"
+	"github.com/studentmain/socks6/e2e/e2etool"
+)
+
+func TestBandwidthLimit(t *testing.T) {
+	e2etool.WatchDog10s()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	chargenAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeTCP(ctx, chargenAddr, e2etool.Chargen)
+	sAddr, sPort := e2etool.GetAddr()
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        e2etool.NewServerWorker(),
+	}
+	bw := socks6.NewBandwidthLimiter()
+	bw.SetDefaultClientLimit(socks6.Bandwidth{Download: 256 * 1024})
+	server.Worker.Bandwidth = bw
+	server.Start(ctx)
+	client := socks6.Client{
+		Server: sAddr,
+	}
+	fd, err := client.Dial("tcp", chargenAddr)
+	assert.NoError(t, err)
+	defer fd.Close()
+
+	// first 256KiB is burst, next 64KiB take at least 0.25 second
+	start := time.Now()
+	_, err = io.ReadFull(fd, make([]byte, 320*1024))
+	assert.NoError(t, err)
+	assert.Greater(t, time.Since(start), 150*time.Millisecond)
+
+	// remove limit at runtime, existing connection follow it,
+	// 1MiB take more than 3 seconds if still limited
+	bw.SetDefaultClientLimit(socks6.Bandwidth{})
+	start = time.Now()
+	_, err = io.ReadFull(fd, make([]byte, 1024*1024))
+	assert.NoError(t, err)
+	assert.Less(t, time.Since(start), 2*time.Second)
+}
@@ -2,14 +2,17 @@ package e2e_test
 
 import (
 	"context"
+	"io"
 	"net"
 	"sync"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/studentmain/socks6"
 	"github.com/studentmain/socks6/e2e/e2etool"
+	"github.com/studentmain/socks6/message"
 )
 
 func TestBind(t *testing.T) {
@@ -22,7 +25,7 @@ func TestBind(t *testing.T) {
 	proxy := socks6.Server{
 		Address:       "127.0.0.1",
 		CleartextPort: sPort,
-		Worker:        socks6.NewServerWorker(),
+		Worker:        e2etool.NewServerWorker(),
 	}
 	proxy.Start(ctx)
 	client := socks6.Client{
@@ -65,7 +68,7 @@ func TestBacklogBind(t *testing.T) {
 	proxy := socks6.Server{
 		Address:       "127.0.0.1",
 		CleartextPort: sPort,
-		Worker:        socks6.NewServerWorker(),
+		Worker:        e2etool.NewServerWorker(),
 	}
 	proxy.Start(ctx)
 	client := socks6.Client{
@@ -114,3 +117,36 @@ func TestBacklogBind(t *testing.T) {
 	testFd1.Close()
 	e2etool.AssertClosed(t, clientFd1)
 }
+
+func TestBindAcceptError(t *testing.T) {
+	e2etool.WatchDog()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sAddr, _ := e2etool.GetAddr()
+	// server bound the address, then timed out waiting for incoming connection
+	go e2etool.ServeTCP(ctx, sAddr, func(rwc io.ReadWriteCloser) {
+		defer rwc.Close()
+		if _, err := message.ParseRequestFrom(rwc); err != nil {
+			return
+		}
+		rwc.Write(message.NewAuthenticationReplyWithType(message.AuthenticationReplySuccess).Marshal())
+		rwc.Write(message.NewOperationReplyWithCode(message.OperationReplySuccess).Marshal())
+		rwc.Write(message.NewOperationReplyWithCode(message.OperationReplyTimeout).Marshal())
+		io.Copy(io.Discard, rwc)
+	})
+	time.Sleep(50 * time.Millisecond)
+
+	client := socks6.Client{
+		Server: sAddr,
+	}
+	cListener, err := client.Listen("tcp", "0.0.0.0:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cListener.Close()
+	_, err = cListener.Accept()
+	assert.ErrorIs(t, err, syscall.ETIMEDOUT)
+	_, err = cListener.Accept()
+	assert.Error(t, err)
+}
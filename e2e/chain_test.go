@@ -0,0 +1,185 @@
+package e2e_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/studentmain/socks6"
+	"github.com/studentmain/socks6/e2e/e2etool"
+	"github.com/studentmain/socks6/message"
+	"github.com/studentmain/socks6/metrics"
+)
+
+// startChain start a core server and an edge server forward everything to core,
+// return edge address and core's metrics
+func startChain(ctx context.Context) (string, *metrics.Prometheus) {
+	cAddr, cPort := e2etool.GetAddr()
+	core := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: cPort,
+		Worker:        e2etool.NewServerWorker(),
+	}
+	p := metrics.NewPrometheus()
+	core.Worker.Metrics = p
+	core.Start(ctx)
+
+	eAddr, ePort := e2etool.GetAddr()
+	edge := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: ePort,
+		Worker:        e2etool.NewServerWorker(),
+	}
+	edge.Worker.Outbound = socks6.Socks6ServerOutbound{
+		Client: &socks6.Client{
+			Server: cAddr,
+		},
+	}
+	edge.Start(ctx)
+	return eAddr, p
+}
+
+func assertMetric(t *testing.T, p *metrics.Prometheus, line string) {
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	b, _ := io.ReadAll(rec.Body)
+	assert.Contains(t, string(b), line)
+}
+
+func TestChainConnect(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, echoPort := e2etool.GetAddr()
+	echoAddr := net.JoinHostPort("localhost", strconv.Itoa(int(echoPort)))
+	go e2etool.ServeTCP(ctx, echoAddr, e2etool.Echo)
+	eAddr, p := startChain(ctx)
+
+	client := socks6.Client{Server: eAddr}
+	ops := message.NewOptionSet()
+	ops.Add(message.Option{
+		Kind: message.OptionKindStack,
+		Data: message.BaseStackOptionData{
+			RemoteLeg: true,
+			Level:     message.StackOptionLevelIP,
+			Code:      message.StackOptionCodeHappyEyeball,
+			Data:      &message.HappyEyeballOptionData{Availability: false},
+		},
+	})
+	fd, err := client.ConnectRequest(ctx, message.ParseAddr(echoAddr), nil, ops)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer fd.Close()
+	applied := fd.(*socks6.ProxyTCPConn).AppliedStackOptions()
+	assert.Equal(t, false, applied[message.StackOptionIPHappyEyeball])
+
+	e2etool.AssertForward(t, fd, fd)
+	assertMetric(t, p, `socks6_requests_total{command="connect"} 1`)
+}
+
+func TestChainBind(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	eAddr, p := startChain(ctx)
+
+	client := socks6.Client{Server: eAddr}
+	l, err := client.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+
+	dialer := net.Dialer{Timeout: time.Second}
+	testFd, err := dialer.Dial("tcp", l.Addr().String())
+	assert.NoError(t, err)
+	clientFd, err := l.Accept()
+	assert.NoError(t, err)
+	e2etool.AssertForward2(t, clientFd, testFd)
+	assert.Equal(t, testFd.LocalAddr().String(), clientFd.RemoteAddr().String())
+
+	testFd.Close()
+	e2etool.AssertClosed(t, clientFd)
+	assertMetric(t, p, `socks6_requests_total{command="bind"} 1`)
+}
+
+func TestChainUDP(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echoAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeUDP(ctx, echoAddr, e2etool.UEcho)
+	eAddr, p := startChain(ctx)
+
+	client := socks6.Client{Server: eAddr}
+	fd, err := client.ListenPacketContext(ctx, "udp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer fd.Close()
+	ea := message.ParseAddr(echoAddr)
+	fd.WriteTo([]byte{1}, ea)
+	buf := make([]byte, 10)
+	n, a, err := fd.ReadFrom(buf)
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 1, n)
+		assert.Equal(t, ea.String(), a.String())
+		assert.EqualValues(t, 1, buf[0])
+	}
+	assertMetric(t, p, `socks6_requests_total{command="udp_associate"} 1`)
+}
+
+func TestChainBacklogBind(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	eAddr, _ := startChain(ctx)
+
+	client := socks6.Client{Server: eAddr, Backlog: 10}
+	l, err := client.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+
+	dialer := net.Dialer{Timeout: time.Second}
+	testFd1, err := dialer.Dial("tcp", l.Addr().String())
+	assert.NoError(t, err)
+	testFd2, err := dialer.Dial("tcp", l.Addr().String())
+	assert.NoError(t, err)
+	clientFd1, err := l.Accept()
+	assert.NoError(t, err)
+	clientFd2, err := l.Accept()
+	assert.NoError(t, err)
+	e2etool.AssertForward2(t, clientFd1, testFd1)
+	e2etool.AssertForward2(t, clientFd2, testFd2)
+}
+
+func TestChainInitialData(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echoAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeTCP(ctx, echoAddr, e2etool.Echo)
+	eAddr, _ := startChain(ctx)
+
+	// longer than upstream initial data limit, remaining part is sent after connected
+	data := make([]byte, 20000)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	client := socks6.Client{Server: eAddr}
+	fd, err := client.ConnectRequest(ctx, message.ParseAddr(echoAddr), data, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer fd.Close()
+	e2etool.AssertRead(t, fd, data)
+	e2etool.AssertForward(t, fd, fd)
+}
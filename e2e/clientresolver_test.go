@@ -0,0 +1,75 @@
+package e2e_test
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/studentmain/socks6"
+	"github.com/studentmain/socks6/e2e/e2etool"
+	"github.com/studentmain/socks6/rule"
+)
+
+var dnsRecords = map[string][]net.IP{
+	"example.test.": {net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")},
+}
+
+func TestClientResolver(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	dnsAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeTCP(ctx, dnsAddr, e2etool.DNS(dnsRecords))
+	go e2etool.ServeUDP(ctx, dnsAddr, e2etool.UDNS(dnsRecords))
+
+	sAddr, sPort := e2etool.GetAddr()
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        e2etool.NewServerWorker(),
+	}
+	server.Start(ctx)
+
+	client := socks6.Client{Server: sAddr, DNSServer: dnsAddr}
+	ips, err := client.Resolver().LookupIP(ctx, "ip4", "example.test")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "192.0.2.1", ips[0].String())
+	}
+	ips, err = client.Resolver().LookupIP(ctx, "ip", "example.test")
+	if assert.NoError(t, err) {
+		assert.Len(t, ips, 2)
+	}
+	_, err = client.Resolver().LookupIP(ctx, "ip4", "missing.test")
+	if assert.Error(t, err) {
+		assert.True(t, err.(*net.DNSError).IsNotFound)
+	}
+}
+
+func TestClientResolverTCPFallback(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// only tcp server, udp association is denied too
+	dnsAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeTCP(ctx, dnsAddr, e2etool.DNS(dnsRecords))
+
+	sAddr, sPort := e2etool.GetAddr()
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        e2etool.NewServerWorker(),
+	}
+	rs, err := rule.NewRuleSet([]rule.Rule{
+		{Action: rule.ActionDeny, Command: []string{"udp_associate"}},
+	}, rule.ActionAllow)
+	assert.NoError(t, err)
+	server.Worker.Rule = rs
+	server.Start(ctx)
+
+	client := socks6.Client{Server: sAddr, DNSServer: dnsAddr}
+	ips, err := client.Resolver().LookupIP(ctx, "ip4", "example.test")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "192.0.2.1", ips[0].String())
+	}
+}
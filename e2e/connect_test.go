@@ -25,7 +25,7 @@ func TestConnect(t *testing.T) {
 	server := socks6.Server{
 		Address:       "127.0.0.1",
 		CleartextPort: sPort,
-		Worker:        socks6.NewServerWorker(),
+		Worker:        e2etool.NewServerWorker(),
 	}
 	server.Start(ctx)
 	client := socks6.Client{
@@ -56,7 +56,7 @@ func TestFragmentedConnect(t *testing.T) {
 	server := socks6.Server{
 		Address:       "127.0.0.1",
 		CleartextPort: sPort,
-		Worker:        socks6.NewServerWorker(),
+		Worker:        e2etool.NewServerWorker(),
 	}
 	server.Start(ctx)
 
@@ -92,7 +92,7 @@ func BenchmarkRelay(b *testing.B) {
 	server := socks6.Server{
 		Address:       "127.0.0.1",
 		CleartextPort: sPort,
-		Worker:        socks6.NewServerWorker(),
+		Worker:        e2etool.NewServerWorker(),
 	}
 	server.Start(ctx)
 	client := socks6.Client{
@@ -133,7 +133,7 @@ func BenchmarkAccept(b *testing.B) {
 	server := socks6.Server{
 		Address:       "127.0.0.1",
 		CleartextPort: sPort,
-		Worker:        socks6.NewServerWorker(),
+		Worker:        e2etool.NewServerWorker(),
 	}
 	server.Start(ctx)
 	client := socks6.Client{
@@ -0,0 +1,106 @@
+package e2e_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/studentmain/socks6"
+	"github.com/studentmain/socks6/e2e/e2etool"
+	"github.com/studentmain/socks6/message"
+	"github.com/studentmain/socks6/resolver"
+)
+
+func TestDestinationPolicy(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echoAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeTCP(ctx, echoAddr, e2etool.Echo)
+	go e2etool.ServeUDP(ctx, echoAddr, e2etool.UEcho)
+	_, port := e2etool.GetAddr()
+	deniedAddr := net.JoinHostPort("127.0.0.2", strconv.Itoa(int(port)))
+	go e2etool.ServeTCP(ctx, deniedAddr, e2etool.Echo)
+	go e2etool.ServeUDP(ctx, deniedAddr, e2etool.UEcho)
+
+	sAddr, sPort := e2etool.GetAddr()
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        socks6.NewServerWorker(),
+	}
+	_, allowed, _ := net.ParseCIDR("127.0.0.1/32")
+	server.Worker.DestinationPolicy.Allow = []*net.IPNet{allowed}
+	ob := server.Worker.Outbound.(socks6.InternetServerOutbound)
+	ob.Resolver = &resolver.Resolver{
+		Hosts: map[string][]net.IP{"internal.test": {net.IPv4(127, 0, 0, 2)}},
+	}
+	server.Worker.Outbound = ob
+	server.Start(ctx)
+	client := socks6.Client{Server: sAddr}
+
+	fd, err := client.Dial("tcp", echoAddr)
+	if assert.NoError(t, err) {
+		e2etool.AssertForward(t, fd, fd)
+		fd.Close()
+	}
+	for _, addr := range []string{
+		deniedAddr,
+		// resolved address is checked
+		net.JoinHostPort("internal.test", strconv.Itoa(int(port))),
+		// server itself is denied even though allowed
+		sAddr,
+	} {
+		_, err = client.Dial("tcp", addr)
+		assert.True(t, errors.Is(err, syscall.EACCES), addr)
+	}
+
+	_, err = client.BindRequest(ctx, message.ParseAddr("127.0.0.2:0"), nil)
+	assert.True(t, errors.Is(err, syscall.EACCES))
+
+	pc, err := client.ListenPacketContext(ctx, "udp", ":0")
+	if assert.NoError(t, err) {
+		// denied datagrams are dropped, first reply is from allowed one
+		pc.WriteTo([]byte{1}, message.ParseAddr(deniedAddr))
+		pc.WriteTo([]byte{2}, message.ParseAddr(sAddr))
+		pc.WriteTo([]byte{3}, message.ParseAddr(echoAddr))
+		buf := make([]byte, 10)
+		n, a, err := pc.ReadFrom(buf)
+		if assert.NoError(t, err) {
+			assert.Equal(t, []byte{3}, buf[:n])
+			assert.Equal(t, echoAddr, a.String())
+		}
+		pc.Close()
+	}
+}
+
+func TestDefaultDestinationPolicy(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echoAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeTCP(ctx, echoAddr, e2etool.Echo)
+	sAddr, sPort := e2etool.GetAddr()
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        socks6.NewServerWorker(),
+	}
+	server.Start(ctx)
+	client := socks6.Client{Server: sAddr}
+
+	for _, addr := range []string{
+		echoAddr,
+		"0.0.0.0:" + strconv.Itoa(int(sPort)),
+		"[::ffff:127.0.0.1]:6379",
+		"100.64.0.1:80",
+		"100.127.255.254:80",
+	} {
+		_, err := client.Dial("tcp", addr)
+		assert.True(t, errors.Is(err, syscall.EACCES), addr)
+	}
+}
@@ -2,6 +2,8 @@ package e2etool
 
 import (
 	"fmt"
+	"net"
+	"sync/atomic"
 
 	"github.com/studentmain/socks6/common/rnd"
 )
@@ -11,7 +13,29 @@ const (
 	portCount = 128
 )
 
+var nextPort = uint32(rnd.RandUint16())
+
+// GetAddr return a loopback address, ports are allocated in turn and skip ports in use
 func GetAddr() (string, uint16) {
-	port := rnd.RandUint16()%portCount + startPort
-	return fmt.Sprintf("127.0.0.1:%d", port), port
+	for {
+		port := uint16(atomic.AddUint32(&nextPort, 1)%portCount) + startPort
+		addr := fmt.Sprintf("127.0.0.1:%d", port)
+		if portFree(addr) {
+			return addr, port
+		}
+	}
+}
+
+func portFree(addr string) bool {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return false
+	}
+	l.Close()
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return false
+	}
+	pc.Close()
+	return true
 }
@@ -0,0 +1,70 @@
+package e2etool
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// DNS answer A and AAAA queries over TCP from records, key is fully qualified name, e.g. example.com.
+func DNS(records map[string][]net.IP) func(io.ReadWriteCloser) {
+	return func(c io.ReadWriteCloser) {
+		defer c.Close()
+		lb := make([]byte, 2)
+		for {
+			if _, err := io.ReadFull(c, lb); err != nil {
+				return
+			}
+			b := make([]byte, binary.BigEndian.Uint16(lb))
+			if _, err := io.ReadFull(c, b); err != nil {
+				return
+			}
+			r := dnsReply(records, b)
+			binary.BigEndian.PutUint16(lb, uint16(len(r)))
+			if _, err := c.Write(append(lb, r...)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// UDNS answer A and AAAA queries over UDP from records
+func UDNS(records map[string][]net.IP) func(p net.PacketConn, d []byte, a net.Addr) {
+	return func(p net.PacketConn, d []byte, a net.Addr) {
+		p.WriteTo(dnsReply(records, d), a)
+	}
+}
+
+func dnsReply(records map[string][]net.IP, b []byte) []byte {
+	m := dnsmessage.Message{}
+	if err := m.Unpack(b); err != nil || len(m.Questions) != 1 {
+		return nil
+	}
+	q := m.Questions[0]
+	resp := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: m.ID, Response: true, RecursionDesired: m.RecursionDesired, RecursionAvailable: true},
+		Questions: m.Questions,
+	}
+	ips, ok := records[q.Name.String()]
+	if !ok {
+		resp.RCode = dnsmessage.RCodeNameError
+	}
+	for _, ip := range ips {
+		h := dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: 60}
+		if ip4 := ip.To4(); ip4 != nil && q.Type == dnsmessage.TypeA {
+			h.Type = dnsmessage.TypeA
+			r := &dnsmessage.AResource{}
+			copy(r.A[:], ip4)
+			resp.Answers = append(resp.Answers, dnsmessage.Resource{Header: h, Body: r})
+		} else if ip.To4() == nil && q.Type == dnsmessage.TypeAAAA {
+			h.Type = dnsmessage.TypeAAAA
+			r := &dnsmessage.AAAAResource{}
+			copy(r.AAAA[:], ip)
+			resp.Answers = append(resp.Answers, dnsmessage.Resource{Header: h, Body: r})
+		}
+	}
+	ret, _ := resp.Pack()
+	return ret
+}
@@ -0,0 +1,177 @@
+package e2etool
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+
+	"github.com/studentmain/socks6/message"
+)
+
+// Socks5 is a minimal SOCKS 5 server handler for ServeTCP,
+// password authentication is required when user is not empty
+func Socks5(user, pass string) func(io.ReadWriteCloser) {
+	return func(rwc io.ReadWriteCloser) {
+		defer rwc.Close()
+		conn := rwc.(net.Conn)
+		hs, err := message.ParseHandshake5From(conn)
+		if err != nil {
+			return
+		}
+		method := byte(0)
+		if user != "" {
+			method = 2
+		}
+		if !bytes.Contains(hs.Methods, []byte{method}) {
+			conn.Write([]byte{5, 0xff})
+			return
+		}
+		conn.Write((&message.MethodSelection{Method: method}).Marshal5())
+		if method == 2 {
+			buf := make([]byte, 256)
+			// ver ulen
+			io.ReadFull(conn, buf[:2])
+			u := make([]byte, buf[1])
+			io.ReadFull(conn, u)
+			io.ReadFull(conn, buf[:1])
+			p := make([]byte, buf[0])
+			io.ReadFull(conn, p)
+			if string(u) != user || string(p) != pass {
+				conn.Write([]byte{1, 1})
+				return
+			}
+			conn.Write([]byte{1, 0})
+		}
+
+		req, err := message.ParseRequest5From(conn)
+		if err != nil {
+			return
+		}
+		reply := func(code message.ReplyCode, addr net.Addr) {
+			rep := message.OperationReply{ReplyCode: code, Endpoint: message.ConvertAddr(addr)}
+			conn.Write(rep.Marshal5())
+		}
+		switch req.CommandCode {
+		case message.CommandConnect:
+			r, err := net.Dial("tcp", req.Endpoint.String())
+			if err != nil {
+				reply(message.OperationReplyConnectionRefused, nil)
+				return
+			}
+			reply(message.OperationReplySuccess, r.LocalAddr())
+			pipe(conn, conn, r)
+		case message.CommandBind:
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				reply(message.OperationReplyServerFailure, nil)
+				return
+			}
+			reply(message.OperationReplySuccess, l.Addr())
+			r, err := l.Accept()
+			l.Close()
+			if err != nil {
+				return
+			}
+			reply(message.OperationReplySuccess, r.RemoteAddr())
+			pipe(conn, conn, r)
+		case message.CommandUdpAssociate:
+			pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+			if err != nil {
+				reply(message.OperationReplyServerFailure, nil)
+				return
+			}
+			reply(message.OperationReplySuccess, pc.LocalAddr())
+			go func() {
+				io.Copy(io.Discard, conn)
+				pc.Close()
+			}()
+			udpRelay5(pc)
+		default:
+			reply(message.OperationReplyCommandNotSupported, nil)
+		}
+	}
+}
+
+// udpRelay5 relay datagram between first sender (the client) and others
+func udpRelay5(pc net.PacketConn) {
+	var client net.Addr
+	buf := make([]byte, 4096)
+	for {
+		n, a, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if client == nil {
+			client = a
+		}
+		if a.String() == client.String() {
+			msg, err := message.ParseUDPMessage5From(bytes.NewReader(buf[:n]))
+			if err != nil {
+				continue
+			}
+			ua, err := net.ResolveUDPAddr("udp", msg.Endpoint.String())
+			if err != nil {
+				continue
+			}
+			pc.WriteTo(msg.Data, ua)
+			continue
+		}
+		msg := message.UDPMessage{
+			Type:     message.UDPMessageDatagram,
+			Endpoint: message.ConvertAddr(a),
+			Data:     buf[:n],
+		}
+		pc.WriteTo(msg.Marshal5(), client)
+	}
+}
+
+// HTTPConnect is a minimal HTTP CONNECT proxy handler for ServeTCP,
+// basic authentication is required when user is not empty
+func HTTPConnect(user, pass string) func(io.ReadWriteCloser) {
+	return func(rwc io.ReadWriteCloser) {
+		defer rwc.Close()
+		conn := rwc.(net.Conn)
+		br := bufio.NewReader(conn)
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			return
+		}
+		if req.Method != http.MethodConnect {
+			io.WriteString(conn, "HTTP/1.1 405 Method Not Allowed\r\n\r\n")
+			return
+		}
+		if user != "" {
+			cred := base64.StdEncoding.EncodeToString([]byte(user + ":" + pass))
+			if req.Header.Get("Proxy-Authorization") != "Basic "+cred {
+				io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+				return
+			}
+		}
+		r, err := net.Dial("tcp", req.Host)
+		if err != nil {
+			io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+			return
+		}
+		io.WriteString(conn, "HTTP/1.1 200 Connection Established\r\n\r\n")
+		pipe(br, conn, r)
+	}
+}
+
+// pipe copy between client and remote until either direction end
+func pipe(cr io.Reader, cw io.WriteCloser, r net.Conn) {
+	defer r.Close()
+	defer cw.Close()
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(r, cr)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(cw, r)
+		done <- struct{}{}
+	}()
+	<-done
+}
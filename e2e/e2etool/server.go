@@ -0,0 +1,16 @@
+package e2etool
+
+import (
+	"net"
+
+	"github.com/studentmain/socks6"
+)
+
+// NewServerWorker create a standard server worker, destination policy allow loopback addresses used by tests
+func NewServerWorker() *socks6.ServerWorker {
+	w := socks6.NewServerWorker()
+	_, lo4, _ := net.ParseCIDR("127.0.0.0/8")
+	_, lo6, _ := net.ParseCIDR("::1/128")
+	w.DestinationPolicy.Allow = []*net.IPNet{lo4, lo6}
+	return w
+}
@@ -1,11 +1,13 @@
 package e2etool
 
 import (
+	"sync"
 	"time"
 
 	"github.com/studentmain/socks6/common/lg"
 )
 
+// WatchDog panic when current test run more than 1 second
 func WatchDog() {
 	wd(1 * time.Second)
 }
@@ -14,14 +16,24 @@ func WatchDog10s() {
 	wd(10 * time.Second)
 }
 
+var (
+	wdLock  sync.Mutex
+	wdTimer *time.Timer
+)
+
+// wd start a watchdog, previous watchdog is stopped since its test is finished
 func wd(t time.Duration) {
-	go func() {
-		before := time.Now()
-		<-time.After(t)
+	wdLock.Lock()
+	defer wdLock.Unlock()
+	if wdTimer != nil {
+		wdTimer.Stop()
+	}
+	before := time.Now()
+	wdTimer = time.AfterFunc(t, func() {
 		after := time.Now()
 		if after.Sub(before) < t*11/10 {
 			panic("test timeout")
 		}
 		lg.Warning("watchdog timeout, timer unstable, maybe in debug mode")
-	}()
+	})
 }
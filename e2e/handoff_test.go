@@ -0,0 +1,102 @@
+package e2e_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/studentmain/socks6"
+	"github.com/studentmain/socks6/e2e/e2etool"
+	"github.com/studentmain/socks6/message"
+)
+
+func TestListenerHandoff(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echoAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeTCP(ctx, echoAddr, e2etool.Echo)
+	sAddr, sPort := e2etool.GetAddr()
+	old := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        e2etool.NewServerWorker(),
+	}
+	old.Start(ctx)
+	client := socks6.Client{
+		Server: sAddr,
+	}
+	fd, err := client.Dial("tcp", echoAddr)
+	assert.NoError(t, err)
+
+	files, err := old.Files()
+	assert.NoError(t, err)
+	assert.Len(t, files, 2)
+	// would fail with EADDRINUSE if sockets are not inherited
+	new := socks6.Server{
+		Address:        "127.0.0.1",
+		CleartextPort:  sPort,
+		Worker:         e2etool.NewServerWorker(),
+		InheritedFiles: files,
+	}
+	new.Start(ctx)
+
+	go old.Shutdown(ctx)
+	// existing relay kept by old server, new connection accepted by new server
+	e2etool.AssertForward(t, fd, fd)
+	fd.Close()
+	fd2, err := client.Dial("tcp", echoAddr)
+	assert.NoError(t, err)
+	e2etool.AssertForward(t, fd2, fd2)
+	fd2.Close()
+}
+
+func TestPacketSocketHandoff(t *testing.T) {
+	e2etool.WatchDog10s()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echoAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeUDP(ctx, echoAddr, e2etool.UEcho)
+	sAddr, sPort := e2etool.GetAddr()
+	old := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        e2etool.NewServerWorker(),
+	}
+	old.Start(ctx)
+
+	files, err := old.Files()
+	assert.NoError(t, err)
+	new := socks6.Server{
+		Address:        "127.0.0.1",
+		CleartextPort:  sPort,
+		Worker:         e2etool.NewServerWorker(),
+		InheritedFiles: files,
+	}
+	new.Start(ctx)
+	old.ReleasePacketSockets()
+	go old.Shutdown(ctx)
+
+	// every datagram is processed by new server
+	client := socks6.Client{
+		Server: sAddr,
+	}
+	eAddr := message.ParseAddr(echoAddr)
+	fd, err := client.ListenPacketContext(ctx, "udp", ":0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer fd.Close()
+	buf := make([]byte, 10)
+	for i := 0; i < 10; i++ {
+		_, err := fd.WriteTo([]byte{byte(i)}, eAddr)
+		assert.NoError(t, err)
+		fd.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := fd.ReadFrom(buf)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, []byte{byte(i)}, buf[:n])
+	}
+}
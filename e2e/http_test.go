@@ -0,0 +1,228 @@
+package e2e_test
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/studentmain/socks6"
+	"github.com/studentmain/socks6/auth"
+	"github.com/studentmain/socks6/e2e/e2etool"
+	"github.com/studentmain/socks6/message"
+	"github.com/studentmain/socks6/rule"
+)
+
+// serveHTTPEcho reply request line, proxy headers and body
+func serveHTTPEcho(ctx context.Context, addr string) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		panic(err)
+	}
+	srv := http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "%s %s %s|%s%s|%s", r.Method, r.Host, r.RequestURI,
+			r.Header.Get("Proxy-Authorization"), r.Header.Get("Proxy-Connection"), body)
+	})}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	srv.Serve(l)
+}
+
+func TestHTTPClient(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echoAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeTCP(ctx, echoAddr, e2etool.Echo)
+	webAddr, _ := e2etool.GetAddr()
+	go serveHTTPEcho(ctx, webAddr)
+	closedAddr, _ := e2etool.GetAddr()
+
+	sAddr, sPort := e2etool.GetAddr()
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        e2etool.NewServerWorker(),
+	}
+	sa := auth.NewServerAuthenticator()
+	sa.AddMethod(auth.PasswordServerAuthenticationMethod{
+		Passwords: map[string]string{"alice": "123456"},
+	})
+	server.Worker.Authenticator = sa
+	server.Worker.EnableHTTP = true
+	server.Start(ctx)
+
+	// connect
+	client := socks6.HTTPServerOutbound{Server: sAddr, Username: "alice", Password: "123456"}
+	fd, _, err := client.Dial(ctx, message.StackOptionInfo{}, message.ParseAddr(echoAddr))
+	if assert.NoError(t, err) {
+		e2etool.AssertForward(t, fd, fd)
+		fd.Close()
+	}
+	_, _, err = client.Dial(ctx, message.StackOptionInfo{}, message.ParseAddr(closedAddr))
+	assert.True(t, errors.Is(err, syscall.EHOSTUNREACH))
+	for _, c := range []socks6.HTTPServerOutbound{
+		{Server: sAddr, Username: "alice", Password: "654321"},
+		{Server: sAddr},
+	} {
+		_, _, err = c.Dial(ctx, message.StackOptionInfo{}, message.ParseAddr(echoAddr))
+		assert.True(t, errors.Is(err, syscall.EACCES))
+	}
+
+	// absolute URI
+	hc := http.Client{Transport: &http.Transport{
+		Proxy: http.ProxyURL(&url.URL{Scheme: "http", Host: sAddr, User: url.UserPassword("alice", "123456")}),
+	}}
+	resp, err := hc.Get("http://" + webAddr + "/a?b=c")
+	if assert.NoError(t, err) {
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, "GET "+webAddr+" /a?b=c||", string(body))
+	}
+	resp, err = hc.Post("http://"+webAddr+"/post", "text/plain", strings.NewReader("hello"))
+	if assert.NoError(t, err) {
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, "POST "+webAddr+" /post||hello", string(body))
+	}
+	hc.Transport = &http.Transport{Proxy: http.ProxyURL(&url.URL{Scheme: "http", Host: sAddr})}
+	resp, err = hc.Get("http://" + webAddr + "/")
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusProxyAuthRequired, resp.StatusCode)
+		assert.Contains(t, resp.Header.Get("Proxy-Authenticate"), "Basic")
+	}
+
+	// origin form request is not a proxy request
+	conn, err := net.Dial("tcp", sAddr)
+	if assert.NoError(t, err) {
+		conn.Write([]byte("GET / HTTP/1.1\r\nHost: " + sAddr + "\r\n\r\n"))
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if assert.NoError(t, err) {
+			assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		}
+		conn.Close()
+	}
+}
+
+func TestHTTPClientRule(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	webAddr, webPort := e2etool.GetAddr()
+	go serveHTTPEcho(ctx, webAddr)
+
+	sAddr, sPort := e2etool.GetAddr()
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        e2etool.NewServerWorker(),
+	}
+	rs, err := rule.NewRuleSet([]rule.Rule{
+		{Name: "no-web", Action: rule.ActionDeny, Port: []string{strconv.Itoa(int(webPort))}},
+	}, rule.ActionAllow)
+	assert.NoError(t, err)
+	server.Worker.Rule = rs
+	server.Worker.EnableHTTP = true
+	server.Start(ctx)
+
+	hc := http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(&url.URL{Scheme: "http", Host: sAddr})}}
+	resp, err := hc.Get("http://" + webAddr + "/")
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	}
+	_, _, err = socks6.HTTPServerOutbound{Server: sAddr}.Dial(ctx, message.StackOptionInfo{}, message.ParseAddr(webAddr))
+	assert.True(t, errors.Is(err, syscall.EACCES))
+}
+
+func TestHTTPClientPipeline(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// origin keep connection alive, and report first request's body and data sent after it
+	webAddr, _ := e2etool.GetAddr()
+	recv := make(chan string, 2)
+	go e2etool.ServeTCP(ctx, webAddr, func(c io.ReadWriteCloser) {
+		defer c.Close()
+		br := bufio.NewReader(c)
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			recv <- err.Error()
+			return
+		}
+		body, _ := io.ReadAll(req.Body)
+		recv <- string(body)
+		c.Write([]byte("HTTP/1.1 200 OK\r\nConnection: keep-alive\r\nContent-Length: 2\r\n\r\nok"))
+		c.(net.Conn).SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		rest, _ := io.ReadAll(br)
+		recv <- string(rest)
+	})
+
+	sAddr, sPort := e2etool.GetAddr()
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        e2etool.NewServerWorker(),
+	}
+	server.Worker.EnableHTTP = true
+	server.Start(ctx)
+
+	conn, err := net.Dial("tcp", sAddr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	conn.Write([]byte("POST http://" + webAddr + "/a HTTP/1.1\r\nHost: " + webAddr + "\r\nTransfer-Encoding: chunked\r\n\r\n" +
+		"5\r\nhello\r\n0\r\n\r\n" +
+		"GET http://" + webAddr + "/b HTTP/1.1\r\nHost: " + webAddr + "\r\nProxy-Authorization: Basic YTpi\r\n\r\n"))
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if assert.NoError(t, err) {
+		body, _ := io.ReadAll(resp.Body)
+		assert.Equal(t, "ok", string(body))
+		assert.True(t, resp.Close)
+	}
+	assert.Equal(t, "hello", <-recv)
+	// second request is not forwarded
+	assert.Equal(t, "", <-recv)
+	rest, _ := io.ReadAll(br)
+	assert.Empty(t, rest)
+}
+
+func TestHTTPDisabled(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sAddr, sPort := e2etool.GetAddr()
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        e2etool.NewServerWorker(),
+	}
+	server.Start(ctx)
+
+	conn, err := net.Dial("tcp", sAddr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte("CONNECT 127.0.0.1:1 HTTP/1.1\r\nHost: 127.0.0.1:1\r\n\r\n"))
+	assert.NoError(t, err)
+	b, _ := io.ReadAll(conn)
+	// version mismatch reply instead of a tunnel
+	assert.True(t, strings.HasPrefix(string(b), "HTTP/1.0 500 "))
+}
@@ -0,0 +1,77 @@
+package e2e_test
+
+import (
+	"context"
+	"io"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/studentmain/socks6"
+	"github.com/studentmain/socks6/e2e/e2etool"
+	"github.com/studentmain/socks6/metrics"
+)
+
+func TestMetrics(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echoAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeTCP(ctx, echoAddr, e2etool.Echo)
+	sAddr, sPort := e2etool.GetAddr()
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        e2etool.NewServerWorker(),
+	}
+	p := metrics.NewPrometheus()
+	server.Worker.Metrics = p
+	server.Start(ctx)
+	client := socks6.Client{
+		Server: sAddr,
+	}
+	fd, err := client.Dial("tcp", echoAddr)
+	assert.NoError(t, err)
+	e2etool.AssertForward(t, fd, fd)
+	fd.Close()
+	assert.NoError(t, client.NoopRequest(ctx))
+	time.Sleep(50 * time.Millisecond)
+
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	b, _ := io.ReadAll(rec.Body)
+	body := string(b)
+	assert.Contains(t, body, "socks6_connections_total 2\n")
+	assert.Contains(t, body, `socks6_authentications_total{result="success"} 2`)
+	assert.Contains(t, body, `socks6_requests_total{command="connect"} 1`)
+	assert.Contains(t, body, `socks6_requests_total{command="noop"} 1`)
+	assert.Contains(t, body, `socks6_replies_total{code="success"} 2`)
+	assert.Contains(t, body, `socks6_relay_duration_seconds_count{command="noop"} 1`)
+	assert.Contains(t, body, "socks6_handshake_duration_seconds_count 2\n")
+}
+
+func TestMetricsNil(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echoAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeTCP(ctx, echoAddr, e2etool.Echo)
+	sAddr, sPort := e2etool.GetAddr()
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        e2etool.NewServerWorker(),
+	}
+	server.Worker.Metrics = nil
+	server.Start(ctx)
+	client := socks6.Client{
+		Server: sAddr,
+	}
+	fd, err := client.Dial("tcp", echoAddr)
+	if assert.NoError(t, err) {
+		e2etool.AssertForward(t, fd, fd)
+		fd.Close()
+	}
+	assert.NoError(t, client.NoopRequest(ctx))
+}
@@ -0,0 +1,320 @@
+package e2e_test
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/studentmain/socks6"
+	"github.com/studentmain/socks6/e2e/e2etool"
+	"github.com/studentmain/socks6/message"
+	"github.com/studentmain/socks6/rule"
+)
+
+func startQUICServer(ctx context.Context, addr string) *socks6.Server {
+	server := &socks6.Server{
+		Listeners: []socks6.ListenerConfig{{Transport: "quic", Address: addr}},
+		TlsConfig: e2etool.ServerTLSConfig(),
+		Worker:    e2etool.NewServerWorker(),
+	}
+	server.Start(ctx)
+	return server
+}
+
+// killQUICServer close server and all QUIC connections
+func killQUICServer(server *socks6.Server) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	server.Shutdown(ctx)
+	// quic-go forget closed socket asynchronously, new server on same address can't start before that
+	time.Sleep(100 * time.Millisecond)
+}
+
+func newQUICClient(sAddr string) *socks6.Client {
+	return &socks6.Client{
+		Server:    sAddr,
+		QUIC:      true,
+		TLSConfig: &tls.Config{InsecureSkipVerify: true},
+		Backlog:   4,
+	}
+}
+
+// assertUDPEcho check association can reach echo server, datagrams may lost during recovery
+func assertUDPEcho(t *testing.T, fd net.PacketConn, echoAddr net.Addr) {
+	buf := make([]byte, 10)
+	for i := 0; i < 20; i++ {
+		_, err := fd.WriteTo([]byte{byte(i)}, echoAddr)
+		if !assert.NoError(t, err) {
+			return
+		}
+		fd.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		n, a, err := fd.ReadFrom(buf)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			continue
+		}
+		if assert.NoError(t, err) {
+			assert.EqualValues(t, 1, n)
+			assert.EqualValues(t, i, buf[0])
+			assert.Equal(t, echoAddr.String(), a.String())
+		}
+		fd.SetReadDeadline(time.Time{})
+		return
+	}
+	assert.Fail(t, "no echo")
+}
+
+// assertAccept check listener can accept connection
+func assertAccept(t *testing.T, l net.Listener) {
+	testFd, err := net.DialTimeout("tcp", l.Addr().String(), time.Second)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer testFd.Close()
+	clientFd, err := l.Accept()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer clientFd.Close()
+	e2etool.AssertForward2(t, clientFd, testFd)
+}
+
+func TestQUIC(t *testing.T) {
+	e2etool.WatchDog10s()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echoAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeTCP(ctx, echoAddr, e2etool.Echo)
+	uechoAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeUDP(ctx, uechoAddr, e2etool.UEcho)
+	sAddr, _ := e2etool.GetAddr()
+	startQUICServer(ctx, sAddr)
+	client := newQUICClient(sAddr)
+	defer client.Close()
+
+	// streams after first one skip authentication
+	wg := sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c, err := client.DialContext(ctx, "tcp", echoAddr)
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer c.Close()
+			e2etool.AssertForward(t, c, c)
+		}()
+	}
+	wg.Wait()
+
+	// initial data
+	c, err := client.ConnectRequest(ctx, message.ParseAddr(echoAddr), []byte{1, 2, 3}, nil)
+	if assert.NoError(t, err) {
+		e2etool.AssertRead(t, c, []byte{1, 2, 3})
+		c.Close()
+	}
+
+	fd, err := client.ListenPacketContext(ctx, "udp", "127.0.0.1:0")
+	if assert.NoError(t, err) {
+		assertUDPEcho(t, fd, message.ParseAddr(uechoAddr))
+		fd.Close()
+	}
+
+	l, err := client.ListenContext(ctx, "tcp", "127.0.0.1:0")
+	if assert.NoError(t, err) {
+		assertAccept(t, l)
+		assertAccept(t, l)
+		l.Close()
+		_, err = l.Accept()
+		assert.True(t, errors.Is(err, net.ErrClosed))
+	}
+}
+
+func TestQUICRecovery(t *testing.T) {
+	e2etool.WatchDog10s()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	uechoAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeUDP(ctx, uechoAddr, e2etool.UEcho)
+	eAddr := message.ParseAddr(uechoAddr)
+	sAddr, _ := e2etool.GetAddr()
+	server := startQUICServer(ctx, sAddr)
+	client := newQUICClient(sAddr)
+	defer client.Close()
+
+	fd, err := client.ListenPacketContext(ctx, "udp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer fd.Close()
+	client.UDPOverTCP = true
+	fdTcp, err := client.ListenPacketContext(ctx, "udp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer fdTcp.Close()
+	l, err := client.ListenContext(ctx, "tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+	assertUDPEcho(t, fd, eAddr)
+	assertUDPEcho(t, fdTcp, eAddr)
+	assertAccept(t, l)
+	lAddr := l.Addr().String()
+
+	// connection lost, then server is back
+	killQUICServer(server)
+	startQUICServer(ctx, sAddr)
+
+	assertUDPEcho(t, fd, eAddr)
+	assertUDPEcho(t, fdTcp, eAddr)
+	assert.Equal(t, lAddr, l.Addr().String())
+	assertAccept(t, l)
+}
+
+func TestQUICRecoveryFail(t *testing.T) {
+	e2etool.WatchDog10s()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	uechoAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeUDP(ctx, uechoAddr, e2etool.UEcho)
+	sAddr, _ := e2etool.GetAddr()
+	server := startQUICServer(ctx, sAddr)
+	client := newQUICClient(sAddr)
+	client.QUICRecoveryTimeout = 500 * time.Millisecond
+	defer client.Close()
+
+	fd, err := client.ListenPacketContext(ctx, "udp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	l, err := client.ListenContext(ctx, "tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assertUDPEcho(t, fd, message.ParseAddr(uechoAddr))
+
+	killQUICServer(server)
+
+	_, _, err = fd.ReadFrom(make([]byte, 10))
+	assert.True(t, errors.Is(err, socks6.ErrConnectionLost), err)
+	_, err = fd.WriteTo([]byte{1}, message.ParseAddr(uechoAddr))
+	assert.True(t, errors.Is(err, socks6.ErrConnectionLost), err)
+	_, err = l.Accept()
+	assert.True(t, errors.Is(err, socks6.ErrConnectionLost), err)
+}
+
+func TestQUICReconnect(t *testing.T) {
+	e2etool.WatchDog10s()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	uechoAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeUDP(ctx, uechoAddr, e2etool.UEcho)
+	echoAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeTCP(ctx, echoAddr, e2etool.Echo)
+	eAddr := message.ParseAddr(uechoAddr)
+	sAddr, _ := e2etool.GetAddr()
+	startQUICServer(ctx, sAddr)
+	client := newQUICClient(sAddr)
+	defer client.Close()
+
+	fd, err := client.ListenPacketContext(ctx, "udp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer fd.Close()
+	l, err := client.ListenContext(ctx, "tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+	c, err := client.DialContext(ctx, "tcp", echoAddr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer c.Close()
+	assertUDPEcho(t, fd, eAddr)
+	lAddr := l.Addr().String()
+	local := fd.LocalAddr().String()
+
+	assert.NoError(t, client.ReconnectQUIC(ctx))
+	assert.NotEqual(t, local, fd.LocalAddr().String())
+	assertUDPEcho(t, fd, eAddr)
+	assert.Equal(t, lAddr, l.Addr().String())
+	assertAccept(t, l)
+
+	// old connection is kept until its last stream closed
+	e2etool.AssertForward(t, c, c)
+	assert.False(t, udpPortFree(local))
+	c.Close()
+	for !udpPortFree(local) {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// udpPortFree report whether nothing listen at UDP port of addr
+func udpPortFree(addr string) bool {
+	_, port, _ := net.SplitHostPort(addr)
+	pc, err := net.ListenPacket("udp", ":"+port)
+	if err != nil {
+		return false
+	}
+	pc.Close()
+	return true
+}
+
+func TestQUICClose(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sAddr, _ := e2etool.GetAddr()
+	startQUICServer(ctx, sAddr)
+	client := newQUICClient(sAddr)
+
+	fd, err := client.ListenPacketContext(ctx, "udp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, client.Close())
+	_, _, err = fd.ReadFrom(make([]byte, 10))
+	assert.True(t, errors.Is(err, net.ErrClosed), err)
+}
+
+func TestQUICFirstRequestDenied(t *testing.T) {
+	e2etool.WatchDog10s()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echoAddr, echoPort := e2etool.GetAddr()
+	go e2etool.ServeTCP(ctx, echoAddr, e2etool.Echo)
+	sAddr, _ := e2etool.GetAddr()
+	rs, err := rule.NewRuleSet([]rule.Rule{
+		{Name: "no-echo", Action: rule.ActionDeny, Port: []string{strconv.Itoa(int(echoPort))}},
+	}, rule.ActionAllow)
+	assert.NoError(t, err)
+	server := &socks6.Server{
+		Listeners: []socks6.ListenerConfig{{Transport: "quic", Address: sAddr}},
+		TlsConfig: e2etool.ServerTLSConfig(),
+		Worker:    e2etool.NewServerWorker(),
+	}
+	server.Worker.Rule = rs
+	server.Start(ctx)
+
+	client := newQUICClient(sAddr)
+	defer client.Close()
+	_, err = client.DialContext(ctx, "tcp", echoAddr)
+	assert.True(t, errors.Is(err, syscall.EACCES), err)
+
+	// server still serving
+	client2 := newQUICClient(sAddr)
+	defer client2.Close()
+	assert.NoError(t, client2.NoopRequest(ctx))
+}
@@ -0,0 +1,127 @@
+package e2e_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/studentmain/socks6"
+	"github.com/studentmain/socks6/e2e/e2etool"
+	"github.com/studentmain/socks6/message"
+	"github.com/studentmain/socks6/resolver"
+)
+
+// startResolveServer start a server accept resolve commands, names are resolved by records
+// or upstream when it's not nil
+func startResolveServer(ctx context.Context, records map[string][]net.IP, upstream *socks6.Client) string {
+	dnsAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeUDP(ctx, dnsAddr, e2etool.UDNS(records))
+
+	sAddr, sPort := e2etool.GetAddr()
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        e2etool.NewServerWorker(),
+	}
+	w := server.Worker
+	w.Outbound = socks6.InternetServerOutbound{
+		Resolver: &resolver.Resolver{Servers: []resolver.Server{{Address: dnsAddr}}},
+	}
+	if upstream != nil {
+		w.Outbound = socks6.Socks6ServerOutbound{Client: upstream}
+	}
+	w.CommandHandlers[message.CommandResolve] = w.ResolveHandler
+	w.CommandHandlers[message.CommandResolvePTR] = w.ResolvePTRHandler
+	w.EnableSocks5 = true
+	server.Start(ctx)
+	return sAddr
+}
+
+func TestResolve(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sAddr := startResolveServer(ctx, map[string][]net.IP{
+		"echo.test.":    {net.ParseIP("127.0.0.1")},
+		"private.test.": {net.ParseIP("10.0.0.1")},
+	}, nil)
+	client := socks6.Client{Server: sAddr}
+
+	ips, err := client.Resolve(ctx, "echo.test")
+	if assert.NoError(t, err) {
+		assert.Equal(t, []net.IP{net.IPv4(127, 0, 0, 1).To4()}, ips)
+	}
+	ips, err = client.Resolve(ctx, "192.0.2.1")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "192.0.2.1", ips[0].String())
+	}
+	// denied by destination policy
+	_, err = client.Resolve(ctx, "private.test")
+	assert.True(t, errors.Is(err, syscall.EACCES), err)
+	_, err = client.Resolve(ctx, "missing.test")
+	assert.True(t, errors.Is(err, syscall.EHOSTUNREACH), err)
+
+	// from hosts file
+	names, err := client.ResolvePTR(ctx, net.IPv4(127, 0, 0, 1))
+	if assert.NoError(t, err) {
+		assert.Contains(t, names, "localhost")
+	}
+	_, err = client.ResolvePTR(ctx, net.ParseIP("10.0.0.1"))
+	assert.True(t, errors.Is(err, syscall.EACCES), err)
+
+	// not registered by default
+	dAddr, dPort := e2etool.GetAddr()
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: dPort,
+		Worker:        e2etool.NewServerWorker(),
+	}
+	server.Start(ctx)
+	client2 := socks6.Client{Server: dAddr}
+	_, err = client2.Resolve(ctx, "echo.test")
+	assert.True(t, errors.Is(err, syscall.EOPNOTSUPP), err)
+}
+
+func TestResolveChain(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cAddr := startResolveServer(ctx, map[string][]net.IP{
+		"echo.test.": {net.ParseIP("127.0.0.1")},
+	}, nil)
+	eAddr := startResolveServer(ctx, nil, &socks6.Client{Server: cAddr})
+
+	client := socks6.Client{Server: eAddr}
+	ips, err := client.Resolve(ctx, "echo.test")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "127.0.0.1", ips[0].String())
+	}
+}
+
+func TestResolveSocks5(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sAddr := startResolveServer(ctx, map[string][]net.IP{
+		"echo.test.": {net.ParseIP("127.0.0.1")},
+	}, nil)
+
+	// Tor style RESOLVE
+	conn, err := net.Dial("tcp", sAddr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	conn.Write([]byte{5, 1, 0})
+	e2etool.AssertRead(t, conn, []byte{5, 0})
+	conn.Write(append(append([]byte{5, 0xf0, 0, 3, 9}, "echo.test"...), 0, 0))
+	rep := make([]byte, 10)
+	_, err = io.ReadFull(conn, rep)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []byte{5, 0, 0, 1, 127, 0, 0, 1, 0, 0}, rep)
+	}
+}
@@ -0,0 +1,102 @@
+package e2e_test
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/studentmain/socks6"
+	"github.com/studentmain/socks6/e2e/e2etool"
+	"github.com/studentmain/socks6/message"
+	"github.com/studentmain/socks6/resolver"
+)
+
+func TestResolverOutbound(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echoAddr, echoPort := e2etool.GetAddr()
+	go e2etool.ServeTCP(ctx, echoAddr, e2etool.Echo)
+
+	sAddr, sPort := e2etool.GetAddr()
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        e2etool.NewServerWorker(),
+	}
+	server.Worker.Outbound = socks6.InternetServerOutbound{
+		Resolver: &resolver.Resolver{
+			Hosts: map[string][]net.IP{
+				"echo.test": {net.IPv4(127, 0, 0, 1)},
+				// nothing listen at ::1, fallback to 127.0.0.1
+				"dual.test": {net.IPv6loopback, net.IPv4(127, 0, 0, 1)},
+			},
+		},
+	}
+	server.Start(ctx)
+	client := socks6.Client{Server: sAddr}
+	port := strconv.Itoa(int(echoPort))
+
+	fd, err := client.Dial("tcp", net.JoinHostPort("echo.test", port))
+	if assert.NoError(t, err) {
+		e2etool.AssertForward(t, fd, fd)
+		fd.Close()
+	}
+
+	ops := message.NewOptionSet()
+	ops.Add(message.Option{Kind: message.OptionKindStack, Data: message.BaseStackOptionData{
+		RemoteLeg: true, Level: message.StackOptionLevelIP, Code: message.StackOptionCodeHappyEyeball,
+		Data: &message.HappyEyeballOptionData{Availability: true},
+	}})
+	conn, err := client.ConnectRequest(ctx, message.ParseAddr(net.JoinHostPort("dual.test", port)), nil, ops)
+	if assert.NoError(t, err) {
+		assert.Equal(t, message.StackOptionInfo{message.StackOptionIPHappyEyeball: true}, conn.(*socks6.ProxyTCPConn).AppliedStackOptions())
+		e2etool.AssertForward(t, conn, conn)
+		conn.Close()
+	}
+}
+
+func TestResolverOutboundTFO(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echoAddr, echoPort := e2etool.GetAddr()
+	go e2etool.ServeTCP(ctx, echoAddr, e2etool.Echo)
+
+	sAddr, sPort := e2etool.GetAddr()
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        e2etool.NewServerWorker(),
+	}
+	server.Worker.Outbound = socks6.InternetServerOutbound{
+		Resolver: &resolver.Resolver{
+			Hosts: map[string][]net.IP{
+				"dual.test": {net.IPv6loopback, net.IPv4(127, 0, 0, 1)},
+			},
+		},
+	}
+	server.Start(ctx)
+	client := socks6.Client{Server: sAddr}
+
+	// initial data in SYN can't be raced, addresses are tried one by one
+	ops := message.NewOptionSet()
+	ops.Add(message.Option{Kind: message.OptionKindStack, Data: message.BaseStackOptionData{
+		RemoteLeg: true, Level: message.StackOptionLevelIP, Code: message.StackOptionCodeHappyEyeball,
+		Data: &message.HappyEyeballOptionData{Availability: true},
+	}})
+	ops.Add(message.Option{Kind: message.OptionKindStack, Data: message.BaseStackOptionData{
+		RemoteLeg: true, Level: message.StackOptionLevelTCP, Code: message.StackOptionCodeTFO,
+		Data: &message.TFOOptionData{PayloadSize: 16},
+	}})
+	addr := message.ParseAddr(net.JoinHostPort("dual.test", strconv.Itoa(int(echoPort))))
+	conn, err := client.ConnectRequest(ctx, addr, []byte("hello"), ops)
+	if assert.NoError(t, err) {
+		assert.Equal(t, false, conn.(*socks6.ProxyTCPConn).AppliedStackOptions()[message.StackOptionIPHappyEyeball])
+		e2etool.AssertRead(t, conn, []byte("hello"))
+		e2etool.AssertForward(t, conn, conn)
+		conn.Close()
+	}
+}
@@ -0,0 +1,105 @@
+package e2e_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/studentmain/socks6"
+	"github.com/studentmain/socks6/auth"
+	"github.com/studentmain/socks6/e2e/e2etool"
+	"github.com/studentmain/socks6/rule"
+)
+
+func TestRouterOutbound(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echoAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeTCP(ctx, echoAddr, e2etool.Echo)
+	blockedAddr, blockedPort := e2etool.GetAddr()
+	go e2etool.ServeTCP(ctx, blockedAddr, e2etool.Echo)
+	// nothing listen here
+	deadAddr, _ := e2etool.GetAddr()
+
+	mustMatch := func(r rule.Rule) *rule.Matcher {
+		m, err := rule.NewMatcher(r)
+		assert.NoError(t, err)
+		return m
+	}
+	direct := socks6.InternetServerOutbound{}
+	lo2 := direct
+	lo2.SourceIP = net.IPv4(127, 0, 0, 2)
+	router, err := socks6.NewRouterServerOutbound(
+		map[string]socks6.ServerOutbound{
+			"direct":    direct,
+			"lo2":       lo2,
+			"dead":      socks6.Socks5ServerOutbound{Server: deadAddr},
+			"blackhole": socks6.BlackholeServerOutbound{},
+		},
+		[]socks6.OutboundRoute{
+			{Name: "blocked", Match: mustMatch(rule.Rule{Port: []string{strconv.Itoa(int(blockedPort))}}), Outbounds: []string{"blackhole"}},
+			{Name: "alice", Match: mustMatch(rule.Rule{ClientId: []string{"alice"}}), Outbounds: []string{"dead", "lo2"}},
+		},
+		[]string{"direct"},
+	)
+	assert.NoError(t, err)
+
+	sAddr, sPort := e2etool.GetAddr()
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        e2etool.NewServerWorker(),
+	}
+	sa := auth.NewServerAuthenticator()
+	sa.AddMethod(auth.PasswordServerAuthenticationMethod{
+		Passwords: map[string]string{"alice": "123456", "bob": "654321"},
+	})
+	server.Worker.Authenticator = sa
+	server.Worker.Outbound = router
+	server.Start(ctx)
+
+	// default route
+	client := socks6.Client{
+		Server: sAddr,
+		AuthenticationMethod: auth.PasswordClientAuthenticationMethod{
+			Username: "bob",
+			Password: "654321",
+		},
+	}
+	fd, err := client.Dial("tcp", echoAddr)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "127.0.0.1", proxyLocalIP(fd))
+		e2etool.AssertForward(t, fd, fd)
+		fd.Close()
+	}
+
+	// blackhole
+	_, err = client.Dial("tcp", blockedAddr)
+	assert.True(t, errors.Is(err, syscall.EACCES))
+
+	// dead upstream, fallback to lo2
+	alice := socks6.Client{
+		Server: sAddr,
+		AuthenticationMethod: auth.PasswordClientAuthenticationMethod{
+			Username: "alice",
+			Password: "123456",
+		},
+	}
+	fd, err = alice.Dial("tcp", echoAddr)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "127.0.0.2", proxyLocalIP(fd))
+		e2etool.AssertForward(t, fd, fd)
+		fd.Close()
+	}
+}
+
+// proxyLocalIP return IP used by server to connect destination
+func proxyLocalIP(c net.Conn) string {
+	host, _, _ := net.SplitHostPort(c.(*socks6.ProxyTCPConn).ProxyLocalAddr().String())
+	return host
+}
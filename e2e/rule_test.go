@@ -0,0 +1,42 @@
+package e2e_test
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/studentmain/socks6"
+	"github.com/studentmain/socks6/e2e/e2etool"
+	"github.com/studentmain/socks6/rule"
+)
+
+func TestRuleDeny(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echoAddr, echoPort := e2etool.GetAddr()
+	go e2etool.ServeTCP(ctx, echoAddr, e2etool.Echo)
+	sAddr, sPort := e2etool.GetAddr()
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        e2etool.NewServerWorker(),
+	}
+	rs, err := rule.NewRuleSet([]rule.Rule{
+		{Name: "no-echo", Action: rule.ActionDeny, Port: []string{strconv.Itoa(int(echoPort))}},
+	}, rule.ActionAllow)
+	assert.NoError(t, err)
+	server.Worker.Rule = rs
+	server.Start(ctx)
+	client := socks6.Client{
+		Server: sAddr,
+	}
+	_, err = client.Dial("tcp", echoAddr)
+	assert.Error(t, err)
+	assert.True(t, errors.Is(err, syscall.EACCES))
+
+	assert.NoError(t, client.NoopRequest(ctx))
+}
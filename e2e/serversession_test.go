@@ -0,0 +1,128 @@
+package e2e_test
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/studentmain/socks6"
+	"github.com/studentmain/socks6/auth"
+	"github.com/studentmain/socks6/e2e/e2etool"
+	"github.com/studentmain/socks6/message"
+	"github.com/studentmain/socks6/rule"
+)
+
+// requestAuthReply send req to server and read authentication reply
+func requestAuthReply(t *testing.T, sAddr string, req *message.Request) *message.AuthenticationReply {
+	c, err := net.Dial("tcp", sAddr)
+	if !assert.NoError(t, err) {
+		return message.NewAuthenticationReply()
+	}
+	defer c.Close()
+	_, err = c.Write(req.Marshal())
+	assert.NoError(t, err)
+	rep, err := message.ParseAuthenticationReplyFrom(c)
+	if !assert.NoError(t, err) {
+		return message.NewAuthenticationReply()
+	}
+	return rep
+}
+
+func TestServerSessionReply(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sAddr, sPort := e2etool.GetAddr()
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        e2etool.NewServerWorker(),
+	}
+	server.Start(ctx)
+
+	authn := func(opts ...message.Option) *message.AuthenticationReply {
+		req := message.NewRequest()
+		req.CommandCode = message.CommandNoop
+		req.Options.AddMany(opts)
+		return requestAuthReply(t, sAddr, req)
+	}
+
+	// session and token window are sent in authentication reply
+	rep := authn(
+		message.Option{Kind: message.OptionKindSessionRequest, Data: message.SessionRequestOptionData{}},
+		message.Option{Kind: message.OptionKindTokenRequest, Data: message.TokenRequestOptionData{WindowSize: 8}},
+	)
+	assert.Equal(t, message.AuthenticationReplySuccess, rep.Type)
+	_, ok := rep.Options.GetData(message.OptionKindSessionOK)
+	assert.True(t, ok)
+	sidData, ok := rep.Options.GetData(message.OptionKindSessionID)
+	if !assert.True(t, ok) {
+		return
+	}
+	windowData, ok := rep.Options.GetData(message.OptionKindIdempotenceWindow)
+	if !assert.True(t, ok) {
+		return
+	}
+	sid := sidData.(message.SessionIDOptionData)
+	base := windowData.(message.IdempotenceWindowOptionData).WindowBase
+
+	spend := []message.Option{
+		{Kind: message.OptionKindSessionID, Data: sid},
+		{Kind: message.OptionKindIdempotenceExpenditure, Data: message.IdempotenceExpenditureOptionData{Token: base}},
+	}
+	rep = authn(spend...)
+	assert.Equal(t, message.AuthenticationReplySuccess, rep.Type)
+	_, ok = rep.Options.GetData(message.OptionKindIdempotenceAccepted)
+	assert.True(t, ok)
+
+	// spent token is rejected, and the rejection is reported
+	rep = authn(spend...)
+	assert.Equal(t, message.AuthenticationReplyFail, rep.Type)
+	_, ok = rep.Options.GetData(message.OptionKindIdempotenceRejected)
+	assert.True(t, ok)
+}
+
+func TestServerSessionDeniedRequest(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echoAddr, echoPort := e2etool.GetAddr()
+	sAddr, sPort := e2etool.GetAddr()
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        e2etool.NewServerWorker(),
+	}
+	rs, err := rule.NewRuleSet([]rule.Rule{
+		{Name: "no-echo", Action: rule.ActionDeny, Port: []string{strconv.Itoa(int(echoPort))}},
+	}, rule.ActionAllow)
+	assert.NoError(t, err)
+	server.Worker.Rule = rs
+	server.Worker.Authenticator.(*auth.DefaultServerAuthenticator).SessionTimeout = 100 * time.Millisecond
+	server.Start(ctx)
+
+	// session started by a request denied by rule
+	req := message.NewRequest()
+	req.CommandCode = message.CommandConnect
+	req.Endpoint = message.ParseAddr(echoAddr)
+	req.Options.Add(message.Option{Kind: message.OptionKindSessionRequest, Data: message.SessionRequestOptionData{}})
+	rep := requestAuthReply(t, sAddr, req)
+	assert.Equal(t, message.AuthenticationReplySuccess, rep.Type)
+	sidData, ok := rep.Options.GetData(message.OptionKindSessionID)
+	if !assert.True(t, ok) {
+		return
+	}
+
+	// released after session timeout
+	time.Sleep(300 * time.Millisecond)
+	req = message.NewRequest()
+	req.CommandCode = message.CommandNoop
+	req.Options.Add(message.Option{Kind: message.OptionKindSessionID, Data: sidData})
+	rep = requestAuthReply(t, sAddr, req)
+	assert.Equal(t, message.AuthenticationReplyFail, rep.Type)
+	_, ok = rep.Options.GetData(message.OptionKindSessionInvalid)
+	assert.True(t, ok)
+}
@@ -0,0 +1,419 @@
+package e2e_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/studentmain/socks6"
+	"github.com/studentmain/socks6/auth"
+	"github.com/studentmain/socks6/e2e/e2etool"
+	"github.com/studentmain/socks6/message"
+	"github.com/studentmain/socks6/rule"
+)
+
+// countingAuthenticator count requests which request a new session, spend a token or teardown session
+type countingAuthenticator struct {
+	auth.ServerAuthenticator
+	sessionRequest int32
+	tokenSpent     int32
+	teardown       int32
+	// reject next token when set to 1
+	rejectToken int32
+}
+
+func (a *countingAuthenticator) Authenticate(
+	ctx context.Context,
+	conn net.Conn,
+	req message.Request,
+) (
+	*auth.ServerAuthenticationResult,
+	*auth.ServerAuthenticationChannels,
+) {
+	if _, ok := req.Options.GetData(message.OptionKindSessionRequest); ok {
+		atomic.AddInt32(&a.sessionRequest, 1)
+	}
+	if _, ok := req.Options.GetData(message.OptionKindIdempotenceExpenditure); ok {
+		if atomic.CompareAndSwapInt32(&a.rejectToken, 1, 0) {
+			return &auth.ServerAuthenticationResult{
+				AdditionalOptions: []message.Option{
+					{Kind: message.OptionKindSessionOK, Data: message.SessionOKOptionData{}},
+					{Kind: message.OptionKindIdempotenceRejected, Data: message.IdempotenceRejectedOptionData{}},
+				},
+			}, nil
+		}
+		atomic.AddInt32(&a.tokenSpent, 1)
+	}
+	if _, ok := req.Options.GetData(message.OptionKindSessionTeardown); ok {
+		atomic.AddInt32(&a.teardown, 1)
+	}
+	return a.ServerAuthenticator.Authenticate(ctx, conn, req)
+}
+
+func startSessionServer(ctx context.Context) (string, *countingAuthenticator) {
+	sAddr, sPort := e2etool.GetAddr()
+	w := e2etool.NewServerWorker()
+	ca := &countingAuthenticator{ServerAuthenticator: w.Authenticator}
+	w.Authenticator = ca
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        w,
+	}
+	server.Start(ctx)
+	return sAddr, ca
+}
+
+func TestSessionConcurrent(t *testing.T) {
+	e2etool.WatchDog10s()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echoAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeTCP(ctx, echoAddr, e2etool.Echo)
+	sAddr, ca := startSessionServer(ctx)
+
+	client := socks6.Client{
+		Server:     sAddr,
+		UseSession: true,
+		UseToken:   256,
+	}
+	wg := sync.WaitGroup{}
+	for i := 0; i < 64; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c, err := client.DialContext(ctx, "tcp", echoAddr)
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer c.Close()
+			e2etool.AssertForward(t, c, c)
+		}()
+	}
+	wg.Wait()
+
+	// single session shared by all requests, and all other requests spent a token
+	assert.EqualValues(t, 1, atomic.LoadInt32(&ca.sessionRequest))
+	assert.EqualValues(t, 63, atomic.LoadInt32(&ca.tokenSpent))
+}
+
+func TestSessionConcurrentNoToken(t *testing.T) {
+	e2etool.WatchDog10s()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sAddr, ca := startSessionServer(ctx)
+
+	client := socks6.Client{
+		Server:     sAddr,
+		UseSession: true,
+	}
+	wg := sync.WaitGroup{}
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, client.NoopRequest(ctx))
+		}()
+	}
+	wg.Wait()
+
+	assert.EqualValues(t, 1, atomic.LoadInt32(&ca.sessionRequest))
+	assert.EqualValues(t, 0, atomic.LoadInt32(&ca.tokenSpent))
+}
+
+func TestSessionRetryInvalid(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sAddr, ca := startSessionServer(ctx)
+
+	client := socks6.Client{
+		Server:     sAddr,
+		UseSession: true,
+		UseToken:   16,
+	}
+	assert.NoError(t, client.NoopRequest(ctx))
+	old := client.SessionState().ID
+	assert.NotEmpty(t, old)
+
+	// session removed by server
+	c, err := net.Dial("tcp", sAddr)
+	assert.NoError(t, err)
+	req := message.Request{
+		CommandCode: message.CommandNoop,
+		Endpoint:    message.DefaultAddr,
+		Options:     message.NewOptionSet(),
+	}
+	req.Options.Add(message.Option{Kind: message.OptionKindSessionID, Data: message.SessionIDOptionData{ID: old}})
+	req.Options.Add(message.Option{Kind: message.OptionKindSessionTeardown, Data: message.SessionTeardownOptionData{}})
+	_, err = c.Write(req.Marshal())
+	assert.NoError(t, err)
+	rep, err := message.ParseAuthenticationReplyFrom(c)
+	assert.NoError(t, err)
+	assert.Equal(t, message.AuthenticationReplyFail, rep.Type)
+	c.Close()
+
+	// transparently retried with new session
+	assert.NoError(t, client.NoopRequest(ctx))
+	state := client.SessionState()
+	assert.NotEmpty(t, state.ID)
+	assert.NotEqual(t, old, state.ID)
+	assert.EqualValues(t, 2, atomic.LoadInt32(&ca.sessionRequest))
+}
+
+func TestSessionTokenRefill(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sAddr, ca := startSessionServer(ctx)
+
+	client := socks6.Client{
+		Server:     sAddr,
+		UseSession: true,
+		UseToken:   16,
+	}
+	for i := 0; i < 100; i++ {
+		assert.NoError(t, client.NoopRequest(ctx))
+	}
+	// window is refilled before tokens run out, every request except first spent a token
+	assert.EqualValues(t, 1, atomic.LoadInt32(&ca.sessionRequest))
+	assert.EqualValues(t, 99, atomic.LoadInt32(&ca.tokenSpent))
+	assert.NotZero(t, client.SessionState().Tokens)
+}
+
+func TestSessionRetryTokenRejected(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sAddr, ca := startSessionServer(ctx)
+
+	client := socks6.Client{
+		Server:     sAddr,
+		UseSession: true,
+		UseToken:   16,
+	}
+	assert.NoError(t, client.NoopRequest(ctx))
+	assert.NoError(t, client.NoopRequest(ctx))
+	assert.EqualValues(t, 1, atomic.LoadInt32(&ca.tokenSpent))
+
+	atomic.StoreInt32(&ca.rejectToken, 1)
+	// retried without token, and get window again
+	assert.NoError(t, client.NoopRequest(ctx))
+	assert.EqualValues(t, 1, atomic.LoadInt32(&ca.tokenSpent))
+	assert.NotZero(t, client.SessionState().Tokens)
+
+	// tokens are spent again
+	assert.NoError(t, client.NoopRequest(ctx))
+	assert.EqualValues(t, 2, atomic.LoadInt32(&ca.tokenSpent))
+	assert.EqualValues(t, 1, atomic.LoadInt32(&ca.sessionRequest))
+}
+
+func TestSessionClose(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sAddr, ca := startSessionServer(ctx)
+
+	client := socks6.Client{
+		Server:     sAddr,
+		UseSession: true,
+	}
+	assert.NoError(t, client.NoopRequest(ctx))
+	assert.NotEmpty(t, client.SessionState().ID)
+
+	assert.NoError(t, client.Close())
+	assert.EqualValues(t, 1, atomic.LoadInt32(&ca.teardown))
+	state := client.SessionState()
+	assert.True(t, state.Closed)
+	assert.Empty(t, state.ID)
+
+	err := client.NoopRequest(ctx)
+	assert.True(t, errors.Is(err, net.ErrClosed))
+	assert.True(t, errors.Is(client.Close(), net.ErrClosed))
+}
+
+func TestSessionNotSupported(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sAddr, sPort := e2etool.GetAddr()
+	w := e2etool.NewServerWorker()
+	w.Authenticator.(*auth.DefaultServerAuthenticator).DisableSession = true
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        w,
+	}
+	server.Start(ctx)
+
+	client := socks6.Client{
+		Server:     sAddr,
+		UseSession: true,
+		UseToken:   16,
+	}
+	assert.NoError(t, client.NoopRequest(ctx))
+	assert.NoError(t, client.NoopRequest(ctx))
+	assert.Empty(t, client.SessionState().ID)
+	assert.NoError(t, client.Close())
+}
+
+func TestSessionClientRule(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echoAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeTCP(ctx, echoAddr, e2etool.Echo)
+	deniedAddr, deniedPort := e2etool.GetAddr()
+	go e2etool.ServeTCP(ctx, deniedAddr, e2etool.Echo)
+
+	sAddr, sPort := e2etool.GetAddr()
+	w := e2etool.NewServerWorker()
+	sa := auth.NewServerAuthenticator()
+	sa.AddMethod(auth.PasswordServerAuthenticationMethod{Passwords: map[string]string{"alice": "123456"}})
+	w.Authenticator = sa
+	rs, err := rule.NewRuleSet([]rule.Rule{
+		{Name: "alice-no-echo", Action: rule.ActionDeny, ClientId: []string{"alice"}, Port: []string{strconv.Itoa(int(deniedPort))}},
+	}, rule.ActionAllow)
+	assert.NoError(t, err)
+	w.Rule = rs
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        w,
+	}
+	server.Start(ctx)
+
+	client := socks6.Client{
+		Server:     sAddr,
+		UseSession: true,
+		AuthenticationMethod: auth.PasswordClientAuthenticationMethod{
+			Username: "alice",
+			Password: "123456",
+		},
+	}
+	fd, err := client.Dial("tcp", echoAddr)
+	if assert.NoError(t, err) {
+		fd.Close()
+	}
+	assert.NotEmpty(t, client.SessionState().ID)
+	// request authenticated by session is still made by alice
+	_, err = client.Dial("tcp", deniedAddr)
+	assert.True(t, errors.Is(err, syscall.EACCES))
+}
+
+// blockingOutbound block dialing to addr until release is closed
+type blockingOutbound struct {
+	socks6.ServerOutbound
+	addr    string
+	dialing chan struct{}
+	release chan struct{}
+}
+
+func (b blockingOutbound) Dial(ctx context.Context, option message.StackOptionInfo, addr *message.SocksAddr) (net.Conn, message.StackOptionInfo, error) {
+	if addr.String() == b.addr {
+		close(b.dialing)
+		<-b.release
+	}
+	return b.ServerOutbound.Dial(ctx, option, addr)
+}
+
+// blockingAuthenticator block next authentication after armed, until release is closed
+type blockingAuthenticator struct {
+	auth.ServerAuthenticator
+	armed          int32
+	authenticating chan struct{}
+	release        chan struct{}
+}
+
+func (a *blockingAuthenticator) Authenticate(
+	ctx context.Context,
+	conn net.Conn,
+	req message.Request,
+) (
+	*auth.ServerAuthenticationResult,
+	*auth.ServerAuthenticationChannels,
+) {
+	if atomic.CompareAndSwapInt32(&a.armed, 1, 0) {
+		close(a.authenticating)
+		<-a.release
+	}
+	return a.ServerAuthenticator.Authenticate(ctx, conn, req)
+}
+
+func TestSessionNotSupportedConcurrent(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echoAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeTCP(ctx, echoAddr, e2etool.Echo)
+	slowAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeTCP(ctx, slowAddr, e2etool.Echo)
+
+	sAddr, sPort := e2etool.GetAddr()
+	w := e2etool.NewServerWorker()
+	w.Authenticator.(*auth.DefaultServerAuthenticator).DisableSession = true
+	ba := &blockingAuthenticator{
+		ServerAuthenticator: w.Authenticator,
+		authenticating:      make(chan struct{}),
+		release:             make(chan struct{}),
+	}
+	w.Authenticator = ba
+	ob := blockingOutbound{
+		ServerOutbound: w.Outbound,
+		addr:           slowAddr,
+		dialing:        make(chan struct{}),
+		release:        make(chan struct{}),
+	}
+	w.Outbound = ob
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        w,
+	}
+	server.Start(ctx)
+
+	client := socks6.Client{
+		Server:     sAddr,
+		UseSession: true,
+	}
+	dialDone := make(chan error, 1)
+	go func() {
+		fd, err := client.Dial("tcp", slowAddr)
+		if err == nil {
+			fd.Close()
+		}
+		dialDone <- err
+	}()
+	<-ob.dialing
+	// first request is authenticated without session, others don't wait its operation reply
+	rctx, rcancel := context.WithTimeout(ctx, 300*time.Millisecond)
+	defer rcancel()
+	fd, err := client.DialContext(rctx, "tcp", echoAddr)
+	if assert.NoError(t, err) {
+		e2etool.AssertForward(t, fd, fd)
+		fd.Close()
+	}
+	close(ob.release)
+	assert.NoError(t, <-dialDone)
+	assert.Empty(t, client.SessionState().ID)
+
+	// session is declined, requests don't wait another request's authentication
+	atomic.StoreInt32(&ba.armed, 1)
+	authnDone := make(chan error, 1)
+	go func() {
+		authnDone <- client.NoopRequest(ctx)
+	}()
+	<-ba.authenticating
+	rctx2, rcancel2 := context.WithTimeout(ctx, 300*time.Millisecond)
+	defer rcancel2()
+	assert.NoError(t, client.NoopRequest(rctx2))
+	close(ba.release)
+	assert.NoError(t, <-authnDone)
+}
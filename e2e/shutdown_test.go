@@ -0,0 +1,122 @@
+package e2e_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/studentmain/socks6"
+	"github.com/studentmain/socks6/e2e/e2etool"
+)
+
+func TestShutdown(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echoAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeTCP(ctx, echoAddr, e2etool.Echo)
+	sAddr, sPort := e2etool.GetAddr()
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        e2etool.NewServerWorker(),
+	}
+	server.Start(ctx)
+	client := socks6.Client{
+		Server: sAddr,
+	}
+	fd, err := client.Dial("tcp", echoAddr)
+	assert.NoError(t, err)
+
+	done := make(chan int)
+	go func() {
+		sctx, scancel := context.WithTimeout(ctx, 300*time.Millisecond)
+		defer scancel()
+		n, err := server.Shutdown(sctx)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		done <- n
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// no new connection
+	_, err = client.Dial("tcp", echoAddr)
+	assert.Error(t, err)
+	// existing relay still work
+	e2etool.AssertForward(t, fd, fd)
+
+	assert.Equal(t, 1, <-done)
+	e2etool.AssertClosed(t, fd)
+}
+
+func TestShutdownIdle(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, sPort := e2etool.GetAddr()
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        e2etool.NewServerWorker(),
+	}
+	server.Start(ctx)
+	n, err := server.Shutdown(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+	assert.True(t, server.Worker.Draining())
+}
+
+func TestShutdownRefuse(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sAddr, sPort := e2etool.GetAddr()
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        e2etool.NewServerWorker(),
+	}
+	server.Start(ctx)
+	client := socks6.Client{
+		Server: sAddr,
+	}
+	assert.NoError(t, client.NoopRequest(ctx))
+	// listener still accepting, worker refuse request
+	_, err := server.Worker.Shutdown(ctx)
+	assert.NoError(t, err)
+	assert.Error(t, client.NoopRequest(ctx))
+}
+
+func TestShutdownQUIC(t *testing.T) {
+	e2etool.WatchDog10s()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echoAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeTCP(ctx, echoAddr, e2etool.Echo)
+	sAddr, _ := e2etool.GetAddr()
+	server := startQUICServer(ctx, sAddr)
+	client := newQUICClient(sAddr)
+	fd, err := client.Dial("tcp", echoAddr)
+	assert.NoError(t, err)
+
+	done := make(chan int)
+	go func() {
+		sctx, scancel := context.WithTimeout(ctx, time.Second)
+		defer scancel()
+		n, err := server.Shutdown(sctx)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		done <- n
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// QUIC connection is kept, existing relay still work
+	e2etool.AssertForward(t, fd, fd)
+	// no new connection or request
+	_, err = newQUICClient(sAddr).Dial("tcp", echoAddr)
+	assert.Error(t, err)
+	_, err = client.Dial("tcp", echoAddr)
+	assert.Error(t, err)
+
+	assert.NotZero(t, <-done)
+	e2etool.AssertClosed(t, fd)
+}
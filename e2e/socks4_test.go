@@ -0,0 +1,104 @@
+package e2e_test
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/studentmain/socks6"
+	"github.com/studentmain/socks6/e2e/e2etool"
+	"github.com/studentmain/socks6/message"
+)
+
+// socks4Request send a SOCKS 4 request and read first reply
+func socks4Request(t *testing.T, server string, cmd byte, addr string) (net.Conn, []byte) {
+	conn, err := net.Dial("tcp", server)
+	if !assert.NoError(t, err) {
+		return nil, nil
+	}
+	a := message.ParseAddr(addr)
+	req := []byte{4, cmd, 0, 0}
+	binary.BigEndian.PutUint16(req[2:], a.Port)
+	req = append(req, a.Address...)
+	req = append(req, 0)
+	conn.Write(req)
+	rep := make([]byte, 8)
+	if _, err = io.ReadFull(conn, rep); err != nil {
+		conn.Close()
+		return nil, nil
+	}
+	return conn, rep
+}
+
+func TestSocks4Client(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echoAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeTCP(ctx, echoAddr, e2etool.Echo)
+
+	sAddr, sPort := e2etool.GetAddr()
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        e2etool.NewServerWorker(),
+	}
+	server.Worker.EnableSocks4 = true
+	server.Start(ctx)
+
+	// connect
+	conn, rep := socks4Request(t, sAddr, 1, echoAddr)
+	if assert.NotNil(t, conn) {
+		assert.EqualValues(t, 90, rep[1])
+		e2etool.AssertForward(t, conn, conn)
+		conn.Close()
+	}
+
+	// bind
+	conn, rep = socks4Request(t, sAddr, 2, "127.0.0.1:0")
+	if assert.NotNil(t, conn) {
+		assert.EqualValues(t, 90, rep[1])
+		bindAddr := &net.TCPAddr{IP: net.IP(rep[4:8]), Port: int(binary.BigEndian.Uint16(rep[2:4]))}
+		dialer := net.Dialer{Timeout: time.Second}
+		testFd, err := dialer.Dial("tcp", bindAddr.String())
+		if assert.NoError(t, err) {
+			_, err = io.ReadFull(conn, rep)
+			assert.NoError(t, err)
+			assert.EqualValues(t, 90, rep[1])
+			assert.EqualValues(t, testFd.LocalAddr().(*net.TCPAddr).Port, binary.BigEndian.Uint16(rep[2:4]))
+			e2etool.AssertForward2(t, conn, testFd)
+			testFd.Close()
+		}
+		conn.Close()
+	}
+
+	// unknown command
+	conn, rep = socks4Request(t, sAddr, 3, echoAddr)
+	if assert.NotNil(t, conn) {
+		assert.EqualValues(t, 91, rep[1])
+		conn.Close()
+	}
+}
+
+func TestSocks4Disabled(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sAddr, sPort := e2etool.GetAddr()
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        e2etool.NewServerWorker(),
+	}
+	server.Start(ctx)
+
+	conn, rep := socks4Request(t, sAddr, 1, "127.0.0.1:1")
+	if assert.NotNil(t, conn) {
+		assert.Equal(t, []byte{0, 91}, rep[:2])
+		conn.Close()
+	}
+}
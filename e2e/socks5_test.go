@@ -0,0 +1,141 @@
+package e2e_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/studentmain/socks6"
+	"github.com/studentmain/socks6/auth"
+	"github.com/studentmain/socks6/e2e/e2etool"
+	"github.com/studentmain/socks6/message"
+	"github.com/studentmain/socks6/rule"
+)
+
+func TestSocks5Client(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echoAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeTCP(ctx, echoAddr, e2etool.Echo)
+	uechoAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeUDP(ctx, uechoAddr, e2etool.UEcho)
+
+	sAddr, sPort := e2etool.GetAddr()
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        e2etool.NewServerWorker(),
+	}
+	sa := auth.NewServerAuthenticator()
+	sa.AddMethod(auth.PasswordServerAuthenticationMethod{
+		Passwords: map[string]string{"alice": "123456"},
+	})
+	server.Worker.Authenticator = sa
+	server.Worker.EnableSocks5 = true
+	server.Start(ctx)
+	client := socks6.Socks5ServerOutbound{Server: sAddr, Username: "alice", Password: "123456"}
+	echo := message.ParseAddr(echoAddr)
+
+	// connect
+	fd, _, err := client.Dial(ctx, message.StackOptionInfo{}, echo)
+	if assert.NoError(t, err) {
+		e2etool.AssertForward(t, fd, fd)
+		fd.Close()
+	}
+
+	// bind
+	l, _, err := client.Listen(ctx, message.StackOptionInfo{}, message.ParseAddr("127.0.0.1:0"))
+	if assert.NoError(t, err) {
+		dialer := net.Dialer{Timeout: time.Second}
+		testFd, err := dialer.Dial("tcp", l.Addr().String())
+		assert.NoError(t, err)
+		clientFd, err := l.Accept()
+		if assert.NoError(t, err) {
+			e2etool.AssertForward2(t, clientFd, testFd)
+			clientFd.Close()
+		}
+		testFd.Close()
+	}
+
+	// udp
+	pc, _, err := client.ListenPacket(ctx, message.StackOptionInfo{}, message.ParseAddr("0.0.0.0:0"))
+	if assert.NoError(t, err) {
+		ua := message.ParseAddr(uechoAddr)
+		pc.WriteTo([]byte{1, 2}, ua)
+		buf := make([]byte, 10)
+		n, a, err := pc.ReadFrom(buf)
+		if assert.NoError(t, err) {
+			assert.Equal(t, []byte{1, 2}, buf[:n])
+			assert.Equal(t, ua.String(), a.String())
+		}
+		pc.Close()
+	}
+
+	// wrong password and no authentication
+	for _, c := range []socks6.Socks5ServerOutbound{
+		{Server: sAddr, Username: "alice", Password: "654321"},
+		{Server: sAddr},
+	} {
+		_, _, err = c.Dial(ctx, message.StackOptionInfo{}, echo)
+		assert.Error(t, err)
+	}
+
+	// socks 6 client still work
+	fd, err = (&socks6.Client{
+		Server: sAddr,
+		AuthenticationMethod: auth.PasswordClientAuthenticationMethod{
+			Username: "alice",
+			Password: "123456",
+		},
+	}).Dial("tcp", echoAddr)
+	if assert.NoError(t, err) {
+		e2etool.AssertForward(t, fd, fd)
+		fd.Close()
+	}
+}
+
+func TestSocks5ClientRule(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echoAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeTCP(ctx, echoAddr, e2etool.Echo)
+
+	sAddr, sPort := e2etool.GetAddr()
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        e2etool.NewServerWorker(),
+	}
+	rs, err := rule.NewRuleSet([]rule.Rule{
+		{Name: "connect-only", Action: rule.ActionAllow, Command: []string{"connect"}},
+	}, rule.ActionDeny)
+	assert.NoError(t, err)
+	server.Worker.Rule = rs
+	server.Worker.EnableSocks5 = true
+	server.Start(ctx)
+	client := socks6.Socks5ServerOutbound{Server: sAddr}
+
+	fd, _, err := client.Dial(ctx, message.StackOptionInfo{}, message.ParseAddr(echoAddr))
+	if assert.NoError(t, err) {
+		e2etool.AssertForward(t, fd, fd)
+		fd.Close()
+	}
+	_, _, err = client.Listen(ctx, message.StackOptionInfo{}, message.ParseAddr("127.0.0.1:0"))
+	assert.Error(t, err)
+
+	// disabled by default
+	s6Addr, s6Port := e2etool.GetAddr()
+	s6 := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: s6Port,
+		Worker:        e2etool.NewServerWorker(),
+	}
+	s6.Start(ctx)
+	client.Server = s6Addr
+	_, _, err = client.Dial(ctx, message.StackOptionInfo{}, message.ParseAddr(echoAddr))
+	assert.Error(t, err)
+}
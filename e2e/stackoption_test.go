@@ -0,0 +1,141 @@
+package e2e_test
+
+import (
+	"context"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/studentmain/socks6"
+	"github.com/studentmain/socks6/e2e/e2etool"
+	"github.com/studentmain/socks6/message"
+)
+
+// ipStackOptions create TOS, TTL and no fragment options on given legs
+func ipStackOptions(clientLeg, remoteLeg bool) *message.OptionSet {
+	ops := message.NewOptionSet()
+	for _, d := range []message.BaseStackOptionData{
+		{Level: message.StackOptionLevelIP, Code: message.StackOptionCodeTOS, Data: &message.TOSOptionData{TOS: 0x20}},
+		{Level: message.StackOptionLevelIP, Code: message.StackOptionCodeTTL, Data: &message.TTLOptionData{TTL: 42}},
+		{Level: message.StackOptionLevelIP, Code: message.StackOptionCodeNoFragment, Data: &message.NoFragmentationOptionData{Availability: true}},
+	} {
+		d.ClientLeg = clientLeg
+		d.RemoteLeg = remoteLeg
+		ops.Add(message.Option{Kind: message.OptionKindStack, Data: d})
+	}
+	return ops
+}
+
+func TestIPStackOption(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("IP stack options are only implemented on linux")
+	}
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echoAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeTCP(ctx, echoAddr, e2etool.Echo)
+	uechoAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeUDP(ctx, uechoAddr, e2etool.UEcho)
+	sAddr, sPort := e2etool.GetAddr()
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        e2etool.NewServerWorker(),
+	}
+	server.Start(ctx)
+	client := socks6.Client{Server: sAddr}
+	expected := message.StackOptionInfo{
+		message.StackOptionIPTOS:        byte(0x20),
+		message.StackOptionIPTTL:        byte(42),
+		message.StackOptionIPNoFragment: true,
+	}
+
+	fd, err := client.ConnectRequest(ctx, message.ParseAddr(echoAddr), nil, ipStackOptions(true, true))
+	if assert.NoError(t, err) {
+		assert.Equal(t, expected, fd.(*socks6.ProxyTCPConn).AppliedStackOptions())
+		e2etool.AssertForward(t, fd, fd)
+		fd.Close()
+	}
+
+	// client leg only, remote leg untouched
+	fd, err = client.ConnectRequest(ctx, message.ParseAddr(echoAddr), nil, ipStackOptions(true, false))
+	if assert.NoError(t, err) {
+		assert.Empty(t, fd.(*socks6.ProxyTCPConn).AppliedStackOptions())
+		fd.Close()
+	}
+
+	l, err := client.BindRequest(ctx, message.ParseAddr("127.0.0.1:0"), ipStackOptions(false, true))
+	if assert.NoError(t, err) {
+		assert.Equal(t, expected, l.AppliedStackOptions())
+		l.Close()
+	}
+
+	pc, err := client.UDPAssociateRequest(ctx, message.ParseAddr("127.0.0.1:0"), ipStackOptions(false, true))
+	if assert.NoError(t, err) {
+		assert.Equal(t, expected, pc.AppliedStackOptions())
+		ua := message.ParseAddr(uechoAddr)
+		pc.WriteTo([]byte{1}, ua)
+		buf := make([]byte, 10)
+		n, _, err := pc.ReadFrom(buf)
+		assert.NoError(t, err)
+		assert.EqualValues(t, 1, n)
+		pc.Close()
+	}
+}
+
+func TestTCPStackOption(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("TCP stack options are only implemented on linux")
+	}
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echoAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeTCP(ctx, echoAddr, e2etool.Echo)
+	sAddr, sPort := e2etool.GetAddr()
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        e2etool.NewServerWorker(),
+	}
+	server.Start(ctx)
+	client := socks6.Client{Server: sAddr}
+
+	ops := message.NewOptionSet()
+	ops.Add(message.Option{Kind: message.OptionKindStack, Data: message.BaseStackOptionData{
+		RemoteLeg: true, Level: message.StackOptionLevelTCP, Code: message.StackOptionCodeTFO,
+		Data: &message.TFOOptionData{PayloadSize: 4},
+	}})
+	ops.Add(message.Option{Kind: message.OptionKindStack, Data: message.BaseStackOptionData{
+		RemoteLeg: true, Level: message.StackOptionLevelTCP, Code: message.StackOptionCodeMultipath,
+		Data: &message.MultipathOptionData{Availability: true},
+	}})
+	// initial data is sent in SYN or after connected
+	fd, err := client.ConnectRequest(ctx, message.ParseAddr(echoAddr), []byte("hello"), ops)
+	if assert.NoError(t, err) {
+		applied := fd.(*socks6.ProxyTCPConn).AppliedStackOptions()
+		assert.Contains(t, applied, message.StackOptionTCPMultipath)
+		e2etool.AssertRead(t, fd, []byte("hello"))
+		e2etool.AssertForward(t, fd, fd)
+		fd.Close()
+	}
+
+	ops = message.NewOptionSet()
+	ops.Add(message.Option{Kind: message.OptionKindStack, Data: message.BaseStackOptionData{
+		RemoteLeg: true, Level: message.StackOptionLevelTCP, Code: message.StackOptionCodeTFO,
+		Data: &message.TFOOptionData{PayloadSize: 16},
+	}})
+	ops.Add(message.Option{Kind: message.OptionKindStack, Data: message.BaseStackOptionData{
+		RemoteLeg: true, Level: message.StackOptionLevelTCP, Code: message.StackOptionCodeBacklog,
+		Data: &message.BacklogOptionData{Backlog: 3},
+	}})
+	l, err := client.BindRequest(ctx, message.ParseAddr("127.0.0.1:0"), ops)
+	if assert.NoError(t, err) {
+		assert.Equal(t, message.StackOptionInfo{
+			message.StackOptionTCPTFO:     uint16(16),
+			message.StackOptionTCPBacklog: uint16(3),
+		}, l.AppliedStackOptions())
+		l.Close()
+	}
+}
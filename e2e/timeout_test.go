@@ -0,0 +1,213 @@
+package e2e_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/studentmain/socks6"
+	"github.com/studentmain/socks6/auth"
+	"github.com/studentmain/socks6/e2e/e2etool"
+	"github.com/studentmain/socks6/message"
+)
+
+func TestRelayIdleTimeout(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echoAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeTCP(ctx, echoAddr, e2etool.Echo)
+	sAddr, sPort := e2etool.GetAddr()
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        e2etool.NewServerWorker(),
+	}
+	server.Worker.CommandTimeouts = map[message.CommandCode]socks6.Timeouts{
+		message.CommandConnect: {Idle: 100 * time.Millisecond},
+	}
+	server.Start(ctx)
+	client := socks6.Client{
+		Server: sAddr,
+	}
+	fd, err := client.Dial("tcp", echoAddr)
+	assert.NoError(t, err)
+	defer fd.Close()
+	e2etool.AssertWrite(t, fd, []byte{1})
+	e2etool.AssertRead(t, fd, []byte{1})
+
+	time.Sleep(250 * time.Millisecond)
+	e2etool.AssertClosed(t, fd)
+}
+
+func TestRelayLifetime(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echoAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeTCP(ctx, echoAddr, e2etool.Echo)
+	sAddr, sPort := e2etool.GetAddr()
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        e2etool.NewServerWorker(),
+	}
+	server.Worker.Timeouts.Lifetime = 200 * time.Millisecond
+	server.Start(ctx)
+	client := socks6.Client{
+		Server: sAddr,
+	}
+	fd, err := client.Dial("tcp", echoAddr)
+	assert.NoError(t, err)
+	defer fd.Close()
+
+	// active relay is still closed after lifetime
+	start := time.Now()
+	buf := []byte{0}
+	for time.Since(start) < 600*time.Millisecond {
+		if _, err = fd.Write(buf); err != nil {
+			break
+		}
+		if _, err = fd.Read(buf); err != nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	assert.Error(t, err)
+	assert.Less(t, time.Since(start), 500*time.Millisecond)
+}
+
+func TestBindAcceptTimeout(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sAddr, sPort := e2etool.GetAddr()
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        e2etool.NewServerWorker(),
+	}
+	server.Worker.CommandTimeouts = map[message.CommandCode]socks6.Timeouts{
+		message.CommandBind: {BindAccept: 100 * time.Millisecond},
+	}
+	server.Start(ctx)
+	client := socks6.Client{
+		Server: sAddr,
+	}
+	l, err := client.Listen("tcp", "0.0.0.0:0")
+	assert.NoError(t, err)
+	start := time.Now()
+	_, err = l.Accept()
+	assert.Error(t, err)
+	assert.Less(t, time.Since(start), 500*time.Millisecond)
+}
+
+func TestHandshakeTimeoutNotOverridden(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sAddr, sPort := e2etool.GetAddr()
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        e2etool.NewServerWorker(),
+	}
+	// NOOP override only apply to NOOP command, not handshake of every request
+	server.Worker.CommandTimeouts = map[message.CommandCode]socks6.Timeouts{
+		message.CommandNoop: {Handshake: 50 * time.Millisecond},
+	}
+	server.Start(ctx)
+	c, err := net.Dial("tcp", sAddr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer c.Close()
+	time.Sleep(150 * time.Millisecond)
+	req := message.Request{
+		CommandCode: message.CommandNoop,
+		Endpoint:    message.DefaultAddr,
+		Options:     message.NewOptionSet(),
+	}
+	_, err = c.Write(req.Marshal())
+	assert.NoError(t, err)
+	rep, err := message.ParseAuthenticationReplyFrom(c)
+	if assert.NoError(t, err) {
+		assert.Equal(t, message.AuthenticationReplySuccess, rep.Type)
+	}
+}
+
+const authIdStall = 0xab
+
+// stallServerAuthenticationMethod never finish stage 2 until its context done
+type stallServerAuthenticationMethod struct {
+	done chan struct{}
+}
+
+func (s stallServerAuthenticationMethod) Authenticate(
+	ctx context.Context,
+	conn net.Conn,
+	data []byte,
+	sac *auth.ServerAuthenticationChannels,
+) {
+	sac.Result <- auth.ServerAuthenticationResult{Continue: true}
+	if !<-sac.Continue {
+		sac.Err <- nil
+		return
+	}
+	<-ctx.Done()
+	sac.Err <- ctx.Err()
+	close(s.done)
+}
+
+func (s stallServerAuthenticationMethod) ID() byte {
+	return authIdStall
+}
+
+type stallClientAuthenticationMethod struct{}
+
+func (s stallClientAuthenticationMethod) Authenticate(
+	ctx context.Context,
+	conn net.Conn,
+	cac auth.ClientAuthenticationChannels,
+) {
+	cac.Data <- []byte{}
+	<-cac.FirstAuthReply
+	r, e := message.ParseAuthenticationReplyFrom(conn)
+	cac.FinalAuthReply <- r
+	cac.Error <- e
+}
+
+func (s stallClientAuthenticationMethod) ID() byte {
+	return authIdStall
+}
+
+func TestAuthenticationTimeout(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sAddr, sPort := e2etool.GetAddr()
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        e2etool.NewServerWorker(),
+	}
+	method := stallServerAuthenticationMethod{done: make(chan struct{})}
+	sa := auth.NewServerAuthenticator()
+	sa.AddMethod(method)
+	server.Worker.Authenticator = sa
+	server.Worker.Timeouts.Authentication = 100 * time.Millisecond
+	server.Start(ctx)
+	client := socks6.Client{
+		Server:               sAddr,
+		AuthenticationMethod: stallClientAuthenticationMethod{},
+	}
+	assert.Error(t, client.NoopRequest(ctx))
+	// method is stopped after timeout
+	select {
+	case <-method.done:
+	case <-time.After(time.Second):
+		assert.Fail(t, "authentication method not stopped")
+	}
+}
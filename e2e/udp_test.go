@@ -20,7 +20,7 @@ func TestUDP(t *testing.T) {
 	server := socks6.Server{
 		Address:       "127.0.0.1",
 		CleartextPort: sPort,
-		Worker:        socks6.NewServerWorker(),
+		Worker:        e2etool.NewServerWorker(),
 	}
 	server.Start(ctx)
 	client := socks6.Client{
@@ -51,7 +51,7 @@ func TestUDPOverTCP(t *testing.T) {
 	server := socks6.Server{
 		Address:       "127.0.0.1",
 		CleartextPort: sPort,
-		Worker:        socks6.NewServerWorker(),
+		Worker:        e2etool.NewServerWorker(),
 	}
 	server.Start(ctx)
 	client := socks6.Client{
@@ -0,0 +1,144 @@
+package e2e_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/studentmain/socks6"
+	"github.com/studentmain/socks6/e2e/e2etool"
+	"github.com/studentmain/socks6/message"
+)
+
+// startUpstreamEdge start a server forward everything to ob, return its address
+func startUpstreamEdge(ctx context.Context, ob socks6.ServerOutbound) string {
+	sAddr, sPort := e2etool.GetAddr()
+	server := socks6.Server{
+		Address:       "127.0.0.1",
+		CleartextPort: sPort,
+		Worker:        e2etool.NewServerWorker(),
+	}
+	server.Worker.Outbound = ob
+	server.Start(ctx)
+	return sAddr
+}
+
+func TestSocks5Upstream(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echoAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeTCP(ctx, echoAddr, e2etool.Echo)
+	uechoAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeUDP(ctx, uechoAddr, e2etool.UEcho)
+	upAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeTCP(ctx, upAddr, e2etool.Socks5("user", "pass"))
+
+	sAddr := startUpstreamEdge(ctx, socks6.Socks5ServerOutbound{
+		Server:   upAddr,
+		Username: "user",
+		Password: "pass",
+	})
+	client := socks6.Client{Server: sAddr}
+
+	// connect, stack options are not applied
+	ops := message.NewOptionSet()
+	ops.Add(message.Option{
+		Kind: message.OptionKindStack,
+		Data: message.BaseStackOptionData{
+			RemoteLeg: true,
+			Level:     message.StackOptionLevelIP,
+			Code:      message.StackOptionCodeHappyEyeball,
+			Data:      &message.HappyEyeballOptionData{Availability: false},
+		},
+	})
+	fd, err := client.ConnectRequest(ctx, message.ParseAddr(echoAddr), nil, ops)
+	if assert.NoError(t, err) {
+		assert.Empty(t, fd.(*socks6.ProxyTCPConn).AppliedStackOptions())
+		e2etool.AssertForward(t, fd, fd)
+		fd.Close()
+	}
+
+	// bind
+	l, err := client.Listen("tcp", "127.0.0.1:0")
+	if assert.NoError(t, err) {
+		dialer := net.Dialer{Timeout: time.Second}
+		testFd, err := dialer.Dial("tcp", l.Addr().String())
+		assert.NoError(t, err)
+		clientFd, err := l.Accept()
+		if assert.NoError(t, err) {
+			e2etool.AssertForward2(t, clientFd, testFd)
+			clientFd.Close()
+		}
+		testFd.Close()
+	}
+
+	// udp
+	pc, err := client.ListenPacketContext(ctx, "udp", "0.0.0.0:0")
+	if assert.NoError(t, err) {
+		ua := message.ParseAddr(uechoAddr)
+		pc.WriteTo([]byte{1}, ua)
+		buf := make([]byte, 10)
+		n, a, err := pc.ReadFrom(buf)
+		if assert.NoError(t, err) {
+			assert.EqualValues(t, 1, n)
+			assert.Equal(t, ua.String(), a.String())
+		}
+		pc.Close()
+	}
+}
+
+func TestSocks5UpstreamAuthFail(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	upAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeTCP(ctx, upAddr, e2etool.Socks5("user", "pass"))
+
+	sAddr := startUpstreamEdge(ctx, socks6.Socks5ServerOutbound{
+		Server:   upAddr,
+		Username: "user",
+		Password: "wrong",
+	})
+	client := socks6.Client{Server: sAddr}
+	_, err := client.Dial("tcp", "127.0.0.1:1")
+	assert.True(t, errors.Is(err, socks6.ErrServerFailure))
+}
+
+func TestHTTPUpstream(t *testing.T) {
+	e2etool.WatchDog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echoAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeTCP(ctx, echoAddr, e2etool.Echo)
+	upAddr, _ := e2etool.GetAddr()
+	go e2etool.ServeTCP(ctx, upAddr, e2etool.HTTPConnect("user", "pass"))
+
+	sAddr := startUpstreamEdge(ctx, socks6.HTTPServerOutbound{
+		Server:   upAddr,
+		Username: "user",
+		Password: "pass",
+	})
+	client := socks6.Client{Server: sAddr}
+	fd, err := client.Dial("tcp", echoAddr)
+	if assert.NoError(t, err) {
+		e2etool.AssertForward(t, fd, fd)
+		fd.Close()
+	}
+
+	_, err = client.Listen("tcp", "127.0.0.1:0")
+	assert.True(t, errors.Is(err, syscall.EOPNOTSUPP))
+
+	// wrong password
+	sAddr2 := startUpstreamEdge(ctx, socks6.HTTPServerOutbound{
+		Server:   upAddr,
+		Username: "user",
+	})
+	client2 := socks6.Client{Server: sAddr2}
+	_, err = client2.Dial("tcp", echoAddr)
+	assert.True(t, errors.Is(err, syscall.EACCES))
+}
@@ -6,3 +6,8 @@ var ErrTTLExpired = errors.New("ttl expired")
 var ErrServerFailure = errors.New("socks 6 server failure")
 var ErrUnexpectedMessage = errors.New("unexpected protocol message")
 var ErrAssociationMismatch = errors.New("association mismatch")
+var ErrServerShutdown = errors.New("server is shutting down")
+var ErrAuthenticationFailed = errors.New("authentication failed")
+var ErrSessionInvalid = errors.New("session invalid")
+var ErrTokenRejected = errors.New("idempotence token rejected")
+var ErrConnectionLost = errors.New("QUIC connection lost")
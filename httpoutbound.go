@@ -0,0 +1,118 @@
+package socks6
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"syscall"
+
+	"github.com/studentmain/socks6/common"
+	"github.com/studentmain/socks6/message"
+)
+
+// HTTPServerOutbound implements ServerOutbound, forward CONNECT requests through an upstream HTTP proxy.
+// BIND and UDP ASSOCIATE are not supported, all stack options are reported as not applied.
+type HTTPServerOutbound struct {
+	// Server is upstream server address
+	Server string
+	// Username and Password are used for basic authentication, empty Username means no authentication
+	Username string
+	Password string
+	// DialFunc create TCP connection to upstream, net.Dialer is used when nil
+	DialFunc func(ctx context.Context, network string, addr string) (net.Conn, error)
+}
+
+var _ ServerOutbound = HTTPServerOutbound{}
+
+func (h HTTPServerOutbound) Dial(ctx context.Context, option message.StackOptionInfo, addr *message.SocksAddr) (net.Conn, message.StackOptionInfo, error) {
+	netErr := net.OpError{
+		Op:   "dial",
+		Net:  "http",
+		Addr: addr,
+	}
+	conn, err := dialUpstream(ctx, h.DialFunc, h.Server)
+	if err != nil {
+		netErr.Err = err
+		return nil, nil, &netErr
+	}
+	netErr.Source = conn.LocalAddr()
+
+	cd := common.NewCancellableDefer(func() { conn.Close() })
+	defer cd.Defer()
+	stop := watchContext(ctx, conn)
+	defer stop()
+
+	req, err := http.NewRequest(http.MethodConnect, "", nil)
+	if err != nil {
+		netErr.Err = err
+		return nil, nil, &netErr
+	}
+	req.Host = addr.String()
+	if h.Username != "" {
+		cred := base64.StdEncoding.EncodeToString([]byte(h.Username + ":" + h.Password))
+		req.Header.Set("Proxy-Authorization", "Basic "+cred)
+	}
+	if err = req.Write(conn); err != nil {
+		netErr.Err = err
+		return nil, nil, &netErr
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		netErr.Err = err
+		return nil, nil, &netErr
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		netErr.Err = convertHTTPStatusError(resp)
+		return nil, nil, &netErr
+	}
+
+	cd.Cancel()
+	var rconn net.Conn = conn
+	if br.Buffered() > 0 {
+		// remote sent data right after response
+		rconn = bufferedConn{Conn: conn, r: br}
+	}
+	// HTTP proxy doesn't tell which address it used
+	return upstreamConn{
+		Conn:   rconn,
+		local:  message.DefaultAddr,
+		remote: addr,
+	}, message.StackOptionInfo{}, nil
+}
+
+func (h HTTPServerOutbound) Listen(ctx context.Context, option message.StackOptionInfo, addr *message.SocksAddr) (net.Listener, message.StackOptionInfo, error) {
+	return nil, nil, &net.OpError{Op: "listen", Net: "http", Addr: addr, Err: syscall.EOPNOTSUPP}
+}
+
+func (h HTTPServerOutbound) ListenPacket(ctx context.Context, option message.StackOptionInfo, addr *message.SocksAddr) (net.PacketConn, message.StackOptionInfo, error) {
+	return nil, nil, &net.OpError{Op: "listen", Net: "http", Addr: addr, Err: syscall.EOPNOTSUPP}
+}
+
+// convertHTTPStatusError convert HTTP proxy's failure response to error
+func convertHTTPStatusError(resp *http.Response) error {
+	switch resp.StatusCode {
+	case http.StatusForbidden, http.StatusProxyAuthRequired:
+		return syscall.EACCES
+	case http.StatusBadGateway:
+		return syscall.EHOSTUNREACH
+	case http.StatusGatewayTimeout:
+		return syscall.ETIMEDOUT
+	}
+	return fmt.Errorf("http proxy: %s", resp.Status)
+}
+
+// bufferedConn is a net.Conn with some data already read into r
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (b bufferedConn) Read(p []byte) (int, error) {
+	return b.r.Read(p)
+}
@@ -0,0 +1,309 @@
+package socks6
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strings"
+
+	"github.com/studentmain/socks6/auth"
+	"github.com/studentmain/socks6/common"
+	"github.com/studentmain/socks6/common/lg"
+	"github.com/studentmain/socks6/message"
+)
+
+// isHTTPMethodStart check whether b is first byte of a HTTP method
+func isHTTPMethodStart(b int) bool {
+	return b < 0x80 && strings.IndexByte("CDGHOPT", byte(b)) >= 0
+}
+
+// handshakeHTTP read a HTTP proxy request, authenticate it with Proxy-Authorization, and convert it to CONNECT.
+// first is first byte of request, already consumed by SOCKS 6 request parser.
+func (s *ServerWorker) handshakeHTTP(
+	ctx context.Context,
+	conn net.Conn,
+	first byte,
+) (*SocksConn, message.CommandCode, *auth.ServerAuthenticationResult) {
+	closeConn := common.NewCancellableDefer(func() {
+		conn.Close()
+	})
+	defer closeConn.Defer()
+
+	ccid := conn3Tuple(conn)
+	lg.Trace(ccid, "http client")
+	br := bufio.NewReader(io.MultiReader(bytes.NewReader([]byte{first}), conn))
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		lg.Warning(ccid, "can't parse http request", err)
+		writeHTTPError(conn, http.StatusBadRequest, "http_request_error", "")
+		return nil, 0, nil
+	}
+	if s.Draining() {
+		lg.Info(ccid, "server is shutting down, request refused")
+		writeHTTPError(conn, http.StatusServiceUnavailable, "proxy_internal_error", "")
+		return nil, 0, nil
+	}
+	front, dest, err := httpDestination(req)
+	if err != nil {
+		lg.Warning(ccid, "not a http proxy request", err)
+		writeHTTPError(conn, http.StatusBadRequest, "http_request_error", "")
+		return nil, 0, nil
+	}
+
+	authResult := s.authnHTTP(ctx, conn, req)
+	s.collector().Authenticate(authResult.Success)
+	if !authResult.Success {
+		lg.Info(ccid, "authenticate fail")
+		writeHTTPError(conn, http.StatusProxyAuthRequired, "http_request_denied", "Proxy-Authenticate: Basic realm=\"socks6\"\r\n")
+		return nil, 0, nil
+	}
+	lg.Trace(ccid, "authenticate success")
+	setReadTimeout(conn, 0)
+
+	var initData []byte
+	if front == frontHTTPForward {
+		// body is read by relay, following requests are never forwarded
+		initData = forwardHeader(req)
+		conn = &httpForwardConn{Conn: conn, body: req.Body, chunked: len(req.TransferEncoding) > 0}
+	} else {
+		// client may send data before reply
+		initData, _ = br.Peek(br.Buffered())
+		initData = append([]byte{}, initData...)
+	}
+	lg.Tracef("%s requested http %s %s", ccid, req.Method, dest)
+
+	cc := SocksConn{
+		Conn: conn,
+		Request: &message.Request{
+			CommandCode: message.CommandConnect,
+			Endpoint:    dest,
+			Options:     message.NewOptionSet(),
+		},
+		ClientId:    authResult.ClientName,
+		InitialData: initData,
+
+		front:   front,
+		acct:    s.Accounting,
+		metrics: s.Metrics,
+	}
+	if !s.checkRequest(cc) {
+		return nil, message.CommandConnect, authResult
+	}
+	closeConn.Cancel()
+	return &cc, message.CommandConnect, authResult
+}
+
+// authnHTTP authenticate HTTP request, Basic credential is passed to password method, none method is tried without it
+func (s *ServerWorker) authnHTTP(ctx context.Context, conn net.Conn, req *http.Request) *auth.ServerAuthenticationResult {
+	if req.Header.Get("Proxy-Authorization") == "" {
+		return s.authenticateData(ctx, conn, nil)
+	}
+	// ProxyAuth read Authorization, reuse it
+	r := http.Request{Header: http.Header{"Authorization": req.Header.Values("Proxy-Authorization")}}
+	user, pass, ok := r.BasicAuth()
+	if !ok || len(user) > 255 || len(pass) > 255 {
+		return &auth.ServerAuthenticationResult{Success: false}
+	}
+	b := bytes.Buffer{}
+	b.WriteByte(1)
+	b.WriteByte(byte(len(user)))
+	b.WriteString(user)
+	b.WriteByte(byte(len(pass)))
+	b.WriteString(pass)
+	return s.authenticateData(ctx, conn, &message.AuthenticationDataOptionData{Method: socks5MethodPassword, Data: b.Bytes()})
+}
+
+// httpDestination find destination of proxy request, CONNECT use authority form, others use http absolute URI
+func httpDestination(req *http.Request) (frontEnd, *message.SocksAddr, error) {
+	if req.Method == http.MethodConnect {
+		addr, err := message.NewAddr(req.Host)
+		return frontHTTPConnect, addr, err
+	}
+	if req.URL.Scheme != "http" || req.URL.Host == "" {
+		return 0, nil, fmt.Errorf("unsupported request target %s", req.RequestURI)
+	}
+	port := req.URL.Port()
+	if port == "" {
+		port = "80"
+	}
+	addr, err := message.NewAddr(net.JoinHostPort(req.URL.Hostname(), port))
+	return frontHTTPForward, addr, err
+}
+
+// hopHeaders is hop-by-hop headers removed from forwarded request
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Upgrade",
+}
+
+// forwardHeader rewrite request header to origin form.
+// Connection is closed after first response, following requests may go to other host.
+// Chunked body is re-encoded by httpForwardConn, its trailer is dropped.
+func forwardHeader(req *http.Request) []byte {
+	h := req.Header.Clone()
+	for _, f := range h.Values("Connection") {
+		for _, k := range strings.Split(f, ",") {
+			if k = textproto.TrimString(k); k != "" {
+				h.Del(k)
+			}
+		}
+	}
+	for _, k := range hopHeaders {
+		h.Del(k)
+	}
+	h.Set("Connection", "close")
+	// body is not read by http.ReadRequest, keep its framing
+	if len(req.TransferEncoding) > 0 {
+		h.Set("Transfer-Encoding", "chunked")
+	}
+
+	b := bytes.Buffer{}
+	fmt.Fprintf(&b, "%s %s HTTP/1.1\r\nHost: %s\r\n", req.Method, req.URL.RequestURI(), req.Host)
+	h.Write(&b)
+	b.WriteString("\r\n")
+	return b.Bytes()
+}
+
+// maxHTTPHeader is max response header size rewritten by httpForwardConn, larger response is passed through
+const maxHTTPHeader = 64 * 1024
+
+// httpForwardConn is client connection of a forwarded HTTP request, only the first request is forwarded.
+// Read return request body then EOF, Write add Connection: close to remote's response.
+type httpForwardConn struct {
+	net.Conn
+	body    io.Reader // request body, nil after EOF
+	chunked bool      // body is chunked, and re-encoded
+	rbuf    []byte    // encoded body not read yet
+	whead   []byte    // response header not written yet
+	wdone   bool      // final response header written
+}
+
+func (c *httpForwardConn) unwrap() net.Conn {
+	return c.Conn
+}
+
+func (c *httpForwardConn) Read(p []byte) (int, error) {
+	for len(c.rbuf) == 0 {
+		if c.body == nil {
+			return 0, io.EOF
+		}
+		buf := make([]byte, len(p))
+		n, err := c.body.Read(buf)
+		if n > 0 {
+			c.rbuf = buf[:n]
+			if c.chunked {
+				c.rbuf = append([]byte(fmt.Sprintf("%x\r\n", n)), append(c.rbuf, "\r\n"...)...)
+			}
+		}
+		if err == io.EOF {
+			c.body = nil
+			if c.chunked {
+				c.rbuf = append(c.rbuf, "0\r\n\r\n"...)
+			}
+		} else if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.rbuf)
+	c.rbuf = c.rbuf[n:]
+	return n, nil
+}
+
+func (c *httpForwardConn) Write(p []byte) (int, error) {
+	if c.wdone {
+		return c.Conn.Write(p)
+	}
+	c.whead = append(c.whead, p...)
+	for !c.wdone {
+		i := bytes.Index(c.whead, []byte("\r\n\r\n"))
+		if i < 0 {
+			if len(c.whead) <= maxHTTPHeader {
+				return len(p), nil
+			}
+			c.wdone = true
+			break
+		}
+		head, interim := closeResponseHeader(c.whead[:i+4])
+		if _, err := c.Conn.Write(head); err != nil {
+			return 0, err
+		}
+		c.whead = c.whead[i+4:]
+		c.wdone = !interim
+	}
+	rest := c.whead
+	c.whead = nil
+	if _, err := c.Conn.Write(rest); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// closeResponseHeader replace connection headers of a response header with Connection: close,
+// interim (1xx) response is returned unchanged
+func closeResponseHeader(head []byte) ([]byte, bool) {
+	lines := strings.Split(string(head[:len(head)-4]), "\r\n")
+	status := strings.SplitN(lines[0], " ", 3)
+	if len(status) > 1 && len(status[1]) == 3 && status[1][0] == '1' && status[1] != "101" {
+		return head, true
+	}
+	b := bytes.Buffer{}
+	b.WriteString(lines[0] + "\r\n")
+	for _, l := range lines[1:] {
+		k := textproto.TrimString(strings.SplitN(l, ":", 2)[0])
+		if strings.EqualFold(k, "Connection") || strings.EqualFold(k, "Keep-Alive") || strings.EqualFold(k, "Proxy-Connection") {
+			continue
+		}
+		b.WriteString(l + "\r\n")
+	}
+	b.WriteString("Connection: close\r\n\r\n")
+	return b.Bytes(), false
+}
+
+// writeHTTPReply write reply code as HTTP response, successful forward request has no reply, remote's response is sent instead
+func (c SocksConn) writeHTTPReply(code message.ReplyCode) error {
+	if code != message.OperationReplySuccess {
+		status, proxyErr := httpStatus(code)
+		return writeHTTPError(c.Conn, status, proxyErr, "")
+	}
+	if c.front == frontHTTPForward {
+		return nil
+	}
+	_, err := c.Conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+	return err
+}
+
+// httpStatus convert reply code to HTTP status and Proxy-Status error type (RFC 9209)
+func httpStatus(code message.ReplyCode) (int, string) {
+	switch code {
+	case message.OperationReplyNotAllowedByRule:
+		return http.StatusForbidden, "http_request_denied"
+	case message.OperationReplyNetworkUnreachable, message.OperationReplyHostUnreachable:
+		return http.StatusBadGateway, "destination_unavailable"
+	case message.OperationReplyConnectionRefused:
+		return http.StatusBadGateway, "connection_refused"
+	case message.OperationReplyTTLExpired, message.OperationReplyTimeout:
+		return http.StatusGatewayTimeout, "connection_timeout"
+	case message.OperationReplyCommandNotSupported, message.OperationReplyAddressNotSupported:
+		return http.StatusNotImplemented, "proxy_internal_error"
+	default:
+		return http.StatusBadGateway, "proxy_internal_error"
+	}
+}
+
+// writeHTTPError write an empty error response, header is extra header lines
+func writeHTTPError(w io.Writer, status int, proxyErr string, header string) error {
+	_, err := fmt.Fprintf(w, "HTTP/1.1 %d %s\r\nProxy-Status: SOCKS6Server; error=%s\r\n%sContent-Length: 0\r\nConnection: close\r\n\r\n",
+		status, http.StatusText(status), proxyErr, header)
+	return err
+}
@@ -2,8 +2,8 @@ package internal
 
 import "github.com/studentmain/socks6/common/lg"
 
-// BytesPool is a fixed size byte array pool
-// byte array is fized size, but byte array count is increased automatically
+// BytesPool is a fixed size byte array pool, safe for concurrent use
+// byte array is fized size, arrays returned when pool is full are left to GC
 type BytesPool struct {
 	ch chan []byte
 	l  int
@@ -18,11 +18,12 @@ func NewBytesPool(bytesSize, poolSize int) *BytesPool {
 
 // Rent rent a byte array from pool, length is determined when creating pool
 func (p *BytesPool) Rent() []byte {
-	count := len(p.ch)
-	if count == 0 {
+	select {
+	case b := <-p.ch:
+		return b
+	default:
 		return make([]byte, p.l)
 	}
-	return <-p.ch
 }
 
 // Return return a rented byte array to pool\
@@ -31,17 +32,10 @@ func (p *BytesPool) Return(b []byte) {
 	if len(b) != p.l {
 		lg.Panic("please return all bytes you rented!")
 	}
-	capacity := cap(p.ch)
-
-	if len(p.ch) == capacity {
-		lg.Warning("returned more than rented")
-		ch2 := make(chan []byte, capacity*2)
-		for i := 0; i < capacity; i++ {
-			ch2 <- <-p.ch
-		}
-		p.ch = ch2
+	select {
+	case p.ch <- b:
+	default:
 	}
-	p.ch <- b
 }
 
 // BytesPool64k is a BytesPool with array size 65536, primarily used as large header and UDP receive buffer
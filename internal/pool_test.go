@@ -0,0 +1,34 @@
+package internal
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBytesPool(t *testing.T) {
+	p := NewBytesPool(16, 2)
+	bs := [][]byte{p.Rent(), p.Rent(), p.Rent()}
+	for _, b := range bs {
+		assert.Len(t, b, 16)
+		p.Return(b)
+	}
+	// extra array is dropped
+	assert.Len(t, p.ch, 2)
+	assert.Equal(t, 2, cap(p.ch))
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				b := p.Rent()
+				p.Return(b)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.LessOrEqual(t, len(p.ch), 2)
+}
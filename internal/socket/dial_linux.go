@@ -0,0 +1,198 @@
+package socket
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/studentmain/socks6/message"
+	"golang.org/x/sys/unix"
+)
+
+// TCPI_OPT_SYN_DATA, data in SYN is acknowledged
+const tcpiOptSynData = 0x20
+
+// dialSocket connect to ip by creating socket manually, used by options net.Dialer can't do, i.e. TFO and MPTCP.
+// When TFO requested, data is sent in SYN as much as possible, return number of bytes sent.
+func dialSocket(ctx context.Context, ip net.IP, port uint16, local net.IP, opt message.StackOptionInfo, data []byte) (net.Conn, message.StackOptionInfo, int, error) {
+	applied := message.StackOptionInfo{}
+	domain, sa := sockaddr(ip, int(port))
+
+	mptcp := false
+	if v, ok := opt[message.StackOptionTCPMultipath]; ok {
+		mptcp = v.(bool)
+	}
+	fd, err := -1, error(nil)
+	if mptcp {
+		fd, err = unix.Socket(domain, unix.SOCK_STREAM|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, unix.IPPROTO_MPTCP)
+		if err != nil {
+			// kernel without MPTCP, use TCP instead
+			mptcp = false
+		}
+	}
+	if !mptcp {
+		fd, err = unix.Socket(domain, unix.SOCK_STREAM|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, unix.IPPROTO_TCP)
+	}
+	if err != nil {
+		return nil, nil, 0, os.NewSyscallError("socket", err)
+	}
+	if _, ok := opt[message.StackOptionTCPMultipath]; ok {
+		applied[message.StackOptionTCPMultipath] = mptcp
+	}
+	// f own fd, it is closed when f closed
+	f := os.NewFile(uintptr(fd), "")
+	defer f.Close()
+
+	applied.Combine(setIPOption(uintptr(fd), opt))
+	if local != nil {
+		ldomain, lsa := sockaddr(local, 0)
+		if ldomain != domain {
+			return nil, nil, 0, &net.AddrError{Err: "mismatched local address type", Addr: local.String()}
+		}
+		if err = unix.Bind(fd, lsa); err != nil {
+			return nil, nil, 0, os.NewSyscallError("bind", err)
+		}
+	}
+
+	// send data in SYN when TFO requested
+	sent := 0
+	if v, ok := opt[message.StackOptionTCPTFO]; ok && len(data) > 0 {
+		size := int(v.(uint16))
+		if size > len(data) || size == 0 {
+			size = len(data)
+		}
+		sent, err = unix.SendmsgN(fd, data[:size], nil, sa, unix.MSG_FASTOPEN)
+		switch {
+		case errors.Is(err, unix.EINPROGRESS):
+			// no cookie yet, SYN sent without data
+			sent, err = 0, nil
+		case errors.Is(err, unix.EOPNOTSUPP):
+			// TFO disabled by sysctl
+			sent = 0
+			err = unix.Connect(fd, sa)
+		}
+	} else {
+		err = unix.Connect(fd, sa)
+	}
+	if err != nil && !errors.Is(err, unix.EINPROGRESS) {
+		return nil, nil, 0, os.NewSyscallError("connect", err)
+	}
+
+	if err = waitConnect(ctx, f); err != nil {
+		return nil, nil, 0, err
+	}
+	if sent > 0 {
+		info, err := unix.GetsockoptTCPInfo(fd, unix.IPPROTO_TCP, unix.TCP_INFO)
+		if err == nil && info.Options&tcpiOptSynData != 0 {
+			applied[message.StackOptionTCPTFO] = uint16(sent)
+		}
+	}
+
+	conn, err := net.FileConn(f)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	return conn, applied, sent, nil
+}
+
+// sockaddr convert ip and port to socket address and its family
+func sockaddr(ip net.IP, port int) (int, unix.Sockaddr) {
+	if ip4 := ip.To4(); ip4 != nil {
+		sa := &unix.SockaddrInet4{Port: port}
+		copy(sa.Addr[:], ip4)
+		return unix.AF_INET, sa
+	}
+	sa := &unix.SockaddrInet6{Port: port}
+	copy(sa.Addr[:], ip.To16())
+	return unix.AF_INET6, sa
+}
+
+// waitConnect wait non-blocking connect on f finish
+func waitConnect(ctx context.Context, f *os.File) error {
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	if d, ok := ctx.Deadline(); ok {
+		f.SetWriteDeadline(d)
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			f.SetWriteDeadline(time.Unix(1, 0))
+		case <-stop:
+		}
+	}()
+
+	var soErr error
+	err = rc.Write(func(fd uintptr) bool {
+		errno, err := unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_ERROR)
+		if err != nil {
+			soErr = err
+			return true
+		}
+		if errno != 0 {
+			soErr = syscall.Errno(errno)
+			return true
+		}
+		// connected when peer is known
+		_, err = unix.Getpeername(int(fd))
+		return err == nil
+	})
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+	if soErr != nil {
+		return os.NewSyscallError("connect", soErr)
+	}
+	return nil
+}
+
+// setListenerOption set TFO and kernel backlog on a listening socket, return options successfully set
+func setListenerOption(fd uintptr, opt message.StackOptionInfo) message.StackOptionInfo {
+	applied := message.StackOptionInfo{}
+	if v, ok := opt[message.StackOptionTCPTFO]; ok {
+		qlen := int(v.(uint16))
+		if qlen == 0 {
+			qlen = 1
+		}
+		if unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_FASTOPEN, qlen) == nil {
+			applied[message.StackOptionTCPTFO] = v
+		}
+	}
+	if v, ok := opt[message.StackOptionTCPBacklog]; ok {
+		backlog := int(v.(uint16))
+		// listen again change backlog of a listening socket
+		if unix.Listen(int(fd), backlog) == nil {
+			// kernel silently truncate it
+			if max := somaxconn(); max < backlog {
+				backlog = max
+			}
+			applied[message.StackOptionTCPBacklog] = uint16(backlog)
+		}
+	}
+	return applied
+}
+
+// somaxconn return max listen backlog allowed by kernel
+func somaxconn() int {
+	b, err := os.ReadFile("/proc/sys/net/core/somaxconn")
+	if err != nil {
+		return unix.SOMAXCONN
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil || n <= 0 {
+		return unix.SOMAXCONN
+	}
+	return n
+}
@@ -0,0 +1,25 @@
+//go:build !linux
+
+package socket
+
+import (
+	"context"
+	"net"
+	"syscall"
+
+	"github.com/studentmain/socks6/message"
+)
+
+// dialSocket is not implemented on this platform
+func dialSocket(ctx context.Context, ip net.IP, port uint16, local net.IP, opt message.StackOptionInfo, data []byte) (net.Conn, message.StackOptionInfo, int, error) {
+	return nil, nil, 0, syscall.EOPNOTSUPP
+}
+
+// setListenerOption is not implemented on this platform, backlog is simulated by ServerWorker
+func setListenerOption(fd uintptr, opt message.StackOptionInfo) message.StackOptionInfo {
+	applied := message.StackOptionInfo{}
+	if backlog, ok := opt[message.StackOptionTCPBacklog]; ok {
+		applied[message.StackOptionTCPBacklog] = backlog
+	}
+	return applied
+}
@@ -0,0 +1,247 @@
+package socket
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/studentmain/socks6/message"
+)
+
+// fallbackDelay is how long to wait before trying the other address family, same as net.Dialer
+const fallbackDelay = 300 * time.Millisecond
+
+// Dialer create TCP connections with stack options
+type Dialer struct {
+	// LocalIP is the source address, nil means decided by OS
+	LocalIP net.IP
+	// LookupIP resolve domain name to addresses in preferred order, nil means system resolver
+	LookupIP func(ctx context.Context, host string) ([]net.IP, error)
+	// Check is called with each resolved address before connect, connect is aborted when it returned error
+	Check func(ip net.IP, port int) error
+}
+
+// dialResult is the outcome of one dial attempt, sent is number of initial data bytes sent in SYN
+type dialResult struct {
+	conn    net.Conn
+	applied message.StackOptionInfo
+	sent    int
+	err     error
+}
+
+// DialWithOption dial addr with stack options.
+// data is sent to remote after connected, or in SYN when TFO requested.
+func (d Dialer) DialWithOption(ctx context.Context, addr message.SocksAddr, opt message.StackOptionInfo, data []byte) (net.Conn, message.StackOptionInfo, error) {
+	_, tfo := opt[message.StackOptionTCPTFO]
+	mptcp, _ := opt[message.StackOptionTCPMultipath].(bool)
+	manual := (tfo && len(data) > 0) || mptcp
+
+	happyEyeball := true
+	if v, ok := opt[message.StackOptionIPHappyEyeball]; ok {
+		happyEyeball = v.(bool)
+	}
+	if tfo && len(data) > 0 {
+		// data is sent in SYN, connection lost the race would have sent it too
+		happyEyeball = false
+	}
+
+	var r dialResult
+	if d.LookupIP == nil && !manual {
+		// net.Dialer resolve and race addresses by itself
+		r = d.dialNet(ctx, addr.String(), opt, happyEyeball)
+	} else {
+		r = d.dialResolved(ctx, addr, opt, data, manual, happyEyeball)
+	}
+	if r.err != nil {
+		return nil, nil, r.err
+	}
+	if _, ok := opt[message.StackOptionIPHappyEyeball]; ok && addr.AddressType == message.AddressTypeDomainName {
+		r.applied[message.StackOptionIPHappyEyeball] = happyEyeball
+	}
+	if _, err := r.conn.Write(data[r.sent:]); err != nil {
+		r.conn.Close()
+		return nil, nil, err
+	}
+	return r.conn, r.applied, nil
+}
+
+// dialNet dial address with net.Dialer
+func (d Dialer) dialNet(ctx context.Context, address string, opt message.StackOptionInfo, happyEyeball bool) dialResult {
+	oc := newOptionControl(opt)
+	dialer := net.Dialer{Control: checkControl(d.Check, oc.control)}
+	if d.LocalIP != nil {
+		dialer.LocalAddr = &net.TCPAddr{IP: d.LocalIP}
+	}
+	if !happyEyeball {
+		dialer.FallbackDelay = -1
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return dialResult{err: err}
+	}
+	return dialResult{conn: conn, applied: oc.result(conn)}
+}
+
+// dialResolved resolve addr with LookupIP and dial each address, happy eyeballs is done here
+func (d Dialer) dialResolved(ctx context.Context, addr message.SocksAddr, opt message.StackOptionInfo, data []byte, manual bool, happyEyeball bool) dialResult {
+	ips, err := d.lookup(ctx, addr)
+	if err != nil {
+		return dialResult{err: &net.OpError{Op: "dial", Net: "tcp", Addr: &addr, Err: err}}
+	}
+	dialOne := func(ctx context.Context, ip net.IP) dialResult {
+		if manual {
+			if d.Check != nil {
+				if err := d.Check(ip, int(addr.Port)); err != nil {
+					return dialResult{err: &net.OpError{Op: "dial", Net: "tcp", Addr: &net.TCPAddr{IP: ip, Port: int(addr.Port)}, Err: err}}
+				}
+			}
+			conn, applied, sent, err := dialSocket(ctx, ip, addr.Port, d.LocalIP, opt, data)
+			if !errors.Is(err, syscall.EOPNOTSUPP) {
+				return dialResult{conn: conn, applied: applied, sent: sent, err: err}
+			}
+		}
+		return d.dialNet(ctx, net.JoinHostPort(ip.String(), strconv.Itoa(int(addr.Port))), opt, false)
+	}
+
+	var r dialResult
+	if primaries, fallbacks := splitFamily(ips); happyEyeball && len(fallbacks) > 0 {
+		r = dialParallel(ctx, primaries, fallbacks, dialOne)
+	} else {
+		r = dialSerial(ctx, ips, dialOne)
+	}
+	if r.err != nil {
+		if _, ok := r.err.(*net.OpError); !ok {
+			r.err = &net.OpError{Op: "dial", Net: "tcp", Addr: &addr, Err: r.err}
+		}
+	}
+	return r
+}
+
+// lookup resolve addr to addresses usable with LocalIP
+func (d Dialer) lookup(ctx context.Context, addr message.SocksAddr) ([]net.IP, error) {
+	var ips []net.IP
+	if addr.AddressType == message.AddressTypeDomainName {
+		host := string(addr.Address)
+		var err error
+		if d.LookupIP != nil {
+			ips, err = d.LookupIP(ctx, host)
+		} else {
+			var ipas []net.IPAddr
+			ipas, err = net.DefaultResolver.LookupIPAddr(ctx, host)
+			for _, ipa := range ipas {
+				ips = append(ips, ipa.IP)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		ips = []net.IP{net.IP(addr.Address)}
+	}
+	if d.LocalIP == nil {
+		return ips, nil
+	}
+	// source and destination must be same family
+	ret := []net.IP{}
+	for _, ip := range ips {
+		if (ip.To4() != nil) == (d.LocalIP.To4() != nil) {
+			ret = append(ret, ip)
+		}
+	}
+	if len(ret) == 0 {
+		return nil, &net.AddrError{Err: "no suitable address found", Addr: addr.String()}
+	}
+	return ret, nil
+}
+
+// splitFamily split ips to addresses of same family as first one and the others, order is kept
+func splitFamily(ips []net.IP) (primaries, fallbacks []net.IP) {
+	if len(ips) == 0 {
+		return nil, nil
+	}
+	v4 := ips[0].To4() != nil
+	for _, ip := range ips {
+		if (ip.To4() != nil) == v4 {
+			primaries = append(primaries, ip)
+		} else {
+			fallbacks = append(fallbacks, ip)
+		}
+	}
+	return primaries, fallbacks
+}
+
+// dialSerial try ips in order until one connected, return the first error when all failed
+func dialSerial(ctx context.Context, ips []net.IP, dial func(context.Context, net.IP) dialResult) dialResult {
+	var firstErr error
+	for _, ip := range ips {
+		r := dial(ctx, ip)
+		if r.err == nil {
+			return r
+		}
+		if firstErr == nil {
+			firstErr = r.err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if firstErr == nil {
+		firstErr = errors.New("no address to dial")
+	}
+	return dialResult{err: firstErr}
+}
+
+// dialParallel race primaries and fallbacks, fallbacks start after fallbackDelay or primaries failed, as RFC 8305 described.
+// The first connected one is returned, the late one is closed.
+// Data may be sent by both of them, so it must not be used with data in SYN.
+func dialParallel(ctx context.Context, primaries, fallbacks []net.IP, dial func(context.Context, net.IP) dialResult) dialResult {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan dialResult, 2)
+	start := func(ips []net.IP) {
+		go func() { results <- dialSerial(ctx, ips, dial) }()
+	}
+	start(primaries)
+	pending := 1
+	fallbackStarted := false
+	timer := time.NewTimer(fallbackDelay)
+	defer timer.Stop()
+
+	var firstErr error
+	for {
+		select {
+		case <-timer.C:
+			if !fallbackStarted {
+				start(fallbacks)
+				fallbackStarted = true
+				pending++
+			}
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				if pending > 0 {
+					go func() {
+						if late := <-results; late.conn != nil {
+							late.conn.Close()
+						}
+					}()
+				}
+				return r
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if !fallbackStarted {
+				start(fallbacks)
+				fallbackStarted = true
+				pending++
+			} else if pending == 0 {
+				return dialResult{err: firstErr}
+			}
+		}
+	}
+}
@@ -3,38 +3,123 @@ package socket
 import (
 	"context"
 	"net"
+	"strconv"
+	"sync"
+	"syscall"
 
 	"github.com/studentmain/socks6/message"
 )
 
+// SetConnOpt apply IP level options to an established connection, return options actually applied
 func SetConnOpt(conn net.Conn, opt message.StackOptionInfo) message.StackOptionInfo {
-	return message.StackOptionInfo{}
+	applied := message.StackOptionInfo{}
+	sc, ok := conn.(syscall.Conn)
+	if !ok || len(opt) == 0 {
+		return applied
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return applied
+	}
+	rc.Control(func(fd uintptr) {
+		applied = setIPOption(fd, opt)
+	})
+	return applied
 }
 
-func DialWithOption(ctx context.Context, addr message.SocksAddr, opt message.StackOptionInfo) (net.Conn, message.StackOptionInfo, error) {
-	appliedOption := message.StackOptionInfo{}
+// optionControl apply options to every socket created by a dialer or listener.
+// Happy eyeballs may create several sockets, so the result is recorded per socket
+// and picked after the used one is known.
+type optionControl struct {
+	opt message.StackOptionInfo
 
-	dialer := net.Dialer{}
+	lock    sync.Mutex
+	applied map[uintptr]message.StackOptionInfo
+}
 
-	happyEyeballOp, ok := opt[message.StackOptionIPHappyEyeball]
-	if ok && addr.AddressType == message.AddressTypeDomainName {
-		if happyEyeballOp.(bool) {
-			appliedOption[message.StackOptionIPHappyEyeball] = true
-		} else {
-			dialer.FallbackDelay = -1
-			appliedOption[message.StackOptionIPHappyEyeball] = false
-		}
+func newOptionControl(opt message.StackOptionInfo) *optionControl {
+	return &optionControl{
+		opt:     opt,
+		applied: map[uintptr]message.StackOptionInfo{},
 	}
+}
 
-	conn, err := dialer.DialContext(ctx, "tcp", addr.String())
-	return conn, appliedOption, err
+func (o *optionControl) control(network, address string, c syscall.RawConn) error {
+	return c.Control(func(fd uintptr) {
+		applied := setIPOption(fd, o.opt)
+		o.lock.Lock()
+		defer o.lock.Unlock()
+		o.applied[fd] = applied
+	})
 }
 
-func ListenerWithOption(ctx context.Context, addr message.SocksAddr, opt message.StackOptionInfo) (net.Listener, message.StackOptionInfo, error) {
-	appliedOption := message.StackOptionInfo{}
+// result return options applied to socket of c
+func (o *optionControl) result(c interface{}) message.StackOptionInfo {
+	ret := message.StackOptionInfo{}
+	sc, ok := c.(syscall.Conn)
+	if !ok {
+		return ret
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return ret
+	}
+	rc.Control(func(fd uintptr) {
+		o.lock.Lock()
+		defer o.lock.Unlock()
+		ret.Combine(o.applied[fd])
+	})
+	return ret
+}
 
-	cfg := net.ListenConfig{}
+// ListenerWithOption listen at addr, check is called with resolved address before bind, nil means no check
+func ListenerWithOption(ctx context.Context, addr message.SocksAddr, opt message.StackOptionInfo, check func(ip net.IP, port int) error) (net.Listener, message.StackOptionInfo, error) {
+	appliedOption := message.StackOptionInfo{}
 
+	oc := newOptionControl(opt)
+	cfg := net.ListenConfig{Control: checkControl(check, oc.control)}
 	listener, err := cfg.Listen(ctx, "tcp", addr.String())
-	return listener, appliedOption, err
+	if err != nil {
+		return nil, nil, err
+	}
+	appliedOption.Combine(oc.result(listener))
+	// TFO and backlog are set after listen
+	if rc, err := listener.(syscall.Conn).SyscallConn(); err == nil {
+		rc.Control(func(fd uintptr) {
+			appliedOption.Combine(setListenerOption(fd, opt))
+		})
+	}
+	return listener, appliedOption, nil
+}
+
+// checkControl call check with address before control, check can be nil
+func checkControl(check func(ip net.IP, port int) error, control func(network, address string, c syscall.RawConn) error) func(network, address string, c syscall.RawConn) error {
+	if check == nil {
+		return control
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+		p, err := strconv.Atoi(port)
+		if err != nil {
+			return err
+		}
+		if err = check(net.ParseIP(host), p); err != nil {
+			return err
+		}
+		return control(network, address, c)
+	}
+}
+
+// ListenPacketWithOption create UDP socket at addr
+func ListenPacketWithOption(ctx context.Context, addr *net.UDPAddr, opt message.StackOptionInfo) (net.PacketConn, message.StackOptionInfo, error) {
+	oc := newOptionControl(opt)
+	cfg := net.ListenConfig{Control: oc.control}
+	pc, err := cfg.ListenPacket(ctx, "udp", addr.String())
+	if err != nil {
+		return nil, nil, err
+	}
+	return pc, oc.result(pc), nil
 }
@@ -0,0 +1,50 @@
+package socket
+
+import (
+	"github.com/studentmain/socks6/message"
+	"golang.org/x/sys/unix"
+)
+
+// setIPOption set TOS, TTL and don't fragment on socket fd, return options successfully set
+func setIPOption(fd uintptr, opt message.StackOptionInfo) message.StackOptionInfo {
+	applied := message.StackOptionInfo{}
+	s := int(fd)
+	domain, err := unix.GetsockoptInt(s, unix.SOL_SOCKET, unix.SO_DOMAIN)
+	if err != nil {
+		return applied
+	}
+	set := func(opt4, value4, opt6, value6 int) bool {
+		if domain != unix.AF_INET6 {
+			return unix.SetsockoptInt(s, unix.IPPROTO_IP, opt4, value4) == nil
+		}
+		if unix.SetsockoptInt(s, unix.IPPROTO_IPV6, opt6, value6) != nil {
+			return false
+		}
+		// dual stack socket may also send IPv4 packets
+		unix.SetsockoptInt(s, unix.IPPROTO_IP, opt4, value4)
+		return true
+	}
+
+	if v, ok := opt[message.StackOptionIPTOS]; ok {
+		tos := int(v.(byte))
+		if set(unix.IP_TOS, tos, unix.IPV6_TCLASS, tos) {
+			applied[message.StackOptionIPTOS] = v
+		}
+	}
+	if v, ok := opt[message.StackOptionIPTTL]; ok {
+		ttl := int(v.(byte))
+		if set(unix.IP_TTL, ttl, unix.IPV6_UNICAST_HOPS, ttl) {
+			applied[message.StackOptionIPTTL] = v
+		}
+	}
+	if v, ok := opt[message.StackOptionIPNoFragment]; ok {
+		pmtud4, pmtud6 := unix.IP_PMTUDISC_DONT, unix.IPV6_PMTUDISC_DONT
+		if v.(bool) {
+			pmtud4, pmtud6 = unix.IP_PMTUDISC_DO, unix.IPV6_PMTUDISC_DO
+		}
+		if set(unix.IP_MTU_DISCOVER, pmtud4, unix.IPV6_MTU_DISCOVER, pmtud6) {
+			applied[message.StackOptionIPNoFragment] = v
+		}
+	}
+	return applied
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package socket
+
+import "github.com/studentmain/socks6/message"
+
+// setIPOption is not implemented on this platform, nothing is applied
+func setIPOption(fd uintptr, opt message.StackOptionInfo) message.StackOptionInfo {
+	return message.StackOptionInfo{}
+}
@@ -0,0 +1,59 @@
+// Package yamlpath locate values in a YAML document by keys and indexes,
+// used by commands to report config errors with line number.
+package yamlpath
+
+import (
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Errorf create an error of value at path in document root of file, path is keys and indexes from root
+func Errorf(file string, root *yaml.Node, path []interface{}, format string, v ...interface{}) error {
+	name := []string{}
+	for _, p := range path {
+		switch p := p.(type) {
+		case string:
+			name = append(name, p)
+		case int:
+			name[len(name)-1] += fmt.Sprintf("[%d]", p)
+		}
+	}
+	pos := file
+	if n := Lookup(root, path); n != nil {
+		pos = fmt.Sprintf("%s:%d", file, n.Line)
+	}
+	return fmt.Errorf("%s: %s: %s", pos, strings.Join(name, "."), fmt.Sprintf(format, v...))
+}
+
+// Lookup find the deepest node on path, nil when document is empty
+func Lookup(root *yaml.Node, path []interface{}) *yaml.Node {
+	if root == nil || len(root.Content) == 0 {
+		return nil
+	}
+	n := root.Content[0]
+	for _, p := range path {
+		var next *yaml.Node
+		switch p := p.(type) {
+		case string:
+			if n.Kind != yaml.MappingNode {
+				return n
+			}
+			for i := 0; i+1 < len(n.Content); i += 2 {
+				if n.Content[i].Value == p {
+					next = n.Content[i+1]
+				}
+			}
+		case int:
+			if n.Kind == yaml.SequenceNode && p < len(n.Content) {
+				next = n.Content[p]
+			}
+		}
+		if next == nil {
+			return n
+		}
+		n = next
+	}
+	return n
+}
@@ -0,0 +1,168 @@
+package socks6
+
+import (
+	"net"
+	"os"
+
+	"github.com/pion/dtls/v2/pkg/protocol"
+	"github.com/pion/dtls/v2/pkg/protocol/recordlayer"
+	"github.com/studentmain/socks6/common/lg"
+)
+
+// inheritedSockets is pre-opened sockets which are not yet used by listeners
+type inheritedSockets struct {
+	stream []net.Listener
+	packet []net.PacketConn
+}
+
+// newInheritedSockets convert files to listeners, files are closed
+func newInheritedSockets(files []*os.File) *inheritedSockets {
+	is := &inheritedSockets{}
+	for _, f := range files {
+		if l, err := net.FileListener(f); err == nil {
+			is.stream = append(is.stream, l)
+		} else if pc, err := net.FilePacketConn(f); err == nil {
+			is.packet = append(is.packet, pc)
+		} else {
+			lg.Warning("unsupported inherited socket", f.Name())
+		}
+		f.Close()
+	}
+	return is
+}
+
+// listener take an inherited stream socket listening at addr
+func (is *inheritedSockets) listener(addr string) net.Listener {
+	for i, l := range is.stream {
+		if sameAddr(l.Addr(), addr) {
+			is.stream = append(is.stream[:i], is.stream[i+1:]...)
+			return l
+		}
+	}
+	return nil
+}
+
+// packetConn take an inherited packet socket listening at addr
+func (is *inheritedSockets) packetConn(addr string) net.PacketConn {
+	for i, pc := range is.packet {
+		if sameAddr(pc.LocalAddr(), addr) {
+			is.packet = append(is.packet[:i], is.packet[i+1:]...)
+			return pc
+		}
+	}
+	return nil
+}
+
+// closeUnused close sockets not taken by any listener
+func (is *inheritedSockets) closeUnused() {
+	for _, l := range is.stream {
+		lg.Warning("inherited socket unused", l.Addr())
+		l.Close()
+	}
+	for _, pc := range is.packet {
+		lg.Warning("inherited socket unused", pc.LocalAddr())
+		pc.Close()
+	}
+	is.stream = nil
+	is.packet = nil
+}
+
+// sameAddr check whether socket address a is the address described by addr,
+// unspecified IP (0.0.0.0, ::, or empty host) match each other
+func sameAddr(a net.Addr, addr string) bool {
+	expect, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return false
+	}
+	actual, err := net.ResolveTCPAddr("tcp", a.String())
+	if err != nil {
+		return false
+	}
+	if expect.Port != actual.Port {
+		return false
+	}
+	if len(expect.IP) == 0 || expect.IP.IsUnspecified() {
+		return len(actual.IP) == 0 || actual.IP.IsUnspecified()
+	}
+	return expect.IP.Equal(actual.IP)
+}
+
+// listenTCP use inherited socket or create a TCP listener
+func (s *Server) listenTCP(addr string) (net.Listener, error) {
+	if s.inherited != nil {
+		if l := s.inherited.listener(addr); l != nil {
+			lg.Info("use inherited socket", l.Addr())
+			return l, nil
+		}
+	}
+	addr2, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return net.ListenTCP("tcp", addr2)
+}
+
+// listenUDP use inherited socket or create a UDP socket
+func (s *Server) listenUDP(addr string) (net.PacketConn, error) {
+	if s.inherited != nil {
+		if pc := s.inherited.packetConn(addr); pc != nil {
+			lg.Info("use inherited socket", pc.LocalAddr())
+			return pc, nil
+		}
+	}
+	addr2, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return net.ListenUDP("udp", addr2)
+}
+
+type hasFile interface {
+	File() (*os.File, error)
+}
+
+// Files return duplicated file of TCP, UDP, TLS, DTLS and QUIC listener sockets,
+// pass them to another process's Server.InheritedFiles to let it accept connections on same ports.
+// Caller should close returned files, and call ReleasePacketSockets after another process started.
+func (s *Server) Files() ([]*os.File, error) {
+	ret := []*os.File{}
+	for _, v := range s.sockets {
+		hf, ok := v.(hasFile)
+		if !ok {
+			continue
+		}
+		f, err := hf.File()
+		if err != nil {
+			for _, f2 := range ret {
+				f2.Close()
+			}
+			return nil, err
+		}
+		ret = append(ret, f)
+	}
+	return ret, nil
+}
+
+// ReleasePacketSockets stop reading UDP, DTLS and QUIC sockets after they are passed to another process.
+// Datagrams are delivered to one of the processes reading same socket at random,
+// so only the new process should read them. Stream listeners are drained by Shutdown as usual,
+// UDP associations over UDP or DTLS and QUIC connections can't be drained and are broken,
+// QUIC connections are closed so clients can reconnect to the new process.
+func (s *Server) ReleasePacketSockets() {
+	lg.Info("release packet sockets")
+	s.closeListeners(s.packets)
+	s.packets = nil
+}
+
+// dtlsAcceptFilter only accept DTLS handshake as new connection
+func dtlsAcceptFilter(packet []byte) bool {
+	pkts, err := recordlayer.UnpackDatagram(packet)
+	if err != nil || len(pkts) < 1 {
+		return false
+	}
+	h := &recordlayer.Header{}
+	if err := h.Unmarshal(pkts[0]); err != nil {
+		return false
+	}
+	return h.ContentType == protocol.ContentTypeHandshake
+}
@@ -0,0 +1,39 @@
+package socks6
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const listenFdsStart = 3
+
+// ListenFDs return sockets passed by systemd socket activation or a parent process,
+// following LISTEN_FDS protocol. When LISTEN_PID is set but not current process id,
+// nothing is returned. Environment variables are unset to avoid passing to child process.
+func ListenFDs() []*os.File {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	if pid := os.Getenv("LISTEN_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	files := make([]*os.File, 0, n)
+	for i := 0; i < n; i++ {
+		fd := listenFdsStart + i
+		syscall.CloseOnExec(fd)
+		name := "LISTEN_FD_" + strconv.Itoa(fd)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		files = append(files, os.NewFile(uintptr(fd), name))
+	}
+	return files
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !windows
+
+package socks6
+
+import "os"
+
+// ListenFDs return nil, socket passing is not supported on this platform
+func ListenFDs() []*os.File {
+	return nil
+}
@@ -0,0 +1,8 @@
+package socks6
+
+import "os"
+
+// ListenFDs return nil, socket passing is not supported on windows
+func ListenFDs() []*os.File {
+	return nil
+}
@@ -174,11 +174,12 @@ func (a *SocksAddr) Marshal6(pad byte) []byte {
 	if a.AddressType == AddressTypeDomainName {
 		l := 1 + len(a.Address)
 		total := arrayx.PaddedLen(l, 4)
-		lg.Debugf("serialize socks 6 address domain name, padding %d to %d", total, l)
-		if total > 255 {
+		lg.Debugf("serialize socks 6 address domain name, padding %d to %d", l, total)
+		if total > 256 {
 			lg.Panic("address too long")
 		}
-		b.WriteByte(byte(total))
+		// length byte counts name and padding, not itself
+		b.WriteByte(byte(total - 1))
 		npad = total - l
 	}
 	b.Write(a.Address)
@@ -272,7 +273,7 @@ func (a *SocksAddr) Marshal5() []byte {
 	b.WriteByte(byte(a.AddressType))
 
 	if a.AddressType == AddressTypeDomainName {
-		l := 1 + len(a.Address)
+		l := len(a.Address)
 		if l > 255 {
 			lg.Panic("address too long")
 		}
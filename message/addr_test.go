@@ -1,6 +1,7 @@
 package message_test
 
 import (
+	"bytes"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -112,6 +113,29 @@ func TestAddrString(t *testing.T) {
 	}
 }
 
+func TestAddrMarshal6(t *testing.T) {
+	for _, s := range []string{"a:1", "aa:1", "aaa:1", "localhost:1", "example.com:1", "127.0.0.1:1", "[::1]:1"} {
+		a := message.ParseAddr(s)
+		b := a.Marshal6(0)
+		assert.Zero(t, len(b)%4, s)
+		a2, _, n, err := message.ParseSocksAddr6FromWithLimit(bytes.NewReader(b), 300)
+		if assert.NoError(t, err, s) {
+			assert.Equal(t, len(b), n, s)
+			assert.Equal(t, a, a2, s)
+		}
+	}
+}
+
+func TestAddrMarshal5(t *testing.T) {
+	for _, s := range []string{"a:1", "example.com:1", "127.0.0.1:1", "[::1]:1"} {
+		a := message.ParseAddr(s)
+		a2, err := message.ParseSocksAddr5From(bytes.NewReader(a.Marshal5()))
+		if assert.NoError(t, err, s) {
+			assert.Equal(t, a, a2, s)
+		}
+	}
+}
+
 /*
 func TestAddrMarshalAddress(t *testing.T) {
 	tests := []struct {
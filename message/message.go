@@ -21,6 +21,14 @@ const (
 	CommandUdpAssociate
 )
 
+// experimental commands, same values as Tor's SOCKS extension
+const (
+	// CommandResolve resolve endpoint's domain name, addresses are returned in OptionKindResolveResult
+	CommandResolve CommandCode = 0xf0
+	// CommandResolvePTR reverse lookup endpoint's IP address, names are returned in OptionKindResolveResult
+	CommandResolvePTR CommandCode = 0xf1
+)
+
 type Request struct {
 	CommandCode CommandCode
 	Endpoint    *SocksAddr
@@ -108,11 +116,11 @@ func ParseRequest5From(b io.Reader) (*Request, error) {
 	if buf[0] != Socks5Version {
 		return r, ErrVersionMismatch{Version: int(buf[0]), ConsumedBytes: buf[:1]}
 	}
-	// ver cc opLen2
-	if _, err := io.ReadFull(b, buf[1:2]); err != nil {
+	// ver cc rsv
+	if _, err := io.ReadFull(b, buf[1:3]); err != nil {
 		return nil, err
 	}
-	lg.Debug("read request5 command", buf[:4])
+	lg.Debug("read request5 command", buf[:3])
 
 	r.CommandCode = CommandCode(buf[1])
 	addr, err := ParseSocksAddr5From(b)
@@ -409,7 +417,7 @@ func (u *UDPMessage) Marshal5() []byte {
 	switch u.Type {
 	case UDPMessageDatagram:
 		lg.Debug("serialize udpmsg5 dgram")
-		addr := u.Endpoint.Marshal6(0)
+		addr := u.Endpoint.Marshal5()
 		b.WriteByte(0)
 		b.WriteByte(0)
 		b.WriteByte(0)
@@ -498,7 +506,7 @@ func ParseUDPMessage5From(b io.Reader) (*UDPMessage, error) {
 	u.Endpoint = addr
 	lg.Debug("read udpmsg5 addr", addr)
 
-	if _, err = io.ReadAll(b); err != nil {
+	if u.Data, err = io.ReadAll(b); err != nil {
 		return nil, err
 	}
 	lg.Debug("read udpmsg5 data")
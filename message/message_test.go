@@ -66,3 +66,29 @@ func TestRequest(t *testing.T) {
 		}
 	}
 }
+
+func TestUDPMessage5(t *testing.T) {
+	msg := message.UDPMessage{
+		Type:     message.UDPMessageDatagram,
+		Endpoint: message.ParseAddr("example.com:53"),
+		Data:     []byte{1, 2, 3},
+	}
+	b := msg.Marshal5()
+	assert.Equal(t, append([]byte{0, 0, 0, 3, 11}, []byte("example.com\x00\x35\x01\x02\x03")...), b)
+
+	actual, err := message.ParseUDPMessage5From(bytes.NewReader(b))
+	if assert.NoError(t, err) {
+		assert.Equal(t, msg.Endpoint, actual.Endpoint)
+		assert.Equal(t, msg.Data, actual.Data)
+	}
+}
+
+func TestRequest5(t *testing.T) {
+	r := bytes.NewReader([]byte{5, 1, 0, 1, 127, 0, 0, 1, 0, 80})
+	req, err := message.ParseRequest5From(r)
+	if assert.NoError(t, err) {
+		assert.Equal(t, message.CommandConnect, req.CommandCode)
+		assert.Equal(t, message.ParseAddr("127.0.0.1:80"), req.Endpoint)
+		assert.Zero(t, r.Len())
+	}
+}
@@ -1,9 +1,15 @@
 package message
 
-import "encoding/binary"
+import (
+	"bytes"
+	"encoding/binary"
+)
 
 const OptionKindStreamID OptionKind = 0xfd10
 
+// OptionKindResolveResult carry addresses or names found by CommandResolve and CommandResolvePTR
+const OptionKindResolveResult OptionKind = 0xfd11
+
 func init() {
 	SetOptionDataParser(OptionKindStreamID, func(b []byte) (OptionData, error) {
 		if len(b) != 4 {
@@ -11,6 +17,7 @@ func init() {
 		}
 		return StreamIDOptionData{ID: binary.BigEndian.Uint32(b)}, nil
 	})
+	SetOptionDataParser(OptionKindResolveResult, parseResolveResultOptionData)
 }
 
 type StreamIDOptionData struct {
@@ -24,3 +31,32 @@ func (s StreamIDOptionData) Marshal() []byte {
 	binary.BigEndian.PutUint32(b, s.ID)
 	return b
 }
+
+// ResolveResultOptionData is a list of IP addresses or domain names,
+// each entry is encoded as a SOCKS 6 address with port 0
+type ResolveResultOptionData struct {
+	Addresses []*SocksAddr
+}
+
+var _ OptionData = ResolveResultOptionData{}
+
+func parseResolveResultOptionData(b []byte) (OptionData, error) {
+	r := ResolveResultOptionData{}
+	for len(b) > 0 {
+		addr, _, n, err := ParseSocksAddr6FromWithLimit(bytes.NewReader(b), len(b)+1)
+		if err != nil {
+			return nil, err
+		}
+		r.Addresses = append(r.Addresses, addr)
+		b = b[n:]
+	}
+	return r, nil
+}
+
+func (r ResolveResultOptionData) Marshal() []byte {
+	b := []byte{}
+	for _, a := range r.Addresses {
+		b = append(b, a.Marshal6(0)...)
+	}
+	return b
+}
@@ -284,3 +284,22 @@ func TestIdempotenceRejectedOptionData(t *testing.T) {
 			Data: message.IdempotenceRejectedOptionData{},
 		})
 }
+
+func TestResolveResultOptionData(t *testing.T) {
+	optionDataTest(t,
+		[]byte{
+			0xfd, 0x11, 0, 44,
+			0, 0, 0, 1, 192, 0, 2, 1,
+			0, 0, 0, 4, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1,
+			0, 0, 0, 3, 7, 'a', '.', 'c', 'o', 'm', 0, 0,
+		}, message.Option{
+			Kind: message.OptionKindResolveResult,
+			Data: message.ResolveResultOptionData{
+				Addresses: []*message.SocksAddr{
+					message.ParseAddr("192.0.2.1:0"),
+					message.ParseAddr("[2001:db8::1]:0"),
+					message.ParseAddr("a.com:0"),
+				},
+			},
+		})
+}
@@ -55,6 +55,13 @@ func (s *OptionSet) AddMany(o []Option) {
 		s.Add(v)
 	}
 }
+
+// Clone return a copy of option set, option data are shared
+func (s *OptionSet) Clone() *OptionSet {
+	ret := NewOptionSet()
+	ret.AddMany(s.list)
+	return ret
+}
 func (s *OptionSet) Marshal() []byte {
 	if s.cached {
 		return s.cache
@@ -51,3 +51,17 @@ func TestOptionSet(t *testing.T) {
 		}, ops)
 
 }
+
+func TestOptionSetClone(t *testing.T) {
+	opset := message.NewOptionSet()
+	opset.Add(message.Option{Kind: message.OptionKindSessionOK, Data: message.SessionOKOptionData{}})
+	c := opset.Clone()
+	c.Add(message.Option{Kind: message.OptionKindSessionInvalid, Data: message.SessionInvalidOptionData{}})
+
+	assert.Equal(t, 1, opset.Len())
+	assert.Equal(t, 2, c.Len())
+	assert.Equal(t, []byte{0, 8, 0, 4}, opset.Marshal())
+	assert.Equal(t, []byte{0, 8, 0, 4, 0, 9, 0, 4}, c.Marshal())
+	_, ok := opset.GetData(message.OptionKindSessionInvalid)
+	assert.False(t, ok)
+}
@@ -341,3 +341,34 @@ func TestPortParityOptionData(t *testing.T) {
 			Reserve: true,
 		})
 }
+
+func TestStackOptionInfoLeg(t *testing.T) {
+	ops := message.NewOptionSet()
+	ops.Add(message.Option{Kind: message.OptionKindStack, Data: message.BaseStackOptionData{
+		ClientLeg: true, Level: message.StackOptionLevelIP, Code: message.StackOptionCodeTOS,
+		Data: &message.TOSOptionData{TOS: 1},
+	}})
+	ops.Add(message.Option{Kind: message.OptionKindStack, Data: message.BaseStackOptionData{
+		RemoteLeg: true, Level: message.StackOptionLevelIP, Code: message.StackOptionCodeTTL,
+		Data: &message.TTLOptionData{TTL: 2},
+	}})
+	assert.Equal(t, message.StackOptionInfo{message.StackOptionIPTOS: byte(1)}, message.GetStackOptionInfo(ops, true))
+	assert.Equal(t, message.StackOptionInfo{message.StackOptionIPTTL: byte(2)}, message.GetStackOptionInfo(ops, false))
+
+	combined := message.GetCombinedStackOptions(
+		message.StackOptionInfo{message.StackOptionIPTOS: byte(1), message.StackOptionIPTTL: byte(2)},
+		message.StackOptionInfo{message.StackOptionIPTOS: byte(1), message.StackOptionIPTTL: byte(3)},
+	)
+	assert.Len(t, combined, 3)
+	legs := map[byte]message.BaseStackOptionData{}
+	for _, o := range combined {
+		d := o.Data.(message.BaseStackOptionData)
+		if d.Code == message.StackOptionCodeTTL {
+			legs[d.Data.GetData().(byte)] = d
+		} else {
+			assert.True(t, d.ClientLeg && d.RemoteLeg)
+		}
+	}
+	assert.True(t, legs[2].ClientLeg && !legs[2].RemoteLeg)
+	assert.True(t, !legs[3].ClientLeg && legs[3].RemoteLeg)
+}
@@ -14,9 +14,11 @@ func getStackOptions(options *OptionSet, clientLeg bool) []Option {
 	}
 	return options.GetKindF(OptionKindStack, fn)
 }
+
+// GetStackOptionInfo collect stack options of client leg or remote leg
 func GetStackOptionInfo(ops *OptionSet, clientLeg bool) StackOptionInfo {
 	rso := StackOptionInfo{}
-	o := getStackOptions(ops, false)
+	o := getStackOptions(ops, clientLeg)
 	rso.AddMany(o)
 	return rso
 }
@@ -97,31 +99,19 @@ func (s StackOptionInfo) GetOptions(clientLeg bool, remoteLeg bool) []Option {
 	return r
 }
 
+// GetCombinedStackOptions convert client leg and remote leg options to options,
+// option with same value on both legs is merged
 func GetCombinedStackOptions(client StackOptionInfo, remote StackOptionInfo) []Option {
-	keys := make([]int, 0, len(client)+len(remote))
-	for k := range client {
-		keys = append(keys, k)
-	}
-	for k := range remote {
-		keys = append(keys, k)
-	}
-
-	ret := make([]Option, 0)
-	for _, k := range keys {
-		cval, cok := client[k]
+	ret := make([]Option, 0, len(client)+len(remote))
+	for k, cval := range client {
 		rval, rok := remote[k]
-		var op Option
-		if cok != rok || cval != rval {
-			if cok {
-				op = getOptionFromData(k, cval, true, false)
-			}
-			if rok {
-				op = getOptionFromData(k, rval, false, true)
-			}
-		} else {
-			op = getOptionFromData(k, cval, true, true)
+		ret = append(ret, getOptionFromData(k, cval, true, rok && rval == cval))
+	}
+	for k, rval := range remote {
+		if cval, cok := client[k]; cok && cval == rval {
+			continue
 		}
-		ret = append(ret, op)
+		ret = append(ret, getOptionFromData(k, rval, false, true))
 	}
 	return ret
 }
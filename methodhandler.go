@@ -3,12 +3,15 @@ package socks6
 import (
 	"bytes"
 	"context"
+	"errors"
+	"io"
 	"net"
-	"time"
 
+	"github.com/studentmain/socks6/accounting"
 	"github.com/studentmain/socks6/common"
 	"github.com/studentmain/socks6/common/lg"
 	"github.com/studentmain/socks6/common/nt"
+	"github.com/studentmain/socks6/internal/socket"
 	"github.com/studentmain/socks6/message"
 )
 
@@ -26,12 +29,15 @@ func (s *ServerWorker) ConnectHandler(
 	cc SocksConn,
 ) {
 	defer cc.Conn.Close()
-	clientAppliedOpt := message.StackOptionInfo{}
+	clientAppliedOpt := socket.SetConnOpt(baseConn(cc.Conn), message.GetStackOptionInfo(cc.Request.Options, true))
 	remoteOpt := message.GetStackOptionInfo(cc.Request.Options, false)
+	timeouts := s.timeouts(message.CommandConnect)
 
 	lg.Trace(cc.ConnId(), "dial to", cc.Destination())
 
-	rconn, remoteAppliedOpt, err := s.Outbound.Dial(ctx, remoteOpt, cc.Destination())
+	dctx, cancel := withTimeout(ctx, timeouts.Dial)
+	rconn, remoteAppliedOpt, dataSent, err := dialWithData(dctx, s.Outbound, remoteOpt, cc.Destination(), cc.InitialData)
+	cancel()
 	code := getReplyCode(err)
 
 	if code != message.OperationReplySuccess {
@@ -40,9 +46,14 @@ func (s *ServerWorker) ConnectHandler(
 		return
 	}
 	defer rconn.Close()
+	rconn = cc.accountConn(rconn, cc.Conn, cc.Destination().String())
 
 	lg.Trace(cc.ConnId(), "remote conn established")
-	if _, err := rconn.Write(cc.InitialData); err != nil {
+	if dataSent {
+		if a, ok := rconn.(*accountedConn); ok {
+			a.add(accounting.Usage{BytesUp: uint64(len(cc.InitialData))})
+		}
+	} else if _, err := rconn.Write(cc.InitialData); err != nil {
 		// it will fail again at relay()
 		lg.Info(cc.ConnId(), "can't write initdata to remote connection")
 	}
@@ -55,10 +66,26 @@ func (s *ServerWorker) ConnectHandler(
 		lg.Warning(cc.ConnId(), "can't write reply", err)
 	}
 
-	relay(ctx, cc.Conn, rconn, 10*time.Minute)
+	timeouts.relay(ctx, cc.Conn, rconn)
 	lg.Trace(cc.ConnId(), "relay end")
 }
 
+// dialWithData dial addr with outbound, and send data while connecting if outbound support it
+func dialWithData(
+	ctx context.Context,
+	outbound ServerOutbound,
+	option message.StackOptionInfo,
+	addr *message.SocksAddr,
+	data []byte,
+) (net.Conn, message.StackOptionInfo, bool, error) {
+	if o, ok := outbound.(InitialDataServerOutbound); ok {
+		conn, applied, err := o.DialWithData(ctx, option, addr, data)
+		return conn, applied, true, err
+	}
+	conn, applied, err := outbound.Dial(ctx, option, addr)
+	return conn, applied, false, err
+}
+
 func (s *ServerWorker) BindHandler(
 	ctx context.Context,
 	cc SocksConn,
@@ -70,6 +97,7 @@ func (s *ServerWorker) BindHandler(
 	defer closeConn.Defer()
 
 	subStream := cc.MuxConn != nil
+	timeouts := s.timeouts(message.CommandBind)
 
 	if !subStream {
 		// find backlogged listener
@@ -84,31 +112,25 @@ func (s *ServerWorker) BindHandler(
 
 	// not a backlogged accept
 
+	clientAppliedOpt := socket.SetConnOpt(baseConn(cc.Conn), message.GetStackOptionInfo(cc.Request.Options, true))
 	remoteOpt := message.GetStackOptionInfo(cc.Request.Options, false)
-	iBacklog, backlogged := remoteOpt[message.StackOptionTCPBacklog]
 
 	listener, remoteAppliedOpt, err := s.Outbound.Listen(ctx, remoteOpt, cc.Destination())
-	lg.Info(cc.ConnId(), "bind at", listener.Addr())
 	code := getReplyCode(err)
 	if code != message.OperationReplySuccess {
+		lg.Warningf("%s bind at %s failed %+v", cc.ConnId(), cc.Destination(), err)
 		cc.WriteReplyCode(code)
 		return
 	}
+	lg.Info(cc.ConnId(), "bind at", listener.Addr())
 
-	// add backlog option to notify client
+	// backlog is applied only when outbound listener can accept many times
+	iBacklog, backlogged := remoteAppliedOpt[message.StackOptionTCPBacklog]
 	if backlogged {
 		lg.Info(cc.ConnId(), "start backlogged bind at", listener.Addr())
-		remoteAppliedOpt.Add(message.BaseStackOptionData{
-			RemoteLeg: true,
-			Level:     message.StackOptionLevelTCP,
-			Code:      message.StackOptionCodeBacklog,
-			Data: &message.BacklogOptionData{
-				Backlog: iBacklog.(uint16),
-			},
-		})
 	}
 
-	appliedOpt := message.GetCombinedStackOptions(message.StackOptionInfo{}, remoteAppliedOpt)
+	appliedOpt := message.GetCombinedStackOptions(clientAppliedOpt, remoteAppliedOpt)
 	options := message.NewOptionSet()
 	options.AddMany(appliedOpt)
 
@@ -119,22 +141,33 @@ func (s *ServerWorker) BindHandler(
 	// bind "handshake" done
 
 	if backlogged {
-		// backlog will only simulated on server
-		// https://github.com/golang/go/issues/39000
+		// SOCKS 6 level accept queue is kept by backlogBindWorker,
+		// outbound may also set kernel backlog
 		backlog := iBacklog.(uint16)
 		// let backloglisteners handle conn
 		closeConn.Cancel()
 		if !subStream {
 			bl := newBacklogBindWorker(listener, cc, backlog)
+			bl.timeouts = timeouts
+			bl.onClose = s.track(func() { bl.close(ErrServerShutdown) })
 
 			blAddr := listener.Addr().String()
 			s.backlogWorker.Store(blAddr, bl)
+			s.collector().BacklogBindOpen()
 			lg.Trace(cc.ConnId(), "start backlog listener worker")
 			go bl.worker(ctx)
 			return
 		} else {
 			bl := newBacklogListener(ctx, listener, backlog)
+			s.collector().BacklogBindOpen()
+			// client closed listener or lost connection
 			go func() {
+				defer cc.Conn.Close()
+				io.Copy(io.Discard, cc.Conn)
+				bl.Close()
+			}()
+			go func() {
+				defer s.collector().BacklogBindClose()
 				defer bl.Close()
 				for {
 					rconn, err2 := bl.Accept()
@@ -149,7 +182,9 @@ func (s *ServerWorker) BindHandler(
 						if err3 != nil {
 							return
 						}
+						cconn = cc.limitConn(ctx, cconn)
 						defer cconn.Close()
+						rconn = cc.accountConn(rconn, cconn, rconn.RemoteAddr().String())
 
 						// reply remote address without handshake
 						rep := message.NewOperationReply()
@@ -160,21 +195,21 @@ func (s *ServerWorker) BindHandler(
 							return
 						}
 
-						relay(ctx, cconn, rconn, time.Hour)
+						timeouts.relay(ctx, cconn, rconn)
 					}(rconn)
 				}
 			}()
+			return
 		}
 	}
 	// non backlogged path
 	defer listener.Close()
 	// timeout or cancelled
+	actx, cancel := withTimeout(ctx, timeouts.BindAccept)
+	defer cancel()
 	go func() {
-		select {
-		case <-time.After(60 * time.Second):
-		case <-ctx.Done():
-		}
-		// can always close listener after 60s
+		<-actx.Done()
+		// can always close listener after timeout
 		// in normal condition, listener accept exactly 1 conn, then close, another close call is unnecessary but safe
 		// in error condition, of course close listener
 		listener.Close()
@@ -185,6 +220,9 @@ func (s *ServerWorker) BindHandler(
 	rconn, err := listener.Accept()
 	listener.Close()
 	code2 := getReplyCode(err)
+	if err != nil && errors.Is(actx.Err(), context.DeadlineExceeded) {
+		code2 = message.OperationReplyTimeout
+	}
 	if code2 != message.OperationReplySuccess {
 		cc.WriteReplyCode(code2)
 		lg.Warning(cc.ConnId(), "can't accept inbound connection", err)
@@ -193,8 +231,9 @@ func (s *ServerWorker) BindHandler(
 	lg.Info(cc.ConnId(), "inbound connection accepted")
 	cc.WriteReplyAddr(code2, rconn.RemoteAddr())
 	defer rconn.Close()
+	rconn = cc.accountConn(rconn, cc.Conn, rconn.RemoteAddr().String())
 
-	relay(ctx, cc.Conn, rconn, 10*time.Minute)
+	timeouts.relay(ctx, cc.Conn, rconn)
 	lg.Trace(cc.ConnId(), "relay end")
 }
 
@@ -202,6 +241,10 @@ func (s *ServerWorker) UdpAssociateHandler(
 	ctx context.Context,
 	cc SocksConn,
 ) {
+	if cc.front == frontSocks5 {
+		s.udpAssociate5(ctx, cc)
+		return
+	}
 	closeConn := common.NewCancellableDefer(func() {
 		cc.Conn.Close()
 	})
@@ -233,8 +276,9 @@ func (s *ServerWorker) UdpAssociateHandler(
 		return
 	}
 	var reservedAddr net.Addr
-	// reserve port
-	if ippod, ok := remoteOpt[message.StackOptionUDPPortParity]; ok {
+	// reserve port, unless outbound already did it (e.g. an upstream proxy)
+	_, reservedByOutbound := remoteAppliedOpt[message.StackOptionUDPPortParity]
+	if ippod, ok := remoteOpt[message.StackOptionUDPPortParity]; ok && !reservedByOutbound {
 		appliedPpod := message.PortParityOptionData{
 			Reserve: true,
 			Parity:  message.StackPortParityOptionParityNo,
@@ -269,8 +313,7 @@ func (s *ServerWorker) UdpAssociateHandler(
 	icmpOn := false
 	if s.EnableICMP {
 		if iicmp, ok := remoteOpt[message.StackOptionUDPUDPError]; ok {
-			i := iicmp.(message.UDPErrorOptionData)
-			if i.Availability {
+			if iicmp.(bool) {
 				icmpOn = true
 				remoteAppliedOpt.Add(message.BaseStackOptionData{
 					RemoteLeg: true,
@@ -289,8 +332,11 @@ func (s *ServerWorker) UdpAssociateHandler(
 	opset.AddMany(so)
 	cc.WriteReply(message.OperationReplySuccess, pc.LocalAddr(), opset)
 	// start association
-	assoc := newUdpAssociation(cc, pc, reservedAddr, s.AddressDependentFiltering, icmpOn)
+	assoc := newUdpAssociation(cc, pc, reservedAddr, s.AddressDependentFiltering, icmpOn, s.timeouts(message.CommandUdpAssociate))
+	assoc.onExit = s.track(assoc.exit)
+	assoc.checkDst = s.checkDestination
 	s.udpAssociation.Store(assoc.id, assoc)
+	s.collector().AssociationCreate()
 	lg.Trace("start udp assoc", assoc.id)
 	if reservedAddr != nil {
 		s.reservedUdpAddr.Store(reservedAddr.String(), assoc.id)
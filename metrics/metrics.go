@@ -0,0 +1,87 @@
+// metrics contains server instrumentation interface and a Prometheus exporter
+package metrics
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/studentmain/socks6/message"
+)
+
+// Collector is called by ServerWorker at each lifecycle point,
+// implementations must be safe for concurrent use
+type Collector interface {
+	// ConnectionOpen is called when a client stream connection or multiplexed connection accepted
+	ConnectionOpen()
+	// ConnectionClose is called when the connection processing finished
+	ConnectionClose()
+	// Handshake is called when handshake stage finished, ok is false when request rejected or failed
+	Handshake(d time.Duration, ok bool)
+	// Authenticate is called when authentication finished
+	Authenticate(success bool)
+	// Dispatch is called before a command handler is called
+	Dispatch(cmd message.CommandCode)
+	// Reply is called when an operation reply sent
+	Reply(code message.ReplyCode)
+	// RelayEnd is called when a command handler returned, usually means relay ended
+	RelayEnd(cmd message.CommandCode, d time.Duration)
+	// AssociationCreate is called when a UDP association created
+	AssociationCreate()
+	// AssociationExpire is called when a UDP association closed
+	AssociationExpire()
+	// BacklogBindOpen is called when a backlogged bind listener started
+	BacklogBindOpen()
+	// BacklogBindClose is called when a backlogged bind listener closed
+	BacklogBindClose()
+}
+
+// Nop is a Collector which do nothing
+type Nop struct{}
+
+func (Nop) ConnectionOpen()                                   {}
+func (Nop) ConnectionClose()                                  {}
+func (Nop) Handshake(d time.Duration, ok bool)                {}
+func (Nop) Authenticate(success bool)                         {}
+func (Nop) Dispatch(cmd message.CommandCode)                  {}
+func (Nop) Reply(code message.ReplyCode)                      {}
+func (Nop) RelayEnd(cmd message.CommandCode, d time.Duration) {}
+func (Nop) AssociationCreate()                                {}
+func (Nop) AssociationExpire()                                {}
+func (Nop) BacklogBindOpen()                                  {}
+func (Nop) BacklogBindClose()                                 {}
+
+var commandName = map[message.CommandCode]string{
+	message.CommandNoop:         "noop",
+	message.CommandConnect:      "connect",
+	message.CommandBind:         "bind",
+	message.CommandUdpAssociate: "udp_associate",
+	message.CommandResolve:      "resolve",
+	message.CommandResolvePTR:   "resolve_ptr",
+}
+
+var replyName = map[message.ReplyCode]string{
+	message.OperationReplySuccess:             "success",
+	message.OperationReplyServerFailure:       "server_failure",
+	message.OperationReplyNotAllowedByRule:    "not_allowed_by_rule",
+	message.OperationReplyNetworkUnreachable:  "network_unreachable",
+	message.OperationReplyHostUnreachable:     "host_unreachable",
+	message.OperationReplyConnectionRefused:   "connection_refused",
+	message.OperationReplyTTLExpired:          "ttl_expired",
+	message.OperationReplyCommandNotSupported: "command_not_supported",
+	message.OperationReplyAddressNotSupported: "address_not_supported",
+	message.OperationReplyTimeout:             "timeout",
+}
+
+func cmdLabel(cmd message.CommandCode) string {
+	if n, ok := commandName[cmd]; ok {
+		return n
+	}
+	return strconv.Itoa(int(cmd))
+}
+
+func replyLabel(code message.ReplyCode) string {
+	if n, ok := replyName[code]; ok {
+		return n
+	}
+	return strconv.Itoa(int(code))
+}
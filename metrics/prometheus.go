@@ -0,0 +1,244 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/studentmain/socks6/message"
+)
+
+// Prometheus is a Collector which serve collected metrics in Prometheus text format
+type Prometheus struct {
+	lock sync.Mutex
+
+	connActive   int64
+	connTotal    uint64
+	handshake    histogram
+	handshakeErr uint64
+	auth         map[string]uint64 // map[result]count
+	requests     map[string]uint64 // map[command]count
+	replies      map[string]uint64 // map[reply code]count
+	relay        map[string]*histogram
+	assocActive  int64
+	assocTotal   uint64
+	backlogBinds int64
+}
+
+var (
+	handshakeBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+	relayBuckets     = []float64{.1, 1, 10, 60, 300, 600, 1800, 3600}
+)
+
+func NewPrometheus() *Prometheus {
+	return &Prometheus{
+		handshake: newHistogram(handshakeBuckets),
+		auth:      map[string]uint64{},
+		requests:  map[string]uint64{},
+		replies:   map[string]uint64{},
+		relay:     map[string]*histogram{},
+	}
+}
+
+func (p *Prometheus) ConnectionOpen() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.connActive++
+	p.connTotal++
+}
+
+func (p *Prometheus) ConnectionClose() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.connActive--
+}
+
+func (p *Prometheus) Handshake(d time.Duration, ok bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.handshake.observe(d.Seconds())
+	if !ok {
+		p.handshakeErr++
+	}
+}
+
+func (p *Prometheus) Authenticate(success bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if success {
+		p.auth["success"]++
+	} else {
+		p.auth["failure"]++
+	}
+}
+
+func (p *Prometheus) Dispatch(cmd message.CommandCode) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.requests[cmdLabel(cmd)]++
+}
+
+func (p *Prometheus) Reply(code message.ReplyCode) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.replies[replyLabel(code)]++
+}
+
+func (p *Prometheus) RelayEnd(cmd message.CommandCode, d time.Duration) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	l := cmdLabel(cmd)
+	h, ok := p.relay[l]
+	if !ok {
+		nh := newHistogram(relayBuckets)
+		h = &nh
+		p.relay[l] = h
+	}
+	h.observe(d.Seconds())
+}
+
+func (p *Prometheus) AssociationCreate() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.assocActive++
+	p.assocTotal++
+}
+
+func (p *Prometheus) AssociationExpire() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.assocActive--
+}
+
+func (p *Prometheus) BacklogBindOpen() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.backlogBinds++
+}
+
+func (p *Prometheus) BacklogBindClose() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.backlogBinds--
+}
+
+// ServeHTTP write metrics in Prometheus text exposition format
+func (p *Prometheus) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	p.write(bw)
+	bw.Flush()
+}
+
+func (p *Prometheus) write(w *bufio.Writer) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	writeHeader(w, "socks6_connections_active", "gauge", "Client connections being processed.")
+	writeSample(w, "socks6_connections_active", "", float64(p.connActive))
+	writeHeader(w, "socks6_connections_total", "counter", "Client connections accepted.")
+	writeSample(w, "socks6_connections_total", "", float64(p.connTotal))
+
+	writeHeader(w, "socks6_handshake_duration_seconds", "histogram", "Time from connection accepted to command dispatched.")
+	p.handshake.write(w, "socks6_handshake_duration_seconds", "")
+	writeHeader(w, "socks6_handshake_failures_total", "counter", "Handshakes failed or rejected.")
+	writeSample(w, "socks6_handshake_failures_total", "", float64(p.handshakeErr))
+
+	writeHeader(w, "socks6_authentications_total", "counter", "Authentications by result.")
+	writeLabeled(w, "socks6_authentications_total", "result", p.auth)
+	writeHeader(w, "socks6_requests_total", "counter", "Requests dispatched by command.")
+	writeLabeled(w, "socks6_requests_total", "command", p.requests)
+	writeHeader(w, "socks6_replies_total", "counter", "Operation replies sent by reply code.")
+	writeLabeled(w, "socks6_replies_total", "code", p.replies)
+
+	writeHeader(w, "socks6_relay_duration_seconds", "histogram", "Command processing time, usually relay duration.")
+	for _, k := range sortedKeys(p.relay) {
+		p.relay[k].write(w, "socks6_relay_duration_seconds", label("command", k))
+	}
+
+	writeHeader(w, "socks6_udp_associations_active", "gauge", "Open UDP associations.")
+	writeSample(w, "socks6_udp_associations_active", "", float64(p.assocActive))
+	writeHeader(w, "socks6_udp_associations_total", "counter", "UDP associations created.")
+	writeSample(w, "socks6_udp_associations_total", "", float64(p.assocTotal))
+	writeHeader(w, "socks6_backlog_binds_active", "gauge", "Open backlogged bind listeners.")
+	writeSample(w, "socks6_backlog_binds_active", "", float64(p.backlogBinds))
+}
+
+// histogram is a cumulative histogram, caller should hold lock
+type histogram struct {
+	bounds []float64
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func newHistogram(bounds []float64) histogram {
+	return histogram{
+		bounds: bounds,
+		counts: make([]uint64, len(bounds)),
+	}
+}
+
+func (h *histogram) observe(v float64) {
+	for i, b := range h.bounds {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+func (h *histogram) write(w *bufio.Writer, name string, labels string) {
+	for i, b := range h.bounds {
+		writeSample(w, name+"_bucket", joinLabel(labels, label("le", formatFloat(b))), float64(h.counts[i]))
+	}
+	writeSample(w, name+"_bucket", joinLabel(labels, label("le", "+Inf")), float64(h.count))
+	writeSample(w, name+"_sum", labels, h.sum)
+	writeSample(w, name+"_count", labels, float64(h.count))
+}
+
+func writeHeader(w *bufio.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func writeSample(w *bufio.Writer, name, labels string, v float64) {
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(w, "%s%s %s\n", name, labels, formatFloat(v))
+}
+
+func writeLabeled(w *bufio.Writer, name, key string, m map[string]uint64) {
+	for _, k := range sortedKeys(m) {
+		writeSample(w, name, label(key, k), float64(m[k]))
+	}
+}
+
+func label(k, v string) string {
+	return k + "=" + strconv.Quote(v)
+}
+
+func joinLabel(a, b string) string {
+	if a == "" {
+		return b
+	}
+	return a + "," + b
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	ret := make([]string, 0, len(m))
+	for k := range m {
+		ret = append(ret, k)
+	}
+	sort.Strings(ret)
+	return ret
+}
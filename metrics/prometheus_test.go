@@ -0,0 +1,42 @@
+package metrics_test
+
+import (
+	"io"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/studentmain/socks6/message"
+	"github.com/studentmain/socks6/metrics"
+)
+
+func TestPrometheus(t *testing.T) {
+	p := metrics.NewPrometheus()
+	p.ConnectionOpen()
+	p.Handshake(30*time.Millisecond, true)
+	p.Authenticate(false)
+	p.Reply(message.OperationReplyNotAllowedByRule)
+	p.Reply(message.ReplyCode(0xf0))
+	p.AssociationCreate()
+	p.AssociationCreate()
+	p.AssociationExpire()
+	p.BacklogBindOpen()
+
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	b, _ := io.ReadAll(rec.Body)
+	body := string(b)
+	assert.Contains(t, rec.Header().Get("Content-Type"), "text/plain")
+	assert.Contains(t, body, "# TYPE socks6_connections_active gauge\n")
+	assert.Contains(t, body, "socks6_connections_active 1\n")
+	assert.Contains(t, body, `socks6_handshake_duration_seconds_bucket{le="0.025"} 0`)
+	assert.Contains(t, body, `socks6_handshake_duration_seconds_bucket{le="0.05"} 1`)
+	assert.Contains(t, body, `socks6_handshake_duration_seconds_bucket{le="+Inf"} 1`)
+	assert.Contains(t, body, `socks6_authentications_total{result="failure"} 1`)
+	assert.Contains(t, body, `socks6_replies_total{code="not_allowed_by_rule"} 1`)
+	assert.Contains(t, body, `socks6_replies_total{code="240"} 1`)
+	assert.Contains(t, body, "socks6_udp_associations_active 1\n")
+	assert.Contains(t, body, "socks6_udp_associations_total 2\n")
+	assert.Contains(t, body, "socks6_backlog_binds_active 1\n")
+}
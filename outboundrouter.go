@@ -0,0 +1,209 @@
+package socks6
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/studentmain/socks6/common/lg"
+	"github.com/studentmain/socks6/message"
+	"github.com/studentmain/socks6/rule"
+)
+
+type requestContextKey struct{}
+
+// withRequest attach the request being processed to ctx
+func withRequest(ctx context.Context, r rule.Request) context.Context {
+	return context.WithValue(ctx, requestContextKey{}, r)
+}
+
+// RequestFromContext return the request being processed by ServerWorker,
+// ServerOutbound can use it to decide how to fulfill the request.
+func RequestFromContext(ctx context.Context) (rule.Request, bool) {
+	r, ok := ctx.Value(requestContextKey{}).(rule.Request)
+	return r, ok
+}
+
+// BlackholeServerOutbound implements ServerOutbound, reject every request as not allowed by rule
+type BlackholeServerOutbound struct{}
+
+func (BlackholeServerOutbound) Dial(ctx context.Context, option message.StackOptionInfo, addr *message.SocksAddr) (net.Conn, message.StackOptionInfo, error) {
+	return nil, nil, &net.OpError{Op: "dial", Net: "blackhole", Addr: addr, Err: syscall.EACCES}
+}
+func (BlackholeServerOutbound) Listen(ctx context.Context, option message.StackOptionInfo, addr *message.SocksAddr) (net.Listener, message.StackOptionInfo, error) {
+	return nil, nil, &net.OpError{Op: "listen", Net: "blackhole", Addr: addr, Err: syscall.EACCES}
+}
+func (BlackholeServerOutbound) ListenPacket(ctx context.Context, option message.StackOptionInfo, addr *message.SocksAddr) (net.PacketConn, message.StackOptionInfo, error) {
+	return nil, nil, &net.OpError{Op: "listen", Net: "blackhole", Addr: addr, Err: syscall.EACCES}
+}
+
+// OutboundRoute send matched requests to a chain of outbounds
+type OutboundRoute struct {
+	// Name is used in log
+	Name string
+	// Match decide which request use this route, nil matches every request.
+	// Command and Destination are the outbound operation's, others are from RequestFromContext.
+	Match *rule.Matcher
+	// Outbounds is names of outbound, tried in order until one succeeded
+	Outbounds []string
+}
+
+// RouterServerOutbound implements ServerOutbound, choose outbounds per request by routes.
+// First matched route is used, when an outbound failed, next outbound in route is tried.
+type RouterServerOutbound struct {
+	// Outbounds is available outbounds, key is outbound name
+	Outbounds map[string]ServerOutbound
+	Routes    []OutboundRoute
+	// Default is names of outbound used when no route matched
+	Default []string
+}
+
+var _ InitialDataServerOutbound = &RouterServerOutbound{}
+var _ ResolverServerOutbound = &RouterServerOutbound{}
+
+// NewRouterServerOutbound check that all outbound names used by routes exist
+func NewRouterServerOutbound(outbounds map[string]ServerOutbound, routes []OutboundRoute, def []string) (*RouterServerOutbound, error) {
+	r := &RouterServerOutbound{
+		Outbounds: outbounds,
+		Routes:    routes,
+		Default:   def,
+	}
+	check := func(route string, names []string) error {
+		if len(names) == 0 {
+			return fmt.Errorf("route %s: no outbound", route)
+		}
+		for _, n := range names {
+			if _, ok := outbounds[n]; !ok {
+				return fmt.Errorf("route %s: unknown outbound %q", route, n)
+			}
+		}
+		return nil
+	}
+	for i, rt := range routes {
+		name := rt.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i)
+		}
+		if err := check(name, rt.Outbounds); err != nil {
+			return nil, err
+		}
+	}
+	if err := check("default", def); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// route find outbound names for request
+func (r *RouterServerOutbound) route(ctx context.Context, cmd message.CommandCode, addr *message.SocksAddr) []string {
+	req, _ := RequestFromContext(ctx)
+	req.Command = cmd
+	req.Destination = addr
+	for _, rt := range r.Routes {
+		if rt.Match.Match(req) {
+			lg.Tracef("route %s matched %s %d %s", rt.Name, req.ClientId, cmd, addr)
+			return rt.Outbounds
+		}
+	}
+	return r.Default
+}
+
+// try call fn with each outbound of route until succeeded, return last error
+func (r *RouterServerOutbound) try(ctx context.Context, cmd message.CommandCode, addr *message.SocksAddr, fn func(ServerOutbound) error) error {
+	var err error
+	for _, name := range r.route(ctx, cmd, addr) {
+		if err = fn(r.Outbounds[name]); err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return err
+		}
+		lg.Infof("outbound %s failed for %s, %v", name, addr, err)
+	}
+	if err == nil {
+		err = &net.OpError{Op: "dial", Net: "router", Addr: addr, Err: syscall.ENETUNREACH}
+	}
+	return err
+}
+
+func (r *RouterServerOutbound) Dial(ctx context.Context, option message.StackOptionInfo, addr *message.SocksAddr) (net.Conn, message.StackOptionInfo, error) {
+	var conn net.Conn
+	var applied message.StackOptionInfo
+	err := r.try(ctx, message.CommandConnect, addr, func(ob ServerOutbound) (err error) {
+		conn, applied, err = ob.Dial(ctx, option, addr)
+		return err
+	})
+	return conn, applied, err
+}
+
+// DialWithData send data while connecting when outbound support it, otherwise right after connected
+func (r *RouterServerOutbound) DialWithData(ctx context.Context, option message.StackOptionInfo, addr *message.SocksAddr, data []byte) (net.Conn, message.StackOptionInfo, error) {
+	var conn net.Conn
+	var applied message.StackOptionInfo
+	err := r.try(ctx, message.CommandConnect, addr, func(ob ServerOutbound) (err error) {
+		var sent bool
+		conn, applied, sent, err = dialWithData(ctx, ob, option, addr, data)
+		if err != nil || sent {
+			return err
+		}
+		if _, err = conn.Write(data); err != nil {
+			conn.Close()
+		}
+		return err
+	})
+	return conn, applied, err
+}
+
+// LookupIP resolve host by outbounds of matched route, outbounds can't resolve are skipped
+func (r *RouterServerOutbound) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	addr, err := message.NewAddr(net.JoinHostPort(host, "0"))
+	if err != nil {
+		return nil, err
+	}
+	var ips []net.IP
+	err = r.try(ctx, message.CommandResolve, addr, func(ob ServerOutbound) (err error) {
+		rob, ok := ob.(ResolverServerOutbound)
+		if !ok {
+			return &net.OpError{Op: "lookup", Net: "router", Addr: addr, Err: syscall.EOPNOTSUPP}
+		}
+		ips, err = rob.LookupIP(ctx, host)
+		return err
+	})
+	return ips, err
+}
+
+// LookupAddr reverse lookup ip by outbounds of matched route, outbounds can't resolve are skipped
+func (r *RouterServerOutbound) LookupAddr(ctx context.Context, ip net.IP) ([]string, error) {
+	addr := message.ConvertAddr(&net.TCPAddr{IP: ip})
+	var names []string
+	err := r.try(ctx, message.CommandResolvePTR, addr, func(ob ServerOutbound) (err error) {
+		rob, ok := ob.(ResolverServerOutbound)
+		if !ok {
+			return &net.OpError{Op: "lookup", Net: "router", Addr: addr, Err: syscall.EOPNOTSUPP}
+		}
+		names, err = rob.LookupAddr(ctx, ip)
+		return err
+	})
+	return names, err
+}
+
+func (r *RouterServerOutbound) Listen(ctx context.Context, option message.StackOptionInfo, addr *message.SocksAddr) (net.Listener, message.StackOptionInfo, error) {
+	var l net.Listener
+	var applied message.StackOptionInfo
+	err := r.try(ctx, message.CommandBind, addr, func(ob ServerOutbound) (err error) {
+		l, applied, err = ob.Listen(ctx, option, addr)
+		return err
+	})
+	return l, applied, err
+}
+
+func (r *RouterServerOutbound) ListenPacket(ctx context.Context, option message.StackOptionInfo, addr *message.SocksAddr) (net.PacketConn, message.StackOptionInfo, error) {
+	var pc net.PacketConn
+	var applied message.StackOptionInfo
+	err := r.try(ctx, message.CommandUdpAssociate, addr, func(ob ServerOutbound) (err error) {
+		pc, applied, err = ob.ListenPacket(ctx, option, addr)
+		return err
+	})
+	return pc, applied, err
+}
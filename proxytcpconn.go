@@ -2,6 +2,8 @@ package socks6
 
 import (
 	"net"
+
+	"github.com/studentmain/socks6/message"
 )
 
 // netConn is net.Conn, but private
@@ -16,6 +18,7 @@ type addrPair struct {
 type ProxyTCPConn struct {
 	netConn
 	addrPair
+	applied message.StackOptionInfo
 }
 
 var _ net.Conn = &ProxyTCPConn{}
@@ -33,3 +36,8 @@ func (t *ProxyTCPConn) ProxyLocalAddr() net.Addr {
 func (t *ProxyTCPConn) ProxyRemoteAddr() net.Addr {
 	return t.remote
 }
+
+// AppliedStackOptions return remote leg stack options applied by proxy server
+func (t *ProxyTCPConn) AppliedStackOptions() message.StackOptionInfo {
+	return t.applied
+}
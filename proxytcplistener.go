@@ -4,8 +4,11 @@ import (
 	"context"
 	"net"
 	"sync"
+	"sync/atomic"
+	"syscall"
 
 	"github.com/studentmain/socks6/common"
+	"github.com/studentmain/socks6/common/lg"
 	"github.com/studentmain/socks6/message"
 )
 
@@ -15,14 +18,34 @@ type ProxyTCPListener struct {
 	backlog uint16
 	// socks6 client, used for accept backlog connection
 	client *Client
-	// options, used for accept
+	// caller's options, used for accept and recovery
 	op *message.OptionSet
+	// stack options applied by server
+	applied message.StackOptionInfo
 	// accept call lock
 	lock sync.Mutex
 	// already accepted
 	used bool
+	// 1 when netConn is handed to accepted connection
+	handoff int32
 
+	// qlock guards netConn, bind, backlog, applied and states below,
+	// they are replaced when backlogged listener over QUIC is recovered
+	qlock sync.Mutex
+	// stream id of backlogged listener over QUIC
+	sid uint32
+	// QUIC connection listener is on
+	qc *clientQuicConn
+	// closed when recovery finished, nil when not recovering
+	recovery chan struct{}
+	closed   bool
+
+	// accepted connections over QUIC, delivered by Client.muxAccept
 	qch chan net.Conn
+	// closed when listener over QUIC closed or failed
+	qdone chan struct{}
+	qerr  error
+	qonce sync.Once
 }
 
 var _ net.Listener = &ProxyTCPListener{}
@@ -38,11 +61,14 @@ func (t *ProxyTCPListener) AcceptContext(ctx context.Context) (net.Conn, error)
 
 	// quic enabled
 	if t.qch != nil {
-		conn, ok := <-t.qch
-		if !ok {
-			return nil, &net.OpError{}
+		select {
+		case conn := <-t.qch:
+			return conn, nil
+		case <-t.qdone:
+			return nil, &net.OpError{Op: "accept", Net: "socks6", Addr: t.Addr(), Err: t.qerr}
+		case <-ctx.Done():
+			return nil, ctx.Err()
 		}
-		return conn, nil
 	}
 
 	t.lock.Lock()
@@ -57,6 +83,10 @@ func (t *ProxyTCPListener) AcceptContext(ctx context.Context) (net.Conn, error)
 	if err != nil {
 		return nil, err
 	}
+	if oprep.ReplyCode != message.OperationReplySuccess {
+		t.used = true
+		return nil, &net.OpError{Op: "accept", Net: "socks6", Addr: t.bind, Err: convertReplyError(oprep.ReplyCode)}
+	}
 	cconn := ProxyTCPConn{
 		addrPair: addrPair{
 			local:  t.bind,
@@ -66,6 +96,7 @@ func (t *ProxyTCPListener) AcceptContext(ctx context.Context) (net.Conn, error)
 	if t.backlog == 0 {
 		t.used = true
 		cconn.netConn = t.netConn
+		atomic.StoreInt32(&t.handoff, 1)
 		return &cconn, nil
 	} else {
 		// unlock asap, BindRequest is time consuming
@@ -80,20 +111,188 @@ func (t *ProxyTCPListener) AcceptContext(ctx context.Context) (net.Conn, error)
 	}
 }
 
+// request send BIND request,
+// it's sent again with same stream id when backlogged listener over QUIC is recovered
+func (t *ProxyTCPListener) request(ctx context.Context, addr net.Addr) error {
+	c := t.client
+	option := message.NewOptionSet()
+	if t.op != nil {
+		option = t.op.Clone()
+	}
+	if c.Backlog > 0 {
+		option.Add(message.Option{
+			Kind: message.OptionKindStack,
+			Data: message.BaseStackOptionData{
+				ClientLeg: false,
+				RemoteLeg: true,
+				Level:     message.StackOptionLevelTCP,
+				Code:      message.StackOptionCodeBacklog,
+				Data: &message.BacklogOptionData{
+					Backlog: uint16(c.Backlog),
+				},
+			},
+		})
+		if c.useQuic() {
+			option.Add(message.Option{
+				Kind: message.OptionKindStreamID,
+				Data: message.StreamIDOptionData{
+					ID: t.sid,
+				},
+			})
+		}
+	}
+
+	sconn, opr, err := c.handshake(ctx, message.CommandBind, addr, []byte{}, option)
+	if err != nil {
+		return err
+	}
+	rso := message.GetStackOptionInfo(opr.Options, false)
+	backlog := uint16(0)
+	if ibl, ok := rso[message.StackOptionTCPBacklog]; ok {
+		backlog = ibl.(uint16)
+	}
+	qs, overQuic := sconn.(*quicStream)
+	overQuic = overQuic && backlog > 0
+
+	t.qlock.Lock()
+	defer t.qlock.Unlock()
+	if t.closed {
+		sconn.Close()
+		return net.ErrClosed
+	}
+	if t.qch != nil && !overQuic {
+		// recovered listener should be backlogged again
+		sconn.Close()
+		return &net.OpError{Op: "listen", Net: "socks6", Addr: addr, Err: syscall.EOPNOTSUPP}
+	}
+	old := t.netConn
+	t.netConn = sconn
+	t.bind = opr.Endpoint
+	t.backlog = backlog
+	t.applied = rso
+	if overQuic {
+		t.qc = qs.q
+		if t.qch == nil {
+			t.qch = make(chan net.Conn, backlog)
+			t.qdone = make(chan struct{})
+		}
+		c.qbind.Store(t.sid, t)
+	}
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+// deliver queue connection accepted over QUIC, it's dropped when queue is full
+func (t *ProxyTCPListener) deliver(conn net.Conn) {
+	select {
+	case <-t.qdone:
+		conn.Close()
+		return
+	default:
+	}
+	select {
+	case t.qch <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+// fail stop accepting over QUIC, Accept return err after queued connections
+func (t *ProxyTCPListener) fail(err error) {
+	t.qonce.Do(func() {
+		t.qerr = err
+		close(t.qdone)
+		t.client.qbind.Delete(t.sid)
+	})
+}
+
+// startRecovery send BIND request on current QUIC connection when listener is on q.
+// Returned channel is closed when recovery finished, it's nil when there is nothing to do.
+func (t *ProxyTCPListener) startRecovery(q *clientQuicConn) chan struct{} {
+	t.qlock.Lock()
+	defer t.qlock.Unlock()
+	if t.closed || t.qc != q {
+		return t.recovery
+	}
+	if t.recovery == nil {
+		t.recovery = make(chan struct{})
+		go t.recover(t.recovery)
+	}
+	return t.recovery
+}
+
+// recover bind at same address again, listener is failed when it can't be recovered
+func (t *ProxyTCPListener) recover(done chan struct{}) {
+	defer close(done)
+	addr := t.Addr()
+	// server release the address after old control stream closed
+	t.conn().Close()
+	err := t.client.retryRecovery(func(ctx context.Context) error {
+		err := t.request(ctx, addr)
+		if err != nil && t.isClosed() {
+			return nil
+		}
+		return err
+	})
+	t.qlock.Lock()
+	t.recovery = nil
+	t.qlock.Unlock()
+	if err != nil {
+		lg.Warning("can't recover listener at", addr, err)
+		t.fail(err)
+	}
+}
+
+func (t *ProxyTCPListener) isClosed() bool {
+	t.qlock.Lock()
+	defer t.qlock.Unlock()
+	return t.closed
+}
+
+// conn return current control connection
+func (t *ProxyTCPListener) conn() netConn {
+	t.qlock.Lock()
+	defer t.qlock.Unlock()
+	return t.netConn
+}
+
 // [localaddr]----netConn----[[proxyremoteaddr][addr]]<--
 
 func (t *ProxyTCPListener) Addr() net.Addr {
+	t.qlock.Lock()
+	defer t.qlock.Unlock()
 	return t.bind
 }
 
 func (t *ProxyTCPListener) LocalAddr() net.Addr {
-	return t.netConn.LocalAddr()
+	return t.conn().LocalAddr()
 }
 
 func (t *ProxyTCPListener) ProxyRemoteAddr() net.Addr {
-	return t.netConn.RemoteAddr()
+	return t.conn().RemoteAddr()
 }
 
+// AppliedStackOptions return remote leg stack options applied by proxy server
+func (t *ProxyTCPListener) AppliedStackOptions() message.StackOptionInfo {
+	t.qlock.Lock()
+	defer t.qlock.Unlock()
+	return t.applied
+}
+
+// Close stop waiting for inbound connection,
+// the connection already accepted without backlog is not affected.
 func (t *ProxyTCPListener) Close() error {
-	return t.netConn.Close()
+	if atomic.LoadInt32(&t.handoff) == 1 {
+		return nil
+	}
+	t.qlock.Lock()
+	t.closed = true
+	conn := t.netConn
+	t.qlock.Unlock()
+	if t.qch != nil {
+		t.fail(net.ErrClosed)
+	}
+	return conn.Close()
 }
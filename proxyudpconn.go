@@ -2,9 +2,11 @@ package socks6
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"math/rand"
 	"net"
+	"os"
 	"sync"
 	"syscall"
 	"time"
@@ -12,51 +14,112 @@ import (
 	"github.com/studentmain/socks6/common"
 	"github.com/studentmain/socks6/common/lg"
 	"github.com/studentmain/socks6/common/nt"
-	"github.com/studentmain/socks6/internal"
 	"github.com/studentmain/socks6/message"
 )
 
-// ProxyUDPConn represents a SOCKS 6 UDP client "connection", implements net.PacketConn, net.Conn
+// ProxyUDPConn represents a SOCKS 6 UDP client "connection", implements net.PacketConn, net.Conn.
+// Association over QUIC is recovered on a new QUIC connection when current one is lost or migrated.
 type ProxyUDPConn struct {
-	origConn   net.Conn     // original tcp conn
-	dataConn   nt.SeqPacket // data conn
 	overTcp    bool
 	expectAddr net.Addr // expected remote addr
 	icmp       bool     // accept icmp error report
 
-	assocId uint64
-
 	parseLock sync.Mutex // needn't write lock, write message is finished in 1 write, but read message is in many read
-	rbind     net.Addr   // remote bind addr
-
-	acked   bool
-	ackwg   sync.WaitGroup
-	lastErr error // todo actually use lastErr ?
 
-	c Client
+	// alock guards association state, which is replaced when association is recovered
+	alock    sync.Mutex
+	origConn net.Conn                // original tcp conn
+	dataConn nt.SeqPacket            // data conn
+	assocId  uint64                  // association id
+	rbind    net.Addr                // remote bind addr
+	applied  message.StackOptionInfo // stack options applied by server
+	qc       *clientQuicConn         // QUIC connection association is on, nil when QUIC is not used
+	recovery chan struct{}           // closed when recovery finished, nil when not recovering
+	closed   bool
+	closeErr error // returned by operations after closed
+	acked    bool  // current association acked by server
+
+	c *Client
+	// request, sent again when association recovered
+	reqAddr   net.Addr
+	reqOption *message.OptionSet
 }
 
-// init setup association
-func (u *ProxyUDPConn) init() error {
+// associate send UDP ASSOCIATE request and setup association,
+// it's called again when association is recovered
+func (u *ProxyUDPConn) associate(ctx context.Context) error {
+	sconn, opr, err := u.c.handshake(ctx, message.CommandUdpAssociate, u.reqAddr, []byte{}, u.reqOption)
+	if err != nil {
+		return err
+	}
+	netErr := net.OpError{Op: "dial", Net: "socks6", Addr: u.reqAddr, Source: sconn.LocalAddr()}
+	var q *clientQuicConn
+	if qs, ok := sconn.(*quicStream); ok {
+		q = qs.q
+	}
+
+	var dataConn nt.SeqPacket
+	if u.overTcp {
+		dataConn = nt.WrapNetConnUDP(sconn)
+	} else if q == nil {
+		dconn, err2 := u.c.connectDatagram(ctx)
+		if err2 != nil {
+			sconn.Close()
+			netErr.Err = err2
+			return &netErr
+		}
+		dataConn = dconn
+	}
+	closeConn := common.NewCancellableDefer(func() {
+		sconn.Close()
+		if dataConn != nil {
+			dataConn.Close()
+		}
+	})
+	defer closeConn.Defer()
+
 	// read assoc init
 	// assoc init is always from orig conn
-	a, err := message.ParseUDPMessageFrom(u.origConn)
+	a, err := message.ParseUDPMessageFrom(sconn)
 	if err != nil {
-		return err
+		netErr.Err = err
+		return &netErr
 	}
 	if a.Type != message.UDPMessageAssociationInit {
-		return ErrUnexpectedMessage
+		netErr.Err = ErrUnexpectedMessage
+		return &netErr
 	}
-	u.assocId = a.AssociationID
 
+	u.alock.Lock()
+	if u.closed {
+		u.alock.Unlock()
+		return net.ErrClosed
+	}
+	closeConn.Cancel()
+	old := u.origConn
 	// set client quic mux filter if necessary
-	if !u.overTcp && u.c.QUIC {
-		msp := &muxSeqPacket{
-			SeqPacket: u.dataConn,
-			ch:        make(chan nt.Datagram, 64),
+	if dataConn == nil {
+		msp, ok := u.dataConn.(*muxSeqPacket)
+		if ok {
+			msp.setConn(q)
+			u.c.qudpconn.Delete(u.assocId)
+		} else {
+			msp = newMuxSeqPacket(q)
 		}
-		u.dataConn = msp
-		u.c.qudpconn.Store(u.assocId, msp)
+		dataConn = msp
+		u.c.qudpconn.Store(a.AssociationID, msp)
+	}
+	u.origConn = sconn
+	u.dataConn = dataConn
+	u.assocId = a.AssociationID
+	u.rbind = opr.Endpoint
+	u.applied = message.GetStackOptionInfo(opr.Options, false)
+	u.qc = q
+	u.acked = false
+	u.alock.Unlock()
+	if old != nil {
+		// old association is replaced, server should release it
+		old.Close()
 	}
 
 	// needn't wait for ACK before read data
@@ -65,12 +128,12 @@ func (u *ProxyUDPConn) init() error {
 	// ack is send over tcp:
 	// 1. won't lost
 	// 2. can be slower than data over udp
-	go u.rexmitFirstPacket()
-	u.readAck()
+	go u.rexmitFirstPacket(sconn, dataConn, a.AssociationID)
+	u.readAck(sconn, a.AssociationID)
 	return nil
 }
 
-func (u *ProxyUDPConn) rexmitFirstPacket() {
+func (u *ProxyUDPConn) rexmitFirstPacket(origConn net.Conn, dataConn nt.SeqPacket, assocId uint64) {
 	<-time.After(5 * time.Second)
 
 	// it's possible to have a "smart fallback"
@@ -81,27 +144,28 @@ func (u *ProxyUDPConn) rexmitFirstPacket() {
 		// randomized timeout to somehow mitigate it
 		ms := time.Duration(rand.Intn(5000)+5000) * time.Millisecond
 		<-time.After(ms)
-		if u.acked {
+		u.alock.Lock()
+		stop := u.acked || u.closed || u.origConn != origConn
+		u.alock.Unlock()
+		if stop {
 			break
 		}
 
 		msg := message.UDPMessage{
 			Type:          message.UDPMessageDatagram,
-			AssociationID: u.assocId,
+			AssociationID: assocId,
 			Endpoint:      message.AddrIPv4Zero,
 			Data:          []byte{},
 		}
-		err := u.dataConn.Reply(msg.Marshal())
+		err := dataConn.Reply(msg.Marshal())
 		if err != nil {
-			u.lastErr = err
-			u.Close()
+			u.fail(origConn, err)
 			return
 		}
 	}
-	u.lastErr = errors.New("timeout")
 }
 
-func (u *ProxyUDPConn) readAck() {
+func (u *ProxyUDPConn) readAck(origConn net.Conn, assocId uint64) {
 	// block TCP read
 	// lock when init
 	u.parseLock.Lock()
@@ -110,21 +174,20 @@ func (u *ProxyUDPConn) readAck() {
 		// to avoid goroutine shedule cause lock delayed
 		defer u.parseLock.Unlock()
 
-		ack, err := message.ParseUDPMessageFrom(u.origConn)
-		failed := true
-		if err != nil {
-			u.lastErr = err
-		} else if ack.AssociationID != u.assocId {
-			u.lastErr = ErrAssociationMismatch
-		} else if ack.Type != message.UDPMessageAssociationAck {
-			u.lastErr = ErrUnexpectedMessage
-		} else {
-			failed = false
+		ack, err := message.ParseUDPMessageFrom(origConn)
+		if err == nil && ack.AssociationID != assocId {
+			err = ErrAssociationMismatch
+		} else if err == nil && ack.Type != message.UDPMessageAssociationAck {
+			err = ErrUnexpectedMessage
 		}
-		u.acked = true
+		u.alock.Lock()
+		if u.origConn == origConn {
+			u.acked = true
+		}
+		u.alock.Unlock()
 
-		if failed {
-			u.Close()
+		if err != nil {
+			u.fail(origConn, err)
 			return
 		}
 
@@ -133,10 +196,9 @@ func (u *ProxyUDPConn) readAck() {
 			go func() {
 				buf := make([]byte, 256)
 				for {
-					_, err := u.origConn.Read(buf)
+					_, err := origConn.Read(buf)
 					if err != nil {
-						u.lastErr = err
-						u.Close()
+						u.fail(origConn, err)
 						return
 					}
 				}
@@ -145,6 +207,98 @@ func (u *ProxyUDPConn) readAck() {
 	}()
 }
 
+// state return current association state
+func (u *ProxyUDPConn) state() (origConn net.Conn, dataConn nt.SeqPacket, assocId uint64, q *clientQuicConn) {
+	u.alock.Lock()
+	defer u.alock.Unlock()
+	return u.origConn, u.dataConn, u.assocId, u.qc
+}
+
+// isCurrent report whether origConn belongs to current association
+func (u *ProxyUDPConn) isCurrent(origConn net.Conn) bool {
+	u.alock.Lock()
+	defer u.alock.Unlock()
+	return u.origConn == origConn
+}
+
+// overQuic report whether association is on shared QUIC connection
+func (u *ProxyUDPConn) overQuic() bool {
+	u.alock.Lock()
+	defer u.alock.Unlock()
+	return u.qc != nil
+}
+
+// fail close association on origConn with err, it's recovered instead when QUIC connection lost
+func (u *ProxyUDPConn) fail(origConn net.Conn, err error) {
+	cur, _, _, q := u.state()
+	if cur != origConn {
+		// replaced by recovered association
+		return
+	}
+	if q != nil && q.lostBy(err) {
+		u.startRecovery(q)
+		return
+	}
+	u.closeWithError(err)
+}
+
+// startRecovery associate again on current QUIC connection when association is on q.
+// Returned channel is closed when recovery finished, it's nil when there is nothing to do.
+func (u *ProxyUDPConn) startRecovery(q *clientQuicConn) chan struct{} {
+	u.alock.Lock()
+	defer u.alock.Unlock()
+	if u.closed || u.qc != q {
+		return u.recovery
+	}
+	if u.recovery == nil {
+		u.recovery = make(chan struct{})
+		go u.recover(u.recovery)
+	}
+	return u.recovery
+}
+
+// recover associate again, association is closed when it can't be recovered
+func (u *ProxyUDPConn) recover(done chan struct{}) {
+	defer close(done)
+	err := u.c.retryRecovery(func(ctx context.Context) error {
+		err := u.associate(ctx)
+		if err != nil && u.isClosed() {
+			return nil
+		}
+		return err
+	})
+	u.alock.Lock()
+	u.recovery = nil
+	u.alock.Unlock()
+	if err != nil {
+		lg.Warning("can't recover udp association", err)
+		u.closeWithError(err)
+	}
+}
+
+// awaitRecovery wait until association on origConn recovered when err is caused by QUIC connection lost,
+// return false when it's not recoverable
+func (u *ProxyUDPConn) awaitRecovery(origConn net.Conn, q *clientQuicConn, err error) bool {
+	if q == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		return false
+	}
+	if u.isCurrent(origConn) && !q.lostBy(err) {
+		return false
+	}
+	if ch := u.startRecovery(q); ch != nil {
+		<-ch
+	}
+	u.alock.Lock()
+	defer u.alock.Unlock()
+	return !u.closed && u.origConn != origConn
+}
+
+func (u *ProxyUDPConn) isClosed() bool {
+	u.alock.Lock()
+	defer u.alock.Unlock()
+	return u.closed
+}
+
 // Read implements net.Conn
 func (u *ProxyUDPConn) Read(p []byte) (int, error) {
 	if u.expectAddr == nil {
@@ -169,7 +323,6 @@ func (u *ProxyUDPConn) Read(p []byte) (int, error) {
 // ReadFrom implements net.PacketConn
 func (u *ProxyUDPConn) ReadFrom(p []byte) (int, net.Addr, error) {
 	lg.Debug("readfrom")
-	cd := common.NewCancellableDefer(func() { u.Close() })
 
 	netErr := net.OpError{
 		Op:     "readfrom",
@@ -178,46 +331,19 @@ func (u *ProxyUDPConn) ReadFrom(p []byte) (int, net.Addr, error) {
 		Addr:   u.ProxyRemoteAddr(),
 	}
 	// read message
-	h := message.UDPMessage{}
-	if u.overTcp {
-		u.parseLock.Lock()
-		defer u.parseLock.Unlock()
-
-		// here, orig conn is data conn without seqpacket wrapper
-		// only read need to operate with stream
-		h2, err := message.ParseUDPMessageFrom(u.origConn)
-		h = *h2
-		if err != nil {
-			netErr.Err = err
-			return 0, nil, &netErr
-		}
-	} else {
-		// good old "UDP packet size" problem
-		// also cause some radar "reflection" (UDP is known for it's low RCS, so not a big problem)
-		// UDP allow 64k, path MTU usually not, but IP fragmentation exist, but IP fragmentation bad
-		buf := internal.BytesPool4k.Rent()
-		defer internal.BytesPool4k.Return(buf)
-
-		d, err := u.dataConn.NextDatagram()
-		if err != nil {
-			netErr.Err = err
-			return 0, nil, &netErr
-		}
-		h2, err := message.ParseUDPMessageFrom(bytes.NewReader(d.Data()))
-		h = *h2
-		if err != nil {
-			netErr.Err = err
-			return 0, nil, err
-		}
+	h, assocId, err := u.readMessage()
+	if err != nil {
+		netErr.Err = err
+		return 0, nil, &netErr
 	}
 
 	// silently drop to avoid DoS? is it possible or necessary (it's only possible in plaintext)?
-	if h.AssociationID != u.assocId {
+	if h.AssociationID != assocId {
 		netErr.Err = ErrAssociationMismatch
 		return 0, nil, &netErr
 	}
 	if h.Type == message.UDPMessageError && u.icmp {
-		netErr.Err = convertIcmpError(h)
+		netErr.Err = convertIcmpError(*h)
 		return 0, nil, &netErr
 	} else if h.Type != message.UDPMessageDatagram {
 		netErr.Err = ErrUnexpectedMessage
@@ -240,10 +366,42 @@ func (u *ProxyUDPConn) ReadFrom(p []byte) (int, net.Addr, error) {
 		n = copy(p[:ld], h.Data)
 	}
 
-	cd.Cancel()
 	return n, addr, nil
 }
 
+// readMessage read a message of current association, wait for recovery when QUIC connection lost
+func (u *ProxyUDPConn) readMessage() (*message.UDPMessage, uint64, error) {
+	for {
+		origConn, dataConn, assocId, q := u.state()
+		h, err := u.readMessageFrom(origConn, dataConn)
+		if err == nil {
+			return h, assocId, nil
+		}
+		if !u.awaitRecovery(origConn, q, err) {
+			return nil, 0, u.closeError(err)
+		}
+	}
+}
+
+func (u *ProxyUDPConn) readMessageFrom(origConn net.Conn, dataConn nt.SeqPacket) (*message.UDPMessage, error) {
+	if u.overTcp {
+		u.parseLock.Lock()
+		defer u.parseLock.Unlock()
+
+		// here, orig conn is data conn without seqpacket wrapper
+		// only read need to operate with stream
+		return message.ParseUDPMessageFrom(origConn)
+	}
+	// good old "UDP packet size" problem
+	// also cause some radar "reflection" (UDP is known for it's low RCS, so not a big problem)
+	// UDP allow 64k, path MTU usually not, but IP fragmentation exist, but IP fragmentation bad
+	d, err := dataConn.NextDatagram()
+	if err != nil {
+		return nil, err
+	}
+	return message.ParseUDPMessageFrom(bytes.NewReader(d.Data()))
+}
+
 // Write implements net.Conn
 func (u *ProxyUDPConn) Write(p []byte) (int, error) {
 	if u.expectAddr == nil {
@@ -265,40 +423,75 @@ func (u *ProxyUDPConn) WriteTo(p []byte, addr net.Addr) (int, error) {
 		Source: u.LocalAddr(),
 		Addr:   u.ProxyRemoteAddr(),
 	}
-	if netErr.Err != nil {
-		u.Close()
-		return 0, &netErr
-	}
-
-	h := message.UDPMessage{
-		Type:          message.UDPMessageDatagram,
-		AssociationID: u.assocId,
-		Endpoint:      message.ConvertAddr(addr),
-		Data:          p,
-	}
 
-	err := u.dataConn.Reply(h.Marshal())
-	if err != nil {
-		netErr.Err = err
-		u.Close()
-		return 0, &netErr
+	for {
+		origConn, dataConn, assocId, q := u.state()
+		h := message.UDPMessage{
+			Type:          message.UDPMessageDatagram,
+			AssociationID: assocId,
+			Endpoint:      message.ConvertAddr(addr),
+			Data:          p,
+		}
+		err := dataConn.Reply(h.Marshal())
+		if err == nil {
+			return len(p), nil
+		}
+		// datagram is sent again on recovered association
+		if !u.awaitRecovery(origConn, q, err) {
+			netErr.Err = u.closeError(err)
+			u.Close()
+			return 0, &netErr
+		}
 	}
-	return len(p), nil
 }
 
 func (u *ProxyUDPConn) Close() error {
+	return u.closeWithError(net.ErrClosed)
+}
+
+// closeWithError close association, later operations return err
+func (u *ProxyUDPConn) closeWithError(err error) error {
+	u.alock.Lock()
+	if u.closed {
+		u.alock.Unlock()
+		return nil
+	}
+	u.closed = true
+	u.closeErr = err
 	u.acked = true
-	e1 := u.origConn.Close()
-	e2 := u.dataConn.Close()
+	origConn, dataConn, assocId, q := u.origConn, u.dataConn, u.assocId, u.qc
+	u.alock.Unlock()
+
+	if msp, ok := dataConn.(*muxSeqPacket); ok {
+		// stop receiving from shared QUIC connection
+		u.c.qudpconn.Delete(assocId)
+		msp.fail(err)
+	}
+	if q != nil {
+		u.c.qassoc.Delete(u)
+	}
+	e1 := origConn.Close()
+	e2 := dataConn.Close()
 	if e1 != nil {
 		return e1
 	}
 	return e2
 }
 
+// closeError return the error association closed with, or err when it's not closed
+func (u *ProxyUDPConn) closeError(err error) error {
+	u.alock.Lock()
+	defer u.alock.Unlock()
+	if u.closed {
+		return u.closeErr
+	}
+	return err
+}
+
 // LocalAddr return client-proxy connection's client side address
 func (u *ProxyUDPConn) LocalAddr() net.Addr {
-	return u.dataConn.LocalAddr()
+	_, dataConn, _, _ := u.state()
+	return dataConn.LocalAddr()
 }
 
 func (u *ProxyUDPConn) RemoteAddr() net.Addr {
@@ -307,22 +500,35 @@ func (u *ProxyUDPConn) RemoteAddr() net.Addr {
 
 // ProxyBindAddr return proxy's outbound address
 func (u *ProxyUDPConn) ProxyBindAddr() net.Addr {
+	u.alock.Lock()
+	defer u.alock.Unlock()
 	return u.rbind
 }
 
 // ProxyRemoteAddr return client-proxy connection's proxy side address
 func (u *ProxyUDPConn) ProxyRemoteAddr() net.Addr {
-	return u.dataConn.RemoteAddr()
+	_, dataConn, _, _ := u.state()
+	return dataConn.RemoteAddr()
+}
+
+// AppliedStackOptions return remote leg stack options applied by proxy server
+func (u *ProxyUDPConn) AppliedStackOptions() message.StackOptionInfo {
+	u.alock.Lock()
+	defer u.alock.Unlock()
+	return u.applied
 }
 
 func (u *ProxyUDPConn) SetDeadline(t time.Time) error {
-	return u.dataConn.SetDeadline(t)
+	_, dataConn, _, _ := u.state()
+	return dataConn.SetDeadline(t)
 }
 func (u *ProxyUDPConn) SetReadDeadline(t time.Time) error {
-	return u.dataConn.SetReadDeadline(t)
+	_, dataConn, _, _ := u.state()
+	return dataConn.SetReadDeadline(t)
 }
 func (u *ProxyUDPConn) SetWriteDeadline(t time.Time) error {
-	return u.dataConn.SetWriteDeadline(t)
+	_, dataConn, _, _ := u.state()
+	return dataConn.SetWriteDeadline(t)
 }
 
 func convertIcmpError(msg message.UDPMessage) error {
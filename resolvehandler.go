@@ -0,0 +1,119 @@
+package socks6
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+
+	"github.com/studentmain/socks6/common/lg"
+	"github.com/studentmain/socks6/message"
+)
+
+// maxResolveResults limit number of addresses or names in a resolve reply
+const maxResolveResults = 32
+
+// ResolveHandler resolve destination domain name with Outbound, it's experimental and not registered by default,
+// use it as CommandHandlers[message.CommandResolve].
+// Reply endpoint is the first address, so SOCKS 5 clients get same reply as Tor's RESOLVE,
+// all addresses are sent in OptionKindResolveResult option.
+func (s *ServerWorker) ResolveHandler(
+	ctx context.Context,
+	cc SocksConn,
+) {
+	defer cc.Conn.Close()
+	dst := cc.Destination()
+	if dst.AddressType != message.AddressTypeDomainName {
+		// nothing to resolve
+		s.writeResolveReply(cc, []*message.SocksAddr{{AddressType: dst.AddressType, Address: dst.Address}})
+		return
+	}
+	r, ok := s.Outbound.(ResolverServerOutbound)
+	if !ok {
+		cc.WriteReplyCode(message.OperationReplyCommandNotSupported)
+		return
+	}
+
+	lg.Trace(cc.ConnId(), "resolve", dst)
+	rctx, cancel := withTimeout(ctx, s.timeouts(message.CommandResolve).Dial)
+	ips, err := r.LookupIP(rctx, string(dst.Address))
+	cancel()
+	if err != nil {
+		lg.Info(cc.ConnId(), "resolve", dst, "failed", err)
+		cc.WriteReplyCode(resolveReplyCode(err))
+		return
+	}
+	result := []*message.SocksAddr{}
+	for _, ip := range ips {
+		result = append(result, message.ConvertAddr(&net.TCPAddr{IP: ip}))
+	}
+	s.writeResolveReply(cc, result)
+}
+
+// ResolvePTRHandler reverse lookup destination IP address with Outbound, it's experimental and not registered by default,
+// use it as CommandHandlers[message.CommandResolvePTR].
+// Reply endpoint is the first name, all names are sent in OptionKindResolveResult option.
+func (s *ServerWorker) ResolvePTRHandler(
+	ctx context.Context,
+	cc SocksConn,
+) {
+	defer cc.Conn.Close()
+	dst := cc.Destination()
+	if dst.AddressType == message.AddressTypeDomainName {
+		cc.WriteReplyCode(message.OperationReplyAddressNotSupported)
+		return
+	}
+	r, ok := s.Outbound.(ResolverServerOutbound)
+	if !ok {
+		cc.WriteReplyCode(message.OperationReplyCommandNotSupported)
+		return
+	}
+
+	lg.Trace(cc.ConnId(), "reverse lookup", dst)
+	rctx, cancel := withTimeout(ctx, s.timeouts(message.CommandResolvePTR).Dial)
+	names, err := r.LookupAddr(rctx, net.IP(dst.Address))
+	cancel()
+	if err != nil {
+		lg.Info(cc.ConnId(), "reverse lookup", dst, "failed", err)
+		cc.WriteReplyCode(resolveReplyCode(err))
+		return
+	}
+	result := []*message.SocksAddr{}
+	for _, name := range names {
+		a, err := message.NewAddr(net.JoinHostPort(strings.TrimSuffix(name, "."), "0"))
+		if err != nil || a.AddressType != message.AddressTypeDomainName {
+			continue
+		}
+		result = append(result, a)
+	}
+	s.writeResolveReply(cc, result)
+}
+
+// writeResolveReply reply result in option, host unreachable when result is empty
+func (s *ServerWorker) writeResolveReply(cc SocksConn, result []*message.SocksAddr) {
+	if len(result) == 0 {
+		cc.WriteReplyCode(message.OperationReplyHostUnreachable)
+		return
+	}
+	if len(result) > maxResolveResults {
+		result = result[:maxResolveResults]
+	}
+	ops := message.NewOptionSet()
+	ops.Add(message.Option{
+		Kind: message.OptionKindResolveResult,
+		Data: message.ResolveResultOptionData{Addresses: result},
+	})
+	cc.WriteReply(message.OperationReplySuccess, result[0], ops)
+}
+
+// resolveReplyCode convert lookup error to reply code, name not found is host unreachable
+func resolveReplyCode(err error) message.ReplyCode {
+	dnsErr := &net.DNSError{}
+	if errors.As(err, &dnsErr) {
+		if dnsErr.IsTimeout {
+			return message.OperationReplyTimeout
+		}
+		return message.OperationReplyHostUnreachable
+	}
+	return getReplyCode(err)
+}
@@ -0,0 +1,311 @@
+// Package resolver resolve domain names for outbound connections,
+// with upstream DNS servers, cache, static hosts and address family preference.
+package resolver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/studentmain/socks6/common/lg"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Preference decide which address family is used and tried first
+type Preference int
+
+const (
+	// PreferIPv6 put IPv6 addresses first, as RFC 6724 does
+	PreferIPv6 Preference = iota
+	// PreferIPv4 put IPv4 addresses first
+	PreferIPv4
+	// IPv4Only drop IPv6 addresses
+	IPv4Only
+	// IPv6Only drop IPv4 addresses
+	IPv6Only
+)
+
+var preferenceName = map[Preference]string{
+	PreferIPv6: "prefer_ipv6",
+	PreferIPv4: "prefer_ipv4",
+	IPv4Only:   "ipv4_only",
+	IPv6Only:   "ipv6_only",
+}
+
+func (p Preference) String() string {
+	if n, ok := preferenceName[p]; ok {
+		return n
+	}
+	return fmt.Sprintf("preference(%d)", int(p))
+}
+
+func (p Preference) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+func (p *Preference) UnmarshalText(b []byte) error {
+	s := strings.ToLower(string(b))
+	for k, v := range preferenceName {
+		if v == s {
+			*p = k
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown address preference %q", string(b))
+}
+
+// ErrNotFound means domain has no address of wanted family
+var ErrNotFound = errors.New("no such host")
+
+// maxCacheSize is number of cached results which trigger expired results cleanup
+const maxCacheSize = 4096
+
+// DefaultNegativeTTL is how long a failed lookup is cached when Resolver.NegativeTTL is 0
+const DefaultNegativeTTL = 30 * time.Second
+
+// Resolver resolve domain names with upstream servers, results are cached by record TTL.
+// Its zero value use system resolver without cache.
+type Resolver struct {
+	// Servers is upstream DNS servers, tried in order until one answered.
+	// System resolver is used when empty, its result is not cached.
+	Servers []Server
+	// Hosts is static name to address map, override DNS, name is lower case without trailing dot
+	Hosts map[string][]net.IP
+	// Prefer decide address family and order of lookup result
+	Prefer Preference
+	// Timeout is max time of a query to one server, 0 means 5 seconds
+	Timeout time.Duration
+	// NegativeTTL is how long a failed lookup is cached, 0 means DefaultNegativeTTL, negative means not cached
+	NegativeTTL time.Duration
+	// MaxTTL cap TTL of cached records, 0 means no limit
+	MaxTTL time.Duration
+
+	lock  sync.Mutex
+	cache map[cacheKey]cacheEntry
+}
+
+type cacheKey struct {
+	name  string
+	qtype dnsmessage.Type
+}
+
+type cacheEntry struct {
+	ips     []net.IP
+	err     error
+	expires time.Time
+}
+
+// LookupIP resolve host to addresses, ordered by Prefer.
+// IP literal is returned as is.
+func (r *Resolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	name := strings.ToLower(strings.TrimSuffix(host, "."))
+	if ips, ok := r.Hosts[name]; ok {
+		return r.sort(ips, host)
+	}
+	if len(r.Servers) == 0 {
+		ipas, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		ips := make([]net.IP, 0, len(ipas))
+		for _, ipa := range ipas {
+			ips = append(ips, ipa.IP)
+		}
+		return r.sort(ips, host)
+	}
+
+	types := []dnsmessage.Type{}
+	if r.Prefer != IPv4Only {
+		types = append(types, dnsmessage.TypeAAAA)
+	}
+	if r.Prefer != IPv6Only {
+		types = append(types, dnsmessage.TypeA)
+	}
+	results := make([]cacheEntry, len(types))
+	wg := sync.WaitGroup{}
+	for i, t := range types {
+		wg.Add(1)
+		go func(i int, t dnsmessage.Type) {
+			defer wg.Done()
+			results[i] = r.lookup(ctx, name, t)
+		}(i, t)
+	}
+	wg.Wait()
+
+	ips := []net.IP{}
+	var err error
+	for _, e := range results {
+		ips = append(ips, e.ips...)
+		if e.err != nil {
+			err = e.err
+		}
+	}
+	if len(ips) == 0 {
+		if err == nil {
+			err = ErrNotFound
+		}
+		return nil, &net.DNSError{Err: err.Error(), Name: host, IsNotFound: errors.Is(err, ErrNotFound)}
+	}
+	return r.sort(ips, host)
+}
+
+// sort filter and order ips by Prefer
+func (r *Resolver) sort(ips []net.IP, host string) ([]net.IP, error) {
+	v4 := []net.IP{}
+	v6 := []net.IP{}
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	var ret []net.IP
+	switch r.Prefer {
+	case PreferIPv4:
+		ret = append(v4, v6...)
+	case IPv4Only:
+		ret = v4
+	case IPv6Only:
+		ret = v6
+	default:
+		ret = append(v6, v4...)
+	}
+	if len(ret) == 0 {
+		return nil, &net.DNSError{Err: ErrNotFound.Error(), Name: host, IsNotFound: true}
+	}
+	return ret, nil
+}
+
+// lookup find addresses of type t from cache or upstream servers
+func (r *Resolver) lookup(ctx context.Context, name string, t dnsmessage.Type) cacheEntry {
+	key := cacheKey{name: name, qtype: t}
+	r.lock.Lock()
+	e, ok := r.cache[key]
+	r.lock.Unlock()
+	if ok && time.Now().Before(e.expires) {
+		return e
+	}
+
+	e = r.query(ctx, name, t)
+	if e.expires.IsZero() {
+		// not cacheable, e.g. all servers unreachable
+		return e
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.cache == nil {
+		r.cache = map[cacheKey]cacheEntry{}
+	}
+	if len(r.cache) >= maxCacheSize {
+		r.cleanup()
+	}
+	r.cache[key] = e
+	return e
+}
+
+// query ask servers in order, set expires when result can be cached
+func (r *Resolver) query(ctx context.Context, name string, t dnsmessage.Type) cacheEntry {
+	qname, err := dnsmessage.NewName(name + ".")
+	if err != nil {
+		return cacheEntry{err: err}
+	}
+	q := dnsmessage.Question{Name: qname, Type: t, Class: dnsmessage.ClassINET}
+	timeout := r.Timeout
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+
+	e := cacheEntry{err: ErrNotFound}
+	for _, s := range r.Servers {
+		qctx, cancel := context.WithTimeout(ctx, timeout)
+		m, err := s.exchange(qctx, q)
+		cancel()
+		if err != nil {
+			lg.Infof("dns query %s %s to %s failed %v", name, t, s.Address, err)
+			e.err = err
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+		return r.answer(m, t)
+	}
+	return e
+}
+
+// answer convert response to cache entry
+func (r *Resolver) answer(m *dnsmessage.Message, t dnsmessage.Type) cacheEntry {
+	now := time.Now()
+	e := cacheEntry{}
+	switch m.RCode {
+	case dnsmessage.RCodeSuccess, dnsmessage.RCodeNameError:
+	default:
+		// server failure etc. is not cached
+		e.err = fmt.Errorf("dns server reply %s", m.RCode)
+		return e
+	}
+	var ttl uint32
+	for _, a := range m.Answers {
+		if a.Header.Type != t {
+			// CNAME, chain is followed by upstream
+			continue
+		}
+		switch b := a.Body.(type) {
+		case *dnsmessage.AResource:
+			e.ips = append(e.ips, net.IP(append([]byte{}, b.A[:]...)))
+		case *dnsmessage.AAAAResource:
+			e.ips = append(e.ips, net.IP(append([]byte{}, b.AAAA[:]...)))
+		default:
+			continue
+		}
+		if len(e.ips) == 1 || a.Header.TTL < ttl {
+			ttl = a.Header.TTL
+		}
+	}
+	if len(e.ips) > 0 {
+		d := time.Duration(ttl) * time.Second
+		if r.MaxTTL > 0 && d > r.MaxTTL {
+			d = r.MaxTTL
+		}
+		e.expires = now.Add(d)
+		return e
+	}
+
+	e.err = ErrNotFound
+	negTTL := r.NegativeTTL
+	if negTTL == 0 {
+		negTTL = DefaultNegativeTTL
+	}
+	if negTTL > 0 {
+		e.expires = now.Add(negTTL)
+	}
+	return e
+}
+
+// cleanup remove expired results, drop all when still too many, lock should be held
+func (r *Resolver) cleanup() {
+	now := time.Now()
+	for k, e := range r.cache {
+		if now.After(e.expires) {
+			delete(r.cache, k)
+		}
+	}
+	if len(r.cache) >= maxCacheSize {
+		r.cache = map[cacheKey]cacheEntry{}
+	}
+}
+
+// Flush drop all cached results
+func (r *Resolver) Flush() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.cache = nil
+}
@@ -0,0 +1,216 @@
+package resolver_test
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/studentmain/socks6/resolver"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// fakeDNS answer A and AAAA queries from records on UDP and TCP at same port
+type fakeDNS struct {
+	records map[string][]net.IP
+	// truncate names' UDP response
+	truncate map[string]bool
+
+	udpQueries int32
+	tcpQueries int32
+}
+
+func (f *fakeDNS) start(t *testing.T, ctx context.Context) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		<-ctx.Done()
+		pc.Close()
+		l.Close()
+	}()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, a, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&f.udpQueries, 1)
+			pc.WriteTo(f.reply(buf[:n], false), a)
+		}
+	}()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&f.tcpQueries, 1)
+			lb := make([]byte, 2)
+			if _, err := io.ReadFull(c, lb); err != nil {
+				c.Close()
+				continue
+			}
+			b := make([]byte, binary.BigEndian.Uint16(lb))
+			io.ReadFull(c, b)
+			r := f.reply(b, true)
+			binary.BigEndian.PutUint16(lb, uint16(len(r)))
+			c.Write(append(lb, r...))
+			c.Close()
+		}
+	}()
+	return pc.LocalAddr().String()
+}
+
+func (f *fakeDNS) reply(b []byte, tcp bool) []byte {
+	m := dnsmessage.Message{}
+	if err := m.Unpack(b); err != nil || len(m.Questions) != 1 {
+		return nil
+	}
+	q := m.Questions[0]
+	resp := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: m.ID, Response: true},
+		Questions: m.Questions,
+	}
+	name := q.Name.String()
+	ips, ok := f.records[name]
+	switch {
+	case !ok:
+		resp.RCode = dnsmessage.RCodeNameError
+	case f.truncate[name] && !tcp:
+		resp.Truncated = true
+	default:
+		for _, ip := range ips {
+			h := dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: 60}
+			if ip4 := ip.To4(); ip4 != nil && q.Type == dnsmessage.TypeA {
+				h.Type = dnsmessage.TypeA
+				r := &dnsmessage.AResource{}
+				copy(r.A[:], ip4)
+				resp.Answers = append(resp.Answers, dnsmessage.Resource{Header: h, Body: r})
+			} else if ip.To4() == nil && q.Type == dnsmessage.TypeAAAA {
+				h.Type = dnsmessage.TypeAAAA
+				r := &dnsmessage.AAAAResource{}
+				copy(r.AAAA[:], ip)
+				resp.Answers = append(resp.Answers, dnsmessage.Resource{Header: h, Body: r})
+			}
+		}
+	}
+	ret, _ := resp.Pack()
+	return ret
+}
+
+func ipStrings(ips []net.IP) []string {
+	ret := []string{}
+	for _, ip := range ips {
+		ret = append(ret, ip.String())
+	}
+	return ret
+}
+
+func TestLookupIP(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	f := &fakeDNS{
+		records: map[string][]net.IP{
+			"dual.example.": {net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")},
+			"big.example.":  {net.ParseIP("192.0.2.2")},
+		},
+		truncate: map[string]bool{"big.example.": true},
+	}
+	addr := f.start(t, ctx)
+	r := &resolver.Resolver{
+		Servers: []resolver.Server{{Address: addr}},
+		Hosts:   map[string][]net.IP{"static.example": {net.ParseIP("192.0.2.9")}},
+		Timeout: time.Second,
+	}
+
+	ips, err := r.LookupIP(ctx, "dual.example")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"2001:db8::1", "192.0.2.1"}, ipStrings(ips))
+	assert.EqualValues(t, 2, atomic.LoadInt32(&f.udpQueries))
+	// cached
+	ips, err = r.LookupIP(ctx, "DUAL.example.")
+	assert.NoError(t, err)
+	assert.Len(t, ips, 2)
+	assert.EqualValues(t, 2, atomic.LoadInt32(&f.udpQueries))
+
+	// negative cached
+	_, err = r.LookupIP(ctx, "none.example")
+	dnsErr := &net.DNSError{}
+	if assert.True(t, errors.As(err, &dnsErr)) {
+		assert.True(t, dnsErr.IsNotFound)
+	}
+	_, err = r.LookupIP(ctx, "none.example")
+	assert.Error(t, err)
+	assert.EqualValues(t, 4, atomic.LoadInt32(&f.udpQueries))
+
+	// hosts and IP literal don't query
+	ips, err = r.LookupIP(ctx, "static.example")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"192.0.2.9"}, ipStrings(ips))
+	ips, err = r.LookupIP(ctx, "192.0.2.10")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"192.0.2.10"}, ipStrings(ips))
+	assert.EqualValues(t, 4, atomic.LoadInt32(&f.udpQueries))
+
+	// truncated UDP response, retry with TCP
+	ips, err = r.LookupIP(ctx, "big.example")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"192.0.2.2"}, ipStrings(ips))
+	assert.EqualValues(t, 2, atomic.LoadInt32(&f.tcpQueries))
+
+	r.Flush()
+	r.Prefer = resolver.IPv4Only
+	ips, err = r.LookupIP(ctx, "dual.example")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"192.0.2.1"}, ipStrings(ips))
+	assert.EqualValues(t, 7, atomic.LoadInt32(&f.udpQueries))
+
+	r.Prefer = resolver.IPv6Only
+	_, err = r.LookupIP(ctx, "static.example")
+	assert.Error(t, err)
+}
+
+func TestLookupIPServerFallback(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	f := &fakeDNS{records: map[string][]net.IP{"a.example.": {net.ParseIP("192.0.2.1")}}}
+	addr := f.start(t, ctx)
+	// nothing listen here
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	dead := l.Addr().String()
+	l.Close()
+
+	r := &resolver.Resolver{
+		Servers: []resolver.Server{{Network: "tcp", Address: dead}, {Network: "tcp", Address: addr}},
+		Prefer:  resolver.PreferIPv4,
+		Timeout: time.Second,
+	}
+	ips, err := r.LookupIP(ctx, "a.example")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"192.0.2.1"}, ipStrings(ips))
+	assert.EqualValues(t, 2, atomic.LoadInt32(&f.tcpQueries))
+}
+
+func TestPreference(t *testing.T) {
+	for _, p := range []resolver.Preference{resolver.PreferIPv6, resolver.PreferIPv4, resolver.IPv4Only, resolver.IPv6Only} {
+		b, err := p.MarshalText()
+		assert.NoError(t, err)
+		var p2 resolver.Preference
+		assert.NoError(t, p2.UnmarshalText(b))
+		assert.Equal(t, p, p2)
+	}
+	var p resolver.Preference
+	assert.Error(t, p.UnmarshalText([]byte("ipv5_only")))
+}
@@ -0,0 +1,151 @@
+package resolver
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/studentmain/socks6/common/rnd"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Server is an upstream DNS server
+type Server struct {
+	// Network is udp, tcp or tls (DNS over TLS), default is udp
+	Network string `json:"network" yaml:"network"`
+	// Address is host:port
+	Address string `json:"address" yaml:"address"`
+	// ServerName is used to verify DoT server certificate, default is host of Address
+	ServerName string `json:"server_name,omitempty" yaml:"server_name,omitempty"`
+}
+
+// ErrTruncated means UDP response is truncated
+var ErrTruncated = errors.New("dns response truncated")
+
+// exchange send query q to server and return the response
+func (s Server) exchange(ctx context.Context, q dnsmessage.Question) (*dnsmessage.Message, error) {
+	switch s.Network {
+	case "", "udp":
+		m, err := s.exchangeUDP(ctx, q)
+		if errors.Is(err, ErrTruncated) {
+			return s.exchangeStream(ctx, q, false)
+		}
+		return m, err
+	case "tcp":
+		return s.exchangeStream(ctx, q, false)
+	case "tls":
+		return s.exchangeStream(ctx, q, true)
+	}
+	return nil, fmt.Errorf("unknown dns network %q", s.Network)
+}
+
+func (s Server) exchangeUDP(ctx context.Context, q dnsmessage.Question) (*dnsmessage.Message, error) {
+	d := net.Dialer{}
+	conn, err := d.DialContext(ctx, "udp", s.Address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	stop := closeOnDone(ctx, conn)
+	defer stop()
+
+	id, b, err := pack(q)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = conn.Write(b); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 65535)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		m := &dnsmessage.Message{}
+		if err = m.Unpack(buf[:n]); err != nil || m.ID != id || !m.Response {
+			// not our response, keep waiting
+			continue
+		}
+		if m.Truncated {
+			return nil, ErrTruncated
+		}
+		return m, nil
+	}
+}
+
+func (s Server) exchangeStream(ctx context.Context, q dnsmessage.Question, useTLS bool) (*dnsmessage.Message, error) {
+	var conn net.Conn
+	var err error
+	if useTLS {
+		name := s.ServerName
+		if name == "" {
+			name, _, _ = net.SplitHostPort(s.Address)
+		}
+		d := tls.Dialer{Config: &tls.Config{ServerName: name}}
+		conn, err = d.DialContext(ctx, "tcp", s.Address)
+	} else {
+		d := net.Dialer{}
+		conn, err = d.DialContext(ctx, "tcp", s.Address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	stop := closeOnDone(ctx, conn)
+	defer stop()
+
+	id, b, err := pack(q)
+	if err != nil {
+		return nil, err
+	}
+	msg := make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(msg, uint16(len(b)))
+	copy(msg[2:], b)
+	if _, err = conn.Write(msg); err != nil {
+		return nil, err
+	}
+	if _, err = io.ReadFull(conn, msg[:2]); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, binary.BigEndian.Uint16(msg[:2]))
+	if _, err = io.ReadFull(conn, buf); err != nil {
+		return nil, err
+	}
+	m := &dnsmessage.Message{}
+	if err = m.Unpack(buf); err != nil {
+		return nil, err
+	}
+	if m.ID != id || !m.Response {
+		return nil, errors.New("dns response mismatch")
+	}
+	return m, nil
+}
+
+// pack create a recursive query message with random id
+func pack(q dnsmessage.Question) (uint16, []byte, error) {
+	id := rnd.RandUint16()
+	m := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{q},
+	}
+	b, err := m.Pack()
+	return id, b, err
+}
+
+// closeOnDone close conn when ctx done, stop should be called after conn is no longer used
+func closeOnDone(ctx context.Context, conn net.Conn) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
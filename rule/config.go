@@ -0,0 +1,156 @@
+package rule
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/studentmain/socks6/message"
+)
+
+// Config is the serialized form of a RuleSet
+type Config struct {
+	// Default is the action used when no rule matched, allow or deny
+	Default Action `json:"default" yaml:"default"`
+	Rules   []Rule `json:"rules" yaml:"rules"`
+}
+
+// Build compile Config to RuleSet
+func (c Config) Build() (*RuleSet, error) {
+	return NewRuleSet(c.Rules, c.Default)
+}
+
+// Parse parse a JSON encoded rule set
+func Parse(b []byte) (*RuleSet, error) {
+	c := Config{}
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, err
+	}
+	return c.Build()
+}
+
+// Load read and parse a JSON encoded rule set file
+func Load(filename string) (*RuleSet, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	rs, err := Parse(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	return rs, nil
+}
+
+var commandName = map[string]message.CommandCode{
+	"noop":          message.CommandNoop,
+	"connect":       message.CommandConnect,
+	"bind":          message.CommandBind,
+	"udp_associate": message.CommandUdpAssociate,
+	"udp":           message.CommandUdpAssociate,
+	"resolve":       message.CommandResolve,
+	"resolve_ptr":   message.CommandResolvePTR,
+}
+
+func compileRule(r Rule) (compiledRule, error) {
+	if r.Action != ActionAllow && r.Action != ActionDeny && r.Action != ActionLog {
+		return compiledRule{}, fmt.Errorf("invalid action %s", r.Action)
+	}
+	cr := compiledRule{
+		name:     r.Name,
+		action:   r.Action,
+		clientId: r.ClientId,
+		session:  r.Session,
+	}
+	var err error
+	if cr.source, err = parseCIDRs(r.Source); err != nil {
+		return cr, fmt.Errorf("source: %w", err)
+	}
+	if cr.destination, err = parseCIDRs(r.Destination); err != nil {
+		return cr, fmt.Errorf("destination: %w", err)
+	}
+	for _, p := range r.ClientId {
+		if _, err := path.Match(p, ""); err != nil {
+			return cr, fmt.Errorf("client: invalid pattern %q", p)
+		}
+	}
+	for _, c := range r.Command {
+		code, err := parseCommand(c)
+		if err != nil {
+			return cr, fmt.Errorf("command: %w", err)
+		}
+		cr.command = append(cr.command, code)
+	}
+	for _, d := range r.Domain {
+		d = strings.ToLower(strings.TrimSuffix(d, "."))
+		if _, err := path.Match(d, ""); err != nil {
+			return cr, fmt.Errorf("domain: invalid pattern %q", d)
+		}
+		cr.domain = append(cr.domain, d)
+	}
+	for _, p := range r.Port {
+		pr, err := parsePortRange(p)
+		if err != nil {
+			return cr, fmt.Errorf("port: %w", err)
+		}
+		cr.port = append(cr.port, pr)
+	}
+	return cr, nil
+}
+
+// parseCIDRs parse CIDR list, single IP address is treated as /32 or /128
+func parseCIDRs(s []string) ([]*net.IPNet, error) {
+	ret := make([]*net.IPNet, 0, len(s))
+	for _, v := range s {
+		if !strings.Contains(v, "/") {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", v)
+			}
+			bits := 128
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+				bits = 32
+			}
+			ret = append(ret, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, n)
+	}
+	return ret, nil
+}
+
+func parseCommand(s string) (message.CommandCode, error) {
+	if c, ok := commandName[strings.ToLower(s)]; ok {
+		return c, nil
+	}
+	n, err := strconv.ParseUint(s, 0, 8)
+	if err != nil {
+		return 0, fmt.Errorf("unknown command %q", s)
+	}
+	return message.CommandCode(n), nil
+}
+
+func parsePortRange(s string) (portRange, error) {
+	from, to, isRange := strings.Cut(s, "-")
+	f, err := strconv.ParseUint(strings.TrimSpace(from), 10, 16)
+	if err != nil {
+		return portRange{}, fmt.Errorf("invalid port %q", s)
+	}
+	if !isRange {
+		return portRange{from: uint16(f), to: uint16(f)}, nil
+	}
+	t, err := strconv.ParseUint(strings.TrimSpace(to), 10, 16)
+	if err != nil || t < f {
+		return portRange{}, fmt.Errorf("invalid port range %q", s)
+	}
+	return portRange{from: uint16(f), to: uint16(t)}, nil
+}
@@ -0,0 +1,350 @@
+// rule is a declarative access control rule engine for SOCKS 6 server
+package rule
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"strings"
+	"sync/atomic"
+
+	"github.com/studentmain/socks6/common/lg"
+	"github.com/studentmain/socks6/message"
+)
+
+// Action is what a rule do when request matched
+type Action int
+
+const (
+	// ActionAllow allow matched request, stop evaluation
+	ActionAllow Action = iota
+	// ActionDeny deny matched request, stop evaluation
+	ActionDeny
+	// ActionLog log matched request, then continue evaluation
+	ActionLog
+)
+
+var actionName = map[Action]string{
+	ActionAllow: "allow",
+	ActionDeny:  "deny",
+	ActionLog:   "log",
+}
+
+func (a Action) String() string {
+	if n, ok := actionName[a]; ok {
+		return n
+	}
+	return fmt.Sprintf("action(%d)", int(a))
+}
+
+func (a Action) MarshalText() ([]byte, error) {
+	return []byte(a.String()), nil
+}
+
+func (a *Action) UnmarshalText(b []byte) error {
+	s := strings.ToLower(string(b))
+	for k, v := range actionName {
+		if v == s {
+			*a = k
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown action %q", string(b))
+}
+
+// Request is the information about a SOCKS request used to match rules
+type Request struct {
+	Source      net.Addr // client's address
+	ClientId    string   // client identifier provided by authenticator
+	Session     []byte   // session id, nil when not in a session
+	Command     message.CommandCode
+	Destination *message.SocksAddr
+}
+
+// Decision is the result of rule evaluation
+type Decision struct {
+	Allow bool
+	// Rule is the name of rule which made the decision, empty when default action is used
+	Rule string
+	// Reason is a human readable explanation of the decision
+	Reason string
+}
+
+// Checker decide whether a request is allowed
+type Checker interface {
+	Check(r Request) Decision
+}
+
+// CheckerFunc is an adapter to allow use ordinary function as Checker
+type CheckerFunc func(r Request) Decision
+
+func (f CheckerFunc) Check(r Request) Decision {
+	return f(r)
+}
+
+// Rule is a single access control rule,
+// empty field match everything, non-empty fields should all match to match the rule
+type Rule struct {
+	Name   string `json:"name" yaml:"name"`
+	Action Action `json:"action" yaml:"action"`
+
+	// Source is client source address CIDR list, e.g. 192.168.0.0/16
+	Source []string `json:"source,omitempty" yaml:"source,omitempty"`
+	// ClientId is a list of client identifier glob, e.g. admin-*
+	ClientId []string `json:"client,omitempty" yaml:"client,omitempty"`
+	// Session match request in (true) or not in (false) a session
+	Session *bool `json:"session,omitempty" yaml:"session,omitempty"`
+	// Command is a list of command name (noop, connect, bind, udp_associate, resolve, resolve_ptr) or number
+	Command []string `json:"command,omitempty" yaml:"command,omitempty"`
+	// Destination is destination address CIDR list, only match request with IP address destination
+	Destination []string `json:"destination,omitempty" yaml:"destination,omitempty"`
+	// Domain is destination domain list, only match request with domain name destination.
+	// Start with . to match suffix (.example.com match example.com and a.example.com),
+	// contains * or ? to match glob (*.example.com), otherwise match exactly
+	Domain []string `json:"domain,omitempty" yaml:"domain,omitempty"`
+	// Port is destination port or port range list, e.g. 80, 8000-8999
+	Port []string `json:"port,omitempty" yaml:"port,omitempty"`
+}
+
+type portRange struct {
+	from uint16
+	to   uint16
+}
+
+type compiledRule struct {
+	name   string
+	action Action
+
+	source      []*net.IPNet
+	clientId    []string
+	session     *bool
+	command     []message.CommandCode
+	destination []*net.IPNet
+	domain      []string
+	port        []portRange
+}
+
+// RuleSet is an ordered rule list, first matched allow or deny rule decide the result
+type RuleSet struct {
+	rules         []compiledRule
+	defaultAction Action
+}
+
+var _ Checker = &RuleSet{}
+
+// NewRuleSet check and compile rules to RuleSet,
+// defaultAction is used when no rule matched, it should be allow or deny
+func NewRuleSet(rules []Rule, defaultAction Action) (*RuleSet, error) {
+	if defaultAction != ActionAllow && defaultAction != ActionDeny {
+		return nil, fmt.Errorf("default action should be allow or deny, got %s", defaultAction)
+	}
+	rs := &RuleSet{
+		rules:         make([]compiledRule, 0, len(rules)),
+		defaultAction: defaultAction,
+	}
+	for i, r := range rules {
+		cr, err := compileRule(r)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d (%s): %w", i, r.Name, err)
+		}
+		if cr.name == "" {
+			cr.name = fmt.Sprintf("#%d", i)
+		}
+		rs.rules = append(rs.rules, cr)
+	}
+	return rs, nil
+}
+
+// Check implements Checker
+func (rs *RuleSet) Check(req Request) Decision {
+	for _, r := range rs.rules {
+		if !r.match(req) {
+			continue
+		}
+		switch r.action {
+		case ActionLog:
+			lg.Infof("rule %s matched %s %d %s", r.name, req.ClientId, req.Command, req.Destination)
+		case ActionAllow:
+			return Decision{Allow: true, Rule: r.name, Reason: "allowed by rule " + r.name}
+		case ActionDeny:
+			return Decision{Allow: false, Rule: r.name, Reason: "denied by rule " + r.name}
+		}
+	}
+	if rs.defaultAction == ActionAllow {
+		return Decision{Allow: true, Reason: "allowed by default"}
+	}
+	return Decision{Allow: false, Reason: "denied by default"}
+}
+
+// Matcher test requests against conditions of a Rule, the Action is ignored.
+// It's used by whoever need rule conditions but not allow or deny, e.g. outbound routing.
+type Matcher struct {
+	r compiledRule
+}
+
+// NewMatcher check and compile r's conditions
+func NewMatcher(r Rule) (*Matcher, error) {
+	r.Action = ActionAllow
+	cr, err := compileRule(r)
+	if err != nil {
+		return nil, err
+	}
+	return &Matcher{r: cr}, nil
+}
+
+// Match report whether req satisfy all conditions, nil Matcher match everything
+func (m *Matcher) Match(req Request) bool {
+	if m == nil {
+		return true
+	}
+	return m.r.match(req)
+}
+
+func (r compiledRule) match(req Request) bool {
+	if len(r.source) > 0 && !matchIPNet(r.source, addrIP(req.Source)) {
+		return false
+	}
+	if len(r.clientId) > 0 && !matchGlob(r.clientId, req.ClientId) {
+		return false
+	}
+	if r.session != nil && *r.session != (len(req.Session) > 0) {
+		return false
+	}
+	if len(r.command) > 0 && !matchCommand(r.command, req.Command) {
+		return false
+	}
+	dst := req.Destination
+	if dst == nil {
+		dst = message.DefaultAddr
+	}
+	if len(r.destination) > 0 {
+		if dst.AddressType == message.AddressTypeDomainName {
+			return false
+		}
+		if !matchIPNet(r.destination, net.IP(dst.Address)) {
+			return false
+		}
+	}
+	if len(r.domain) > 0 {
+		if dst.AddressType != message.AddressTypeDomainName {
+			return false
+		}
+		if !matchDomain(r.domain, string(dst.Address)) {
+			return false
+		}
+	}
+	if len(r.port) > 0 && !matchPort(r.port, dst.Port) {
+		return false
+	}
+	return true
+}
+
+func addrIP(a net.Addr) net.IP {
+	switch aa := a.(type) {
+	case nil:
+		return nil
+	case *net.TCPAddr:
+		return aa.IP
+	case *net.UDPAddr:
+		return aa.IP
+	case *net.IPAddr:
+		return aa.IP
+	case *message.SocksAddr:
+		if aa.AddressType == message.AddressTypeDomainName {
+			return nil
+		}
+		return net.IP(aa.Address)
+	}
+	h, _, err := net.SplitHostPort(a.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(h)
+}
+
+func matchIPNet(nets []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchGlob(patterns []string, s string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, s); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func matchCommand(cmds []message.CommandCode, c message.CommandCode) bool {
+	for _, v := range cmds {
+		if v == c {
+			return true
+		}
+	}
+	return false
+}
+
+func matchDomain(patterns []string, d string) bool {
+	d = strings.TrimSuffix(strings.ToLower(d), ".")
+	for _, p := range patterns {
+		if strings.HasPrefix(p, ".") {
+			if d == p[1:] || strings.HasSuffix(d, p) {
+				return true
+			}
+		} else if strings.ContainsAny(p, "*?[") {
+			if ok, _ := path.Match(p, d); ok {
+				return true
+			}
+		} else if p == d {
+			return true
+		}
+	}
+	return false
+}
+
+func matchPort(ranges []portRange, p uint16) bool {
+	for _, r := range ranges {
+		if p >= r.from && p <= r.to {
+			return true
+		}
+	}
+	return false
+}
+
+// AtomicChecker is a Checker which can be replaced while server running.
+// It's safe for concurrent use.
+type AtomicChecker struct {
+	v atomic.Value // atomicCheckerBox
+}
+
+// atomicCheckerBox let atomic.Value store nil and different Checker types
+type atomicCheckerBox struct {
+	c Checker
+}
+
+func NewAtomicChecker(c Checker) *AtomicChecker {
+	a := &AtomicChecker{}
+	a.Set(c)
+	return a
+}
+
+// Set replace the Checker, nil means allow all request
+func (a *AtomicChecker) Set(c Checker) {
+	a.v.Store(atomicCheckerBox{c: c})
+}
+
+func (a *AtomicChecker) Check(r Request) Decision {
+	b, _ := a.v.Load().(atomicCheckerBox)
+	if b.c == nil {
+		return Decision{Allow: true}
+	}
+	return b.c.Check(r)
+}
@@ -0,0 +1,104 @@
+package rule_test
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/studentmain/socks6/message"
+	"github.com/studentmain/socks6/rule"
+)
+
+func TestRuleSet(t *testing.T) {
+	rs, err := rule.Parse([]byte(`{
+		"default": "allow",
+		"rules": [
+			{"name": "admin", "action": "allow", "client": ["admin-*"]},
+			{"name": "audit", "action": "log", "command": ["bind"]},
+			{"name": "lan", "action": "deny", "destination": ["10.0.0.0/8", "192.168.1.1"]},
+			{"name": "smtp", "action": "deny", "command": ["connect"], "port": ["25", "465-587"]},
+			{"name": "ads", "action": "deny", "domain": [".ads.example", "track*.example.com"]},
+			{"name": "guest", "action": "deny", "source": ["172.16.0.0/12"], "session": false},
+			{"name": "ptr", "action": "deny", "command": ["resolve_ptr"]}
+		]
+	}`))
+	assert.NoError(t, err)
+
+	src := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 12345}
+	guest := &net.TCPAddr{IP: net.IPv4(172, 16, 3, 4), Port: 12345}
+	tests := []struct {
+		name  string
+		req   rule.Request
+		allow bool
+		rule  string
+	}{
+		{"default", rule.Request{Source: src, Destination: message.ParseAddr("1.1.1.1:443")}, true, ""},
+		{"cidr", rule.Request{Source: src, Destination: message.ParseAddr("10.1.2.3:443")}, false, "lan"},
+		{"single ip", rule.Request{Source: src, Destination: message.ParseAddr("192.168.1.1:80")}, false, "lan"},
+		{"admin bypass", rule.Request{Source: src, ClientId: "admin-bob", Destination: message.ParseAddr("10.1.2.3:443")}, true, "admin"},
+		{"port", rule.Request{Source: src, Command: message.CommandConnect, Destination: message.ParseAddr("1.1.1.1:25")}, false, "smtp"},
+		{"port range", rule.Request{Source: src, Command: message.CommandConnect, Destination: message.ParseAddr("1.1.1.1:500")}, false, "smtp"},
+		{"port other command", rule.Request{Source: src, Command: message.CommandBind, Destination: message.ParseAddr("1.1.1.1:25")}, true, ""},
+		{"suffix", rule.Request{Source: src, Destination: message.ParseAddr("x.ads.example:80")}, false, "ads"},
+		{"suffix apex", rule.Request{Source: src, Destination: message.ParseAddr("ads.example:80")}, false, "ads"},
+		{"suffix mismatch", rule.Request{Source: src, Destination: message.ParseAddr("badads.example:80")}, true, ""},
+		{"glob", rule.Request{Source: src, Destination: message.ParseAddr("tracker.example.com:80")}, false, "ads"},
+		{"guest", rule.Request{Source: guest, Destination: message.ParseAddr("1.1.1.1:443")}, false, "guest"},
+		{"guest session", rule.Request{Source: guest, Session: []byte{1}, Destination: message.ParseAddr("1.1.1.1:443")}, true, ""},
+		{"resolve ptr", rule.Request{Source: src, Command: message.CommandResolvePTR, Destination: message.ParseAddr("1.1.1.1:0")}, false, "ptr"},
+	}
+	for _, tt := range tests {
+		d := rs.Check(tt.req)
+		assert.Equal(t, tt.allow, d.Allow, tt.name)
+		assert.Equal(t, tt.rule, d.Rule, tt.name)
+	}
+}
+
+func TestRuleSetDefaultDeny(t *testing.T) {
+	rs, err := rule.NewRuleSet([]rule.Rule{
+		{Action: rule.ActionAllow, Port: []string{"443"}},
+	}, rule.ActionDeny)
+	assert.NoError(t, err)
+	assert.True(t, rs.Check(rule.Request{Destination: message.ParseAddr("1.1.1.1:443")}).Allow)
+	assert.False(t, rs.Check(rule.Request{Destination: message.ParseAddr("1.1.1.1:80")}).Allow)
+}
+
+func TestRuleSetInvalid(t *testing.T) {
+	bad := []string{
+		`{"rules": [{"action": "drop"}]}`,
+		`{"rules": [{"action": "deny", "destination": ["10.0.0.0/33"]}]}`,
+		`{"rules": [{"action": "deny", "port": ["100-10"]}]}`,
+		`{"rules": [{"action": "deny", "command": ["listen"]}]}`,
+		`{"default": "log", "rules": []}`,
+	}
+	for _, b := range bad {
+		_, err := rule.Parse([]byte(b))
+		assert.Error(t, err, b)
+	}
+}
+
+func TestAtomicChecker(t *testing.T) {
+	req := rule.Request{Destination: message.ParseAddr("1.1.1.1:80")}
+	ac := rule.NewAtomicChecker(nil)
+	assert.True(t, ac.Check(req).Allow)
+	rs, err := rule.NewRuleSet(nil, rule.ActionDeny)
+	assert.NoError(t, err)
+	ac.Set(rs)
+	assert.False(t, ac.Check(req).Allow)
+	ac.Set(nil)
+	assert.True(t, ac.Check(req).Allow)
+}
+
+func TestMatcher(t *testing.T) {
+	m, err := rule.NewMatcher(rule.Rule{Domain: []string{".example.com"}, Port: []string{"443"}})
+	assert.NoError(t, err)
+	assert.True(t, m.Match(rule.Request{Destination: message.ParseAddr("a.example.com:443")}))
+	assert.False(t, m.Match(rule.Request{Destination: message.ParseAddr("a.example.com:80")}))
+	assert.False(t, m.Match(rule.Request{Destination: message.ParseAddr("1.1.1.1:443")}))
+
+	var all *rule.Matcher
+	assert.True(t, all.Match(rule.Request{}))
+
+	_, err = rule.NewMatcher(rule.Rule{Destination: []string{"bad"}})
+	assert.Error(t, err)
+}
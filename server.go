@@ -3,8 +3,10 @@ package socks6
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
+	"os"
 
 	"github.com/lucas-clemente/quic-go"
 	"github.com/pion/dtls/v2"
@@ -16,55 +18,101 @@ import (
 	"golang.org/x/net/icmp"
 )
 
-// Server is a SOCKS 6 over TCP/TLS/UDP/DTLS server
+// Server is a SOCKS 6 over TCP/TLS/UDP/DTLS/QUIC server
 // zero value is a cleartext only server with default server worker
 type Server struct {
 	Address       string
 	CleartextPort uint16
 	EncryptedPort uint16
 
+	// Listeners is the transports and addresses to listen.
+	// When empty, TCP and UDP listen at CleartextPort, TLS and DTLS listen at EncryptedPort.
+	Listeners []ListenerConfig
+
 	TlsConfig *tls.Config
 	Worker    *ServerWorker
 
+	// InheritedFiles is pre-opened sockets, e.g. from ListenFDs or another process's Server.Files.
+	// A listener use the socket with same type and address instead of creating a new one,
+	// sockets not used are closed. ICMP sockets are always created.
+	InheritedFiles []*os.File
+
 	// listeners
 
-	tcp   net.Listener
-	udp   net.PacketConn
-	tls   net.Listener
-	dtls  net.Listener
 	icmp4 net.PacketConn
 	icmp6 net.PacketConn
-	quic  quic.Listener
 
 	listeners []canClose
+	streams   []canClose // stop accepting new connections, closed first when shutdown
+	sockets   []canClose // underlying sockets of listeners
+	packets   []canClose // UDP, DTLS and QUIC listeners and their sockets, closed by ReleasePacketSockets
+	inherited *inheritedSockets
+}
+
+// ListenerConfig is a transport and address which Server listen at
+type ListenerConfig struct {
+	// Transport is one of tcp, tls, udp, dtls and quic
+	Transport string
+	// Address is the host:port to listen, empty host means all interfaces
+	Address string
 }
 
 type canClose interface {
 	Close() error
 }
 
+// acceptStopper stop an accept loop by cancelling its context
+type acceptStopper context.CancelFunc
+
+func (a acceptStopper) Close() error {
+	a()
+	return nil
+}
+
 func (s *Server) Start(ctx context.Context) {
 	lg.Info("start SOCKS 6 listener")
 	if s.Worker == nil {
 		s.Worker = NewServerWorker()
 	}
 	s.listeners = []canClose{}
+	s.streams = []canClose{}
+	s.sockets = []canClose{}
+	s.packets = []canClose{}
+	s.inherited = newInheritedSockets(s.InheritedFiles)
+	s.InheritedFiles = nil
 
-	if s.CleartextPort == 0 && s.EncryptedPort == 0 {
-		s.CleartextPort = common.CleartextPort
-		s.EncryptedPort = common.EncryptedPort
-	}
+	if len(s.Listeners) > 0 {
+		for _, l := range s.Listeners {
+			s.startListener(ctx, l)
+		}
+	} else {
+		if s.CleartextPort == 0 && s.EncryptedPort == 0 {
+			s.CleartextPort = common.CleartextPort
+			s.EncryptedPort = common.EncryptedPort
+		}
 
-	if s.CleartextPort != 0 {
-		cleartextEndpoint := net.JoinHostPort(s.Address, fmt.Sprintf("%d", s.CleartextPort))
-		s.startTCP(ctx, cleartextEndpoint)
-		s.startUDP(ctx, cleartextEndpoint)
+		if s.CleartextPort != 0 {
+			cleartextEndpoint := net.JoinHostPort(s.Address, fmt.Sprintf("%d", s.CleartextPort))
+			s.startTCP(ctx, cleartextEndpoint)
+			s.startUDP(ctx, cleartextEndpoint)
+		}
+
+		if s.EncryptedPort != 0 && s.TlsConfig != nil {
+			encryptedEndpoint := net.JoinHostPort(s.Address, fmt.Sprintf("%d", s.EncryptedPort))
+			s.startTLS(ctx, encryptedEndpoint)
+			s.startDTLS(ctx, encryptedEndpoint)
+		}
 	}
 
-	if s.EncryptedPort != 0 && s.TlsConfig != nil {
-		encryptedEndpoint := net.JoinHostPort(s.Address, fmt.Sprintf("%d", s.EncryptedPort))
-		s.startTLS(ctx, encryptedEndpoint)
-		s.startDTLS(ctx, encryptedEndpoint)
+	s.inherited.closeUnused()
+	// destination policy deny connecting server itself
+	for _, v := range s.sockets {
+		switch l := v.(type) {
+		case net.Listener:
+			s.Worker.addListenerAddr(l.Addr())
+		case net.PacketConn:
+			s.Worker.addListenerAddr(l.LocalAddr())
+		}
 	}
 
 	if s.Worker.EnableICMP {
@@ -73,24 +121,66 @@ func (s *Server) Start(ctx context.Context) {
 	go s.Worker.ClearUnusedResource(ctx)
 	go func() {
 		<-ctx.Done()
-		lg.Info("closing all listeners")
-		for _, v := range s.listeners {
-			err := v.Close()
-			if err != nil {
-				lg.Warning("error when close listener", err)
-			}
-		}
+		s.closeListeners(s.listeners)
 	}()
 }
 
+// Shutdown stop accepting new connections and refuse new requests,
+// then wait existing relays, backlog binds and UDP associations finish.
+// When ctx done, remaining works are closed, their count and ctx's error are returned.
+// All listeners are closed when Shutdown return.
+func (s *Server) Shutdown(ctx context.Context) (int, error) {
+	lg.Info("shutting down SOCKS 6 server")
+	// UDP listener is still used by existing UDP associations
+	s.closeListeners(s.streams)
+	n, err := s.Worker.Shutdown(ctx)
+	s.closeListeners(s.listeners)
+	return n, err
+}
+
+func (s *Server) closeListeners(listeners []canClose) {
+	lg.Info("closing listeners")
+	for _, v := range listeners {
+		err := v.Close()
+		if err != nil && !errors.Is(err, net.ErrClosed) {
+			lg.Warning("error when close listener", err)
+		}
+	}
+}
+
+func (s *Server) startListener(ctx context.Context, l ListenerConfig) {
+	switch l.Transport {
+	case "tcp":
+		s.startTCP(ctx, l.Address)
+	case "udp":
+		s.startUDP(ctx, l.Address)
+	case "tls", "dtls", "quic":
+		if s.TlsConfig == nil {
+			lg.Errorf("can't start %s server at %s without TLS config", l.Transport, l.Address)
+			return
+		}
+		switch l.Transport {
+		case "tls":
+			s.startTLS(ctx, l.Address)
+		case "dtls":
+			s.startDTLS(ctx, l.Address)
+		case "quic":
+			s.startQUIC(ctx, l.Address)
+		}
+	default:
+		lg.Errorf("unknown transport %s", l.Transport)
+	}
+}
+
 func (s *Server) startTCP(ctx context.Context, addr string) {
-	addr2 := lo.Must1(net.ResolveTCPAddr("tcp", addr))
-	s.tcp = lo.Must1(net.ListenTCP("tcp", addr2))
-	lg.Infof("start TCP server at %s", s.tcp.Addr())
-	s.listeners = append(s.listeners, s.tcp)
+	l := lo.Must1(s.listenTCP(addr))
+	lg.Infof("start TCP server at %s", l.Addr())
+	s.listeners = append(s.listeners, l)
+	s.streams = append(s.streams, l)
+	s.sockets = append(s.sockets, l)
 	go func() {
 		for {
-			conn, err := s.tcp.Accept()
+			conn, err := l.Accept()
 			if err != nil {
 				lg.Error("stop TCP server", err)
 				return
@@ -101,13 +191,16 @@ func (s *Server) startTCP(ctx context.Context, addr string) {
 }
 
 func (s *Server) startTLS(ctx context.Context, addr string) {
-	s.tls = lo.Must1(tls.Listen("tcp", addr, s.TlsConfig))
-	lg.Infof("start TLS server at %s", s.tls.Addr())
-	s.listeners = append(s.listeners, s.tls)
+	inner := lo.Must1(s.listenTCP(addr))
+	l := tls.NewListener(inner, s.TlsConfig)
+	lg.Infof("start TLS server at %s", l.Addr())
+	s.listeners = append(s.listeners, l)
+	s.streams = append(s.streams, l)
+	s.sockets = append(s.sockets, inner)
 
 	go func() {
 		for {
-			conn, err := s.tls.Accept()
+			conn, err := l.Accept()
 			if err != nil {
 				lg.Error("stop TLS server", err)
 				return
@@ -118,18 +211,19 @@ func (s *Server) startTLS(ctx context.Context, addr string) {
 }
 
 func (s *Server) startUDP(ctx context.Context, addr string) {
-	addr2 := lo.Must1(net.ResolveUDPAddr("udp", addr))
-	s.udp = lo.Must1(net.ListenUDP("udp", addr2))
-	lg.Infof("start UDP server at %s", s.udp.LocalAddr())
-	s.listeners = append(s.listeners, s.udp)
+	pc := lo.Must1(s.listenUDP(addr))
+	lg.Infof("start UDP server at %s", pc.LocalAddr())
+	s.listeners = append(s.listeners, pc)
+	s.sockets = append(s.sockets, pc)
+	s.packets = append(s.packets, pc)
 
 	go func() {
-		defer s.udp.Close()
+		defer pc.Close()
 		buf := internal.BytesPool4k.Rent()
 		defer internal.BytesPool4k.Return(buf)
 
 		for {
-			dgram, err := nt.ReadUDPDatagram(s.udp)
+			dgram, err := nt.ReadUDPDatagram(pc)
 			if err != nil {
 				lg.Error("stop UDP server", err)
 				return
@@ -140,9 +234,31 @@ func (s *Server) startUDP(ctx context.Context, addr string) {
 	}()
 }
 
-func createDTLSConfig(t tls.Config) dtls.Config {
+// quicTLSConfig return a copy of TLS config with SOCKS 6 ALPN protocol when no protocol is set
+func quicTLSConfig(t *tls.Config) *tls.Config {
+	conf := &tls.Config{}
+	if t != nil {
+		conf = t.Clone()
+	}
+	if len(conf.NextProtos) == 0 {
+		conf.NextProtos = []string{common.QUICProtocol}
+	}
+	return conf
+}
+
+// createDTLSConfig convert TLS config to DTLS config,
+// certificate provided by GetCertificate is resolved at call time
+func createDTLSConfig(t tls.Config) (dtls.Config, error) {
+	certs := t.Certificates
+	if len(certs) == 0 && t.GetCertificate != nil {
+		cert, err := t.GetCertificate(&tls.ClientHelloInfo{})
+		if err != nil {
+			return dtls.Config{}, err
+		}
+		certs = []tls.Certificate{*cert}
+	}
 	return dtls.Config{
-		Certificates: t.Certificates,
+		Certificates: certs,
 		// CipherSuites
 		// CustomCipherSuites
 		// SignatureSchemes
@@ -165,24 +281,40 @@ func createDTLSConfig(t tls.Config) dtls.Config {
 		KeyLogWriter: t.KeyLogWriter,
 		// SessionStore
 		SupportedProtocols: t.NextProtos,
-	}
+	}, nil
 }
 
 func (s *Server) startDTLS(ctx context.Context, addr string) {
-	addr2 := lo.Must1(net.ResolveUDPAddr("udp", addr))
-	dtlsConfig := createDTLSConfig(*s.TlsConfig)
-	s.dtls = lo.Must1(dtls.Listen("udp", addr2, &dtlsConfig))
-	lg.Infof("start DTLS server at %s", s.dtls.Addr())
-	s.listeners = append(s.listeners, s.dtls)
+	inner := lo.Must1(s.listenUDP(addr))
+	l := nt.NewPacketListener(inner, dtlsAcceptFilter)
+	lg.Infof("start DTLS server at %s", l.Addr())
+	// inner socket is closed after all DTLS connections closed, or closed explicitly
+	s.listeners = append(s.listeners, l, inner)
+	s.streams = append(s.streams, l)
+	s.sockets = append(s.sockets, inner)
+	s.packets = append(s.packets, l, inner)
 
 	go func() {
 		for {
-			conn, err := s.dtls.Accept()
+			raw, err := l.Accept()
 			if err != nil {
 				lg.Error("stop DTLS server", err)
 				return
 			}
 			go func() {
+				// config is created for each connection to use latest certificate
+				dtlsConfig, err := createDTLSConfig(*s.TlsConfig)
+				if err != nil {
+					lg.Warning("can't create DTLS config", err)
+					raw.Close()
+					return
+				}
+				conn, err := dtls.Server(raw, &dtlsConfig)
+				if err != nil {
+					lg.Warning("DTLS handshake failed", err)
+					raw.Close()
+					return
+				}
 				defer conn.Close()
 
 				buf := internal.BytesPool4k.Rent()
@@ -195,19 +327,35 @@ func (s *Server) startDTLS(ctx context.Context, addr string) {
 }
 
 func (s *Server) startQUIC(ctx context.Context, addr string) {
-	s.quic = lo.Must1(quic.ListenAddr(addr, s.TlsConfig, &quic.Config{}))
-	lg.Infof("start QUIC server at %s", s.quic.Addr())
-	s.listeners = append(s.listeners, s.quic)
+	inner := lo.Must1(s.listenUDP(addr))
+	l := lo.Must1(quic.Listen(inner, quicTLSConfig(s.TlsConfig), &quic.Config{EnableDatagrams: true}))
+	lg.Infof("start QUIC server at %s", l.Addr())
+	// closing QUIC listener close all connections on it,
+	// so accept loop is stopped by context when shutdown, listener is closed after connections drained
+	actx, stop := context.WithCancel(ctx)
+	s.listeners = append(s.listeners, l, inner)
+	s.streams = append(s.streams, acceptStopper(stop))
+	s.sockets = append(s.sockets, inner)
+	// connections are closed by listener before socket closed, so clients are notified
+	s.packets = append(s.packets, l, inner)
 	go func() {
 		for {
-			conn, err := s.quic.Accept(ctx)
+			conn, err := l.Accept(actx)
 			if err != nil {
 				lg.Error("stop QUIC server", err)
-				return
+				break
 			}
 			qmc := nt.WrapQUICConn(conn)
 			go s.Worker.ServeMuxConn(ctx, qmc)
 		}
+		// refuse connections handshaked before listener closed
+		for {
+			conn, err := l.Accept(ctx)
+			if err != nil {
+				return
+			}
+			conn.CloseWithError(0, "")
+		}
 	}()
 }
 
@@ -7,15 +7,21 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"os"
 	"strings"
+	"syscall"
 	"time"
 
+	"github.com/studentmain/socks6/accounting"
 	"github.com/studentmain/socks6/auth"
 	"github.com/studentmain/socks6/common"
 	"github.com/studentmain/socks6/common/lg"
 	"github.com/studentmain/socks6/common/nt"
 	"github.com/studentmain/socks6/internal/socket"
 	"github.com/studentmain/socks6/message"
+	"github.com/studentmain/socks6/metrics"
+	"github.com/studentmain/socks6/resolver"
+	"github.com/studentmain/socks6/rule"
 	"golang.org/x/net/icmp"
 )
 
@@ -29,7 +35,9 @@ type CommandHandler func(
 // ServerWorker is a customizeable SOCKS 6 server
 type ServerWorker struct {
 	Authenticator auth.ServerAuthenticator
-	Rule          func(cc SocksConn) bool
+	// Rule decide whether a request is allowed, nil means allow all request.
+	// rule.RuleSet is a declarative implementation.
+	Rule rule.Checker
 
 	CommandHandlers map[message.CommandCode]CommandHandler
 	// VersionErrorHandler will handle non-SOCKS6 protocol request.
@@ -39,6 +47,9 @@ type ServerWorker struct {
 	DatagramVersionErrorHandler func(ctx context.Context, ver message.ErrVersionMismatch, dgram nt.Datagram)
 
 	Outbound ServerOutbound
+	// DestinationPolicy deny destinations in internal networks, nil means all destinations allowed.
+	// It's checked by InternetServerOutbound and UDP association.
+	DestinationPolicy *DestinationPolicy
 
 	// control UDP NAT filtering behavior,
 	// mapping behavior is always Endpoint Independent.
@@ -57,10 +68,38 @@ type ServerWorker struct {
 	// but it's still a packet sequence on wire.
 	IgnoreFragmentedRequest bool
 	EnableICMP              bool
+	// EnableSocks5 serve SOCKS 5 clients on same listener, with same authenticator, rule and outbound.
+	// Only none and username/password methods are available to SOCKS 5 clients. Disabled by default.
+	EnableSocks5 bool
+	// EnableSocks4 serve SOCKS 4 and 4a clients on same listener, CONNECT and BIND only.
+	// SOCKS 4 has no authentication, only work when none method is available.
+	EnableSocks4 bool
+	// EnableHTTP serve HTTP/1.1 proxy clients on same listener, CONNECT and absolute URI requests are converted to CONNECT.
+	// Proxy-Authorization Basic credential is checked by password method. Disabled by default.
+	EnableHTTP bool
+
+	// Timeouts is timeouts of each stage, zero fields use DefaultTimeouts
+	Timeouts Timeouts
+	// CommandTimeouts override Timeouts' non-zero fields for specific command,
+	// handshake and authentication timeout can't be overridden since command is unknown yet.
+	CommandTimeouts map[message.CommandCode]Timeouts
+
+	// Bandwidth limit relay speed, nil means unlimited
+	Bandwidth *BandwidthLimiter
+	// Accounting record relay and UDP association traffic, and reject client used up its quota.
+	// nil means no accounting. accounting.Ledger is an implementation.
+	Accounting accounting.Accountant
+	// Metrics is notified at each lifecycle point, nil means no metrics.
+	// metrics.Prometheus is an implementation.
+	Metrics metrics.Collector
+
+	draining int32      // 1 when Shutdown called
+	active   *activeSet // in-flight works, closed when Shutdown timeout
 
 	backlogWorker   common.SyncMap[string, *backlogBindWorker] // map[string]*bl
 	reservedUdpAddr common.SyncMap[string, uint64]             // map[string]uint64
 	udpAssociation  common.SyncMap[uint64, *udpAssociation]    // map[uint64]*ua
+	listenerAddr    common.SyncMap[string, *net.TCPAddr]       // addresses server listening at
 }
 
 // ServerOutbound is a group of function called by ServerWorker when a connection or listener is needed to fullfill client request
@@ -70,18 +109,103 @@ type ServerOutbound interface {
 	ListenPacket(ctx context.Context, option message.StackOptionInfo, addr *message.SocksAddr) (net.PacketConn, message.StackOptionInfo, error)
 }
 
+// InitialDataServerOutbound is a ServerOutbound which can send client's initial data while connecting, e.g. in TFO SYN.
+// ServerWorker won't send data again after DialWithData succeeded.
+type InitialDataServerOutbound interface {
+	ServerOutbound
+	DialWithData(ctx context.Context, option message.StackOptionInfo, addr *message.SocksAddr, data []byte) (net.Conn, message.StackOptionInfo, error)
+}
+
+// ResolverServerOutbound is a ServerOutbound which can resolve names as its connections see them,
+// it's used by CommandResolve and CommandResolvePTR.
+type ResolverServerOutbound interface {
+	ServerOutbound
+	LookupIP(ctx context.Context, host string) ([]net.IP, error)
+	LookupAddr(ctx context.Context, ip net.IP) ([]string, error)
+}
+
 // InternetServerOutbound implements ServerOutbound, create a internet connection/listener
 type InternetServerOutbound struct {
 	DefaultIPv4        net.IP         // address used when udp association request didn't provide an address
 	DefaultIPv6        net.IP         // address used when udp association request didn't provide an address
 	MulticastInterface *net.Interface // address
+	// SourceIP is local address of outgoing connections, and listeners whose request didn't provide an address.
+	// nil means decided by OS.
+	SourceIP net.IP
+	// Resolver resolve domain name of outgoing connections, nil means system resolver
+	Resolver *resolver.Resolver
 }
 
+var _ InitialDataServerOutbound = InternetServerOutbound{}
+var _ ResolverServerOutbound = InternetServerOutbound{}
+
 func (i InternetServerOutbound) Dial(ctx context.Context, option message.StackOptionInfo, addr *message.SocksAddr) (net.Conn, message.StackOptionInfo, error) {
-	return socket.DialWithOption(ctx, *addr, option)
+	return i.dialer(ctx).DialWithOption(ctx, *addr, option, nil)
+}
+func (i InternetServerOutbound) DialWithData(ctx context.Context, option message.StackOptionInfo, addr *message.SocksAddr, data []byte) (net.Conn, message.StackOptionInfo, error) {
+	return i.dialer(ctx).DialWithOption(ctx, *addr, option, data)
+}
+
+// LookupIP resolve host with Resolver, addresses denied by destination check are dropped
+func (i InternetServerOutbound) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	var ips []net.IP
+	var err error
+	if i.Resolver != nil {
+		ips, err = i.Resolver.LookupIP(ctx, host)
+	} else {
+		ips, err = net.DefaultResolver.LookupIP(ctx, "ip", host)
+	}
+	if err != nil {
+		return nil, err
+	}
+	check := destinationCheckFromContext(ctx)
+	if check == nil {
+		return ips, nil
+	}
+	allowed := []net.IP{}
+	for _, ip := range ips {
+		if check(ip, 0) == nil {
+			allowed = append(allowed, ip)
+		}
+	}
+	if len(allowed) == 0 {
+		return nil, &net.OpError{Op: "lookup", Net: "ip", Err: syscall.EACCES}
+	}
+	return allowed, nil
+}
+
+// LookupAddr reverse lookup ip with system resolver, ip denied by destination check is not looked up
+func (i InternetServerOutbound) LookupAddr(ctx context.Context, ip net.IP) ([]string, error) {
+	if check := destinationCheckFromContext(ctx); check != nil {
+		if err := check(ip, 0); err != nil {
+			return nil, &net.OpError{Op: "lookup", Net: "ip", Addr: &net.IPAddr{IP: ip}, Err: err}
+		}
+	}
+	return net.DefaultResolver.LookupAddr(ctx, ip.String())
+}
+
+func (i InternetServerOutbound) dialer(ctx context.Context) socket.Dialer {
+	d := socket.Dialer{LocalIP: i.SourceIP, Check: destinationCheckFromContext(ctx)}
+	if i.Resolver != nil {
+		d.LookupIP = i.Resolver.LookupIP
+	}
+	return d
 }
 func (i InternetServerOutbound) Listen(ctx context.Context, option message.StackOptionInfo, addr *message.SocksAddr) (net.Listener, message.StackOptionInfo, error) {
-	return socket.ListenerWithOption(ctx, *addr, option)
+	if i.SourceIP != nil && addr.AddressType != message.AddressTypeDomainName && net.IP(addr.Address).IsUnspecified() {
+		addr = message.ConvertAddr(&net.TCPAddr{IP: i.SourceIP, Port: int(addr.Port)})
+	}
+	var check func(ip net.IP, port int) error
+	if c := destinationCheckFromContext(ctx); c != nil {
+		// listen at all interfaces is fine
+		check = func(ip net.IP, port int) error {
+			if ip.IsUnspecified() {
+				return nil
+			}
+			return c(ip, port)
+		}
+	}
+	return socket.ListenerWithOption(ctx, *addr, option, check)
 }
 func (i InternetServerOutbound) ListenPacket(ctx context.Context, option message.StackOptionInfo, addr *message.SocksAddr) (net.PacketConn, message.StackOptionInfo, error) {
 	mcast := false
@@ -89,6 +213,8 @@ func (i InternetServerOutbound) ListenPacket(ctx context.Context, option message
 		ip := net.IP(addr.Address)
 		if ip.IsMulticast() {
 			mcast = true
+		} else if ip.IsUnspecified() && i.SourceIP != nil {
+			addr = message.ConvertAddr(&net.UDPAddr{IP: i.SourceIP, Port: int(addr.Port)})
 		} else if ip.IsUnspecified() {
 			if addr.AddressType == message.AddressTypeIPv4 {
 				addr.Address = i.DefaultIPv4
@@ -108,8 +234,7 @@ func (i InternetServerOutbound) ListenPacket(ctx context.Context, option message
 		return p, message.StackOptionInfo{}, err2
 	}
 	// todo what's going on? why 0.0.0.0 not work?
-	p, err := net.ListenUDP("udp", ua)
-	return p, message.StackOptionInfo{}, err
+	return socket.ListenPacketWithOption(ctx, ua, option)
 }
 
 // NewServerWorker create a standard SOCKS 6 server
@@ -120,13 +245,17 @@ func NewServerWorker() *ServerWorker {
 	r := &ServerWorker{
 		VersionErrorHandler: ReplyVersionSpecificError,
 		Authenticator:       defaultAuth,
+		Metrics:             metrics.Nop{},
+		DestinationPolicy:   &DestinationPolicy{},
 		Outbound: InternetServerOutbound{
 			DefaultIPv4: nt.GuessDefaultIPv4(),
 			DefaultIPv6: nt.GuessDefaultIPv6(),
 		},
+		active:          newActiveSet(),
 		backlogWorker:   common.NewSyncMap[string, *backlogBindWorker](),
 		reservedUdpAddr: common.NewSyncMap[string, uint64](),
 		udpAssociation:  common.NewSyncMap[uint64, *udpAssociation](),
+		listenerAddr:    common.NewSyncMap[string, *net.TCPAddr](),
 	}
 
 	r.CommandHandlers = map[message.CommandCode]CommandHandler{
@@ -170,7 +299,7 @@ func ReplyVersionSpecificError(ctx context.Context, ver message.ErrVersionMismat
 	// socks4
 	case 4:
 		// header v0, reply 91
-		conn.Write([]byte{0, 91})
+		conn.Write(marshalReply4(message.OperationReplyNotAllowedByRule, message.DefaultAddr))
 	case 5:
 		// no method allowed
 		conn.Write([]byte{5, 0xff})
@@ -190,13 +319,37 @@ func (s *ServerWorker) ServeStream(
 	ctx context.Context,
 	conn net.Conn,
 ) {
+	s.collector().ConnectionOpen()
+	defer s.collector().ConnectionClose()
+	defer s.track(func() { conn.Close() })()
 	cc, cmd, ar := s.handshakeStream(ctx, conn, nil)
-	if ar == nil || cc == nil || !ar.Success {
+	if ar == nil || !ar.Success {
 		conn.Close()
 		return
 	}
+	// request rejected after authentication is counted by session too
 	defer s.Authenticator.SessionConnClose(ar.SessionID)
+	if cc == nil {
+		conn.Close()
+		return
+	}
+	s.dispatch(ctx, cc, cmd)
+}
+
+// dispatch apply connection wide settings to cc and call command handler
+func (s *ServerWorker) dispatch(
+	ctx context.Context,
+	cc *SocksConn,
+	cmd message.CommandCode,
+) {
+	s.applyLimit(ctx, cc)
+	s.collector().Dispatch(cmd)
+	start := time.Now()
+	// let outbound see which request it is serving
+	ctx = withRequest(ctx, cc.ruleRequest())
+	ctx = withDestinationCheck(ctx, s.checkDestination)
 	s.CommandHandlers[cmd](ctx, *cc)
+	s.collector().RelayEnd(cmd, time.Since(start))
 }
 
 // handshakeStream process handshake stage,
@@ -211,6 +364,11 @@ func (s *ServerWorker) handshakeStream(
 	})
 	defer closeConn.Defer()
 
+	start := time.Now()
+	defer func() {
+		s.collector().Handshake(time.Since(start), sc != nil)
+	}()
+
 	ccid := conn3Tuple(conn)
 
 	lg.Trace(ccid, "start processing")
@@ -220,10 +378,27 @@ func (s *ServerWorker) handshakeStream(
 		lg.Debug("ignore fragmented request")
 		conn1 = &nt.NetBufferOnlyReader{Conn: conn}
 	}
+	timeouts := s.handshakeTimeouts()
+	setReadTimeout(conn, timeouts.Handshake)
 
 	req, err := message.ParseRequestFrom(conn1)
 	if err != nil {
 		closeConn.Cancel()
+		evm := message.ErrVersionMismatch{}
+		if errors.As(err, &evm) && prevAuth == nil {
+			if evm.Version == message.Socks5Version && s.EnableSocks5 {
+				sc, cmd, authr = s.handshakeStream5(ctx, conn)
+				return sc, cmd, authr
+			}
+			if evm.Version == 4 && s.EnableSocks4 {
+				sc, cmd, authr = s.handshakeStream4(ctx, conn)
+				return sc, cmd, authr
+			}
+			if isHTTPMethodStart(evm.Version) && s.EnableHTTP {
+				sc, cmd, authr = s.handshakeHTTP(ctx, conn, byte(evm.Version))
+				return sc, cmd, authr
+			}
+		}
 		s.handleRequestError(ctx, conn, err)
 		return nil, 0, nil
 	}
@@ -239,11 +414,25 @@ func (s *ServerWorker) handshakeStream(
 			return nil, 0, nil
 		}
 	}
+	setReadTimeout(conn, 0)
+
+	if s.Draining() {
+		// tell client don't use this session anymore
+		lg.Info(ccid, "server is shutting down, request refused")
+		reply := message.NewAuthenticationReplyWithType(message.AuthenticationReplyFail)
+		reply.Options.Add(message.Option{
+			Kind: message.OptionKindSessionInvalid,
+			Data: message.SessionInvalidOptionData{},
+		})
+		conn.Write(reply.Marshal())
+		return nil, 0, nil
+	}
 
 	authResult := prevAuth
 	if prevAuth == nil {
-		authr2 := s.authn(ctx, conn, req)
+		authr2 := s.authn(ctx, conn, req, timeouts.Authentication)
 		authResult = authr2
+		s.collector().Authenticate(authResult != nil && authResult.Success)
 		if authResult == nil {
 			return nil, 0, nil
 		}
@@ -262,32 +451,53 @@ func (s *ServerWorker) handshakeStream(
 		ClientId:    authResult.ClientName,
 		Session:     authResult.SessionID,
 		InitialData: initData,
+
+		acct:    s.Accounting,
+		metrics: s.Metrics,
 	}
 
 	if sid, ok := req.Options.GetData(message.OptionKindStreamID); ok {
 		sidVal := sid.(message.StreamIDOptionData).ID
 		cc.StreamId = sidVal
 	}
-	if s.Rule != nil && !s.Rule(cc) {
-		lg.Info(ccid, "not allowed by rule")
-		conn.Write(message.NewOperationReplyWithCode(message.OperationReplyNotAllowedByRule).Marshal())
-		return nil, req.CommandCode, authResult
-	}
-
-	// per-command
-	_, ok := s.CommandHandlers[req.CommandCode]
-	if !ok {
-		lg.Warning(ccid, "command not supported", req.CommandCode)
-		conn.Write(message.NewOperationReplyWithCode(message.OperationReplyCommandNotSupported).Marshal())
+	if !s.checkRequest(cc) {
 		return nil, req.CommandCode, authResult
 	}
-	lg.Trace(ccid, "start command specific process", req.CommandCode)
 
 	// it's handler's job to close conn
 	closeConn.Cancel()
 	return &cc, req.CommandCode, authResult
 }
 
+// checkRequest check rule, accounting and command of cc's request, reply error to client when it can't be processed
+func (s *ServerWorker) checkRequest(cc SocksConn) bool {
+	ccid := cc.ConnId()
+	if s.Rule != nil {
+		if d := s.Rule.Check(cc.ruleRequest()); !d.Allow {
+			lg.Info(ccid, "not allowed by rule,", d.Reason)
+			cc.WriteReplyCode(message.OperationReplyNotAllowedByRule)
+			return false
+		}
+	}
+	if s.Accounting != nil {
+		if err := s.Accounting.Allow(cc.ClientId); err != nil {
+			lg.Info(ccid, "not allowed by accounting,", err)
+			cc.WriteReplyCode(message.OperationReplyNotAllowedByRule)
+			return false
+		}
+	}
+
+	// per-command
+	_, ok := s.CommandHandlers[cc.Request.CommandCode]
+	if !ok {
+		lg.Warning(ccid, "command not supported", cc.Request.CommandCode)
+		cc.WriteReplyCode(message.OperationReplyCommandNotSupported)
+		return false
+	}
+	lg.Trace(ccid, "start command specific process", cc.Request.CommandCode)
+	return true
+}
+
 func (s *ServerWorker) handleRequestError(
 	ctx context.Context,
 	conn net.Conn,
@@ -305,7 +515,7 @@ func (s *ServerWorker) handleRequestError(
 
 		// todo really failed? need clarify. no addr type = no message border info = can't authn at all
 		conn.Write(message.NewAuthenticationReplyWithType(message.AuthenticationReplyFail).Marshal())
-		conn.Write(message.NewOperationReplyWithCode(message.OperationReplyAddressNotSupported).Marshal())
+		s.writeReplyCode(conn, message.OperationReplyAddressNotSupported)
 		return
 	} else {
 		lg.Warning(conn3Tuple(conn), "can't parse request", err)
@@ -313,13 +523,32 @@ func (s *ServerWorker) handleRequestError(
 	}
 }
 
+// collector return metrics collector of s, never nil
+func (s *ServerWorker) collector() metrics.Collector {
+	if s.Metrics == nil {
+		return metrics.Nop{}
+	}
+	return s.Metrics
+}
+
+// writeReplyCode write an operation reply to a connection not yet become SocksConn
+func (s *ServerWorker) writeReplyCode(conn net.Conn, code message.ReplyCode) error {
+	s.collector().Reply(code)
+	_, err := conn.Write(message.NewOperationReplyWithCode(code).Marshal())
+	return err
+}
+
 func (s *ServerWorker) authn(
 	ctx context.Context,
 	conn net.Conn,
 	req *message.Request,
+	timeout time.Duration,
 ) *auth.ServerAuthenticationResult {
 	ccid := conn3Tuple(conn)
-	result1, sac := s.Authenticator.Authenticate(ctx, conn, *req)
+	// stop method still running when authentication failed or timeout
+	actx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	result1, sac := s.Authenticator.Authenticate(actx, conn, *req)
 
 	auth := *result1
 	if result1.Success {
@@ -333,7 +562,7 @@ func (s *ServerWorker) authn(
 		}
 	} else if !result1.Continue {
 		// one stage auth, can't continue
-		reply := message.NewAuthenticationReplyWithType(message.AuthenticationReplyFail)
+		reply := setAuthMethodInfo(message.NewAuthenticationReplyWithType(message.AuthenticationReplyFail), *result1)
 		if _, err := conn.Write(reply.Marshal()); err != nil {
 			lg.Warning(ccid, "can't write reply", err)
 			return nil
@@ -348,7 +577,7 @@ func (s *ServerWorker) authn(
 		// run stage 2
 		lg.Debug(ccid, "auth stage 2")
 
-		result2, err := s.Authenticator.ContinueAuthenticate(sac, *req)
+		result2, err := s.continueAuthn(conn, sac, req, timeout)
 		if err != nil {
 			lg.Warning(ccid, "auth stage 2 error", err)
 			conn.Write(message.NewAuthenticationReplyWithType(message.AuthenticationReplyFail).Marshal())
@@ -370,6 +599,42 @@ func (s *ServerWorker) authn(
 	return &auth
 }
 
+// continueAuthn run authentication stage 2, fail when not finished in timeout
+func (s *ServerWorker) continueAuthn(
+	conn net.Conn,
+	sac *auth.ServerAuthenticationChannels,
+	req *message.Request,
+	timeout time.Duration,
+) (*auth.ServerAuthenticationResult, error) {
+	// method may read from conn
+	setReadTimeout(conn, timeout)
+
+	type result struct {
+		r   *auth.ServerAuthenticationResult
+		err error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		r, err := s.Authenticator.ContinueAuthenticate(sac, *req)
+		ch <- result{r, err}
+	}()
+	var timer <-chan time.Time
+	if timeout > 0 {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		timer = t.C
+	}
+	select {
+	case r := <-ch:
+		setReadTimeout(conn, 0)
+		return r.r, r.err
+	case <-timer:
+		// read deadline is kept so method reading conn fail, method's context is cancelled by caller,
+		// goroutine above exit after method finished
+		return nil, os.ErrDeadlineExceeded
+	}
+}
+
 func (s *ServerWorker) ServeSeqPacket(
 	ctx context.Context,
 	dgramSrc nt.SeqPacket,
@@ -380,6 +645,9 @@ func (s *ServerWorker) ServeSeqPacket(
 		return
 	}
 	assoc, h := s.handleFirstDatagram(ctx, d0)
+	if assoc == nil {
+		return
+	}
 	assoc.handleUdpUp(ctx, socksDatagram{
 		msg:    h,
 		src:    d0.RemoteAddr(),
@@ -410,6 +678,9 @@ func (s *ServerWorker) ServeDatagram(
 	dgram nt.Datagram,
 ) {
 	assoc, h := s.handleFirstDatagram(ctx, dgram)
+	if assoc == nil {
+		return
+	}
 	assoc.handleUdpUp(ctx, socksDatagram{
 		msg:    h,
 		src:    dgram.RemoteAddr(),
@@ -470,6 +741,9 @@ func (s *ServerWorker) ServeMuxConn(
 	mux nt.MultiplexedConn,
 ) {
 	defer mux.Close()
+	s.collector().ConnectionOpen()
+	defer s.collector().ConnectionClose()
+	defer s.track(func() { mux.Close() })()
 	c0, err := mux.Accept()
 	if err != nil {
 		return
@@ -479,8 +753,12 @@ func (s *ServerWorker) ServeMuxConn(
 		return
 	}
 	defer s.Authenticator.SessionConnClose(auth0.SessionID)
+	// first request rejected
+	if sc0 == nil {
+		return
+	}
 	sc0.MuxConn = mux
-	go s.CommandHandlers[cmd0](ctx, *sc0)
+	go s.dispatch(ctx, sc0, cmd0)
 
 	if umux, ok := mux.(nt.SeqPacket); ok {
 		go func() {
@@ -502,8 +780,11 @@ func (s *ServerWorker) ServeMuxConn(
 		go func() {
 			// authn skipped
 			sc, cmd, _ := s.handshakeStream(ctx, c, auth0)
+			if sc == nil {
+				return
+			}
 			sc.MuxConn = mux
-			s.CommandHandlers[cmd](ctx, *sc)
+			s.dispatch(ctx, sc, cmd)
 		}()
 	}
 }
@@ -526,7 +807,7 @@ func (s *ServerWorker) ClearUnusedResource(ctx context.Context) {
 
 		s.backlogWorker.Range(func(key string, value *backlogBindWorker) bool {
 			bl := value
-			if bl.alive {
+			if bl.isAlive() {
 				return true
 			}
 			s.backlogWorker.Delete(key)
@@ -541,6 +822,9 @@ func (s *ServerWorker) ClearUnusedResource(ctx context.Context) {
 			s.reservedUdpAddr.Delete(ua.pair)
 			return true
 		})
+		if s.Bandwidth != nil {
+			s.Bandwidth.clear()
+		}
 	}
 }
 
@@ -562,5 +846,7 @@ func setAuthMethodInfo(arep *message.AuthenticationReply, result auth.ServerAuth
 			},
 		})
 	}
+	// session and token options
+	arep.Options.AddMany(result.AdditionalOptions)
 	return arep
 }
@@ -0,0 +1,144 @@
+package socks6
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+
+	"github.com/studentmain/socks6/auth"
+	"github.com/studentmain/socks6/common"
+	"github.com/studentmain/socks6/common/lg"
+	"github.com/studentmain/socks6/message"
+)
+
+const (
+	socks4CommandConnect byte = 1
+	socks4CommandBind    byte = 2
+
+	socks4Granted  byte = 90
+	socks4Rejected byte = 91
+)
+
+// handshakeStream4 process SOCKS 4 and 4a request, version byte is already consumed by SOCKS 6 request parser.
+// SOCKS 4 has no authentication, request is authenticated with none method, USERID is ignored.
+func (s *ServerWorker) handshakeStream4(
+	ctx context.Context,
+	conn net.Conn,
+) (*SocksConn, message.CommandCode, *auth.ServerAuthenticationResult) {
+	closeConn := common.NewCancellableDefer(func() {
+		conn.Close()
+	})
+	defer closeConn.Defer()
+
+	ccid := conn3Tuple(conn)
+	lg.Trace(ccid, "socks 4 client")
+	req, err := parseRequest4From(conn)
+	if err != nil {
+		lg.Warning(ccid, "can't parse socks 4 request", err)
+		conn.Write(marshalReply4(message.OperationReplyCommandNotSupported, message.DefaultAddr))
+		return nil, 0, nil
+	}
+	if s.Draining() {
+		lg.Info(ccid, "server is shutting down, request refused")
+		conn.Write(marshalReply4(message.OperationReplyServerFailure, message.DefaultAddr))
+		return nil, 0, nil
+	}
+
+	authResult := s.authenticateData(ctx, conn, nil)
+	s.collector().Authenticate(authResult.Success)
+	if !authResult.Success {
+		lg.Info(ccid, "authenticate fail")
+		conn.Write(marshalReply4(message.OperationReplyNotAllowedByRule, message.DefaultAddr))
+		return nil, 0, nil
+	}
+	setReadTimeout(conn, 0)
+	lg.Tracef("%s requested command %d, %s", ccid, req.CommandCode, req.Endpoint)
+
+	cc := SocksConn{
+		Conn:     conn,
+		Request:  req,
+		ClientId: authResult.ClientName,
+
+		front:   frontSocks4,
+		acct:    s.Accounting,
+		metrics: s.Metrics,
+	}
+	if !s.checkRequest(cc) {
+		return nil, req.CommandCode, authResult
+	}
+	closeConn.Cancel()
+	return &cc, req.CommandCode, authResult
+}
+
+// parseRequest4From read SOCKS 4 request after version byte, 0.0.0.x destination means a SOCKS 4a domain name follows
+func parseRequest4From(r io.Reader) (*message.Request, error) {
+	// cd dstport dstip
+	b := make([]byte, 7)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	var cmd message.CommandCode
+	switch b[0] {
+	case socks4CommandConnect:
+		cmd = message.CommandConnect
+	case socks4CommandBind:
+		cmd = message.CommandBind
+	default:
+		return nil, errors.New("unknown socks 4 command " + strconv.Itoa(int(b[0])))
+	}
+	port := binary.BigEndian.Uint16(b[1:3])
+	ip := net.IP(b[3:7])
+	// userid
+	if _, err := readString4(r); err != nil {
+		return nil, err
+	}
+	addr := &message.SocksAddr{AddressType: message.AddressTypeIPv4, Address: ip, Port: port}
+	if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 {
+		host, err := readString4(r)
+		if err != nil {
+			return nil, err
+		}
+		if addr, err = message.NewAddr(net.JoinHostPort(host, strconv.Itoa(int(port)))); err != nil {
+			return nil, err
+		}
+	}
+	return &message.Request{
+		CommandCode: cmd,
+		Endpoint:    addr,
+		Options:     message.NewOptionSet(),
+	}, nil
+}
+
+// readString4 read a NUL terminated string no longer than 255 bytes
+func readString4(r io.Reader) (string, error) {
+	b := make([]byte, 0, 16)
+	c := []byte{0}
+	for {
+		if _, err := io.ReadFull(r, c); err != nil {
+			return "", err
+		}
+		if c[0] == 0 {
+			return string(b), nil
+		}
+		if len(b) == 255 {
+			return "", message.ErrFormat.WithVerbose("socks 4 string too long")
+		}
+		b = append(b, c[0])
+	}
+}
+
+// marshalReply4 create a SOCKS 4 reply, IPv6 and domain name endpoint are reported as 0.0.0.0
+func marshalReply4(code message.ReplyCode, ep *message.SocksAddr) []byte {
+	b := []byte{0, socks4Rejected, 0, 0, 0, 0, 0, 0}
+	if code == message.OperationReplySuccess {
+		b[1] = socks4Granted
+	}
+	if ep.AddressType == message.AddressTypeIPv4 {
+		binary.BigEndian.PutUint16(b[2:4], ep.Port)
+		copy(b[4:], ep.Address)
+	}
+	return b
+}
@@ -0,0 +1,307 @@
+package socks6
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/studentmain/socks6/common"
+	"github.com/studentmain/socks6/common/lg"
+	"github.com/studentmain/socks6/internal"
+	"github.com/studentmain/socks6/message"
+)
+
+const (
+	socks5MethodNone         byte = 0
+	socks5MethodPassword     byte = 2
+	socks5MethodNotAvailable byte = 0xff
+)
+
+// Socks5ServerOutbound implements ServerOutbound, forward requests through an upstream SOCKS 5 server.
+// SOCKS 5 has no stack option, all options are reported as not applied.
+type Socks5ServerOutbound struct {
+	// Server is upstream server address
+	Server string
+	// Username and Password are used for RFC 1929 authentication, empty Username means no authentication
+	Username string
+	Password string
+	// DialFunc create TCP connection to upstream, net.Dialer is used when nil
+	DialFunc func(ctx context.Context, network string, addr string) (net.Conn, error)
+}
+
+var _ ServerOutbound = Socks5ServerOutbound{}
+
+func (s Socks5ServerOutbound) Dial(ctx context.Context, option message.StackOptionInfo, addr *message.SocksAddr) (net.Conn, message.StackOptionInfo, error) {
+	conn, rep, err := s.handshake(ctx, message.CommandConnect, addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	return upstreamConn{
+		Conn:   conn,
+		local:  fillUnspecifiedAddr(rep.Endpoint, conn.RemoteAddr()),
+		remote: addr,
+	}, message.StackOptionInfo{}, nil
+}
+
+func (s Socks5ServerOutbound) Listen(ctx context.Context, option message.StackOptionInfo, addr *message.SocksAddr) (net.Listener, message.StackOptionInfo, error) {
+	conn, rep, err := s.handshake(ctx, message.CommandBind, addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &socks5Listener{
+		conn: conn,
+		bind: fillUnspecifiedAddr(rep.Endpoint, conn.RemoteAddr()),
+	}, message.StackOptionInfo{}, nil
+}
+
+func (s Socks5ServerOutbound) ListenPacket(ctx context.Context, option message.StackOptionInfo, addr *message.SocksAddr) (net.PacketConn, message.StackOptionInfo, error) {
+	pc, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	cd := common.NewCancellableDefer(func() { pc.Close() })
+	defer cd.Defer()
+
+	// tell upstream where datagrams come from
+	conn, rep, err := s.handshake(ctx, message.CommandUdpAssociate, message.ConvertAddr(pc.LocalAddr()))
+	if err != nil {
+		return nil, nil, err
+	}
+	relay, err := net.ResolveUDPAddr("udp", fillUnspecifiedAddr(rep.Endpoint, conn.RemoteAddr()).String())
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	u := &socks5PacketConn{
+		UDPConn: pc,
+		conn:    conn,
+		relay:   relay,
+	}
+	go u.watch()
+	cd.Cancel()
+	return u, message.StackOptionInfo{}, nil
+}
+
+// handshake connect to upstream, authenticate and send request, return connection and first reply
+func (s Socks5ServerOutbound) handshake(ctx context.Context, cmd message.CommandCode, addr *message.SocksAddr) (net.Conn, *message.OperationReply, error) {
+	netErr := net.OpError{
+		Op:   "dial",
+		Net:  "socks5",
+		Addr: addr,
+	}
+	conn, err := dialUpstream(ctx, s.DialFunc, s.Server)
+	if err != nil {
+		netErr.Err = err
+		return nil, nil, &netErr
+	}
+	netErr.Source = conn.LocalAddr()
+
+	cd := common.NewCancellableDefer(func() { conn.Close() })
+	defer cd.Defer()
+	stop := watchContext(ctx, conn)
+	defer stop()
+
+	if err = s.authn(conn); err != nil {
+		netErr.Err = err
+		return nil, nil, &netErr
+	}
+
+	req := message.Request{
+		CommandCode: cmd,
+		Endpoint:    addr,
+	}
+	if _, err = conn.Write(req.Marshal5()); err != nil {
+		netErr.Err = err
+		return nil, nil, &netErr
+	}
+	rep, err := message.ParseOperationReply5From(conn)
+	if err != nil {
+		netErr.Err = err
+		return nil, nil, &netErr
+	}
+	if rep.ReplyCode != message.OperationReplySuccess {
+		netErr.Err = convertReply5Error(rep.ReplyCode)
+		return nil, nil, &netErr
+	}
+	cd.Cancel()
+	return conn, rep, nil
+}
+
+// authn select method and do RFC 1929 authentication if necessary
+func (s Socks5ServerOutbound) authn(conn net.Conn) error {
+	hs := message.Handshake{Methods: []byte{socks5MethodNone}}
+	if s.Username != "" {
+		hs.Methods = []byte{socks5MethodPassword}
+	}
+	if _, err := conn.Write(hs.Marshal5()); err != nil {
+		return err
+	}
+	sel, err := message.ParseMethodSelection5From(conn)
+	if err != nil {
+		return err
+	}
+	switch sel.Method {
+	case socks5MethodNone:
+		if s.Username != "" {
+			return ErrUnexpectedMessage
+		}
+		return nil
+	case socks5MethodPassword:
+		if s.Username == "" {
+			return ErrUnexpectedMessage
+		}
+	case socks5MethodNotAvailable:
+		return ErrAuthenticationFailed
+	default:
+		return ErrUnexpectedMessage
+	}
+
+	b := bytes.Buffer{}
+	b.WriteByte(1)
+	b.WriteByte(byte(len(s.Username)))
+	b.WriteString(s.Username)
+	b.WriteByte(byte(len(s.Password)))
+	b.WriteString(s.Password)
+	if _, err = conn.Write(b.Bytes()); err != nil {
+		return err
+	}
+	// ver status
+	buf := make([]byte, 2)
+	if _, err = io.ReadFull(conn, buf); err != nil {
+		return err
+	}
+	if buf[1] != 0 {
+		return ErrAuthenticationFailed
+	}
+	return nil
+}
+
+// convertReply5Error convert SOCKS 5 reply code to error, SOCKS 6 use same value for all SOCKS 5 codes
+func convertReply5Error(code message.ReplyCode) error {
+	if code > message.OperationReplyAddressNotSupported {
+		return ErrServerFailure
+	}
+	return convertReplyError(code)
+}
+
+// socks5Listener accept the only connection of a SOCKS 5 BIND request
+type socks5Listener struct {
+	conn net.Conn
+	bind net.Addr
+
+	lock sync.Mutex
+	used bool
+	// 1 when conn is handed to accepted connection
+	handoff int32
+}
+
+func (l *socks5Listener) Accept() (net.Conn, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	netErr := net.OpError{
+		Op:   "accept",
+		Net:  "socks5",
+		Addr: l.bind,
+	}
+	if l.used {
+		netErr.Err = net.ErrClosed
+		return nil, &netErr
+	}
+	l.used = true
+
+	rep, err := message.ParseOperationReply5From(l.conn)
+	if err != nil {
+		netErr.Err = err
+		return nil, &netErr
+	}
+	if rep.ReplyCode != message.OperationReplySuccess {
+		netErr.Err = convertReply5Error(rep.ReplyCode)
+		return nil, &netErr
+	}
+	atomic.StoreInt32(&l.handoff, 1)
+	return upstreamConn{
+		Conn:   l.conn,
+		local:  l.bind,
+		remote: rep.Endpoint,
+	}, nil
+}
+
+// Close stop waiting for inbound connection, the accepted connection is not affected.
+func (l *socks5Listener) Close() error {
+	if atomic.LoadInt32(&l.handoff) == 1 {
+		return nil
+	}
+	return l.conn.Close()
+}
+
+func (l *socks5Listener) Addr() net.Addr {
+	return l.bind
+}
+
+// socks5PacketConn send and receive datagram through a SOCKS 5 UDP relay
+type socks5PacketConn struct {
+	*net.UDPConn
+	// control connection, association ends when it closed
+	conn  net.Conn
+	relay *net.UDPAddr
+}
+
+// watch close association when upstream close control connection
+func (u *socks5PacketConn) watch() {
+	buf := make([]byte, 256)
+	for {
+		if _, err := u.conn.Read(buf); err != nil {
+			u.UDPConn.Close()
+			return
+		}
+	}
+}
+
+func (u *socks5PacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	buf := internal.BytesPool64k.Rent()
+	defer internal.BytesPool64k.Return(buf)
+	for {
+		n, a, err := u.UDPConn.ReadFromUDP(buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		if !a.IP.Equal(u.relay.IP) || a.Port != u.relay.Port {
+			continue
+		}
+		msg, err := message.ParseUDPMessage5From(bytes.NewReader(buf[:n]))
+		if err != nil {
+			lg.Info("drop malformed socks 5 datagram", err)
+			continue
+		}
+		addr, err := net.ResolveUDPAddr("udp", msg.Endpoint.String())
+		if err != nil {
+			continue
+		}
+		return copy(p, msg.Data), addr, nil
+	}
+}
+
+func (u *socks5PacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	msg := message.UDPMessage{
+		Type:     message.UDPMessageDatagram,
+		Endpoint: message.ConvertAddr(addr),
+		Data:     p,
+	}
+	if _, err := u.UDPConn.WriteTo(msg.Marshal5(), u.relay); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// LocalAddr return relay address, SOCKS 5 doesn't tell which address upstream used
+func (u *socks5PacketConn) LocalAddr() net.Addr {
+	return u.relay
+}
+
+func (u *socks5PacketConn) Close() error {
+	u.conn.Close()
+	return u.UDPConn.Close()
+}
@@ -0,0 +1,274 @@
+package socks6
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+
+	"github.com/studentmain/socks6/auth"
+	"github.com/studentmain/socks6/common"
+	"github.com/studentmain/socks6/common/lg"
+	"github.com/studentmain/socks6/internal"
+	"github.com/studentmain/socks6/message"
+)
+
+// handshakeStream5 process SOCKS 5 method negotiation, authentication and request,
+// version byte is already consumed by SOCKS 6 request parser
+func (s *ServerWorker) handshakeStream5(
+	ctx context.Context,
+	conn net.Conn,
+) (*SocksConn, message.CommandCode, *auth.ServerAuthenticationResult) {
+	closeConn := common.NewCancellableDefer(func() {
+		conn.Close()
+	})
+	defer closeConn.Defer()
+
+	ccid := conn3Tuple(conn)
+	lg.Trace(ccid, "socks 5 client")
+	hs, err := message.ParseHandshake5From(io.MultiReader(bytes.NewReader([]byte{message.Socks5Version}), conn))
+	if err != nil {
+		lg.Warning(ccid, "can't parse socks 5 handshake", err)
+		return nil, 0, nil
+	}
+	if s.Draining() {
+		lg.Info(ccid, "server is shutting down, request refused")
+		conn.Write((&message.MethodSelection{Method: socks5MethodNotAvailable}).Marshal5())
+		return nil, 0, nil
+	}
+
+	authResult := s.authn5(ctx, conn, hs.Methods)
+	s.collector().Authenticate(authResult != nil && authResult.Success)
+	if authResult == nil || !authResult.Success {
+		lg.Info(ccid, "authenticate fail")
+		return nil, 0, nil
+	}
+	lg.Trace(ccid, "authenticate success")
+
+	req, err := message.ParseRequest5From(conn)
+	if err != nil {
+		if errors.Is(err, message.ErrAddressTypeNotSupport) {
+			rep := message.NewOperationReplyWithCode(message.OperationReplyAddressNotSupported)
+			rep.Endpoint = message.DefaultAddr
+			conn.Write(rep.Marshal5())
+		}
+		lg.Warning(ccid, "can't parse socks 5 request", err)
+		return nil, 0, nil
+	}
+	setReadTimeout(conn, 0)
+	req.Options = message.NewOptionSet()
+	lg.Tracef("%s requested command %d, %s", ccid, req.CommandCode, req.Endpoint)
+
+	cc := SocksConn{
+		Conn:     conn,
+		Request:  req,
+		ClientId: authResult.ClientName,
+
+		front:   frontSocks5,
+		acct:    s.Accounting,
+		metrics: s.Metrics,
+	}
+	if !s.checkRequest(cc) {
+		return nil, req.CommandCode, authResult
+	}
+	closeConn.Cancel()
+	return &cc, req.CommandCode, authResult
+}
+
+// authn5 select a SOCKS 5 method and authenticate with Authenticator, return nil when failed.
+// none is preferred, username/password (RFC 1929) request is passed to SOCKS 6 password method.
+func (s *ServerWorker) authn5(
+	ctx context.Context,
+	conn net.Conn,
+	methods []byte,
+) *auth.ServerAuthenticationResult {
+	if bytes.IndexByte(methods, socks5MethodNone) >= 0 {
+		if r := s.authenticateData(ctx, conn, nil); r.Success {
+			if _, err := conn.Write((&message.MethodSelection{Method: socks5MethodNone}).Marshal5()); err != nil {
+				return nil
+			}
+			return r
+		}
+	}
+	if bytes.IndexByte(methods, socks5MethodPassword) < 0 {
+		conn.Write((&message.MethodSelection{Method: socks5MethodNotAvailable}).Marshal5())
+		return nil
+	}
+	if _, err := conn.Write((&message.MethodSelection{Method: socks5MethodPassword}).Marshal5()); err != nil {
+		return nil
+	}
+	data, err := readPasswordRequest5(conn)
+	if err != nil {
+		lg.Warning(conn3Tuple(conn), "can't read socks 5 password", err)
+		return nil
+	}
+	r := s.authenticateData(ctx, conn, &message.AuthenticationDataOptionData{Method: socks5MethodPassword, Data: data})
+	status := byte(1)
+	if r.Success {
+		status = 0
+	}
+	if _, err = conn.Write([]byte{1, status}); err != nil {
+		return nil
+	}
+	return r
+}
+
+// authenticateData run Authenticator with a SOCKS 6 request carrying only data, used by SOCKS 5 and HTTP front ends,
+// methods need second stage are treated as failed
+func (s *ServerWorker) authenticateData(
+	ctx context.Context,
+	conn net.Conn,
+	data *message.AuthenticationDataOptionData,
+) *auth.ServerAuthenticationResult {
+	req := message.Request{Options: message.NewOptionSet()}
+	if data != nil {
+		req.Options.Add(message.Option{
+			Kind: message.OptionKindAuthenticationMethodAdvertisement,
+			Data: message.AuthenticationMethodAdvertisementOptionData{Methods: []byte{data.Method}},
+		})
+		req.Options.Add(message.Option{Kind: message.OptionKindAuthenticationData, Data: *data})
+	}
+	r, sac := s.Authenticator.Authenticate(ctx, conn, req)
+	if r.Continue {
+		sac.Continue <- false
+		return &auth.ServerAuthenticationResult{Success: false}
+	}
+	return r
+}
+
+// readPasswordRequest5 read a RFC 1929 request, which is also SOCKS 6 password method's data
+func readPasswordRequest5(r io.Reader) ([]byte, error) {
+	b := make([]byte, 2, 513)
+	// ver ulen
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	if b[0] != 1 {
+		return nil, message.NewErrVersionMismatch(int(b[0]), nil)
+	}
+	// uname plen
+	b = b[:2+int(b[1])+1]
+	if _, err := io.ReadFull(r, b[2:]); err != nil {
+		return nil, err
+	}
+	// passwd
+	l := len(b)
+	b = b[:l+int(b[l-1])]
+	if _, err := io.ReadFull(r, b[l:]); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// socks5ReplyCode convert reply code to SOCKS 5 one, they are same except timeout
+func socks5ReplyCode(code message.ReplyCode) message.ReplyCode {
+	if code == message.OperationReplyTimeout {
+		return message.OperationReplyHostUnreachable
+	}
+	return code
+}
+
+// udpAssociate5 create a SOCKS 5 UDP association,
+// client send datagrams to a dedicated relay socket, remote datagrams are sent by outbound socket.
+func (s *ServerWorker) udpAssociate5(ctx context.Context, cc SocksConn) {
+	closeConn := common.NewCancellableDefer(func() {
+		cc.Conn.Close()
+	})
+	defer closeConn.Defer()
+
+	// DST.ADDR is where client send datagrams from, not a local address
+	pc, _, err := s.Outbound.ListenPacket(ctx, message.StackOptionInfo{}, message.ParseAddr("0.0.0.0:0"))
+	code := getReplyCode(err)
+	if code != message.OperationReplySuccess {
+		cc.WriteReplyCode(code)
+		return
+	}
+	local := message.ConvertAddr(cc.Conn.LocalAddr())
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IP(local.Address)})
+	if err != nil {
+		pc.Close()
+		cc.WriteReplyCode(getReplyCode(err))
+		return
+	}
+	if err = cc.WriteReplyAddr(message.OperationReplySuccess, relay.LocalAddr()); err != nil {
+		pc.Close()
+		relay.Close()
+		return
+	}
+
+	assoc := newUdpAssociation(cc, pc, nil, s.AddressDependentFiltering, false, s.timeouts(message.CommandUdpAssociate))
+	assoc.onExit = s.track(assoc.exit)
+	assoc.checkDst = s.checkDestination
+	s.udpAssociation.Store(assoc.id, assoc)
+	s.collector().AssociationCreate()
+	lg.Trace("start socks 5 udp assoc", assoc.id, "relay at", relay.LocalAddr())
+	closeConn.Cancel()
+
+	go assoc.handleTcp5Up(ctx, relay)
+	go assoc.handleUdp5Up(ctx, relay, cc.Destination())
+	go assoc.handleUdpDown(ctx)
+}
+
+// handleTcp5Up keep SOCKS 5 UDP association until client closed TCP connection
+func (u *udpAssociation) handleTcp5Up(ctx context.Context, relay net.PacketConn) {
+	defer relay.Close()
+	defer u.exit()
+	u.watchTimeouts(ctx)
+	io.Copy(io.Discard, u.cc.Conn)
+}
+
+// handleUdp5Up read SOCKS 5 UDP requests from relay socket and send them to remote.
+// First datagram from client's address in request decide the client, all zero address match anyone.
+func (u *udpAssociation) handleUdp5Up(ctx context.Context, relay net.PacketConn, client *message.SocksAddr) {
+	defer u.exit()
+	buf := internal.BytesPool64k.Rent()
+	defer internal.BytesPool64k.Return(buf)
+	for {
+		n, src, err := relay.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if !u.assocOk {
+			if !matchClientAddr5(client, src) {
+				continue
+			}
+			u.assocOk = true
+			u.acceptDgram = src.String()
+			u.downlink = func(b []byte) error {
+				_, err := relay.WriteTo(b, src)
+				return err
+			}
+		}
+		if u.acceptDgram != src.String() {
+			continue
+		}
+		// fragmentation is not supported, drop fragments
+		if n < 3 || buf[2] != 0 {
+			continue
+		}
+		msg, err := message.ParseUDPMessage5From(bytes.NewReader(buf[:n]))
+		if err != nil {
+			u.reportErr(err)
+			continue
+		}
+		if err = u.send(ctx, msg); err != nil {
+			u.reportErr(err)
+		}
+	}
+}
+
+// matchClientAddr5 check whether src match SOCKS 5 UDP ASSOCIATE request address, zero IP and port match anything
+func matchClientAddr5(client *message.SocksAddr, src net.Addr) bool {
+	if client == nil || client.AddressType == message.AddressTypeDomainName {
+		return true
+	}
+	a, ok := src.(*net.UDPAddr)
+	if !ok {
+		return true
+	}
+	if ip := net.IP(client.Address); !ip.IsUnspecified() && !ip.Equal(a.IP) {
+		return false
+	}
+	return client.Port == 0 || int(client.Port) == a.Port
+}
@@ -0,0 +1,101 @@
+package socks6
+
+import (
+	"context"
+	"net"
+
+	"github.com/studentmain/socks6/message"
+)
+
+// Socks6ServerOutbound implements ServerOutbound, forward requests through an upstream SOCKS 6 server.
+// Remote leg stack options of the incoming request are sent to upstream,
+// options applied by upstream are reported as applied.
+type Socks6ServerOutbound struct {
+	// Client connect to the upstream server.
+	// Client.Backlog and Client.EnableICMP should be left zero, they are decided by incoming request.
+	Client *Client
+}
+
+var _ InitialDataServerOutbound = Socks6ServerOutbound{}
+var _ ResolverServerOutbound = Socks6ServerOutbound{}
+
+// maxUpstreamInitialData is the max initial data sent in upstream request, remaining data is sent after connected
+const maxUpstreamInitialData = 16383
+
+func (s Socks6ServerOutbound) Dial(ctx context.Context, option message.StackOptionInfo, addr *message.SocksAddr) (net.Conn, message.StackOptionInfo, error) {
+	return s.DialWithData(ctx, option, addr, nil)
+}
+
+// DialWithData send data as upstream request's initial data, so it arrives at destination without waiting for reply
+func (s Socks6ServerOutbound) DialWithData(ctx context.Context, option message.StackOptionInfo, addr *message.SocksAddr, data []byte) (net.Conn, message.StackOptionInfo, error) {
+	initData, rest := data, []byte(nil)
+	if len(data) > maxUpstreamInitialData {
+		initData, rest = data[:maxUpstreamInitialData], data[maxUpstreamInitialData:]
+	}
+	conn, err := s.Client.ConnectRequest(ctx, addr, initData, upstreamOptions(option))
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(rest) > 0 {
+		if _, err = conn.Write(rest); err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+	}
+	pconn := conn.(*ProxyTCPConn)
+	return upstreamConn{
+		Conn:   pconn,
+		local:  pconn.ProxyLocalAddr(),
+		remote: pconn.RemoteAddr(),
+	}, pconn.AppliedStackOptions(), nil
+}
+
+// LookupIP ask upstream to resolve host, upstream should support CommandResolve
+func (s Socks6ServerOutbound) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	return s.Client.Resolve(ctx, host)
+}
+
+// LookupAddr ask upstream to reverse lookup ip, upstream should support CommandResolvePTR
+func (s Socks6ServerOutbound) LookupAddr(ctx context.Context, ip net.IP) ([]string, error) {
+	return s.Client.ResolvePTR(ctx, ip)
+}
+
+func (s Socks6ServerOutbound) Listen(ctx context.Context, option message.StackOptionInfo, addr *message.SocksAddr) (net.Listener, message.StackOptionInfo, error) {
+	l, err := s.Client.BindRequest(ctx, addr, upstreamOptions(option))
+	if err != nil {
+		return nil, nil, err
+	}
+	return l, l.AppliedStackOptions(), nil
+}
+
+func (s Socks6ServerOutbound) ListenPacket(ctx context.Context, option message.StackOptionInfo, addr *message.SocksAddr) (net.PacketConn, message.StackOptionInfo, error) {
+	// upstream's ICMP error will break the association, ServerWorker can't forward it
+	filtered := message.StackOptionInfo{}
+	for k, v := range option {
+		if k != message.StackOptionUDPUDPError {
+			filtered[k] = v
+		}
+	}
+	pc, err := s.Client.UDPAssociateRequest(ctx, addr, upstreamOptions(filtered))
+	if err != nil {
+		return nil, nil, err
+	}
+	return upstreamUDPConn{pc}, pc.AppliedStackOptions(), nil
+}
+
+// upstreamOptions convert remote leg stack options to an option set sent to upstream
+func upstreamOptions(option message.StackOptionInfo) *message.OptionSet {
+	ops := message.NewOptionSet()
+	ops.AddMany(option.GetOptions(false, true))
+	return ops
+}
+
+// upstreamUDPConn is a ProxyUDPConn used as outbound packet conn,
+// its local address is the address used by upstream server.
+type upstreamUDPConn struct {
+	*ProxyUDPConn
+}
+
+func (u upstreamUDPConn) LocalAddr() net.Addr {
+	return u.ProxyBindAddr()
+}
@@ -3,8 +3,25 @@ package socks6
 import (
 	"net"
 
+	"github.com/studentmain/socks6/accounting"
 	"github.com/studentmain/socks6/common/nt"
 	"github.com/studentmain/socks6/message"
+	"github.com/studentmain/socks6/metrics"
+	"github.com/studentmain/socks6/rule"
+)
+
+// frontEnd is protocol spoken by client, requests of other protocols are converted to SOCKS 6
+type frontEnd byte
+
+const (
+	frontSocks6 frontEnd = iota
+	frontSocks5
+	// frontSocks4 is SOCKS 4 and 4a
+	frontSocks4
+	// frontHTTPConnect is HTTP CONNECT tunnel
+	frontHTTPConnect
+	// frontHTTPForward is HTTP request with absolute URI, remote's response is the reply
+	frontHTTPForward
 )
 
 // SocksConn represents a SOCKS 6 connection received by server
@@ -17,6 +34,11 @@ type SocksConn struct {
 	Session     []byte // the session this connection belongs to
 	StreamId    uint32 // stream id provided by client
 	InitialData []byte // client's initial data
+
+	front   frontEnd              // protocol client speaking, replies are written in its format
+	limit   *trafficLimit         // bandwidth limit applied to this connection
+	acct    accounting.Accountant // traffic accountant, nil means no accounting
+	metrics metrics.Collector     // metrics collector, nil means no metrics
 }
 
 // Destination is endpoint included in client's request
@@ -29,6 +51,25 @@ func (c SocksConn) ConnId() string {
 	return conn3Tuple(c.Conn)
 }
 
+// ruleRequest convert connection to rule matching input
+func (c SocksConn) ruleRequest() rule.Request {
+	return rule.Request{
+		Source:      c.Conn.RemoteAddr(),
+		ClientId:    c.ClientId,
+		Session:     c.Session,
+		Command:     c.Request.CommandCode,
+		Destination: c.Destination(),
+	}
+}
+
+// collector return metrics collector of cc, never nil
+func (c SocksConn) collector() metrics.Collector {
+	if c.metrics == nil {
+		return metrics.Nop{}
+	}
+	return c.metrics
+}
+
 // WriteReplyCode see WriteReply
 func (c SocksConn) WriteReplyCode(code message.ReplyCode) error {
 	return c.WriteReply(code, message.DefaultAddr, message.NewOptionSet())
@@ -44,8 +85,24 @@ func (c SocksConn) WriteReply(code message.ReplyCode, ep net.Addr, opt *message.
 	oprep := message.NewOperationReplyWithCode(code)
 	oprep.Endpoint = message.ConvertAddr(ep)
 	oprep.Options = opt
+	switch c.front {
+	case frontSocks5:
+		// SOCKS 5 has no option
+		c.collector().Reply(code)
+		oprep.ReplyCode = socks5ReplyCode(code)
+		_, e := c.Conn.Write(oprep.Marshal5())
+		return e
+	case frontSocks4:
+		c.collector().Reply(code)
+		_, e := c.Conn.Write(marshalReply4(code, oprep.Endpoint))
+		return e
+	case frontHTTPConnect, frontHTTPForward:
+		c.collector().Reply(code)
+		return c.writeHTTPReply(code)
+	}
 	c.setSessionId(oprep)
 	c.setStreamId(oprep)
+	c.collector().Reply(code)
 	_, e := c.Conn.Write(oprep.Marshal())
 	return e
 }
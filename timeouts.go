@@ -0,0 +1,99 @@
+package socks6
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/studentmain/socks6/message"
+)
+
+// Timeouts control how long ServerWorker wait for each stage.
+// 0 means use the value in DefaultTimeouts, negative means no timeout.
+type Timeouts struct {
+	// Handshake is max time to receive request message and initial data
+	Handshake time.Duration
+	// Authentication is max time of authentication stage 2
+	Authentication time.Duration
+	// Dial is max time to connect remote host for CONNECT
+	Dial time.Duration
+	// Idle is max time a relay direction can stay without data
+	Idle time.Duration
+	// Lifetime is max time of a relay, regardless of activity
+	Lifetime time.Duration
+	// BindAccept is max time to wait an inbound connection for BIND
+	BindAccept time.Duration
+	// UDPEstablish is max time between UDP association created and first datagram received
+	UDPEstablish time.Duration
+	// UDPIdle is max time an UDP association can stay without datagram in both direction
+	UDPIdle time.Duration
+}
+
+// DefaultTimeouts is used for zero fields of ServerWorker.Timeouts
+var DefaultTimeouts = Timeouts{
+	Handshake:      time.Minute,
+	Authentication: time.Minute,
+	Dial:           30 * time.Second,
+	Idle:           10 * time.Minute,
+	Lifetime:       -1,
+	BindAccept:     60 * time.Second,
+	UDPEstablish:   120 * time.Second,
+	UDPIdle:        -1,
+}
+
+// Override return t with fields replaced by o's non-zero fields
+func (t Timeouts) Override(o Timeouts) Timeouts {
+	pick := func(a, b time.Duration) time.Duration {
+		if b != 0 {
+			return b
+		}
+		return a
+	}
+	return Timeouts{
+		Handshake:      pick(t.Handshake, o.Handshake),
+		Authentication: pick(t.Authentication, o.Authentication),
+		Dial:           pick(t.Dial, o.Dial),
+		Idle:           pick(t.Idle, o.Idle),
+		Lifetime:       pick(t.Lifetime, o.Lifetime),
+		BindAccept:     pick(t.BindAccept, o.BindAccept),
+		UDPEstablish:   pick(t.UDPEstablish, o.UDPEstablish),
+		UDPIdle:        pick(t.UDPIdle, o.UDPIdle),
+	}
+}
+
+// timeouts return timeouts used by cmd
+func (s *ServerWorker) timeouts(cmd message.CommandCode) Timeouts {
+	t := s.handshakeTimeouts()
+	if o, ok := s.CommandTimeouts[cmd]; ok {
+		t = t.Override(o)
+	}
+	return t
+}
+
+// handshakeTimeouts return timeouts used before command is known, command overrides are not applied
+func (s *ServerWorker) handshakeTimeouts() Timeouts {
+	return DefaultTimeouts.Override(s.Timeouts)
+}
+
+// withTimeout create a context with timeout d, d <= 0 means no timeout
+func withTimeout(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	if d <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, d)
+}
+
+// setReadTimeout set conn's read deadline to d later, d <= 0 clear read deadline
+func setReadTimeout(conn net.Conn, d time.Duration) error {
+	if d <= 0 {
+		return conn.SetReadDeadline(time.Time{})
+	}
+	return conn.SetReadDeadline(time.Now().Add(d))
+}
+
+// relay relay between client and remote connection with idle and lifetime timeout
+func (t Timeouts) relay(ctx context.Context, c, r net.Conn) error {
+	ctx2, cancel := withTimeout(ctx, t.Lifetime)
+	defer cancel()
+	return relay(ctx2, c, r, t.Idle)
+}
@@ -3,8 +3,11 @@ package socks6
 import (
 	"context"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/studentmain/socks6/accounting"
 	"github.com/studentmain/socks6/common"
 	"github.com/studentmain/socks6/common/arrayx"
 	"github.com/studentmain/socks6/common/lg"
@@ -35,11 +38,17 @@ type udpAssociation struct {
 
 	pair     string // reserved port
 	downlink func(b []byte) error
+	checkDst func(ip net.IP, port int) error // destination policy, nil means all allowed
 
 	allowedRemote common.SyncMap[string, any] // allowed remote host
 	addrFilter    bool                        // when true, only datagram from allowedRemote will send to client
 
-	alive bool
+	timeouts   Timeouts
+	lastActive int64 // unix nano time of last datagram
+
+	alive    bool
+	exitOnce sync.Once
+	onExit   func() // called when association closed
 }
 
 func newUdpAssociation(
@@ -48,6 +57,7 @@ func newUdpAssociation(
 	pair net.Addr,
 	addrFilter bool,
 	icmpOn bool,
+	timeouts Timeouts,
 ) *udpAssociation {
 	id := rnd.RandUint64()
 	ps := ""
@@ -67,6 +77,11 @@ func newUdpAssociation(
 
 		addrFilter:    addrFilter,
 		allowedRemote: common.NewSyncMap[string, any](),
+
+		timeouts:   timeouts,
+		lastActive: time.Now().UnixNano(),
+
+		alive: true,
 	}
 }
 
@@ -82,14 +97,7 @@ func (u *udpAssociation) handleTcpUp(ctx context.Context) {
 		lg.Warning(err)
 		return
 	}
-	// check for assoc established in ??? seconds
-	// and close assoc if not established
-	go func() {
-		<-time.After(120 * time.Second)
-		if !u.assocOk {
-			u.exit()
-		}
-	}()
+	u.watchTimeouts(ctx)
 	// read loop
 	for {
 		msg, err := message.ParseUDPMessageFrom(u.cc.Conn)
@@ -121,13 +129,28 @@ func (u *udpAssociation) handleTcpUp(ctx context.Context) {
 				return
 			}
 			// todo report critical error
-			if err := u.send(msg); err != nil {
+			if err := u.send(ctx, msg); err != nil {
 				u.reportErr(err)
 			}
 		}
 	}
 }
 
+// watchTimeouts close association if not established in time, or idle too long
+func (u *udpAssociation) watchTimeouts(ctx context.Context) {
+	if u.timeouts.UDPEstablish > 0 {
+		go func() {
+			<-time.After(u.timeouts.UDPEstablish)
+			if !u.assocOk {
+				u.exit()
+			}
+		}()
+	}
+	if u.timeouts.UDPIdle > 0 {
+		go u.checkIdle(ctx)
+	}
+}
+
 // handleUdpUp process a messages from UDP
 func (u *udpAssociation) handleUdpUp(ctx context.Context, cp socksDatagram) {
 	msg := cp.msg
@@ -149,7 +172,7 @@ func (u *udpAssociation) handleUdpUp(ctx context.Context, cp socksDatagram) {
 		lg.Error(u.cc.ConnId(), "should send association ack via udp first")
 		return
 	}
-	if err := u.send(msg); err != nil {
+	if err := u.send(ctx, msg); err != nil {
 		u.reportErr(err)
 	}
 }
@@ -185,8 +208,26 @@ func (u *udpAssociation) handleUdpDown(ctx context.Context) {
 		if !u.assocOk || u.downlink == nil {
 			continue
 		}
-		if err := u.downlink(msg.Marshal()); err != nil {
+		// datagram over tcp is limited by client connection
+		if !u.acceptTcp {
+			if err := u.cc.limit.waitDown(ctx, l); err != nil {
+				lg.Error("udp downlink", err)
+				return
+			}
+		}
+		b := msg.Marshal()
+		if u.cc.front == frontSocks5 {
+			b = msg.Marshal5()
+		}
+		if err := u.downlink(b); err != nil {
 			lg.Error("udp downlink", err)
+			continue
+		}
+		u.active()
+		if err := u.account(msg.Endpoint, accounting.Usage{BytesDown: uint64(l), PacketsDown: 1}); err != nil {
+			lg.Info(u.cc.ConnId(), "udp association closed", err)
+			u.exit()
+			return
 		}
 	}
 }
@@ -200,26 +241,51 @@ func (u *udpAssociation) handleIcmpDown(ctx context.Context, code message.UDPErr
 		ErrorEndpoint: reporter,
 		ErrorCode:     code,
 	}
-	if err := u.send(&uh); err != nil {
+	if err := u.send(ctx, &uh); err != nil {
 		u.reportErr(err)
 	}
 }
 
 // send write client udp message to remote
-func (u *udpAssociation) send(msg *message.UDPMessage) error {
+func (u *udpAssociation) send(ctx context.Context, msg *message.UDPMessage) error {
+	// datagram over tcp is limited by client connection
+	if !u.acceptTcp {
+		if err := u.cc.limit.waitUp(ctx, len(msg.Data)); err != nil {
+			return err
+		}
+	}
 	a, err := net.ResolveUDPAddr("udp", msg.Endpoint.String())
+	if err != nil {
+		return err
+	}
+	if u.checkDst != nil {
+		if err = u.checkDst(a.IP, a.Port); err != nil {
+			return &net.OpError{Op: "write", Net: "udp", Addr: a, Err: err}
+		}
+	}
 
 	if u.addrFilter {
 		u.allowedRemote.Store(a.IP.String(), nil)
 	}
 
-	if err != nil {
+	if _, err = u.udp.WriteTo(msg.Data, a); err != nil {
 		return err
 	}
-	_, err = u.udp.WriteTo(msg.Data, a)
+	u.active()
+	if err = u.account(msg.Endpoint, accounting.Usage{BytesUp: uint64(len(msg.Data)), PacketsUp: 1}); err != nil {
+		u.exit()
+	}
 	return err
 }
 
+// account record datagram traffic
+func (u *udpAssociation) account(dst *message.SocksAddr, usage accounting.Usage) error {
+	if u.cc.acct == nil {
+		return nil
+	}
+	return u.cc.acct.Add(u.cc.accountRecord(dst.String(), usage))
+}
+
 // ack send assoc ack message
 func (u *udpAssociation) ack() error {
 	h := message.UDPMessage{
@@ -230,10 +296,44 @@ func (u *udpAssociation) ack() error {
 	return err
 }
 
+// active record datagram activity
+func (u *udpAssociation) active() {
+	atomic.StoreInt64(&u.lastActive, time.Now().UnixNano())
+}
+
+// checkIdle close association when no datagram in UDPIdle
+func (u *udpAssociation) checkIdle(ctx context.Context) {
+	interval := u.timeouts.UDPIdle / 4
+	if interval < 10*time.Millisecond {
+		interval = 10 * time.Millisecond
+	}
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for u.alive {
+		select {
+		case <-tick.C:
+		case <-ctx.Done():
+			return
+		}
+		last := time.Unix(0, atomic.LoadInt64(&u.lastActive))
+		if time.Since(last) > u.timeouts.UDPIdle {
+			lg.Info(u.cc.ConnId(), "udp association idle timeout")
+			u.exit()
+			return
+		}
+	}
+}
+
 func (u *udpAssociation) exit() {
-	u.alive = false
-	u.cc.Conn.Close()
-	u.udp.Close()
+	u.exitOnce.Do(func() {
+		u.alive = false
+		u.cc.Conn.Close()
+		u.udp.Close()
+		u.cc.collector().AssociationExpire()
+		if u.onExit != nil {
+			u.onExit()
+		}
+	})
 }
 
 func (u *udpAssociation) reportErr(e error) {
@@ -0,0 +1,70 @@
+package socks6
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/studentmain/socks6/message"
+)
+
+// dialUpstream connect to upstream proxy server with dial, net.Dialer is used when dial is nil
+func dialUpstream(
+	ctx context.Context,
+	dial func(ctx context.Context, network string, addr string) (net.Conn, error),
+	server string,
+) (net.Conn, error) {
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	return dial(ctx, "tcp", server)
+}
+
+// watchContext interrupt conn's pending IO when ctx done, until returned stop function called.
+// Upstream handshake use it to obey dial timeout and cancellation.
+func watchContext(ctx context.Context, conn net.Conn) (stop func()) {
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+		<-exited
+		conn.SetDeadline(time.Time{})
+	}
+}
+
+// fillUnspecifiedAddr replace unspecified IP in address replied by upstream with upstream's IP
+func fillUnspecifiedAddr(a *message.SocksAddr, upstream net.Addr) *message.SocksAddr {
+	if a.AddressType == message.AddressTypeDomainName || !net.IP(a.Address).IsUnspecified() {
+		return a
+	}
+	u := message.ConvertAddr(upstream)
+	return &message.SocksAddr{
+		AddressType: u.AddressType,
+		Address:     u.Address,
+		Port:        a.Port,
+	}
+}
+
+// upstreamConn is a connection made by upstream proxy,
+// its addresses are the addresses used by upstream proxy.
+type upstreamConn struct {
+	net.Conn
+	local  net.Addr
+	remote net.Addr
+}
+
+func (u upstreamConn) LocalAddr() net.Addr {
+	return u.local
+}
+
+func (u upstreamConn) RemoteAddr() net.Addr {
+	return u.remote
+}
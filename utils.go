@@ -37,7 +37,33 @@ func conn5TupleOut(c net.Conn) string {
 	return fmt.Sprintf("%s -(%s)-> %s", c.LocalAddr().String(), connNet(c), c.RemoteAddr().String())
 }
 
+// wrappedConn is a net.Conn wrapper which can return underlying net.Conn
+type wrappedConn interface {
+	unwrap() net.Conn
+}
+
+// baseConn return the connection under wrappers and TLS, e.g. a *net.TCPConn
+func baseConn(c net.Conn) net.Conn {
+	for {
+		switch w := c.(type) {
+		case wrappedConn:
+			c = w.unwrap()
+		case *tls.Conn:
+			c = w.NetConn()
+		default:
+			return c
+		}
+	}
+}
+
 func connNet(c net.Conn) string {
+	for {
+		w, ok := c.(wrappedConn)
+		if !ok {
+			break
+		}
+		c = w.unwrap()
+	}
 	n := "?"
 	switch c.(type) {
 	case *net.TCPConn:
@@ -54,6 +80,9 @@ func connNet(c net.Conn) string {
 	return n
 }
 
+// relay copy data between c and r until any direction fail or ctx done,
+// timeout is max time of a direction without data, timeout <= 0 means no timeout.
+// Both connections are closed when relay return.
 func relay(ctx context.Context, c, r net.Conn, timeout time.Duration) error {
 	var wg sync.WaitGroup
 	wg.Add(3)
@@ -69,6 +98,9 @@ func relay(ctx context.Context, c, r net.Conn, timeout time.Duration) error {
 		select {
 		case <-ctx2.Done():
 			err = ctx2.Err()
+			// unblock both direction
+			c.Close()
+			r.Close()
 		case err = <-errCh:
 			cancel()
 		}
@@ -104,14 +136,18 @@ func relayOneDirection(c1, c2 net.Conn, timeout time.Duration) error {
 
 	// copy pasted from io.Copy with some modify
 	for {
-		c1.SetReadDeadline(time.Now().Add(timeout))
+		if timeout > 0 {
+			c1.SetReadDeadline(time.Now().Add(timeout))
+		}
 		nRead, eRead := c1.Read(buf)
 		if done != nil {
 			return done
 		}
 
 		if nRead > 0 {
-			c2.SetWriteDeadline(time.Now().Add(timeout))
+			if timeout > 0 {
+				c2.SetWriteDeadline(time.Now().Add(timeout))
+			}
 			nWrite, eWrite := c2.Write(buf[:nRead])
 			if done != nil {
 				return done
@@ -155,22 +191,38 @@ func getReplyCode(err error) message.ReplyCode {
 			return message.OperationReplyServerFailure
 		}
 		// windows use windows.WSAExxxx error code, so this is necessary
-		switch common.ConvertSocketErrno(errno) {
-		case syscall.ENETUNREACH:
-			return message.OperationReplyNetworkUnreachable
-		case syscall.EHOSTUNREACH:
-			return message.OperationReplyHostUnreachable
-		case syscall.ECONNREFUSED:
-			return message.OperationReplyConnectionRefused
-		case syscall.ETIMEDOUT:
-			return message.OperationReplyTimeout
-		default:
-			return message.OperationReplyServerFailure
-		}
+		return getErrnoReplyCode(common.ConvertSocketErrno(errno))
+	case syscall.Errno:
+		// reported by upstream proxy, see convertReplyError
+		return getErrnoReplyCode(t)
+	}
+	if opErr.Err == ErrTTLExpired {
+		return message.OperationReplyTTLExpired
 	}
 	return message.OperationReplyServerFailure
 }
 
+func getErrnoReplyCode(errno syscall.Errno) message.ReplyCode {
+	switch errno {
+	case syscall.ENETUNREACH:
+		return message.OperationReplyNetworkUnreachable
+	case syscall.EHOSTUNREACH:
+		return message.OperationReplyHostUnreachable
+	case syscall.ECONNREFUSED:
+		return message.OperationReplyConnectionRefused
+	case syscall.ETIMEDOUT:
+		return message.OperationReplyTimeout
+	case syscall.EACCES:
+		return message.OperationReplyNotAllowedByRule
+	case syscall.EOPNOTSUPP:
+		return message.OperationReplyCommandNotSupported
+	case syscall.EAFNOSUPPORT:
+		return message.OperationReplyAddressNotSupported
+	default:
+		return message.OperationReplyServerFailure
+	}
+}
+
 func convertICMPError(msg *icmp.Message, ip *net.IPAddr, ver int,
 ) (message.UDPErrorType, *message.SocksAddr, []byte) {
 	var code message.UDPErrorType = 0